@@ -0,0 +1,93 @@
+// Package av1util has helpers for working with AV1 bitstreams
+package av1util
+
+import (
+	"bytes"
+
+	"eaglesong.dev/gunk/codec/av1parser"
+	"github.com/nareix/joy4/av"
+)
+
+const (
+	obuHasSizeFlag   = 0x02
+	obuExtensionFlag = 0x04
+)
+
+// WritePacket writes a temporal unit. If the packet is a keyframe without a
+// sequence header, prepend the one from the codec data.
+func WritePacket(w *bytes.Buffer, pkt av.Packet, cd av1parser.CodecData) {
+	if pkt.IsKeyFrame && !hasSequenceHeader(pkt.Data) {
+		w.Write(cd.SeqHeaderOBU)
+	}
+	w.Write(pkt.Data)
+}
+
+func hasSequenceHeader(tu []byte) bool {
+	obus, _ := av1parser.SplitOBUs(tu)
+	for _, obu := range obus {
+		if av1parser.OBUType(obu) == av1parser.OBUSequenceHeader {
+			return true
+		}
+	}
+	return false
+}
+
+// appendOBU appends an OBU to b, adding a size field if it doesn't have one
+func appendOBU(b, obu []byte) []byte {
+	if len(obu) == 0 || obu[0]&obuHasSizeFlag != 0 {
+		return append(b, obu...)
+	}
+	header := 1
+	if obu[0]&obuExtensionFlag != 0 {
+		header++
+	}
+	if len(obu) < header {
+		return b
+	}
+	b = append(b, obu[0]|obuHasSizeFlag)
+	b = append(b, obu[1:header]...)
+	b = appendLEB128(b, uint64(len(obu)-header))
+	return append(b, obu[header:]...)
+}
+
+// stripSize returns an OBU without its size field
+func stripSize(obu []byte) []byte {
+	if len(obu) == 0 || obu[0]&obuHasSizeFlag == 0 {
+		return obu
+	}
+	header := 1
+	if obu[0]&obuExtensionFlag != 0 {
+		header++
+	}
+	if len(obu) < header {
+		return obu
+	}
+	_, n, err := av1parser.ReadLEB128(obu[header:])
+	if err != nil {
+		return obu
+	}
+	out := make([]byte, 0, len(obu)-n)
+	out = append(out, obu[0]&^obuHasSizeFlag)
+	out = append(out, obu[1:header]...)
+	return append(out, obu[header+n:]...)
+}
+
+func appendLEB128(b []byte, v uint64) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func lebSize(v int) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
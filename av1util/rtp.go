@@ -0,0 +1,135 @@
+package av1util
+
+import (
+	"errors"
+
+	"eaglesong.dev/gunk/codec/av1parser"
+)
+
+// RTP payload format for AV1 (https://aomediacodec.github.io/av1-rtp-spec/)
+
+const (
+	aggZ = 0x80 // first element continues an OBU from the previous packet
+	aggY = 0x40 // last element continues in the next packet
+	aggN = 0x08 // first packet of a coded video sequence
+
+	aggWShift = 4
+)
+
+var errShortPacket = errors.New("av1: RTP payload too short")
+
+// Depacketizer converts RTP payloads to a low overhead bitstream with size
+// fields, as stored in MP4. It implements rtp.Depacketizer.
+type Depacketizer struct {
+	fragment []byte
+}
+
+func (d *Depacketizer) Unmarshal(payload []byte) ([]byte, error) {
+	if len(payload) < 2 {
+		return nil, errShortPacket
+	}
+	agg := payload[0]
+	count := int(agg>>aggWShift) & 3
+	b := payload[1:]
+	var out []byte
+	for i := 1; len(b) > 0; i++ {
+		var element []byte
+		if i == count {
+			// last element has no length field
+			element, b = b, nil
+		} else {
+			size, n, err := av1parser.ReadLEB128(b)
+			if err != nil {
+				return nil, err
+			}
+			b = b[n:]
+			if uint64(len(b)) < size {
+				return nil, errShortPacket
+			}
+			element, b = b[:size], b[size:]
+		}
+		if i == 1 && agg&aggZ != 0 {
+			if d.fragment == nil {
+				// missed the start of this OBU
+				continue
+			}
+			element = append(d.fragment, element...)
+		}
+		d.fragment = nil
+		if len(b) == 0 && agg&aggY != 0 {
+			d.fragment = append([]byte(nil), element...)
+			break
+		}
+		switch av1parser.OBUType(element) {
+		case av1parser.OBUTemporalDelimiter, av1parser.OBUTileList, av1parser.OBUPadding:
+			// not stored in MP4
+		default:
+			out = appendOBU(out, element)
+		}
+	}
+	return out, nil
+}
+
+// IsPartitionHead returns false if the packet continues an OBU
+func (d *Depacketizer) IsPartitionHead(payload []byte) bool {
+	return len(payload) > 0 && payload[0]&aggZ == 0
+}
+
+// IsPartitionTail returns true at the last packet of a temporal unit
+func (d *Depacketizer) IsPartitionTail(marker bool, payload []byte) bool {
+	return marker
+}
+
+// Payloader splits a temporal unit into RTP payloads. It implements
+// rtp.Payloader.
+type Payloader struct{}
+
+func (p *Payloader) Payload(mtu uint16, payload []byte) [][]byte {
+	obus, err := av1parser.SplitOBUs(payload)
+	if err != nil {
+		return nil
+	}
+	var payloads [][]byte
+	cur := []byte{0}
+	for _, obu := range obus {
+		switch av1parser.OBUType(obu) {
+		case av1parser.OBUTemporalDelimiter, av1parser.OBUTileList, av1parser.OBUPadding:
+			continue
+		case av1parser.OBUSequenceHeader:
+			if len(payloads) == 0 {
+				cur[0] |= aggN
+			}
+		}
+		data := stripSize(obu)
+		for len(data) > 0 {
+			avail := int(mtu) - len(cur)
+			avail -= lebSize(avail)
+			if avail <= 0 {
+				if len(cur) == 1 {
+					// MTU can't fit any data
+					return nil
+				}
+				payloads = append(payloads, cur)
+				cur = []byte{0}
+				continue
+			}
+			n := len(data)
+			if n > avail {
+				n = avail
+			}
+			cur = appendLEB128(cur, uint64(n))
+			cur = append(cur, data[:n]...)
+			data = data[n:]
+			if len(data) > 0 {
+				// fragment
+				cur[0] |= aggY
+				payloads = append(payloads, cur)
+				cur = []byte{aggZ}
+			}
+		}
+	}
+	if len(cur) > 1 {
+		payloads = append(payloads, cur)
+	}
+	return payloads
+}
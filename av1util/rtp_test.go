@@ -0,0 +1,204 @@
+package av1util
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"eaglesong.dev/gunk/codec/av1parser"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	temporalDelimiter = unhex("1200")
+	// sequence header from a 960x540 libaom stream
+	sequenceHeader = unhex("0a0b00000024cf7f0dbfff3008")
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// frame returns a frame OBU with a size field and a payload of n bytes
+func frame(key bool, n int) []byte {
+	payload := make([]byte, n)
+	for i := range payload {
+		payload[i] = byte(i%251) + 1
+	}
+	payload[0] = 0x10 // show_frame, KEY_FRAME
+	if !key {
+		payload[0] = 0x30 // INTER_FRAME
+	}
+	obu := appendLEB128([]byte{av1parser.OBUFrame<<3 | obuHasSizeFlag}, uint64(n))
+	return append(obu, payload...)
+}
+
+func cat(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
+
+func TestPayloader(t *testing.T) {
+	// without size fields the sequence header is 12 bytes and the frame 21,
+	// each element adds a one byte length
+	tu := cat(temporalDelimiter, sequenceHeader, frame(true, 20))
+	cases := []struct {
+		name  string
+		mtu   uint16
+		sizes []int
+		aggs  []byte
+	}{
+		{name: "Aggregated", mtu: 1200, sizes: []int{36}, aggs: []byte{aggN}},
+		{name: "ExactlyMTU", mtu: 36, sizes: []int{36}, aggs: []byte{aggN}},
+		{name: "OneUnderMTU", mtu: 35, sizes: []int{35, 3}, aggs: []byte{aggN | aggY, aggZ}},
+		// the end of the sequence header shares a packet with the start of the frame
+		{name: "Fragmented", mtu: 10, sizes: []int{10, 10, 10, 10, 4}, aggs: []byte{aggN | aggY, aggZ | aggY, aggZ | aggY, aggZ | aggY, aggZ}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			payloads := (&Payloader{}).Payload(c.mtu, tu)
+			var sizes []int
+			var aggs []byte
+			for _, p := range payloads {
+				sizes = append(sizes, len(p))
+				aggs = append(aggs, p[0])
+			}
+			assert.Equal(t, c.sizes, sizes)
+			assert.Equal(t, c.aggs, aggs)
+		})
+	}
+	assert.Nil(t, (&Payloader{}).Payload(2, tu), "MTU too small for any data")
+	payloads := (&Payloader{}).Payload(1200, frame(false, 20))
+	require.Len(t, payloads, 1)
+	assert.Zero(t, payloads[0][0]&aggN, "only a sequence header starts a new sequence")
+}
+
+func TestRoundTrip(t *testing.T) {
+	tus := [][]byte{
+		cat(temporalDelimiter, sequenceHeader, frame(true, 5000)),
+		cat(temporalDelimiter, frame(false, 100)),
+		cat(temporalDelimiter, frame(false, 1)),
+		// lengths that need two byte LEB128 fields
+		cat(temporalDelimiter, frame(false, 300)),
+	}
+	for _, mtu := range []uint16{1200, 200, 129, 128, 127, 10, 3} {
+		var d Depacketizer
+		for i, tu := range tus {
+			var out []byte
+			payloads := (&Payloader{}).Payload(mtu, tu)
+			require.NotEmpty(t, payloads)
+			for _, p := range payloads {
+				assert.LessOrEqual(t, len(p), int(mtu))
+				b, err := d.Unmarshal(p)
+				require.NoError(t, err)
+				out = append(out, b...)
+			}
+			// the temporal delimiter isn't stored
+			assert.Equal(t, tu[2:], out, "MTU %d temporal unit %d", mtu, i)
+		}
+	}
+}
+
+func TestDepacketizer(t *testing.T) {
+	key := frame(true, 20)
+	bare := stripSize(key)
+	cases := []struct {
+		name     string
+		payloads [][]byte
+		want     []byte
+		err      string
+	}{
+		{
+			name:     "Lengths",
+			payloads: [][]byte{cat([]byte{aggN, 12}, stripSize(sequenceHeader), []byte{21}, bare)},
+			want:     cat(sequenceHeader, key),
+		},
+		{
+			name: "ElementCount",
+			// the last of W elements has no length
+			payloads: [][]byte{cat([]byte{aggN | 2<<aggWShift, 12}, stripSize(sequenceHeader), bare)},
+			want:     cat(sequenceHeader, key),
+		},
+		{
+			name: "Fragments",
+			payloads: [][]byte{
+				cat([]byte{aggY | 1<<aggWShift}, bare[:8]),
+				cat([]byte{aggZ | aggY | 1<<aggWShift}, bare[8:15]),
+				cat([]byte{aggZ | 1<<aggWShift}, bare[15:]),
+			},
+			want: key,
+		},
+		{
+			name: "MissedStart",
+			payloads: [][]byte{
+				cat([]byte{aggZ | 2<<aggWShift, 6}, bare[15:], bare),
+			},
+			want: key,
+		},
+		{
+			name:     "DropsPadding",
+			payloads: [][]byte{cat([]byte{0, 2}, temporalDelimiter[:1], []byte{0}, []byte{3, av1parser.OBUPadding << 3, 0, 0, 21}, bare)},
+			want:     key,
+		},
+		{
+			name:     "Short",
+			payloads: [][]byte{{aggN}},
+			err:      "too short",
+		},
+		{
+			name:     "TruncatedElement",
+			payloads: [][]byte{cat([]byte{0, 30}, bare)},
+			err:      "too short",
+		},
+		{
+			name:     "TruncatedLength",
+			payloads: [][]byte{{0, 0x80}},
+			err:      "truncated leb128",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var d Depacketizer
+			var out []byte
+			var err error
+			for _, p := range c.payloads {
+				var b []byte
+				b, err = d.Unmarshal(p)
+				if err != nil {
+					break
+				}
+				out = append(out, b...)
+			}
+			if c.err != "" {
+				assert.ErrorContains(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, c.want, out)
+		})
+	}
+}
+
+func TestKeyFrameAfterRoundTrip(t *testing.T) {
+	sh, err := av1parser.ParseSequenceHeader(sequenceHeader)
+	require.NoError(t, err)
+	for _, key := range []bool{true, false} {
+		var d Depacketizer
+		var out []byte
+		for _, p := range (&Payloader{}).Payload(100, cat(temporalDelimiter, frame(key, 500))) {
+			b, err := d.Unmarshal(p)
+			require.NoError(t, err)
+			out = append(out, b...)
+		}
+		obus, err := av1parser.SplitOBUs(out)
+		require.NoError(t, err)
+		assert.Equal(t, key, av1parser.IsKeyFrame(obus, sh))
+	}
+}
@@ -0,0 +1,509 @@
+// Package av1parser parses AV1 codec configuration records and sequence
+// headers
+package av1parser
+
+import (
+	"errors"
+	"fmt"
+
+	"eaglesong.dev/gunk/codec"
+	"eaglesong.dev/gunk/internal/bitstream"
+	"github.com/nareix/joy4/av"
+)
+
+// OBU types
+const (
+	OBUSequenceHeader        = 1
+	OBUTemporalDelimiter     = 2
+	OBUFrameHeader           = 3
+	OBUTileGroup             = 4
+	OBUMetadata              = 5
+	OBUFrame                 = 6
+	OBURedundantFrameHeader  = 7
+	OBUTileList              = 8
+	OBUPadding               = 15
+	obuHeaderExtensionFlag   = 0x04
+	obuHeaderHasSizeFlag     = 0x02
+	codecConfigurationMarker = 0x81
+)
+
+// OBUType returns the type of an OBU from its header byte
+func OBUType(obu []byte) int {
+	if len(obu) == 0 {
+		return 0
+	}
+	return int(obu[0]>>3) & 0xf
+}
+
+// ReadLEB128 decodes a LEB128 value, returning the value and its encoded
+// length
+func ReadLEB128(b []byte) (v uint64, n int, err error) {
+	for i := 0; i < 8; i++ {
+		if i >= len(b) {
+			return 0, 0, errors.New("av1: truncated leb128")
+		}
+		v |= uint64(b[i]&0x7f) << (7 * i)
+		if b[i]&0x80 == 0 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, errors.New("av1: leb128 too long")
+}
+
+// SplitOBUs splits a low overhead bitstream into individual OBUs. Each OBU
+// must have its size field set.
+func SplitOBUs(b []byte) (obus [][]byte, err error) {
+	for len(b) > 0 {
+		header := 1
+		if b[0]&obuHeaderExtensionFlag != 0 {
+			header++
+		}
+		if b[0]&obuHeaderHasSizeFlag == 0 {
+			// size is implied by the container
+			obus = append(obus, b)
+			return
+		}
+		if len(b) < header {
+			return nil, errors.New("av1: truncated OBU header")
+		}
+		size, n, err := ReadLEB128(b[header:])
+		if err != nil {
+			return nil, err
+		}
+		total := header + n + int(size)
+		if total > len(b) {
+			return nil, errors.New("av1: truncated OBU")
+		}
+		obus = append(obus, b[:total])
+		b = b[total:]
+	}
+	return
+}
+
+// obuPayload returns the payload of an OBU with a size field
+func obuPayload(obu []byte) ([]byte, error) {
+	header := 1
+	if len(obu) > 0 && obu[0]&obuHeaderExtensionFlag != 0 {
+		header++
+	}
+	if len(obu) < header {
+		return nil, errors.New("av1: truncated OBU header")
+	}
+	if obu[0]&obuHeaderHasSizeFlag == 0 {
+		return obu[header:], nil
+	}
+	size, n, err := ReadLEB128(obu[header:])
+	if err != nil {
+		return nil, err
+	}
+	payload := obu[header+n:]
+	if uint64(len(payload)) < size {
+		return nil, errors.New("av1: truncated OBU")
+	}
+	return payload[:size], nil
+}
+
+// SequenceHeader holds the fields of a sequence header OBU needed to
+// describe the stream
+type SequenceHeader struct {
+	Profile  uint8
+	Level    uint8
+	Tier     uint8
+	Width    uint
+	Height   uint
+	StillPic bool
+
+	ReducedStillPictureHeader bool
+	HighBitdepth              bool
+	TwelveBit                 bool
+	Monochrome                bool
+	SubsamplingX              bool
+	SubsamplingY              bool
+	ChromaSamplePosition      uint8
+}
+
+// ParseSequenceHeader parses a sequence header OBU including its OBU header
+func ParseSequenceHeader(obu []byte) (sh SequenceHeader, err error) {
+	if OBUType(obu) != OBUSequenceHeader {
+		return sh, fmt.Errorf("av1: expected sequence header, got OBU type %d", OBUType(obu))
+	}
+	payload, err := obuPayload(obu)
+	if err != nil {
+		return
+	}
+	r := bitstream.NewReader(payload)
+	v, err := r.ReadBits(3)
+	if err != nil {
+		return
+	}
+	sh.Profile = uint8(v)
+	if sh.StillPic, err = r.ReadBit(); err != nil {
+		return
+	}
+	reduced, err := r.ReadBit()
+	if err != nil {
+		return
+	}
+	sh.ReducedStillPictureHeader = reduced
+	if reduced {
+		if v, err = r.ReadBits(5); err != nil {
+			return
+		}
+		sh.Level = uint8(v)
+	} else {
+		var timingInfo, decoderModelInfo, initialDisplayDelay bool
+		var bufferDelayLength int
+		if timingInfo, err = r.ReadBit(); err != nil {
+			return
+		}
+		if timingInfo {
+			// num_units_in_display_tick, time_scale
+			if err = r.Skip(64); err != nil {
+				return
+			}
+			equalPictureInterval, err2 := r.ReadBit()
+			if err2 != nil {
+				return sh, err2
+			}
+			if equalPictureInterval {
+				if err = skipUVLC(r); err != nil {
+					return
+				}
+			}
+			if decoderModelInfo, err = r.ReadBit(); err != nil {
+				return
+			}
+			if decoderModelInfo {
+				if v, err = r.ReadBits(5); err != nil {
+					return
+				}
+				bufferDelayLength = int(v) + 1
+				// num_units_in_decoding_tick, buffer_removal_time_length_minus_1,
+				// frame_presentation_time_length_minus_1
+				if err = r.Skip(32 + 5 + 5); err != nil {
+					return
+				}
+			}
+		}
+		if initialDisplayDelay, err = r.ReadBit(); err != nil {
+			return
+		}
+		opCount, err2 := r.ReadBits(5)
+		if err2 != nil {
+			return sh, err2
+		}
+		for i := 0; i <= int(opCount); i++ {
+			// operating_point_idc
+			if err = r.Skip(12); err != nil {
+				return
+			}
+			level, err2 := r.ReadBits(5)
+			if err2 != nil {
+				return sh, err2
+			}
+			var tier uint64
+			if level > 7 {
+				if tier, err = r.ReadBits(1); err != nil {
+					return
+				}
+			}
+			if i == 0 {
+				sh.Level = uint8(level)
+				sh.Tier = uint8(tier)
+			}
+			if decoderModelInfo {
+				present, err2 := r.ReadBit()
+				if err2 != nil {
+					return sh, err2
+				}
+				if present {
+					// decoder_buffer_delay, encoder_buffer_delay, low_delay_mode_flag
+					if err = r.Skip(2*bufferDelayLength + 1); err != nil {
+						return
+					}
+				}
+			}
+			if initialDisplayDelay {
+				present, err2 := r.ReadBit()
+				if err2 != nil {
+					return sh, err2
+				}
+				if present {
+					if err = r.Skip(4); err != nil {
+						return
+					}
+				}
+			}
+		}
+	}
+	widthBits, err := r.ReadBits(4)
+	if err != nil {
+		return
+	}
+	heightBits, err := r.ReadBits(4)
+	if err != nil {
+		return
+	}
+	if v, err = r.ReadBits(int(widthBits) + 1); err != nil {
+		return
+	}
+	sh.Width = uint(v) + 1
+	if v, err = r.ReadBits(int(heightBits) + 1); err != nil {
+		return
+	}
+	sh.Height = uint(v) + 1
+	err = sh.parseTools(r)
+	return
+}
+
+// parseTools skips the coding tool flags and reads color_config
+func (sh *SequenceHeader) parseTools(r *bitstream.Reader) error {
+	if !sh.ReducedStillPictureHeader {
+		frameIDs, err := r.ReadBit()
+		if err != nil {
+			return err
+		}
+		if frameIDs {
+			// delta_frame_id_length_minus_2, additional_frame_id_length_minus_1
+			if err := r.Skip(4 + 3); err != nil {
+				return err
+			}
+		}
+	}
+	// use_128x128_superblock, enable_filter_intra, enable_intra_edge_filter
+	if err := r.Skip(3); err != nil {
+		return err
+	}
+	if !sh.ReducedStillPictureHeader {
+		// enable_interintra_compound, enable_masked_compound,
+		// enable_warped_motion, enable_dual_filter
+		if err := r.Skip(4); err != nil {
+			return err
+		}
+		orderHint, err := r.ReadBit()
+		if err != nil {
+			return err
+		}
+		if orderHint {
+			// enable_jnt_comp, enable_ref_frame_mvs
+			if err := r.Skip(2); err != nil {
+				return err
+			}
+		}
+		chooseScreenContent, err := r.ReadBit()
+		if err != nil {
+			return err
+		}
+		forceScreenContent := true
+		if !chooseScreenContent {
+			if forceScreenContent, err = r.ReadBit(); err != nil {
+				return err
+			}
+		}
+		if forceScreenContent {
+			chooseIntegerMV, err := r.ReadBit()
+			if err != nil {
+				return err
+			}
+			if !chooseIntegerMV {
+				// seq_force_integer_mv
+				if err := r.Skip(1); err != nil {
+					return err
+				}
+			}
+		}
+		if orderHint {
+			// order_hint_bits_minus_1
+			if err := r.Skip(3); err != nil {
+				return err
+			}
+		}
+	}
+	// enable_superres, enable_cdef, enable_restoration
+	if err := r.Skip(3); err != nil {
+		return err
+	}
+	return sh.parseColorConfig(r)
+}
+
+func (sh *SequenceHeader) parseColorConfig(r *bitstream.Reader) (err error) {
+	if sh.HighBitdepth, err = r.ReadBit(); err != nil {
+		return
+	}
+	if sh.Profile == 2 && sh.HighBitdepth {
+		if sh.TwelveBit, err = r.ReadBit(); err != nil {
+			return
+		}
+	}
+	if sh.Profile != 1 {
+		if sh.Monochrome, err = r.ReadBit(); err != nil {
+			return
+		}
+	}
+	colorDescription, err := r.ReadBit()
+	if err != nil {
+		return
+	}
+	var primaries, transfer, matrix uint64 = 2, 2, 2
+	if colorDescription {
+		if primaries, err = r.ReadBits(8); err != nil {
+			return
+		}
+		if transfer, err = r.ReadBits(8); err != nil {
+			return
+		}
+		if matrix, err = r.ReadBits(8); err != nil {
+			return
+		}
+	}
+	switch {
+	case sh.Monochrome:
+		// color_range
+		sh.SubsamplingX, sh.SubsamplingY = true, true
+		return r.Skip(1)
+	case primaries == 1 && transfer == 13 && matrix == 0:
+		// sRGB is always 4:4:4
+		return nil
+	}
+	// color_range
+	if err = r.Skip(1); err != nil {
+		return
+	}
+	switch sh.Profile {
+	case 0:
+		sh.SubsamplingX, sh.SubsamplingY = true, true
+	case 1:
+	default:
+		if sh.TwelveBit {
+			if sh.SubsamplingX, err = r.ReadBit(); err != nil {
+				return
+			}
+			if sh.SubsamplingX {
+				if sh.SubsamplingY, err = r.ReadBit(); err != nil {
+					return
+				}
+			}
+		} else {
+			sh.SubsamplingX = true
+		}
+	}
+	if sh.SubsamplingX && sh.SubsamplingY {
+		v, err := r.ReadBits(2)
+		if err != nil {
+			return err
+		}
+		sh.ChromaSamplePosition = uint8(v)
+	}
+	return nil
+}
+
+// IsKeyFrame returns true if any frame header in obus is a key frame
+func IsKeyFrame(obus [][]byte, sh SequenceHeader) bool {
+	if sh.ReducedStillPictureHeader {
+		return true
+	}
+	for _, obu := range obus {
+		switch OBUType(obu) {
+		case OBUFrame, OBUFrameHeader:
+		default:
+			continue
+		}
+		payload, err := obuPayload(obu)
+		if err != nil || len(payload) == 0 {
+			continue
+		}
+		// show_existing_frame is zero and frame_type is KEY_FRAME
+		if payload[0]&0xe0 == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func skipUVLC(r *bitstream.Reader) error {
+	zeros := 0
+	for {
+		bit, err := r.ReadBit()
+		if err != nil {
+			return err
+		} else if bit {
+			break
+		}
+		zeros++
+	}
+	if zeros >= 32 {
+		return nil
+	}
+	return r.Skip(zeros)
+}
+
+type CodecData struct {
+	Record         []byte
+	SeqHeaderOBU   []byte
+	SequenceHeader SequenceHeader
+}
+
+// NewCodecDataFromConfigurationRecord parses an AV1CodecConfigurationRecord
+// as found in an av1C box
+func NewCodecDataFromConfigurationRecord(record []byte) (cd CodecData, err error) {
+	if len(record) < 4 {
+		return cd, errors.New("av1: configuration record too short")
+	} else if record[0] != codecConfigurationMarker {
+		return cd, fmt.Errorf("av1: unsupported configuration record version 0x%02x", record[0])
+	}
+	cd.Record = record
+	obus, err := SplitOBUs(record[4:])
+	if err != nil {
+		return
+	}
+	for _, obu := range obus {
+		if OBUType(obu) == OBUSequenceHeader {
+			cd.SeqHeaderOBU = obu
+			break
+		}
+	}
+	if cd.SeqHeaderOBU == nil {
+		return cd, errors.New("av1: configuration record is missing sequence header")
+	}
+	cd.SequenceHeader, err = ParseSequenceHeader(cd.SeqHeaderOBU)
+	return
+}
+
+// NewCodecDataFromSequenceHeader builds a configuration record from a
+// sequence header OBU, such as one received in-band over RTP
+func NewCodecDataFromSequenceHeader(obu []byte) (cd CodecData, err error) {
+	if cd.SequenceHeader, err = ParseSequenceHeader(obu); err != nil {
+		return
+	}
+	sh := cd.SequenceHeader
+	cd.SeqHeaderOBU = obu
+	record := []byte{
+		codecConfigurationMarker,
+		sh.Profile<<5 | sh.Level&0x1f,
+		sh.Tier<<7 | sh.ChromaSamplePosition&3,
+		0,
+	}
+	for i, flag := range []bool{sh.HighBitdepth, sh.TwelveBit, sh.Monochrome, sh.SubsamplingX, sh.SubsamplingY} {
+		if flag {
+			record[2] |= 0x40 >> i
+		}
+	}
+	cd.Record = append(record, obu...)
+	return
+}
+
+func (cd CodecData) Type() av.CodecType {
+	return codec.AV1
+}
+
+func (cd CodecData) ConfigurationRecordBytes() []byte {
+	return cd.Record
+}
+
+func (cd CodecData) Width() int {
+	return int(cd.SequenceHeader.Width)
+}
+
+func (cd CodecData) Height() int {
+	return int(cd.SequenceHeader.Height)
+}
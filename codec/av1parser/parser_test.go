@@ -0,0 +1,114 @@
+package av1parser
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sequence header from a 960x540 libaom stream
+const sampleSequenceHeader = "0a0b00000024cf7f0dbfff3008"
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestParseSequenceHeader(t *testing.T) {
+	sh, err := ParseSequenceHeader(unhex(sampleSequenceHeader))
+	require.NoError(t, err)
+	assert.Equal(t, SequenceHeader{
+		Level:        4,
+		Width:        960,
+		Height:       540,
+		SubsamplingX: true,
+		SubsamplingY: true,
+	}, sh)
+
+	_, err = ParseSequenceHeader(unhex("1200"))
+	assert.ErrorContains(t, err, "expected sequence header")
+	_, err = ParseSequenceHeader(unhex(sampleSequenceHeader)[:8])
+	assert.Error(t, err)
+}
+
+func TestSplitOBUs(t *testing.T) {
+	cases := []struct {
+		name string
+		tu   string
+		want []string
+		err  string
+	}{
+		{
+			name: "TemporalUnit",
+			tu:   "1200" + sampleSequenceHeader + "3203100000",
+			want: []string{"1200", sampleSequenceHeader, "3203100000"},
+		},
+		{
+			name: "Extension",
+			tu:   "36080210ff",
+			want: []string{"36080210ff"},
+		},
+		{
+			name: "ImpliedSize",
+			tu:   "1200" + "30100000",
+			want: []string{"1200", "30100000"},
+		},
+		{
+			name: "Truncated",
+			tu:   "1200" + "320510",
+			err:  "truncated OBU",
+		},
+		{
+			name: "TruncatedSize",
+			tu:   "3280",
+			err:  "truncated leb128",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			obus, err := SplitOBUs(unhex(c.tu))
+			if c.err != "" {
+				assert.ErrorContains(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			var got []string
+			for _, obu := range obus {
+				got = append(got, hex.EncodeToString(obu))
+			}
+			assert.Equal(t, c.want, got)
+		})
+	}
+}
+
+func TestIsKeyFrame(t *testing.T) {
+	sh, err := ParseSequenceHeader(unhex(sampleSequenceHeader))
+	require.NoError(t, err)
+	cases := []struct {
+		name string
+		tu   string
+		key  bool
+	}{
+		{name: "KeyFrame", tu: "1200" + sampleSequenceHeader + "3203100000", key: true},
+		{name: "KeyFrameHeader", tu: "1200" + "1a021000" + "2202abcd", key: true},
+		{name: "InterFrame", tu: "1200" + "3203300000"},
+		{name: "IntraOnly", tu: "1200" + "3203500000"},
+		{name: "ShowExisting", tu: "1200" + "1a0180"},
+		{name: "SequenceHeaderOnly", tu: sampleSequenceHeader},
+		{name: "EmptyFrame", tu: "3200"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			obus, err := SplitOBUs(unhex(c.tu))
+			require.NoError(t, err)
+			assert.Equal(t, c.key, IsKeyFrame(obus, sh))
+		})
+	}
+	// every frame of a still picture is a key frame
+	assert.True(t, IsKeyFrame(nil, SequenceHeader{ReducedStillPictureHeader: true}))
+}
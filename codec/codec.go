@@ -0,0 +1,46 @@
+// Package codec defines codec types that are not known to joy4
+package codec
+
+import "github.com/nareix/joy4/av"
+
+const codecTypeMagic = 0x67756e
+
+var (
+	HEVC = av.MakeVideoCodecType(codecTypeMagic + 1)
+	AV1  = av.MakeVideoCodecType(codecTypeMagic + 2)
+	VP8  = av.MakeVideoCodecType(codecTypeMagic + 3)
+	VP9  = av.MakeVideoCodecType(codecTypeMagic + 4)
+)
+
+// Name returns a printable name for a codec type, including the ones defined
+// here that joy4 can't format
+func Name(t av.CodecType) string {
+	switch t {
+	case HEVC:
+		return "HEVC"
+	case AV1:
+		return "AV1"
+	case VP8:
+		return "VP8"
+	case VP9:
+		return "VP9"
+	}
+	return t.String()
+}
+
+// VPCodecConfigurationRecord builds the contents of a vpcC box. The level and
+// color description are left unspecified.
+func VPCodecConfigurationRecord(profile, bitDepth, chromaSubsampling uint8, fullRange bool) []byte {
+	b := []byte{
+		1, 0, 0, 0, // version 1, flags
+		profile,
+		0, // level unspecified
+		bitDepth<<4 | chromaSubsampling<<1,
+		2, 2, 2, // colour primaries, transfer and matrix unspecified
+		0, 0, // no codec initialization data
+	}
+	if fullRange {
+		b[6] |= 1
+	}
+	return b
+}
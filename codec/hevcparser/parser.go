@@ -0,0 +1,361 @@
+// Package hevcparser parses H.265 decoder configuration records and
+// parameter sets
+package hevcparser
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"eaglesong.dev/gunk/codec"
+	"eaglesong.dev/gunk/internal/bitstream"
+	"github.com/nareix/joy4/av"
+)
+
+const (
+	naluVPS = 32
+	naluSPS = 33
+	naluPPS = 34
+
+	recordHeaderLen = 23
+)
+
+var errShortRecord = errors.New("hevc: decoder configuration record too short")
+
+// DecoderConfRecord is a HEVCDecoderConfigurationRecord as found in a hvcC box
+type DecoderConfRecord struct {
+	GeneralProfileSpace       uint8
+	GeneralTierFlag           bool
+	GeneralProfileIDC         uint8
+	GeneralProfileCompat      uint32
+	GeneralConstraintFlags    uint64
+	GeneralLevelIDC           uint8
+	MinSpatialSegmentationIDC uint16
+	ParallelismType           uint8
+	ChromaFormat              uint8
+	BitDepthLumaMinus8        uint8
+	BitDepthChromaMinus8      uint8
+	AvgFrameRate              uint16
+	ConstantFrameRate         uint8
+	NumTemporalLayers         uint8
+	TemporalIDNested          bool
+	LengthSizeMinusOne        uint8
+
+	VPS, SPS, PPS [][]byte
+}
+
+func (r *DecoderConfRecord) Unmarshal(b []byte) error {
+	if len(b) < recordHeaderLen {
+		return errShortRecord
+	}
+	if b[0] != 1 {
+		return fmt.Errorf("hevc: unsupported configuration version %d", b[0])
+	}
+	r.GeneralProfileSpace = b[1] >> 6
+	r.GeneralTierFlag = b[1]&0x20 != 0
+	r.GeneralProfileIDC = b[1] & 0x1f
+	r.GeneralProfileCompat = binary.BigEndian.Uint32(b[2:])
+	r.GeneralConstraintFlags = uint64(binary.BigEndian.Uint16(b[6:]))<<32 | uint64(binary.BigEndian.Uint32(b[8:]))
+	r.GeneralLevelIDC = b[12]
+	r.MinSpatialSegmentationIDC = binary.BigEndian.Uint16(b[13:]) & 0xfff
+	r.ParallelismType = b[15] & 3
+	r.ChromaFormat = b[16] & 3
+	r.BitDepthLumaMinus8 = b[17] & 7
+	r.BitDepthChromaMinus8 = b[18] & 7
+	r.AvgFrameRate = binary.BigEndian.Uint16(b[19:])
+	r.ConstantFrameRate = b[21] >> 6
+	r.NumTemporalLayers = (b[21] >> 3) & 7
+	r.TemporalIDNested = b[21]&4 != 0
+	r.LengthSizeMinusOne = b[21] & 3
+	numArrays := int(b[22])
+	b = b[recordHeaderLen:]
+	for i := 0; i < numArrays; i++ {
+		if len(b) < 3 {
+			return errShortRecord
+		}
+		naluType := b[0] & 0x3f
+		numNalus := int(binary.BigEndian.Uint16(b[1:]))
+		b = b[3:]
+		for j := 0; j < numNalus; j++ {
+			if len(b) < 2 {
+				return errShortRecord
+			}
+			size := int(binary.BigEndian.Uint16(b))
+			b = b[2:]
+			if len(b) < size {
+				return errShortRecord
+			}
+			nalu := b[:size]
+			b = b[size:]
+			switch naluType {
+			case naluVPS:
+				r.VPS = append(r.VPS, nalu)
+			case naluSPS:
+				r.SPS = append(r.SPS, nalu)
+			case naluPPS:
+				r.PPS = append(r.PPS, nalu)
+			}
+		}
+	}
+	return nil
+}
+
+// Marshal encodes the record in hvcC format
+func (r *DecoderConfRecord) Marshal() []byte {
+	b := make([]byte, recordHeaderLen)
+	b[0] = 1
+	b[1] = r.GeneralProfileSpace<<6 | r.GeneralProfileIDC&0x1f
+	if r.GeneralTierFlag {
+		b[1] |= 0x20
+	}
+	binary.BigEndian.PutUint32(b[2:], r.GeneralProfileCompat)
+	binary.BigEndian.PutUint16(b[6:], uint16(r.GeneralConstraintFlags>>32))
+	binary.BigEndian.PutUint32(b[8:], uint32(r.GeneralConstraintFlags))
+	b[12] = r.GeneralLevelIDC
+	binary.BigEndian.PutUint16(b[13:], 0xf000|r.MinSpatialSegmentationIDC&0xfff)
+	b[15] = 0xfc | r.ParallelismType&3
+	b[16] = 0xfc | r.ChromaFormat&3
+	b[17] = 0xf8 | r.BitDepthLumaMinus8&7
+	b[18] = 0xf8 | r.BitDepthChromaMinus8&7
+	binary.BigEndian.PutUint16(b[19:], r.AvgFrameRate)
+	b[21] = r.ConstantFrameRate<<6 | (r.NumTemporalLayers&7)<<3 | r.LengthSizeMinusOne&3
+	if r.TemporalIDNested {
+		b[21] |= 4
+	}
+	arrays := []struct {
+		naluType byte
+		nalus    [][]byte
+	}{
+		{naluVPS, r.VPS},
+		{naluSPS, r.SPS},
+		{naluPPS, r.PPS},
+	}
+	for _, arr := range arrays {
+		if len(arr.nalus) == 0 {
+			continue
+		}
+		b[22]++
+		// array_completeness is set since parameter sets are only sent out of band
+		b = append(b, 0x80|arr.naluType, 0, 0)
+		binary.BigEndian.PutUint16(b[len(b)-2:], uint16(len(arr.nalus)))
+		for _, nalu := range arr.nalus {
+			b = append(b, 0, 0)
+			binary.BigEndian.PutUint16(b[len(b)-2:], uint16(len(nalu)))
+			b = append(b, nalu...)
+		}
+	}
+	return b
+}
+
+// SPSInfo holds the fields of a sequence parameter set needed to describe
+// the stream
+type SPSInfo struct {
+	ProfileSpace         uint8
+	TierFlag             bool
+	ProfileIDC           uint8
+	ProfileCompat        uint32
+	ConstraintFlags      uint64
+	LevelIDC             uint8
+	MaxSubLayersMinus1   uint8
+	TemporalIDNested     bool
+	ChromaFormatIDC      uint
+	Width                uint
+	Height               uint
+	BitDepthLumaMinus8   uint
+	BitDepthChromaMinus8 uint
+}
+
+// ParseSPS parses a SPS NALU including its 2-byte header
+func ParseSPS(nalu []byte) (info SPSInfo, err error) {
+	if len(nalu) < 3 {
+		return info, errors.New("hevc: SPS too short")
+	}
+	r := bitstream.NewReader(bitstream.UnescapeRBSP(nalu[2:]))
+	// sps_video_parameter_set_id
+	if err = r.Skip(4); err != nil {
+		return
+	}
+	maxSubLayersMinus1, err := r.ReadBits(3)
+	if err != nil {
+		return
+	}
+	info.MaxSubLayersMinus1 = uint8(maxSubLayersMinus1)
+	if info.TemporalIDNested, err = r.ReadBit(); err != nil {
+		return
+	}
+	// profile_tier_level: general profile space, tier and idc
+	v, err := r.ReadBits(8)
+	if err != nil {
+		return
+	}
+	info.ProfileSpace = uint8(v >> 6)
+	info.TierFlag = v&0x20 != 0
+	info.ProfileIDC = uint8(v & 0x1f)
+	if v, err = r.ReadBits(32); err != nil {
+		return
+	}
+	info.ProfileCompat = uint32(v)
+	if info.ConstraintFlags, err = r.ReadBits(48); err != nil {
+		return
+	}
+	v, err = r.ReadBits(8)
+	if err != nil {
+		return
+	}
+	info.LevelIDC = uint8(v)
+	var profilePresent, levelPresent [8]bool
+	for i := 0; i < int(maxSubLayersMinus1); i++ {
+		if profilePresent[i], err = r.ReadBit(); err != nil {
+			return
+		}
+		if levelPresent[i], err = r.ReadBit(); err != nil {
+			return
+		}
+	}
+	if maxSubLayersMinus1 > 0 {
+		if err = r.Skip(2 * (8 - int(maxSubLayersMinus1))); err != nil {
+			return
+		}
+	}
+	for i := 0; i < int(maxSubLayersMinus1); i++ {
+		if profilePresent[i] {
+			if err = r.Skip(88); err != nil {
+				return
+			}
+		}
+		if levelPresent[i] {
+			if err = r.Skip(8); err != nil {
+				return
+			}
+		}
+	}
+	// sps_seq_parameter_set_id
+	if _, err = r.ReadUE(); err != nil {
+		return
+	}
+	if v, err = r.ReadUE(); err != nil {
+		return
+	}
+	info.ChromaFormatIDC = uint(v)
+	if info.ChromaFormatIDC == 3 {
+		// separate_colour_plane_flag
+		if err = r.Skip(1); err != nil {
+			return
+		}
+	}
+	width, err := r.ReadUE()
+	if err != nil {
+		return
+	}
+	height, err := r.ReadUE()
+	if err != nil {
+		return
+	}
+	cropped, err := r.ReadBit()
+	if err != nil {
+		return
+	}
+	if cropped {
+		var crop [4]uint64
+		for i := range crop {
+			if crop[i], err = r.ReadUE(); err != nil {
+				return
+			}
+		}
+		subWidth, subHeight := uint64(1), uint64(1)
+		switch info.ChromaFormatIDC {
+		case 1:
+			subWidth, subHeight = 2, 2
+		case 2:
+			subWidth = 2
+		}
+		width -= subWidth * (crop[0] + crop[1])
+		height -= subHeight * (crop[2] + crop[3])
+	}
+	info.Width = uint(width)
+	info.Height = uint(height)
+	if v, err = r.ReadUE(); err != nil {
+		return
+	}
+	info.BitDepthLumaMinus8 = uint(v)
+	if v, err = r.ReadUE(); err != nil {
+		return
+	}
+	info.BitDepthChromaMinus8 = uint(v)
+	return
+}
+
+type CodecData struct {
+	Record     []byte
+	RecordInfo DecoderConfRecord
+	SPSInfo    SPSInfo
+}
+
+func NewCodecDataFromDecoderConfRecord(record []byte) (cd CodecData, err error) {
+	cd.Record = record
+	if err = cd.RecordInfo.Unmarshal(record); err != nil {
+		return
+	}
+	if len(cd.RecordInfo.VPS) == 0 || len(cd.RecordInfo.SPS) == 0 || len(cd.RecordInfo.PPS) == 0 {
+		err = errors.New("hevc: decoder configuration record is missing parameter sets")
+		return
+	}
+	cd.SPSInfo, err = ParseSPS(cd.RecordInfo.SPS[0])
+	return
+}
+
+// NewCodecDataFromVPSAndSPSAndPPS builds a decoder configuration record from
+// raw parameter sets, such as those received in-band over RTP
+func NewCodecDataFromVPSAndSPSAndPPS(vps, sps, pps []byte) (cd CodecData, err error) {
+	if cd.SPSInfo, err = ParseSPS(sps); err != nil {
+		return
+	}
+	info := cd.SPSInfo
+	cd.RecordInfo = DecoderConfRecord{
+		GeneralProfileSpace:    info.ProfileSpace,
+		GeneralTierFlag:        info.TierFlag,
+		GeneralProfileIDC:      info.ProfileIDC,
+		GeneralProfileCompat:   info.ProfileCompat,
+		GeneralConstraintFlags: info.ConstraintFlags,
+		GeneralLevelIDC:        info.LevelIDC,
+		ChromaFormat:           uint8(info.ChromaFormatIDC),
+		BitDepthLumaMinus8:     uint8(info.BitDepthLumaMinus8),
+		BitDepthChromaMinus8:   uint8(info.BitDepthChromaMinus8),
+		NumTemporalLayers:      info.MaxSubLayersMinus1 + 1,
+		TemporalIDNested:       info.TemporalIDNested,
+		LengthSizeMinusOne:     3,
+		VPS:                    [][]byte{vps},
+		SPS:                    [][]byte{sps},
+		PPS:                    [][]byte{pps},
+	}
+	cd.Record = cd.RecordInfo.Marshal()
+	return
+}
+
+func (cd CodecData) Type() av.CodecType {
+	return codec.HEVC
+}
+
+func (cd CodecData) DecoderConfRecordBytes() []byte {
+	return cd.Record
+}
+
+func (cd CodecData) VPS() []byte {
+	return cd.RecordInfo.VPS[0]
+}
+
+func (cd CodecData) SPS() []byte {
+	return cd.RecordInfo.SPS[0]
+}
+
+func (cd CodecData) PPS() []byte {
+	return cd.RecordInfo.PPS[0]
+}
+
+func (cd CodecData) Width() int {
+	return int(cd.SPSInfo.Width)
+}
+
+func (cd CodecData) Height() int {
+	return int(cd.SPSInfo.Height)
+}
@@ -0,0 +1,63 @@
+// Package vp8parser parses VP8 frame headers
+package vp8parser
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"eaglesong.dev/gunk/codec"
+	"github.com/nareix/joy4/av"
+)
+
+var errNotKeyFrame = errors.New("vp8: not a key frame")
+
+// IsKeyFrame returns true if frame is a VP8 key frame
+func IsKeyFrame(frame []byte) bool {
+	return len(frame) > 0 && frame[0]&1 == 0
+}
+
+type CodecData struct {
+	Record        []byte
+	width, height int
+}
+
+// NewCodecDataFromKeyFrame reads the frame size from a key frame
+func NewCodecDataFromKeyFrame(frame []byte) (cd CodecData, err error) {
+	if !IsKeyFrame(frame) {
+		return cd, errNotKeyFrame
+	} else if len(frame) < 10 {
+		return cd, errors.New("vp8: key frame too short")
+	} else if frame[3] != 0x9d || frame[4] != 0x01 || frame[5] != 0x2a {
+		return cd, errors.New("vp8: invalid key frame start code")
+	}
+	width := int(binary.LittleEndian.Uint16(frame[6:]) & 0x3fff)
+	height := int(binary.LittleEndian.Uint16(frame[8:]) & 0x3fff)
+	return NewCodecData(width, height), nil
+}
+
+// NewCodecData describes a stream with the given frame size
+func NewCodecData(width, height int) CodecData {
+	// VP8 is always 8-bit 4:2:0
+	return CodecData{
+		Record: codec.VPCodecConfigurationRecord(0, 8, 1, false),
+		width:  width,
+		height: height,
+	}
+}
+
+func (cd CodecData) Type() av.CodecType {
+	return codec.VP8
+}
+
+// ConfigurationRecordBytes returns the contents of a vpcC box
+func (cd CodecData) ConfigurationRecordBytes() []byte {
+	return cd.Record
+}
+
+func (cd CodecData) Width() int {
+	return cd.width
+}
+
+func (cd CodecData) Height() int {
+	return cd.height
+}
@@ -0,0 +1,43 @@
+package vp8parser
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyFrame(t *testing.T) {
+	cases := []struct {
+		name          string
+		frame         string
+		key           bool
+		width, height int
+		err           string
+	}{
+		// frame tags and key frame headers from libvpx output
+		{name: "KeyFrame", frame: "5043009d012a8002e001", key: true, width: 640, height: 480},
+		{name: "Scaled", frame: "b02e019d012a8042e081", key: true, width: 640, height: 480},
+		{name: "InterFrame", frame: "310b00", err: "not a key frame"},
+		{name: "Short", frame: "5043009d012a8002", key: true, err: "too short"},
+		{name: "BadStartCode", frame: "5043009d012b8002e001", key: true, err: "start code"},
+		{name: "Empty", frame: "", err: "not a key frame"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			frame, err := hex.DecodeString(c.frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, c.key, IsKeyFrame(frame))
+			cd, err := NewCodecDataFromKeyFrame(frame)
+			if c.err != "" {
+				assert.ErrorContains(t, err, c.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, c.width, cd.Width())
+			assert.Equal(t, c.height, cd.Height())
+		})
+	}
+}
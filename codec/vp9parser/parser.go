@@ -0,0 +1,180 @@
+// Package vp9parser parses VP9 uncompressed frame headers
+package vp9parser
+
+import (
+	"errors"
+
+	"eaglesong.dev/gunk/codec"
+	"eaglesong.dev/gunk/internal/bitstream"
+	"github.com/nareix/joy4/av"
+)
+
+const (
+	frameMarker = 2
+	csRGB       = 7
+)
+
+var errNotKeyFrame = errors.New("vp9: not a key frame")
+
+// FrameHeader holds the fields of an uncompressed frame header needed to
+// describe the stream. Color and size are only set for key frames.
+type FrameHeader struct {
+	Profile   uint8
+	KeyFrame  bool
+	BitDepth  uint8
+	FullRange bool
+	// chroma subsampling per vpcC: 0 and 1 are 4:2:0, 2 is 4:2:2, 3 is 4:4:4
+	ChromaSubsampling uint8
+	Width             uint
+	Height            uint
+}
+
+// ParseFrameHeader parses the uncompressed header at the start of frame. For
+// a superframe this is the header of the first frame.
+func ParseFrameHeader(frame []byte) (fh FrameHeader, err error) {
+	r := bitstream.NewReader(frame)
+	v, err := r.ReadBits(2)
+	if err != nil {
+		return
+	} else if v != frameMarker {
+		return fh, errors.New("vp9: invalid frame marker")
+	}
+	low, err := r.ReadBits(1)
+	if err != nil {
+		return
+	}
+	high, err := r.ReadBits(1)
+	if err != nil {
+		return
+	}
+	fh.Profile = uint8(high<<1 | low)
+	if fh.Profile == 3 {
+		if err = r.Skip(1); err != nil {
+			return
+		}
+	}
+	showExisting, err := r.ReadBit()
+	if err != nil || showExisting {
+		return
+	}
+	interFrame, err := r.ReadBit()
+	if err != nil || interFrame {
+		return
+	}
+	fh.KeyFrame = true
+	// show_frame, error_resilient_mode
+	if err = r.Skip(2); err != nil {
+		return
+	}
+	if v, err = r.ReadBits(24); err != nil {
+		return
+	} else if v != 0x498342 {
+		return fh, errors.New("vp9: invalid frame sync code")
+	}
+	// color_config
+	fh.BitDepth = 8
+	if fh.Profile >= 2 {
+		twelve, err := r.ReadBit()
+		if err != nil {
+			return fh, err
+		}
+		fh.BitDepth = 10
+		if twelve {
+			fh.BitDepth = 12
+		}
+	}
+	colorSpace, err := r.ReadBits(3)
+	if err != nil {
+		return
+	}
+	subsampling := fh.Profile == 1 || fh.Profile == 3
+	if colorSpace != csRGB {
+		if fh.FullRange, err = r.ReadBit(); err != nil {
+			return
+		}
+		fh.ChromaSubsampling = 1
+		if subsampling {
+			ssX, err := r.ReadBit()
+			if err != nil {
+				return fh, err
+			}
+			ssY, err := r.ReadBit()
+			if err != nil {
+				return fh, err
+			}
+			switch {
+			case ssX && !ssY:
+				fh.ChromaSubsampling = 2
+			case !ssX && !ssY:
+				fh.ChromaSubsampling = 3
+			}
+			if err = r.Skip(1); err != nil {
+				return fh, err
+			}
+		}
+	} else {
+		fh.FullRange = true
+		fh.ChromaSubsampling = 3
+		if subsampling {
+			if err = r.Skip(1); err != nil {
+				return
+			}
+		}
+	}
+	// frame_size
+	if v, err = r.ReadBits(16); err != nil {
+		return
+	}
+	fh.Width = uint(v) + 1
+	if v, err = r.ReadBits(16); err != nil {
+		return
+	}
+	fh.Height = uint(v) + 1
+	return
+}
+
+// IsKeyFrame returns true if frame starts with a VP9 key frame
+func IsKeyFrame(frame []byte) bool {
+	fh, err := ParseFrameHeader(frame)
+	return err == nil && fh.KeyFrame
+}
+
+type CodecData struct {
+	Record      []byte
+	FrameHeader FrameHeader
+}
+
+// NewCodecDataFromKeyFrame reads the stream configuration from a key frame
+func NewCodecDataFromKeyFrame(frame []byte) (cd CodecData, err error) {
+	if cd.FrameHeader, err = ParseFrameHeader(frame); err != nil {
+		return
+	} else if !cd.FrameHeader.KeyFrame {
+		return cd, errNotKeyFrame
+	}
+	return NewCodecData(cd.FrameHeader), nil
+}
+
+// NewCodecData describes a stream from the header of one of its key frames
+func NewCodecData(fh FrameHeader) CodecData {
+	return CodecData{
+		Record:      codec.VPCodecConfigurationRecord(fh.Profile, fh.BitDepth, fh.ChromaSubsampling, fh.FullRange),
+		FrameHeader: fh,
+	}
+}
+
+func (cd CodecData) Type() av.CodecType {
+	return codec.VP9
+}
+
+// ConfigurationRecordBytes returns the contents of a vpcC box
+func (cd CodecData) ConfigurationRecordBytes() []byte {
+	return cd.Record
+}
+
+func (cd CodecData) Width() int {
+	return int(cd.FrameHeader.Width)
+}
+
+func (cd CodecData) Height() int {
+	return int(cd.FrameHeader.Height)
+}
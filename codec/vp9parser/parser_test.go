@@ -0,0 +1,86 @@
+package vp9parser
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFrameHeader(t *testing.T) {
+	cases := []struct {
+		name  string
+		frame string
+		want  FrameHeader
+		err   string
+	}{
+		{
+			// 8-bit 4:2:0 key frame from libvpx
+			name:  "KeyFrame",
+			frame: "824983420027f01df6003824",
+			want:  FrameHeader{Profile: 0, KeyFrame: true, BitDepth: 8, ChromaSubsampling: 1, Width: 640, Height: 480},
+		},
+		{
+			name:  "InterFrame",
+			frame: "8600403b",
+			want:  FrameHeader{Profile: 0},
+		},
+		{
+			name:  "ShowExisting",
+			frame: "8a",
+			want:  FrameHeader{Profile: 0},
+		},
+		{
+			// 10-bit, BT.709 limited range
+			name:  "Profile2",
+			frame: "924983422027f81678",
+			want:  FrameHeader{Profile: 2, KeyFrame: true, BitDepth: 10, ChromaSubsampling: 1, Width: 1280, Height: 720},
+		},
+		{
+			// 4:4:4 sRGB
+			name:  "Profile1RGB",
+			frame: "a2498342e00ff008f0",
+			want:  FrameHeader{Profile: 1, KeyFrame: true, BitDepth: 8, FullRange: true, ChromaSubsampling: 3, Width: 256, Height: 144},
+		},
+		{
+			name:  "BadMarker",
+			frame: "424983420027f01df6",
+			err:   "frame marker",
+		},
+		{
+			name:  "BadSyncCode",
+			frame: "824983430027f01df6",
+			err:   "sync code",
+		},
+		{
+			name:  "Truncated",
+			frame: "824983420027f0",
+			err:   "exhausted",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			frame, err := hex.DecodeString(c.frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fh, err := ParseFrameHeader(frame)
+			if c.err != "" {
+				assert.ErrorContains(t, err, c.err)
+				assert.False(t, IsKeyFrame(frame))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, c.want, fh)
+			assert.Equal(t, c.want.KeyFrame, IsKeyFrame(frame))
+			cd, err := NewCodecDataFromKeyFrame(frame)
+			if !c.want.KeyFrame {
+				assert.ErrorIs(t, err, errNotKeyFrame)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, int(c.want.Width), cd.Width())
+			assert.Equal(t, int(c.want.Height), cd.Height())
+		})
+	}
+}
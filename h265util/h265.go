@@ -0,0 +1,57 @@
+// Package h265util has helpers for working with H.265 bitstreams
+package h265util
+
+import (
+	"bytes"
+
+	"eaglesong.dev/gunk/codec/hevcparser"
+	"eaglesong.dev/gunk/h264util"
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+// SplitNALUs splits a packet in either Annex B or HVCC format. The framing is
+// the same as H.264 so this defers to h264parser.
+func SplitNALUs(b []byte) [][]byte {
+	nalus, _ := h264parser.SplitNALUs(b)
+	return nalus
+}
+
+// WriteAnnexBPacket writes a H265 packet in Annex B format.
+// If the packet is a keyframe, prepend codec information (VPS, SPS and PPS) as well.
+func WriteAnnexBPacket(w *bytes.Buffer, pkt av.Packet, cd hevcparser.CodecData) {
+	nalus := SplitNALUs(pkt.Data)
+	if pkt.IsKeyFrame {
+		nalus = append([][]byte{cd.VPS(), cd.SPS(), cd.PPS()}, nalus...)
+	}
+	h264util.WriteAnnexB(w, nalus)
+}
+
+// AnnexBToHVCC converts an Annex B bitstream to HVCC format
+func AnnexBToHVCC(b []byte) []byte {
+	var out []byte
+	for _, nalu := range SplitNALUs(b) {
+		out = append(out, NALUToHVCC(nalu)...)
+	}
+	return out
+}
+
+// NALUToHVCC converts a raw NALU to HVCC format
+func NALUToHVCC(nalu []byte) []byte {
+	return h264util.NALUToAVCC(nalu)
+}
+
+// ParameterSets returns the last VPS, SPS and PPS found in nalus
+func ParameterSets(nalus [][]byte) (vps, sps, pps []byte) {
+	for _, nalu := range nalus {
+		switch NALType(nalu) {
+		case TypeVideoParameter:
+			vps = nalu
+		case TypeSequenceParameter:
+			sps = nalu
+		case TypePictureParameter:
+			pps = nalu
+		}
+	}
+	return
+}
@@ -0,0 +1,141 @@
+package h265util
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// RTP payload format for H.265 (RFC 7798), without DONL fields
+
+const (
+	naluHeaderSize = 2
+	fuHeaderSize   = 1
+
+	fuStart = 0x80
+	fuEnd   = 0x40
+)
+
+var errShortPacket = errors.New("h265: RTP payload too short")
+
+// Depacketizer converts RTP payloads to NALUs in HVCC format. It implements
+// rtp.Depacketizer.
+type Depacketizer struct {
+	fuBuf []byte
+}
+
+func (d *Depacketizer) Unmarshal(payload []byte) ([]byte, error) {
+	if len(payload) <= naluHeaderSize {
+		return nil, errShortPacket
+	}
+	switch NALType(payload) {
+	case TypeAP:
+		var out []byte
+		b := payload[naluHeaderSize:]
+		for len(b) > 0 {
+			if len(b) < 2 {
+				return nil, errShortPacket
+			}
+			size := int(binary.BigEndian.Uint16(b))
+			b = b[2:]
+			if len(b) < size {
+				return nil, errShortPacket
+			}
+			out = append(out, NALUToHVCC(b[:size])...)
+			b = b[size:]
+		}
+		return out, nil
+	case TypeFU:
+		if len(payload) <= naluHeaderSize+fuHeaderSize {
+			return nil, errShortPacket
+		}
+		fu := payload[naluHeaderSize]
+		if fu&fuStart != 0 {
+			// rebuild the original NALU header from the FU type
+			d.fuBuf = append(d.fuBuf[:0],
+				payload[0]&0x81|(fu&0x3f)<<1,
+				payload[1],
+			)
+		} else if d.fuBuf == nil {
+			// missed the start of this NALU
+			return nil, nil
+		}
+		d.fuBuf = append(d.fuBuf, payload[naluHeaderSize+fuHeaderSize:]...)
+		if fu&fuEnd == 0 {
+			return nil, nil
+		}
+		out := NALUToHVCC(d.fuBuf)
+		d.fuBuf = nil
+		return out, nil
+	case TypePACI:
+		return nil, fmt.Errorf("h265: unsupported RTP payload type %s", TypePACI)
+	default:
+		return NALUToHVCC(payload), nil
+	}
+}
+
+// IsPartitionHead returns false for the continuation of a fragmented NALU
+func (d *Depacketizer) IsPartitionHead(payload []byte) bool {
+	if len(payload) <= naluHeaderSize+fuHeaderSize {
+		return false
+	}
+	if NALType(payload) == TypeFU {
+		return payload[naluHeaderSize]&fuStart != 0
+	}
+	return true
+}
+
+// IsPartitionTail returns true at the last packet of a frame
+func (d *Depacketizer) IsPartitionTail(marker bool, payload []byte) bool {
+	return marker
+}
+
+// Payloader splits an Annex B bitstream into RTP payloads. It implements
+// rtp.Payloader.
+type Payloader struct{}
+
+func (p *Payloader) Payload(mtu uint16, payload []byte) [][]byte {
+	var payloads [][]byte
+	maxSize := int(mtu)
+	for _, nalu := range SplitNALUs(payload) {
+		if len(nalu) <= naluHeaderSize {
+			continue
+		}
+		switch NALType(nalu) {
+		case TypeAccessDelimiter, TypeFiller:
+			continue
+		}
+		if len(nalu) <= maxSize {
+			payloads = append(payloads, append([]byte(nil), nalu...))
+			continue
+		}
+		// fragment
+		fuType := byte(NALType(nalu))
+		header := [naluHeaderSize]byte{
+			nalu[0]&0x81 | byte(TypeFU)<<1,
+			nalu[1],
+		}
+		data := nalu[naluHeaderSize:]
+		chunk := maxSize - naluHeaderSize - fuHeaderSize
+		if chunk <= 0 {
+			return nil
+		}
+		for i := 0; i < len(data); i += chunk {
+			end := i + chunk
+			fu := fuType
+			if i == 0 {
+				fu |= fuStart
+			}
+			if end >= len(data) {
+				end = len(data)
+				fu |= fuEnd
+			}
+			out := make([]byte, 0, naluHeaderSize+fuHeaderSize+end-i)
+			out = append(out, header[:]...)
+			out = append(out, fu)
+			out = append(out, data[i:end]...)
+			payloads = append(payloads, out)
+		}
+	}
+	return payloads
+}
@@ -0,0 +1,265 @@
+package h265util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+
+	"eaglesong.dev/gunk/h264util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// parameter sets from a 1920x1080 Main profile x265 stream
+var (
+	sampleVPS = unhex("40010c01ffff016000000300900000030000030078959809")
+	sampleSPS = unhex("420101016000000300900000030000030078a003c08010e59659a4932bc05a02000003000200000300651008")
+	samplePPS = unhex("4401c172b46240")
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// slice returns a NALU of the given type and total size. The body never
+// contains a start code.
+func slice(t UnitType, size int) []byte {
+	nalu := make([]byte, size)
+	nalu[0], nalu[1] = byte(t)<<1, 1
+	for i := 2; i < size; i++ {
+		nalu[i] = byte(i%251) + 1
+	}
+	return nalu
+}
+
+func annexB(nalus ...[]byte) []byte {
+	var buf bytes.Buffer
+	h264util.WriteAnnexB(&buf, nalus)
+	return buf.Bytes()
+}
+
+func hvcc(nalus ...[]byte) []byte {
+	var out []byte
+	for _, nalu := range nalus {
+		out = append(out, NALUToHVCC(nalu)...)
+	}
+	return out
+}
+
+func TestPayloader(t *testing.T) {
+	const mtu = 100
+	cases := []struct {
+		name  string
+		nalus [][]byte
+		sizes []int // expected payload sizes
+	}{
+		{
+			name:  "ParameterSets",
+			nalus: [][]byte{sampleVPS, sampleSPS, samplePPS},
+			sizes: []int{len(sampleVPS), len(sampleSPS), len(samplePPS)},
+		},
+		{
+			name:  "ExactlyMTU",
+			nalus: [][]byte{slice(TypeIDRWRADL, mtu)},
+			sizes: []int{mtu},
+		},
+		{
+			name:  "OneOverMTU",
+			nalus: [][]byte{slice(TypeIDRWRADL, mtu+1)},
+			// 99 bytes of body in 97 + 2
+			sizes: []int{mtu, 5},
+		},
+		{
+			name:  "ExactFragments",
+			nalus: [][]byte{slice(TypeTrailR, 2+97*3)},
+			sizes: []int{mtu, mtu, mtu},
+		},
+		{
+			name:  "SkipsDelimiterAndFiller",
+			nalus: [][]byte{{0x46, 0x01, 0x50}, slice(TypeFiller, 10), slice(TypeTrailR, 20)},
+			sizes: []int{20},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			payloads := (&Payloader{}).Payload(mtu, annexB(c.nalus...))
+			var sizes []int
+			for _, p := range payloads {
+				sizes = append(sizes, len(p))
+			}
+			assert.Equal(t, c.sizes, sizes)
+		})
+	}
+}
+
+func TestPayloaderFragments(t *testing.T) {
+	nalu := slice(TypeCRA, 250)
+	payloads := (&Payloader{}).Payload(100, annexB(nalu))
+	require.Len(t, payloads, 3)
+	for i, p := range payloads {
+		assert.Equal(t, TypeFU, NALType(p), "packet %d", i)
+		assert.Equal(t, nalu[1], p[1], "packet %d keeps the layer and temporal ID", i)
+		assert.Equal(t, TypeCRA, UnitType(p[2]&0x3f), "packet %d", i)
+		assert.Equal(t, i == 0, p[2]&fuStart != 0, "start bit on packet %d", i)
+		assert.Equal(t, i == 2, p[2]&fuEnd != 0, "end bit on packet %d", i)
+	}
+	assert.Nil(t, (&Payloader{}).Payload(3, annexB(nalu)), "MTU too small for a FU")
+}
+
+func TestRoundTrip(t *testing.T) {
+	nalus := [][]byte{sampleVPS, sampleSPS, samplePPS, slice(TypeIDRWRADL, 3000), slice(TypeTrailR, 1200), slice(TypeTrailN, 40)}
+	for _, mtu := range []uint16{1200, 1000, 100, 47, 4} {
+		var d Depacketizer
+		var out []byte
+		payloads := (&Payloader{}).Payload(mtu, annexB(nalus...))
+		require.NotEmpty(t, payloads)
+		for _, p := range payloads {
+			assert.LessOrEqual(t, len(p), int(mtu))
+			b, err := d.Unmarshal(p)
+			require.NoError(t, err)
+			out = append(out, b...)
+		}
+		assert.Equal(t, hvcc(nalus...), out, "MTU %d", mtu)
+	}
+}
+
+// ap builds an aggregation packet
+func ap(nalus ...[]byte) []byte {
+	p := []byte{byte(TypeAP) << 1, 1}
+	for _, nalu := range nalus {
+		p = binary.BigEndian.AppendUint16(p, uint16(len(nalu)))
+		p = append(p, nalu...)
+	}
+	return p
+}
+
+func TestDepacketizer(t *testing.T) {
+	idr := slice(TypeIDRNLP, 30)
+	fu := func(fu byte, body []byte) []byte {
+		return append([]byte{byte(TypeFU) << 1, 1, fu}, body...)
+	}
+	cases := []struct {
+		name     string
+		payloads [][]byte
+		want     []byte
+		err      string
+	}{
+		{
+			name:     "Single",
+			payloads: [][]byte{idr},
+			want:     hvcc(idr),
+		},
+		{
+			name:     "Aggregation",
+			payloads: [][]byte{ap(sampleVPS, sampleSPS, samplePPS)},
+			want:     hvcc(sampleVPS, sampleSPS, samplePPS),
+		},
+		{
+			name: "Fragments",
+			payloads: [][]byte{
+				fu(fuStart|byte(TypeIDRNLP), idr[2:10]),
+				fu(byte(TypeIDRNLP), idr[10:20]),
+				fu(fuEnd|byte(TypeIDRNLP), idr[20:]),
+			},
+			want: hvcc(idr),
+		},
+		{
+			name: "MissedStart",
+			payloads: [][]byte{
+				fu(byte(TypeIDRNLP), idr[10:20]),
+				fu(fuEnd|byte(TypeIDRNLP), idr[20:]),
+				idr,
+			},
+			want: hvcc(idr),
+		},
+		{
+			name:     "Short",
+			payloads: [][]byte{{0x02, 0x01}},
+			err:      "too short",
+		},
+		{
+			name:     "ShortFU",
+			payloads: [][]byte{{byte(TypeFU) << 1, 1, fuStart | byte(TypeIDRNLP)}},
+			err:      "too short",
+		},
+		{
+			name:     "TruncatedAggregation",
+			payloads: [][]byte{ap(sampleVPS, sampleSPS)[:40]},
+			err:      "too short",
+		},
+		{
+			name:     "TruncatedAggregationSize",
+			payloads: [][]byte{append(ap(sampleVPS), 0)},
+			err:      "too short",
+		},
+		{
+			name:     "PACI",
+			payloads: [][]byte{{byte(TypePACI) << 1, 1, 0, 0}},
+			err:      "unsupported",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var d Depacketizer
+			var out []byte
+			var err error
+			for _, p := range c.payloads {
+				var b []byte
+				b, err = d.Unmarshal(p)
+				if err != nil {
+					break
+				}
+				out = append(out, b...)
+			}
+			if c.err != "" {
+				assert.ErrorContains(t, err, c.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, c.want, out)
+		})
+	}
+}
+
+func TestIsPartitionHead(t *testing.T) {
+	var d Depacketizer
+	payloads := (&Payloader{}).Payload(100, annexB(samplePPS, slice(TypeIDRWRADL, 250)))
+	require.Len(t, payloads, 4)
+	assert.True(t, d.IsPartitionHead(payloads[0]))
+	assert.True(t, d.IsPartitionHead(payloads[1]))
+	assert.False(t, d.IsPartitionHead(payloads[2]))
+	assert.False(t, d.IsPartitionHead(payloads[3]))
+}
+
+func TestKeyFrames(t *testing.T) {
+	cases := []struct {
+		nalu []byte
+		typ  UnitType
+		key  bool
+	}{
+		{sampleVPS, TypeVideoParameter, false},
+		{sampleSPS, TypeSequenceParameter, false},
+		{samplePPS, TypePictureParameter, false},
+		// slice headers from the same stream
+		{unhex("2601af0a4a"), TypeIDRWRADL, true},
+		{unhex("2a01ad01e0"), TypeCRA, true},
+		{unhex("0201d00962"), TypeTrailR, false},
+		{unhex("0001d40a97"), TypeTrailN, false},
+		{unhex("4e01050c"), TypePrefixSEI, false},
+	}
+	for _, c := range cases {
+		t.Run(c.typ.String(), func(t *testing.T) {
+			assert.Equal(t, c.typ, NALType(c.nalu))
+			assert.Equal(t, c.key, NALType(c.nalu).IsKeyFrame())
+		})
+	}
+	vps, sps, pps := ParameterSets(SplitNALUs(annexB(sampleVPS, sampleSPS, samplePPS, unhex("2601af0a4a"))))
+	assert.Equal(t, sampleVPS, vps)
+	assert.Equal(t, sampleSPS, sps)
+	assert.Equal(t, samplePPS, pps)
+}
@@ -0,0 +1,108 @@
+package h265util
+
+import "fmt"
+
+type UnitType uint8
+
+const (
+	// VCL types
+	TypeTrailN UnitType = iota
+	TypeTrailR
+	TypeTSAN
+	TypeTSAR
+	TypeSTSAN
+	TypeSTSAR
+	TypeRADLN
+	TypeRADLR
+	TypeRASLN
+	TypeRASLR
+)
+
+const (
+	// IRAP types
+	TypeBLAWLP UnitType = iota + 16
+	TypeBLAWRADL
+	TypeBLANLP
+	TypeIDRWRADL
+	TypeIDRNLP
+	TypeCRA
+)
+
+const (
+	// Non-VCL types
+	TypeVideoParameter UnitType = iota + 32
+	TypeSequenceParameter
+	TypePictureParameter
+	TypeAccessDelimiter
+	TypeEndSequence
+	TypeEndStream
+	TypeFiller
+	TypePrefixSEI
+	TypeSuffixSEI
+)
+
+const (
+	// RTP framing
+	TypeAP UnitType = iota + 48
+	TypeFU
+	TypePACI
+)
+
+func NALType(nalu []byte) UnitType {
+	if len(nalu) == 0 {
+		return TypeTrailN
+	}
+	return UnitType(nalu[0]>>1) & 0x3f
+}
+
+// IsKeyFrame returns true for intra random access point pictures
+func (t UnitType) IsKeyFrame() bool {
+	return t >= TypeBLAWLP && t <= 23
+}
+
+func (t UnitType) String() string {
+	switch t {
+	case TypeTrailN, TypeTrailR:
+		return "Tra"
+	case TypeTSAN, TypeTSAR:
+		return "TSA"
+	case TypeSTSAN, TypeSTSAR:
+		return "STSA"
+	case TypeRADLN, TypeRADLR:
+		return "RADL"
+	case TypeRASLN, TypeRASLR:
+		return "RASL"
+	case TypeBLAWLP, TypeBLAWRADL, TypeBLANLP:
+		return "BLA"
+	case TypeIDRWRADL, TypeIDRNLP:
+		return "IDR"
+	case TypeCRA:
+		return "CRA"
+	case TypeVideoParameter:
+		return "VPS"
+	case TypeSequenceParameter:
+		return "SPS"
+	case TypePictureParameter:
+		return "PPS"
+	case TypeAccessDelimiter:
+		return "aud"
+	case TypeEndSequence:
+		return "EOQ"
+	case TypeEndStream:
+		return "EOS"
+	case TypeFiller:
+		return "fil"
+	case TypePrefixSEI:
+		return "SEI"
+	case TypeSuffixSEI:
+		return "SEI-S"
+	case TypeAP:
+		return "AP"
+	case TypeFU:
+		return "FU"
+	case TypePACI:
+		return "PACI"
+	default:
+		return fmt.Sprintf("%d", t)
+	}
+}
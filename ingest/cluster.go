@@ -0,0 +1,391 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"eaglesong.dev/gunk/ingest/relay"
+	"eaglesong.dev/gunk/model"
+	"eaglesong.dev/gunk/sinks/playrtc"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// how often an edge polls the origin and reports its viewers
+	edgeInterval = 2 * time.Second
+	// edge reports older than this are not counted
+	edgeReportExpiry = 30 * time.Second
+	// how long a pulled channel is kept without viewers
+	edgeIdleTimeout = time.Minute
+	// how long a viewer waits for a pull to start
+	pullTimeout = 10 * time.Second
+	// how long status and viewer requests to the origin can take
+	originRequestTimeout = 5 * time.Second
+)
+
+// RelayStatus is the state of a channel as reported to edge nodes
+type RelayStatus struct {
+	Live    bool `json:"live"`
+	Pending bool `json:"pending"`
+	Viewers int  `json:"viewers"`
+	RTC     bool `json:"rtc"`
+	// playback details, so that edge viewers can start a player before the
+	// channel is pulled
+	Codec     string   `json:"codec,omitempty"`
+	Modes     []string `json:"modes,omitempty"`
+	WebURL    string   `json:"web_url,omitempty"`
+	NativeURL string   `json:"native_url,omitempty"`
+}
+
+// ViewerReport is sent by an edge node to count its viewers on the origin
+type ViewerReport struct {
+	Node    string         `json:"node"`
+	Viewers map[string]int `json:"viewers"`
+}
+
+type edgeReport struct {
+	viewers map[string]int
+	at      time.Time
+}
+
+// ServeRelay sends a channel to an edge node
+func (m *Manager) ServeRelay(rw http.ResponseWriter, req *http.Request, name string) error {
+	ch := m.channel(name)
+	src := ch.queue(false)
+	if src == nil {
+		return ErrNoChannel
+	}
+	streams, err := src.Streams()
+	if err != nil {
+		return err
+	}
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	muxer := relay.NewMuxer(flushWriter{rw})
+	if err := muxer.WriteHeader(streams); err != nil {
+		return err
+	}
+	return copyStream(req.Context(), muxer, src, "relay")
+}
+
+// flushWriter sends each packet to the edge as soon as it is written
+type flushWriter struct {
+	rw http.ResponseWriter
+}
+
+func (w flushWriter) Write(d []byte) (int, error) {
+	n, err := w.rw.Write(d)
+	if f, ok := w.rw.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+// RelayStatus returns the channels that are live on this node
+func (m *Manager) RelayStatus() map[string]RelayStatus {
+	status := make(map[string]RelayStatus)
+	m.channels.Range(func(k, v interface{}) bool {
+		ch := v.(*channel)
+		if ch.isLive() == stateOffline {
+			return true
+		}
+		info := &model.ChannelInfo{Name: k.(string)}
+		m.populateLocal(info, ch)
+		status[info.Name] = RelayStatus{
+			Live:      info.Live,
+			Pending:   info.Pending,
+			Viewers:   info.Viewers,
+			RTC:       info.RTC,
+			Codec:     info.Codec,
+			Modes:     info.Modes,
+			WebURL:    info.WebURL,
+			NativeURL: info.NativeURL,
+		}
+		return true
+	})
+	return status
+}
+
+// ReportViewers records the viewers of an edge node
+func (m *Manager) ReportViewers(report ViewerReport) {
+	m.edgeReports.Store(report.Node, edgeReport{viewers: report.Viewers, at: time.Now()})
+	if m.Changed != nil {
+		for name := range report.Viewers {
+			m.Changed(name)
+		}
+	}
+}
+
+// edgeViewers returns the number of viewers of a channel on all edge nodes
+func (m *Manager) edgeViewers(name string) (n int) {
+	m.edgeReports.Range(func(k, v interface{}) bool {
+		r := v.(edgeReport)
+		if time.Since(r.at) > edgeReportExpiry {
+			m.edgeReports.Delete(k)
+		} else {
+			n += r.viewers[name]
+		}
+		return true
+	})
+	return
+}
+
+// edge pulls channels from an origin node on demand
+type edge struct {
+	mu     sync.Mutex
+	status map[string]RelayStatus
+	pulls  map[string]*pull
+	client http.Client // status and viewer requests
+	stream http.Client // pulls, which last as long as the channel is watched
+}
+
+func newEdge() *edge {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.ResponseHeaderTimeout = pullTimeout
+	return &edge{
+		pulls:  make(map[string]*pull),
+		client: http.Client{Timeout: originRequestTimeout},
+		stream: http.Client{Transport: tr},
+	}
+}
+
+type pull struct {
+	cancel    context.CancelFunc
+	idleSince time.Time
+}
+
+func (m *Manager) isEdge() bool {
+	return m.Origin != nil
+}
+
+func (m *Manager) runEdge() {
+	for range time.NewTicker(edgeInterval).C {
+		if err := m.pollOrigin(); err != nil {
+			log.Err(err).Msg("failed to get channel status from origin")
+		}
+		if err := m.reportViewers(); err != nil {
+			log.Err(err).Msg("failed to report viewers to origin")
+		}
+	}
+}
+
+func (m *Manager) originRequest(method, path string, body io.Reader) (*http.Request, error) {
+	u := m.Origin.ResolveReference(&url.URL{Path: path})
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.ClusterSecret)
+	return req, nil
+}
+
+func (m *Manager) pollOrigin() error {
+	req, err := m.originRequest("GET", "/relay", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := m.edge.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("origin returned %s", resp.Status)
+	}
+	var status map[string]RelayStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return err
+	}
+	m.edge.mu.Lock()
+	old := m.edge.status
+	m.edge.status = status
+	m.edge.mu.Unlock()
+	if m.Changed != nil {
+		for name, st := range status {
+			if prev, ok := old[name]; !ok || !reflect.DeepEqual(prev, st) {
+				m.Changed(name)
+			}
+		}
+		for name := range old {
+			if _, ok := status[name]; !ok {
+				m.Changed(name)
+			}
+		}
+	}
+	// B-frames are detected on the origin
+	for name, st := range status {
+		ch := m.channel(name)
+		if ch == nil {
+			continue
+		}
+		ch.mu.Lock()
+		rtcOK := st.RTC && len(ch.streams) != 0 && playrtc.CanSend(ch.streams)
+		ch.mu.Unlock()
+		var v uintptr
+		if rtcOK {
+			v = 1
+		}
+		atomic.StoreUintptr(&ch.rtc, v)
+	}
+	return nil
+}
+
+// reportViewers sends the viewer count of each pulled channel to the origin
+// and stops pulling channels that nobody watches
+func (m *Manager) reportViewers() error {
+	report := ViewerReport{Node: m.NodeID, Viewers: make(map[string]int)}
+	m.edge.mu.Lock()
+	for name, p := range m.edge.pulls {
+		ch := m.channel(name)
+		if ch == nil {
+			continue
+		}
+		ch.countWebViewers()
+		n := ch.currentViewers()
+		report.Viewers[name] = n
+		switch {
+		case n > 0:
+			p.idleSince = time.Time{}
+		case p.idleSince.IsZero():
+			p.idleSince = time.Now()
+		case time.Since(p.idleSince) > edgeIdleTimeout:
+			log.Info().Str("channel", name).Msg("no viewers, stopping pull from origin")
+			p.cancel()
+			delete(m.edge.pulls, name)
+		}
+	}
+	m.edge.mu.Unlock()
+	blob, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	req, err := m.originRequest("POST", "/relay/viewers", bytes.NewReader(blob))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := m.edge.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("origin returned %s", resp.Status)
+	}
+	return nil
+}
+
+// originStatus returns the state of a channel on the origin
+func (m *Manager) originStatus(name string) (RelayStatus, bool) {
+	m.edge.mu.Lock()
+	defer m.edge.mu.Unlock()
+	st, ok := m.edge.status[name]
+	return st, ok
+}
+
+// startPull begins pulling a channel from the origin if it isn't already
+func (m *Manager) startPull(name string) {
+	m.edge.mu.Lock()
+	defer m.edge.mu.Unlock()
+	if m.edge.pulls[name] != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &pull{cancel: cancel}
+	m.edge.pulls[name] = p
+	go func() {
+		l := log.With().Str("channel", name).Logger()
+		l.Info().Msg("pulling from origin")
+		if err := m.pullOnce(ctx, name); err != nil && ctx.Err() == nil {
+			l.Err(err).Msg("pull from origin failed")
+		}
+		m.edge.mu.Lock()
+		if m.edge.pulls[name] == p {
+			delete(m.edge.pulls, name)
+		}
+		m.edge.mu.Unlock()
+		cancel()
+	}()
+}
+
+func (m *Manager) pullOnce(ctx context.Context, name string) error {
+	req, err := m.originRequest("GET", "/relay/"+url.PathEscape(name), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := m.edge.stream.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("origin returned %s", resp.Status)
+	}
+	l := log.With().Str("origin", m.Origin.Host).Logger()
+	return m.publish(l.WithContext(ctx), model.ChannelAuth{Name: name}, relay.NewDemuxer(resp.Body), true)
+}
+
+// viewChannel returns a channel for a viewer. On an edge node, a channel that
+// is live on the origin is pulled first.
+func (m *Manager) viewChannel(ctx context.Context, name string) *channel {
+	ch := m.channel(name)
+	if !m.isEdge() || ch.queue(false) != nil {
+		return ch
+	}
+	if _, ok := m.originStatus(name); !ok {
+		return ch
+	}
+	m.startPull(name)
+	ctx, cancel := context.WithTimeout(ctx, pullTimeout)
+	defer cancel()
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return m.channel(name)
+		case <-t.C:
+			if ch := m.channel(name); ch.queue(false) != nil {
+				return ch
+			}
+		}
+	}
+}
+
+// populateOrigin fills in a channel that is live on the origin but not yet
+// pulled to this edge. The pull starts once a viewer asks for the channel. It
+// returns false if the local state should be used instead.
+func (m *Manager) populateOrigin(info *model.ChannelInfo, ch *channel) bool {
+	st, ok := m.originStatus(info.Name)
+	if !ok || ch.isLive() != stateOffline {
+		return false
+	}
+	info.Live = st.Live
+	info.Pending = st.Pending
+	info.Viewers = st.Viewers
+	info.RTC = st.RTC
+	info.Codec = st.Codec
+	info.Modes = st.Modes
+	info.WebURL = st.WebURL
+	info.NativeURL = st.NativeURL
+	return true
+}
+
+// totalViewers returns the viewers of a channel on every node
+func (m *Manager) totalViewers(ch *channel) int {
+	if m.isEdge() {
+		// the origin counts this node's viewers too
+		if st, ok := m.originStatus(ch.name); ok {
+			return st.Viewers
+		}
+	}
+	return ch.currentViewers() + m.edgeViewers(ch.name)
+}
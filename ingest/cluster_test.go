@@ -0,0 +1,127 @@
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"eaglesong.dev/gunk/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testOrigin serves the relay routes of an origin node, the same way the web
+// server does
+type testOrigin struct {
+	m *Manager
+
+	mu     sync.Mutex
+	pulled []string
+}
+
+func (o *testOrigin) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Authorization") != "Bearer "+o.m.ClusterSecret {
+		http.Error(rw, "not authorized", http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case req.URL.Path == "/relay":
+		_ = json.NewEncoder(rw).Encode(o.m.RelayStatus())
+	case req.URL.Path == "/relay/viewers":
+		var report ViewerReport
+		if err := json.NewDecoder(req.Body).Decode(&report); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		o.m.ReportViewers(report)
+		rw.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(req.URL.Path, "/relay/"):
+		name := strings.TrimPrefix(req.URL.Path, "/relay/")
+		o.mu.Lock()
+		o.pulled = append(o.pulled, name)
+		o.mu.Unlock()
+		if err := o.m.ServeRelay(rw, req, name); err == ErrNoChannel {
+			http.NotFound(rw, req)
+		}
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+func (o *testOrigin) pulls() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]string(nil), o.pulled...)
+}
+
+func TestOriginEdge(t *testing.T) {
+	origin := &testOrigin{m: &Manager{ClusterSecret: "secret"}}
+	srv := httptest.NewServer(origin)
+	defer srv.Close()
+	live := origin.m.getChannel("live")
+	atomic.StoreUintptr(&live.live, uintptr(stateLive))
+	atomic.StoreUintptr(&live.rtc, 1)
+	live.addViewer(2)
+	pending := origin.m.getChannel("pending")
+	atomic.StoreUintptr(&pending.live, uintptr(statePending))
+	origin.m.getChannel("offline")
+
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	var changed []string
+	edge := &Manager{
+		Origin:        u,
+		ClusterSecret: "secret",
+		NodeID:        "edge1",
+		Changed:       func(name string) { changed = append(changed, name) },
+	}
+	edge.edge = newEdge()
+	require.NoError(t, edge.pollOrigin())
+	assert.ElementsMatch(t, []string{"live", "pending"}, changed)
+
+	infos := []*model.ChannelInfo{{Name: "live"}, {Name: "pending"}, {Name: "offline"}}
+	edge.PopulateLive(infos)
+	assert.Equal(t, &model.ChannelInfo{
+		Name:    "live",
+		Live:    true,
+		Viewers: 2,
+		RTC:     true,
+		Modes:   []string{model.PlaybackRTC},
+	}, infos[0])
+	assert.Equal(t, &model.ChannelInfo{Name: "pending", Pending: true}, infos[1])
+	assert.Equal(t, &model.ChannelInfo{Name: "offline"}, infos[2])
+	// listing channels doesn't pull them
+	assert.Empty(t, origin.pulls())
+	assert.Empty(t, edge.edge.pulls)
+
+	// a viewer does
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	edge.viewChannel(ctx, "live")
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"live"}, origin.pulls())
+	}, time.Second, 10*time.Millisecond)
+	// channels the origin doesn't have are never pulled
+	edge.viewChannel(ctx, "other")
+	assert.Equal(t, []string{"live"}, origin.pulls())
+
+	// edge viewers are counted on the origin
+	edge.getChannel("live").addViewer(3)
+	edge.edge.mu.Lock()
+	edge.edge.pulls["live"] = &pull{cancel: func() {}}
+	edge.edge.mu.Unlock()
+	require.NoError(t, edge.reportViewers())
+	assert.Equal(t, 3, origin.m.edgeViewers("live"))
+	assert.Equal(t, 5, origin.m.RelayStatus()["live"].Viewers)
+
+	// requests without the cluster secret are refused
+	edge.ClusterSecret = "wrong"
+	assert.EqualError(t, edge.pollOrigin(), "origin returned 401 Unauthorized")
+}
@@ -0,0 +1,539 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"eaglesong.dev/gunk/codec/av1parser"
+	"eaglesong.dev/gunk/codec/hevcparser"
+	"eaglesong.dev/gunk/ingest/slate"
+	"eaglesong.dev/gunk/ingest/whip"
+	"eaglesong.dev/gunk/model"
+	"github.com/jackc/pgx/v5"
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultFailoverTimeout = 3 * time.Second
+	// assumed frame duration until one is measured
+	defaultFrameGap = time.Second / 30
+)
+
+var (
+	errReplaced       = errors.New("replaced by another publisher")
+	errBackupMismatch = errors.New("backup stream does not match the live stream")
+	errSlateExpired   = errors.New("publisher did not return before the slate expired")
+)
+
+// switcher combines all the publishers of a channel into one stream. One
+// input is active at a time, and output switches to another at a keyframe
+// when the active one stalls or disconnects or a primary replaces a backup.
+// Timestamps are shifted so the output stays continuous.
+type switcher struct {
+	streams  []av.CodecData
+	videoIdx int
+	timeout  time.Duration
+	l        zerolog.Logger
+
+	pkts  chan inputPacket
+	ended chan *input
+	done  chan struct{}
+	tick  *time.Ticker
+
+	// called with the output time whenever the source of the stream changes
+	onSwitch func(at time.Duration)
+	// called with timed metadata from the active input
+	onCue func(model.Cue)
+	// how long to wait for a publisher to return when there is no slate
+	reconnectGrace time.Duration
+
+	mu       sync.Mutex
+	inputs   []*input
+	finished bool
+	slate    *slate.Slate
+	grace    time.Duration
+
+	// only used by ReadPacket
+	active, target *input
+	lastTime       time.Duration
+	lastVideo      time.Duration
+	frameGap       time.Duration
+	params         []byte
+	showing        *slateState
+	heldSince      time.Time
+}
+
+// slateState tracks playback of the slate while no publisher is active
+type slateState struct {
+	*slate.Slate
+	since time.Time
+	base  time.Duration
+	pos   int
+	timer *time.Timer
+}
+
+// input is one publisher feeding a switcher
+type input struct {
+	src        av.Demuxer
+	backup     bool
+	offset     time.Duration
+	lastPacket time.Time
+
+	// reported by the stream health API
+	meta   metadataSource
+	norm   *Normalizer
+	active atomic.Bool
+	// set for WHIP sessions
+	whip *whip.Receiver
+
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+type inputPacket struct {
+	in  *input
+	pkt av.Packet
+	cue *model.Cue
+}
+
+func newInput(src av.Demuxer, backup bool) *input {
+	return &input{src: src, backup: backup, done: make(chan struct{})}
+}
+
+// finish releases the publisher
+func (in *input) finish(err error) {
+	in.once.Do(func() {
+		in.err = err
+		close(in.done)
+	})
+}
+
+func newSwitcher(streams []av.CodecData, first *input, timeout time.Duration, l zerolog.Logger) *switcher {
+	if timeout <= 0 {
+		timeout = defaultFailoverTimeout
+	}
+	s := &switcher{
+		streams:  streams,
+		videoIdx: -1,
+		timeout:  timeout,
+		l:        l,
+		pkts:     make(chan inputPacket),
+		ended:    make(chan *input),
+		done:     make(chan struct{}),
+		tick:     time.NewTicker(time.Second),
+		inputs:   []*input{first},
+		active:   first,
+		frameGap: defaultFrameGap,
+	}
+	for i, cd := range streams {
+		if cd.Type().IsVideo() {
+			s.videoIdx = i
+			s.params = slate.ParamSets(cd)
+			break
+		}
+	}
+	go s.read(first)
+	return s
+}
+
+// loadSlate renders the channel's slate to match the live stream
+func (m *Manager) loadSlate(l *zerolog.Logger, name string, s *switcher) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	data, err := model.GetSlate(ctx, name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return
+	} else if err != nil {
+		l.Err(err).Msg("failed to load slate")
+		return
+	}
+	sl, err := slate.Render(ctx, data, s.streams)
+	if errors.Is(err, slate.ErrUnsupported) {
+		l.Warn().Err(err).Msg("slate is not available for this stream")
+		return
+	} else if err != nil {
+		l.Err(err).Msg("failed to render slate")
+		return
+	}
+	s.setSlate(sl, m.SlateGrace)
+}
+
+// setSlate sets the slate to show for up to grace once all publishers are
+// gone
+func (s *switcher) setSlate(sl *slate.Slate, grace time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.slate = sl
+	s.grace = grace
+}
+
+// attach adds a publisher to the channel's current session if it can take
+// over seamlessly, otherwise it starts a new session replacing the old one.
+// A backup never replaces a session.
+func (ch *channel) attach(in *input, streams []av.CodecData, timeout, reconnectGrace time.Duration, l zerolog.Logger) (sw *switcher, joined bool, err error) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.sw != nil {
+		if joined, running := ch.sw.add(in, streams); joined {
+			return ch.sw, true, nil
+		} else if running && in.backup {
+			return nil, false, errBackupMismatch
+		}
+		ch.sw.finish(errReplaced)
+	}
+	ch.sw = newSwitcher(streams, in, timeout, l)
+	ch.sw.reconnectGrace = reconnectGrace
+	return ch.sw, false, nil
+}
+
+// add attaches another publisher if its streams can be switched to
+// seamlessly. A primary replaces the primaries before it, which keep feeding
+// the output until they disconnect or it switches to the new one.
+func (s *switcher) add(in *input, streams []av.CodecData) (joined, running bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished {
+		return false, false
+	} else if !sameStreams(s.streams, streams) {
+		return false, true
+	}
+	if !in.backup {
+		for _, prev := range s.inputs {
+			if !prev.backup {
+				prev.finish(errReplaced)
+			}
+		}
+	}
+	s.inputs = append(s.inputs, in)
+	go s.read(in)
+	return true, true
+}
+
+// finish releases all publishers and ends the stream
+func (s *switcher) finish(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished {
+		return
+	}
+	s.finished = true
+	close(s.done)
+	s.tick.Stop()
+	for _, in := range s.inputs {
+		in.finish(err)
+	}
+	s.inputs = nil
+}
+
+func (s *switcher) read(in *input) {
+	for {
+		pkt, err := in.src.ReadPacket()
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			in.finish(err)
+			select {
+			case s.ended <- in:
+			case <-s.done:
+			}
+			return
+		}
+		select {
+		case s.pkts <- inputPacket{in: in, pkt: pkt}:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *switcher) Streams() ([]av.CodecData, error) {
+	return s.streams, nil
+}
+
+func (s *switcher) ReadPacket() (av.Packet, error) {
+	for {
+		var slateC <-chan time.Time
+		if s.showing != nil {
+			slateC = s.showing.timer.C
+		}
+		select {
+		case ip := <-s.pkts:
+			if ip.cue != nil {
+				s.routeCue(ip)
+			} else if pkt, ok := s.route(ip); ok {
+				return pkt, nil
+			}
+		case in := <-s.ended:
+			if s.remove(in) {
+				s.finish(nil)
+				return av.Packet{}, io.EOF
+			}
+		case <-slateC:
+			return s.nextSlatePacket(), nil
+		case now := <-s.tick.C:
+			if s.showing != nil && now.Sub(s.showing.since) > s.grace {
+				s.l.Info().Msg("slate expired")
+				s.finish(errSlateExpired)
+				return av.Packet{}, io.EOF
+			} else if !s.heldSince.IsZero() && now.Sub(s.heldSince) > s.reconnectGrace {
+				s.l.Info().Msg("publisher did not reconnect")
+				s.finish(nil)
+				return av.Packet{}, io.EOF
+			}
+			s.choose(now)
+		case <-s.done:
+			return av.Packet{}, io.EOF
+		}
+	}
+}
+
+// route returns the packet to output, if any
+func (s *switcher) route(ip inputPacket) (av.Packet, bool) {
+	in, pkt := ip.in, ip.pkt
+	now := time.Now()
+	in.lastPacket = now
+	switch {
+	case in == s.active:
+	case in == s.target && (s.videoIdx < 0 || int(pkt.Idx) == s.videoIdx && pkt.IsKeyFrame):
+		// continue from where the previous input left off
+		in.offset = s.lastTime + s.frameGap - pkt.Time
+		s.setActive(in)
+		s.target = nil
+		s.heldSince = time.Time{}
+		s.l.Info().Bool("backup", in.backup).Msg("switched publisher")
+		s.switched(pkt.Time + in.offset)
+		if s.showing != nil {
+			s.showing.timer.Stop()
+			s.showing = nil
+			// replace the slate's parameter sets
+			pkt.Data = append(append([]byte(nil), s.params...), pkt.Data...)
+		}
+	default:
+		s.choose(now)
+		return pkt, false
+	}
+	pkt.Time += in.offset
+	return s.emit(pkt), true
+}
+
+// activeWHIP returns the receiver of the active input if it is a WHIP session
+func (s *switcher) activeWHIP() *whip.Receiver {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, in := range s.inputs {
+		if in.active.Load() {
+			return in.whip
+		}
+	}
+	return nil
+}
+
+// cue passes timed metadata from an input along with its packets
+func (s *switcher) cue(in *input, c model.Cue) {
+	select {
+	case s.pkts <- inputPacket{in: in, cue: &c}:
+	case <-s.done:
+	}
+}
+
+// routeCue outputs timed metadata from the active input at the time of the
+// latest packet
+func (s *switcher) routeCue(ip inputPacket) {
+	if ip.in != s.active || s.onCue == nil {
+		return
+	}
+	c := *ip.cue
+	c.Time = s.lastTime
+	s.onCue(c)
+}
+
+func (s *switcher) setActive(in *input) {
+	if s.active != nil {
+		s.active.active.Store(false)
+	}
+	s.active = in
+	if in != nil {
+		in.active.Store(true)
+	}
+}
+
+func (s *switcher) switched(at time.Duration) {
+	if s.onSwitch != nil {
+		s.onSwitch(at)
+	}
+}
+
+// emit tracks the timing of an output packet
+func (s *switcher) emit(pkt av.Packet) av.Packet {
+	if int(pkt.Idx) == s.videoIdx {
+		if gap := pkt.Time - s.lastVideo; gap > 0 && gap < time.Second {
+			s.frameGap = gap
+		}
+		s.lastVideo = pkt.Time
+	}
+	if pkt.Time > s.lastTime {
+		s.lastTime = pkt.Time
+	}
+	return pkt
+}
+
+// startSlate shows the slate if there is one, returning false if not
+func (s *switcher) startSlate(now time.Time) bool {
+	if s.showing != nil {
+		return true
+	}
+	s.mu.Lock()
+	sl := s.slate
+	s.mu.Unlock()
+	if sl == nil {
+		return false
+	}
+	s.l.Info().Dur("grace", s.grace).Msg("publisher lost, showing slate")
+	s.setActive(nil)
+	s.heldSince = time.Time{}
+	s.showing = &slateState{
+		Slate: sl,
+		since: now,
+		base:  s.lastTime + s.frameGap,
+		timer: time.NewTimer(0),
+	}
+	s.switched(s.showing.base)
+	return true
+}
+
+// nextSlatePacket returns the next packet of the slate and schedules the one
+// after it in real time
+func (s *switcher) nextSlatePacket() av.Packet {
+	st := s.showing
+	loop, i := st.pos/len(st.Packets), st.pos%len(st.Packets)
+	pkt := st.Packets[i]
+	pkt.Time += st.base + time.Duration(loop)*st.Duration
+	if pkt.IsKeyFrame && int(pkt.Idx) == s.videoIdx {
+		pkt.Data = append(append([]byte(nil), st.Params...), pkt.Data...)
+	}
+	st.pos++
+	loop, i = st.pos/len(st.Packets), st.pos%len(st.Packets)
+	next := st.Packets[i].Time + time.Duration(loop)*st.Duration
+	st.timer.Reset(time.Until(st.since.Add(next)))
+	return s.emit(pkt)
+}
+
+// remove drops a publisher that disconnected, returning true if none are left
+func (s *switcher) remove(in *input) bool {
+	s.mu.Lock()
+	for i, in2 := range s.inputs {
+		if in2 == in {
+			s.inputs = append(s.inputs[:i], s.inputs[i+1:]...)
+			break
+		}
+	}
+	empty := len(s.inputs) == 0
+	s.mu.Unlock()
+	if in == s.target {
+		s.target = nil
+	}
+	if in == s.active {
+		s.setActive(nil)
+		if !empty {
+			s.l.Warn().Bool("backup", in.backup).Msg("active publisher disconnected")
+		}
+	}
+	now := time.Now()
+	if !empty {
+		s.choose(now)
+		return false
+	}
+	// wait for the publisher to come back
+	if s.startSlate(now) {
+		return false
+	} else if s.reconnectGrace > 0 && s.heldSince.IsZero() {
+		s.l.Info().Dur("grace", s.reconnectGrace).Msg("publisher lost, waiting for it to reconnect")
+		s.heldSince = now
+		return false
+	}
+	return s.heldSince.IsZero()
+}
+
+// choose picks the input to switch to: the newest healthy primary, or else
+// the newest healthy backup
+func (s *switcher) choose(now time.Time) {
+	var best *input
+	s.mu.Lock()
+	for _, in := range s.inputs {
+		if in.lastPacket.IsZero() || now.Sub(in.lastPacket) > s.timeout {
+			continue
+		}
+		if best == nil || !in.backup || best.backup {
+			best = in
+		}
+	}
+	s.mu.Unlock()
+	if best == nil {
+		if s.active != nil && now.Sub(s.active.lastPacket) > s.timeout {
+			s.startSlate(now)
+		}
+		return
+	} else if best == s.target {
+		return
+	}
+	if best == s.active {
+		// active input is still the best
+		s.target = nil
+		return
+	}
+	if s.active != nil && now.Sub(s.active.lastPacket) > s.timeout {
+		s.l.Warn().Dur("timeout", s.timeout).Msg("active publisher stalled")
+	}
+	s.target = best
+}
+
+// sameStreams returns true if a publisher sending b can take over from one
+// sending a without restarting the outputs
+func sameStreams(a, b []av.CodecData) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !sameCodec(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameCodec(a, b av.CodecData) bool {
+	if a.Type() != b.Type() {
+		return false
+	}
+	switch a := a.(type) {
+	case h264parser.CodecData:
+		b, ok := b.(h264parser.CodecData)
+		return ok && bytes.Equal(a.AVCDecoderConfRecordBytes(), b.AVCDecoderConfRecordBytes())
+	case hevcparser.CodecData:
+		b, ok := b.(hevcparser.CodecData)
+		return ok && bytes.Equal(a.DecoderConfRecordBytes(), b.DecoderConfRecordBytes())
+	case av1parser.CodecData:
+		b, ok := b.(av1parser.CodecData)
+		return ok && bytes.Equal(a.ConfigurationRecordBytes(), b.ConfigurationRecordBytes())
+	case aacparser.CodecData:
+		b, ok := b.(aacparser.CodecData)
+		return ok && bytes.Equal(a.MPEG4AudioConfigBytes(), b.MPEG4AudioConfigBytes())
+	case av.VideoCodecData:
+		b, ok := b.(av.VideoCodecData)
+		return ok && a.Width() == b.Width() && a.Height() == b.Height()
+	case av.AudioCodecData:
+		b, ok := b.(av.AudioCodecData)
+		return ok && a.SampleRate() == b.SampleRate() && a.ChannelLayout() == b.ChannelLayout()
+	}
+	return true
+}
@@ -0,0 +1,286 @@
+package ingest
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"eaglesong.dev/gunk/ingest/slate"
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sizedVideo struct {
+	w, h int
+}
+
+func (c sizedVideo) Type() av.CodecType { return av.MakeVideoCodecType(1) }
+func (c sizedVideo) Width() int         { return c.w }
+func (c sizedVideo) Height() int        { return c.h }
+
+// testOther has the same type as sizedVideo but isn't video codec data
+type testOther struct{}
+
+func (testOther) Type() av.CodecType { return av.MakeVideoCodecType(1) }
+
+func TestSameStreams(t *testing.T) {
+	h264 := func(record string) av.CodecData { return h264parser.CodecData{Record: []byte(record)} }
+	aac := func(config string) av.CodecData { return aacparser.CodecData{ConfigBytes: []byte(config)} }
+	cases := []struct {
+		name string
+		a, b []av.CodecData
+		same bool
+	}{
+		{"Same", []av.CodecData{h264("a"), aac("1")}, []av.CodecData{h264("a"), aac("1")}, true},
+		{"Empty", nil, nil, true},
+		{"DifferentCount", []av.CodecData{h264("a"), aac("1")}, []av.CodecData{h264("a")}, false},
+		{"DifferentOrder", []av.CodecData{h264("a"), aac("1")}, []av.CodecData{aac("1"), h264("a")}, false},
+		{"DifferentRecord", []av.CodecData{h264("a")}, []av.CodecData{h264("b")}, false},
+		{"DifferentAudioConfig", []av.CodecData{aac("1")}, []av.CodecData{aac("2")}, false},
+		{"SameSize", []av.CodecData{sizedVideo{640, 360}}, []av.CodecData{sizedVideo{640, 360}}, true},
+		{"DifferentSize", []av.CodecData{sizedVideo{640, 360}}, []av.CodecData{sizedVideo{1280, 720}}, false},
+		{"NotVideoCodecData", []av.CodecData{sizedVideo{640, 360}}, []av.CodecData{testOther{}}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.same, sameStreams(c.a, c.b))
+		})
+	}
+}
+
+// chanSource is a publisher whose packets are sent by the test
+type chanSource struct {
+	pkts chan av.Packet
+}
+
+func newChanSource() *chanSource {
+	return &chanSource{pkts: make(chan av.Packet)}
+}
+
+func (s *chanSource) Streams() ([]av.CodecData, error) {
+	return testStreams, nil
+}
+
+func (s *chanSource) ReadPacket() (av.Packet, error) {
+	pkt, ok := <-s.pkts
+	if !ok {
+		return av.Packet{}, io.EOF
+	}
+	return pkt, nil
+}
+
+var testStreams = []av.CodecData{h264parser.CodecData{Record: []byte{1}}}
+
+// switchTest reads the output of a switcher in the background
+type switchTest struct {
+	t   *testing.T
+	ch  *channel
+	sw  *switcher
+	out chan av.Packet
+	err chan error
+}
+
+func newSwitchTest(t *testing.T, first *input) *switchTest {
+	st := &switchTest{t: t, ch: new(channel), out: make(chan av.Packet), err: make(chan error, 1)}
+	sw, joined, err := st.ch.attach(first, testStreams, 50*time.Millisecond, 0, zerolog.Nop())
+	require.NoError(t, err)
+	require.False(t, joined)
+	st.sw = sw
+	go func() {
+		for {
+			pkt, err := sw.ReadPacket()
+			if err != nil {
+				st.err <- err
+				return
+			}
+			st.out <- pkt
+		}
+	}()
+	t.Cleanup(func() { sw.finish(nil) })
+	return st
+}
+
+// join attaches another publisher to the session
+func (st *switchTest) join(in *input) {
+	sw, joined, err := st.ch.attach(in, testStreams, 0, 0, zerolog.Nop())
+	require.NoError(st.t, err)
+	require.True(st.t, joined)
+	require.Equal(st.t, st.sw, sw)
+}
+
+// expect asserts that the next output packet has the given time
+func (st *switchTest) expect(want time.Duration) {
+	st.t.Helper()
+	select {
+	case pkt := <-st.out:
+		assert.Equal(st.t, want, pkt.Time)
+	case <-time.After(time.Second):
+		st.t.Fatal("no output packet")
+	}
+}
+
+func (st *switchTest) expectNone() {
+	st.t.Helper()
+	select {
+	case pkt := <-st.out:
+		st.t.Fatalf("unexpected output packet at %s", pkt.Time)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func key(t time.Duration) av.Packet   { return av.Packet{IsKeyFrame: true, Time: t} }
+func delta(t time.Duration) av.Packet { return av.Packet{Time: t} }
+
+func TestSwitcher(t *testing.T) {
+	t.Run("BackupTakesOver", func(t *testing.T) {
+		primary, backup := newChanSource(), newChanSource()
+		st := newSwitchTest(t, newInput(primary, false))
+		primary.pkts <- key(0)
+		st.expect(0)
+		primary.pkts <- delta(ms(40))
+		st.expect(ms(40))
+		st.join(newInput(backup, true))
+		// the primary is healthy so the backup is held back
+		backup.pkts <- key(5 * time.Second)
+		st.expectNone()
+		// the primary stalls, the backup takes over at its next keyframe with
+		// time continuing from the primary
+		time.Sleep(ms(60))
+		backup.pkts <- delta(5*time.Second + ms(40))
+		st.expectNone()
+		backup.pkts <- key(5*time.Second + ms(80))
+		st.expect(ms(80))
+		backup.pkts <- delta(5*time.Second + ms(120))
+		st.expect(ms(120))
+	})
+	t.Run("PrimaryReplacesPrimary", func(t *testing.T) {
+		first, second := newChanSource(), newChanSource()
+		in1 := newInput(first, false)
+		st := newSwitchTest(t, in1)
+		first.pkts <- key(0)
+		st.expect(0)
+		in2 := newInput(second, false)
+		st.join(in2)
+		// the earlier primary is released as soon as the new one joins
+		select {
+		case <-in1.done:
+		default:
+			t.Fatal("earlier primary still attached")
+		}
+		assert.Equal(t, errReplaced, in1.err)
+		// and feeds the output until the new one has a keyframe
+		first.pkts <- delta(ms(40))
+		st.expect(ms(40))
+		second.pkts <- delta(time.Minute)
+		st.expectNone()
+		second.pkts <- key(time.Minute + ms(40))
+		st.expect(ms(80))
+		close(first.pkts)
+		second.pkts <- delta(time.Minute + ms(80))
+		st.expect(ms(120))
+		select {
+		case <-in2.done:
+			t.Fatal("new primary released")
+		default:
+		}
+	})
+	t.Run("BackupDoesNotReplacePrimary", func(t *testing.T) {
+		primary, backup := newChanSource(), newChanSource()
+		in1 := newInput(primary, false)
+		st := newSwitchTest(t, in1)
+		st.join(newInput(backup, true))
+		select {
+		case <-in1.done:
+			t.Fatal("primary released by a backup")
+		default:
+		}
+	})
+	t.Run("MismatchedBackup", func(t *testing.T) {
+		st := newSwitchTest(t, newInput(newChanSource(), false))
+		other := []av.CodecData{h264parser.CodecData{Record: []byte{2}}}
+		_, _, err := st.ch.attach(newInput(newChanSource(), true), other, 0, 0, zerolog.Nop())
+		assert.Equal(t, errBackupMismatch, err)
+	})
+	t.Run("MismatchedPrimary", func(t *testing.T) {
+		in1 := newInput(newChanSource(), false)
+		st := newSwitchTest(t, in1)
+		other := []av.CodecData{h264parser.CodecData{Record: []byte{2}}}
+		sw, joined, err := st.ch.attach(newInput(newChanSource(), false), other, 0, 0, zerolog.Nop())
+		require.NoError(t, err)
+		assert.False(t, joined)
+		assert.NotEqual(t, st.sw, sw)
+		<-in1.done
+		assert.Equal(t, errReplaced, in1.err)
+		sw.finish(nil)
+	})
+	t.Run("Slate", func(t *testing.T) {
+		src := newChanSource()
+		st := newSwitchTest(t, newInput(src, false))
+		st.sw.setSlate(&slate.Slate{
+			Packets: []av.Packet{
+				{IsKeyFrame: true, Data: []byte{9}},
+				{Time: ms(40), Data: []byte{9}},
+			},
+			Duration: ms(80),
+			Params:   []byte{7},
+		}, time.Minute)
+		src.pkts <- key(0)
+		st.expect(0)
+		src.pkts <- delta(ms(40))
+		st.expect(ms(40))
+		// the slate loops in real time, continuing the stream's timestamps
+		close(src.pkts)
+		var last av.Packet
+		for i, want := range []time.Duration{ms(80), ms(120), ms(160), ms(200)} {
+			last = <-st.out
+			assert.Equal(t, want, last.Time)
+			if i%2 == 0 {
+				assert.Equal(t, []byte{7, 9}, last.Data, "keyframe with the slate's parameter sets")
+			} else {
+				assert.Equal(t, []byte{9}, last.Data)
+			}
+		}
+		// the publisher comes back and replaces the slate at its second
+		// keyframe, the first one makes it the target
+		back := newChanSource()
+		st.join(newInput(back, false))
+		back.pkts <- key(time.Hour)
+		back.pkts <- av.Packet{IsKeyFrame: true, Time: time.Hour + ms(40), Data: []byte{1}}
+		for {
+			pkt := <-st.out
+			if !bytes.HasSuffix(pkt.Data, []byte{1}) {
+				// slate packets sent in the meantime
+				last = pkt
+				continue
+			}
+			assert.Equal(t, last.Time+ms(40), pkt.Time)
+			// the live stream's parameter sets replace the slate's
+			assert.Equal(t, append(slate.ParamSets(testStreams[0]), 1), pkt.Data)
+			break
+		}
+		back.pkts <- delta(time.Hour + ms(80))
+		pkt := <-st.out
+		assert.Equal(t, last.Time+ms(80), pkt.Time)
+	})
+	t.Run("LastPublisherLeaves", func(t *testing.T) {
+		src := newChanSource()
+		in := newInput(src, false)
+		st := newSwitchTest(t, in)
+		src.pkts <- key(0)
+		st.expect(0)
+		close(src.pkts)
+		select {
+		case err := <-st.err:
+			assert.Equal(t, io.EOF, err)
+		case <-time.After(time.Second):
+			t.Fatal("stream did not end")
+		}
+		<-in.done
+		assert.NoError(t, in.err)
+	})
+}
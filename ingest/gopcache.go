@@ -0,0 +1,79 @@
+package ingest
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/av/pubsub"
+)
+
+const (
+	// new viewers only start from the last keyframe if the GOP since then is
+	// within these bounds, otherwise they start at the live edge
+	maxCachedGOPBytes    = 16 << 20
+	maxCachedGOPDuration = 10 * time.Second
+)
+
+// gopCache tracks the GOP in progress on one of a channel's queues. The
+// packets stay in the queue itself, this decides whether new viewers can
+// start from its keyframe. Each queue has its own cache since a transcoded
+// queue doesn't share the original's packet sizes or timing.
+type gopCache struct {
+	q  *pubsub.Queue
+	ok uint32
+}
+
+// newGOPCache starts following q until it is closed
+func newGOPCache(q *pubsub.Queue) *gopCache {
+	g := &gopCache{q: q}
+	go g.watch(q.Latest())
+	return g
+}
+
+// watch follows the queue until it is closed
+func (g *gopCache) watch(src av.Demuxer) {
+	defer atomic.StoreUint32(&g.ok, 0)
+	streams, err := src.Streams()
+	if err != nil {
+		return
+	}
+	var start time.Duration
+	var size int
+	var haveKey bool
+	for {
+		pkt, err := src.ReadPacket()
+		if err != nil {
+			return
+		}
+		if pkt.IsKeyFrame && int(pkt.Idx) < len(streams) && streams[pkt.Idx].Type().IsVideo() {
+			start = pkt.Time
+			size = 0
+			haveKey = true
+		}
+		size += len(pkt.Data)
+		var ok uint32
+		if haveKey && size <= maxCachedGOPBytes && pkt.Time-start <= maxCachedGOPDuration {
+			ok = 1
+		}
+		atomic.StoreUint32(&g.ok, ok)
+	}
+}
+
+// cursor returns a reader that starts at the cached keyframe if there is one,
+// or at the live edge
+func (g *gopCache) cursor() av.Demuxer {
+	if cur := g.rewind(); cur != nil {
+		return cur
+	}
+	return g.q.Latest()
+}
+
+// rewind returns a reader that starts at the cached keyframe, or nil if there
+// isn't one
+func (g *gopCache) rewind() av.Demuxer {
+	if atomic.LoadUint32(&g.ok) == 0 {
+		return nil
+	}
+	return g.q.DelayedGopCount(1)
+}
@@ -0,0 +1,54 @@
+package ingest
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/stretchr/testify/assert"
+)
+
+// stepSource hands packets to a reader one at a time, and signals each time
+// the reader comes back for another
+type stepSource struct {
+	pkts  chan av.Packet
+	ready chan struct{}
+}
+
+func (s *stepSource) Streams() ([]av.CodecData, error) {
+	return []av.CodecData{h264parser.CodecData{}, aacparser.CodecData{}}, nil
+}
+
+func (s *stepSource) ReadPacket() (av.Packet, error) {
+	s.ready <- struct{}{}
+	pkt, ok := <-s.pkts
+	if !ok {
+		return av.Packet{}, io.EOF
+	}
+	return pkt, nil
+}
+
+func TestGOPCacheWatch(t *testing.T) {
+	src := &stepSource{pkts: make(chan av.Packet), ready: make(chan struct{})}
+	g := new(gopCache)
+	go g.watch(src)
+	<-src.ready
+	cached := func(pkt av.Packet) bool {
+		src.pkts <- pkt
+		<-src.ready
+		return atomic.LoadUint32(&g.ok) != 0
+	}
+	assert.False(t, cached(av.Packet{Idx: 1, Time: 0}), "audio before any keyframe")
+	assert.False(t, cached(av.Packet{Idx: 0, Time: 0}), "video before any keyframe")
+	assert.True(t, cached(av.Packet{Idx: 0, Time: time.Second, IsKeyFrame: true}))
+	assert.True(t, cached(av.Packet{Idx: 1, Time: 2 * time.Second, IsKeyFrame: true}), "audio keyframes don't start a GOP")
+	assert.False(t, cached(av.Packet{Idx: 0, Time: 2 * time.Second, Data: make([]byte, maxCachedGOPBytes+1)}), "too many bytes")
+	assert.True(t, cached(av.Packet{Idx: 0, Time: 3 * time.Second, IsKeyFrame: true}))
+	assert.False(t, cached(av.Packet{Idx: 0, Time: 3*time.Second + maxCachedGOPDuration + 1}), "too long")
+	close(src.pkts)
+	assert.Eventually(t, func() bool { return atomic.LoadUint32(&g.ok) == 0 }, time.Second, time.Millisecond, "cleared when the queue ends")
+}
@@ -0,0 +1,86 @@
+package ingest
+
+import (
+	"time"
+
+	"eaglesong.dev/gunk/model"
+	"eaglesong.dev/gunk/sinks/llhls"
+)
+
+// metadataSource is a publisher that describes its encoder and sends timed
+// metadata
+type metadataSource interface {
+	Encoder() model.EncoderInfo
+	SetCueHandler(func(model.Cue))
+}
+
+// Health describes the publishers of a channel
+type Health struct {
+	Live       bool              `json:"live"`
+	Pending    bool              `json:"pending"`
+	Codec      string            `json:"codec,omitempty"`
+	Publishers []PublisherHealth `json:"publishers"`
+}
+
+// PublisherHealth describes one publisher of a channel
+type PublisherHealth struct {
+	Backup      bool               `json:"backup"`
+	Active      bool               `json:"active"`
+	Encoder     *model.EncoderInfo `json:"encoder,omitempty"`
+	Corrections Corrections        `json:"corrections"`
+}
+
+// Health returns the state of a channel's publishers
+func (m *Manager) Health(name string) Health {
+	h := Health{Publishers: []PublisherHealth{}}
+	ch := m.channel(name)
+	if ch == nil {
+		return h
+	}
+	switch ch.isLive() {
+	case statePending:
+		h.Pending = true
+	case stateLive:
+		h.Live = true
+	}
+	ch.mu.Lock()
+	sw := ch.sw
+	h.Codec = videoCodec(ch.streams)
+	ch.mu.Unlock()
+	if sw == nil {
+		return h
+	}
+	sw.mu.Lock()
+	inputs := append([]*input(nil), sw.inputs...)
+	sw.mu.Unlock()
+	for _, in := range inputs {
+		ph := PublisherHealth{
+			Backup: in.backup,
+			Active: in.active.Load(),
+		}
+		if in.meta != nil {
+			info := in.meta.Encoder()
+			ph.Encoder = &info
+		}
+		if in.norm != nil {
+			ph.Corrections = in.norm.Corrections()
+		}
+		h.Publishers = append(h.Publishers, ph)
+	}
+	return h
+}
+
+// eventWriter is a web output that carries timed metadata
+type eventWriter interface {
+	WriteEvent(at, duration time.Duration, scheme string, data []byte)
+}
+
+// writeCue adds timed metadata to a web stream
+func writeCue(w eventWriter, c model.Cue) {
+	switch c.Kind {
+	case model.CueID3:
+		w.WriteEvent(c.Time, c.Duration, llhls.SchemeID3, c.Data)
+	case model.CueSCTE35:
+		w.WriteEvent(c.Time, c.Duration, llhls.SchemeSCTE35, c.Data)
+	}
+}
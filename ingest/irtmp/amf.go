@@ -0,0 +1,217 @@
+package irtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// AMF0 type markers
+const (
+	amfNumber      = 0x00
+	amfBoolean     = 0x01
+	amfString      = 0x02
+	amfObject      = 0x03
+	amfNull        = 0x05
+	amfUndefined   = 0x06
+	amfECMAArray   = 0x08
+	amfObjectEnd   = 0x09
+	amfStrictArray = 0x0a
+	amfDate        = 0x0b
+	amfLongString  = 0x0c
+)
+
+var errShortAMF = errors.New("amf: truncated value")
+
+// amfMap is an AMF0 object or ECMA array
+type amfMap map[string]any
+
+func (m amfMap) String(key string) string {
+	s, _ := m[key].(string)
+	return s
+}
+
+func (m amfMap) Number(key string) float64 {
+	f, _ := m[key].(float64)
+	return f
+}
+
+// amfDecode decodes a sequence of AMF0 values
+func amfDecode(b []byte) (vals []any, err error) {
+	for len(b) > 0 {
+		v, n, err := amfDecodeValue(b)
+		if err != nil {
+			return vals, err
+		}
+		vals = append(vals, v)
+		b = b[n:]
+	}
+	return
+}
+
+func amfDecodeValue(b []byte) (v any, n int, err error) {
+	if len(b) < 1 {
+		return nil, 0, errShortAMF
+	}
+	switch b[0] {
+	case amfNumber:
+		if len(b) < 9 {
+			return nil, 0, errShortAMF
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b[1:])), 9, nil
+	case amfBoolean:
+		if len(b) < 2 {
+			return nil, 0, errShortAMF
+		}
+		return b[1] != 0, 2, nil
+	case amfString:
+		s, n, err := amfDecodeString(b[1:], 2)
+		return s, n + 1, err
+	case amfLongString:
+		s, n, err := amfDecodeString(b[1:], 4)
+		return s, n + 1, err
+	case amfNull, amfUndefined:
+		return nil, 1, nil
+	case amfObject:
+		m, n, err := amfDecodeProps(b[1:])
+		return m, n + 1, err
+	case amfECMAArray:
+		if len(b) < 5 {
+			return nil, 0, errShortAMF
+		}
+		// the count is advisory, the array is terminated like an object
+		m, n, err := amfDecodeProps(b[5:])
+		return m, n + 5, err
+	case amfStrictArray:
+		if len(b) < 5 {
+			return nil, 0, errShortAMF
+		}
+		count := int(binary.BigEndian.Uint32(b[1:]))
+		n = 5
+		var arr []any
+		for i := 0; i < count; i++ {
+			v, m, err := amfDecodeValue(b[n:])
+			if err != nil {
+				return nil, 0, err
+			}
+			arr = append(arr, v)
+			n += m
+		}
+		return arr, n, nil
+	case amfDate:
+		if len(b) < 11 {
+			return nil, 0, errShortAMF
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b[1:])), 11, nil
+	default:
+		return nil, 0, fmt.Errorf("amf: unsupported type marker 0x%02x", b[0])
+	}
+}
+
+func amfDecodeString(b []byte, lenSize int) (string, int, error) {
+	if len(b) < lenSize {
+		return "", 0, errShortAMF
+	}
+	var size int
+	if lenSize == 2 {
+		size = int(binary.BigEndian.Uint16(b))
+	} else {
+		size = int(binary.BigEndian.Uint32(b))
+	}
+	if len(b) < lenSize+size {
+		return "", 0, errShortAMF
+	}
+	return string(b[lenSize : lenSize+size]), lenSize + size, nil
+}
+
+func amfDecodeProps(b []byte) (amfMap, int, error) {
+	m := make(amfMap)
+	n := 0
+	for {
+		key, kn, err := amfDecodeString(b[n:], 2)
+		if err != nil {
+			return nil, 0, err
+		}
+		n += kn
+		if key == "" {
+			if n >= len(b) {
+				return nil, 0, errShortAMF
+			} else if b[n] == amfObjectEnd {
+				return m, n + 1, nil
+			}
+		}
+		v, vn, err := amfDecodeValue(b[n:])
+		if err != nil {
+			return nil, 0, err
+		}
+		m[key] = v
+		n += vn
+	}
+}
+
+// amfEncode encodes a sequence of AMF0 values
+func amfEncode(vals ...any) []byte {
+	var buf bytes.Buffer
+	for _, v := range vals {
+		amfEncodeValue(&buf, v)
+	}
+	return buf.Bytes()
+}
+
+func amfEncodeValue(buf *bytes.Buffer, v any) {
+	var b [8]byte
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(amfNull)
+	case bool:
+		buf.WriteByte(amfBoolean)
+		if v {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case int:
+		amfEncodeValue(buf, float64(v))
+	case float64:
+		buf.WriteByte(amfNumber)
+		binary.BigEndian.PutUint64(b[:], math.Float64bits(v))
+		buf.Write(b[:])
+	case string:
+		if len(v) > math.MaxUint16 {
+			buf.WriteByte(amfLongString)
+			binary.BigEndian.PutUint32(b[:], uint32(len(v)))
+			buf.Write(b[:4])
+		} else {
+			buf.WriteByte(amfString)
+			binary.BigEndian.PutUint16(b[:], uint16(len(v)))
+			buf.Write(b[:2])
+		}
+		buf.WriteString(v)
+	case amfMap:
+		buf.WriteByte(amfObject)
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			binary.BigEndian.PutUint16(b[:], uint16(len(k)))
+			buf.Write(b[:2])
+			buf.WriteString(k)
+			amfEncodeValue(buf, v[k])
+		}
+		buf.Write([]byte{0, 0, amfObjectEnd})
+	case []any:
+		buf.WriteByte(amfStrictArray)
+		binary.BigEndian.PutUint32(b[:], uint32(len(v)))
+		buf.Write(b[:4])
+		for _, e := range v {
+			amfEncodeValue(buf, e)
+		}
+	default:
+		panic(fmt.Sprintf("amf: can't encode %T", v))
+	}
+}
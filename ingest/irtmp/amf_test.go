@@ -0,0 +1,97 @@
+package irtmp
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAMFRoundTrip(t *testing.T) {
+	long := strings.Repeat("x", 70000)
+	cases := []struct {
+		name string
+		in   any
+		want any
+	}{
+		{"Number", 29.97, 29.97},
+		{"Int", 1935, float64(1935)},
+		{"True", true, true},
+		{"False", false, false},
+		{"String", "live", "live"},
+		{"EmptyString", "", ""},
+		{"LongString", long, long},
+		{"Null", nil, nil},
+		{"Object", amfMap{"app": "live", "fourCcList": []any{"hvc1", "av01"}, "videocodecid": 7}, amfMap{"app": "live", "fourCcList": []any{"hvc1", "av01"}, "videocodecid": float64(7)}},
+		{"Nested", amfMap{"a": amfMap{"b": amfMap{}}}, amfMap{"a": amfMap{"b": amfMap{}}}},
+		{"StrictArray", []any{1, "two", nil}, []any{float64(1), "two", nil}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vals, err := amfDecode(amfEncode("_result", c.in))
+			require.NoError(t, err)
+			assert.Equal(t, []any{"_result", c.want}, vals)
+		})
+	}
+}
+
+func TestAMFDecode(t *testing.T) {
+	cases := []struct {
+		name string
+		in   []byte
+		want []any
+	}{
+		{"Undefined", []byte{amfUndefined}, []any{nil}},
+		{
+			"ECMAArray",
+			[]byte{amfECMAArray, 0, 0, 0, 5, 0, 1, 'w', amfNumber, 0x40, 0x9e, 0, 0, 0, 0, 0, 0, 0, 0, amfObjectEnd},
+			[]any{amfMap{"w": float64(1920)}},
+		},
+		{
+			"Date",
+			[]byte{amfDate, 0x40, 0x59, 0, 0, 0, 0, 0, 0, 0, 0},
+			[]any{float64(100)},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vals, err := amfDecode(c.in)
+			require.NoError(t, err)
+			assert.Equal(t, c.want, vals)
+		})
+	}
+}
+
+func TestAMFMalformed(t *testing.T) {
+	// every truncation of a single value must fail rather than panic
+	full := amfEncode(amfMap{
+		"tcUrl":      "rtmp://example.com/live",
+		"fourCcList": []any{"hvc1"},
+		"nested":     amfMap{"n": 1.5, "b": true},
+	})
+	for i := 1; i < len(full); i++ {
+		_, err := amfDecode(full[:i])
+		assert.Error(t, err, "truncated to %d bytes", i)
+	}
+	cases := []struct {
+		name string
+		in   []byte
+	}{
+		{"UnknownMarker", []byte{0x11}},
+		{"ShortNumber", []byte{amfNumber, 1, 2}},
+		{"ShortBoolean", []byte{amfBoolean}},
+		{"StringLength", []byte{amfString, 0xff, 0xff, 'a'}},
+		{"LongStringLength", []byte{amfLongString, 0xff, 0xff, 0xff, 0xff, 'a'}},
+		{"HugeStrictArray", []byte{amfStrictArray, 0xff, 0xff, 0xff, 0xff, amfNull}},
+		{"ShortECMAArray", []byte{amfECMAArray, 0, 0}},
+		{"ObjectWithoutEnd", []byte{amfObject, 0, 1, 'a', amfNull}},
+		{"ShortDate", []byte{amfDate, 0, 0}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := amfDecode(c.in)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,606 @@
+package irtmp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"eaglesong.dev/gunk/model"
+	"github.com/nareix/joy4/av"
+	"github.com/rs/zerolog"
+)
+
+const (
+	handshakeSize = 1536
+	readTimeout   = 30 * time.Second
+	writeTimeout  = 10 * time.Second
+
+	defaultChunkSize = 128
+	outChunkSize     = 4096
+	ackWindowSize    = 2500000
+	publishStreamID  = 1
+)
+
+// limits on what a client can make the server buffer. Until the publisher is
+// authenticated only the few chunk streams used for commands are accepted and
+// messages must be small.
+const (
+	maxChunkStreams = 32
+	maxMessageSize  = 8 << 20
+	maxBuffered     = 32 << 20
+
+	preAuthMaxCSID        = 16
+	preAuthMaxMessageSize = 64 << 10
+	preAuthMaxBuffered    = 256 << 10
+)
+
+// message type IDs
+const (
+	msgSetChunkSize     = 1
+	msgAbort            = 2
+	msgAck              = 3
+	msgUserControl      = 4
+	msgWindowAckSize    = 5
+	msgSetPeerBandwidth = 6
+	msgAudio            = 8
+	msgVideo            = 9
+	msgDataAMF3         = 15
+	msgCommandAMF3      = 17
+	msgDataAMF0         = 18
+	msgCommandAMF0      = 20
+)
+
+// user control event types
+const (
+	eventStreamBegin  = 0
+	eventPingRequest  = 6
+	eventPingResponse = 7
+)
+
+// outgoing chunk stream IDs
+const (
+	csidControl = 2
+	csidCommand = 3
+	csidStream  = 5
+)
+
+var errUnpublished = errors.New("publisher ended the stream")
+
+// Conn is the server side of a RTMP connection from a publisher. Call Prepare
+// to complete the handshake, then read it as a av.Demuxer.
+type Conn struct {
+	URL *url.URL
+
+	nc     net.Conn
+	r      *countingReader
+	w      *bufio.Writer
+	chunks map[uint32]*chunkStream
+	// bytes held in partially received messages
+	buffered int
+	// set once the publisher's stream key is accepted, lifting the pre-auth
+	// limits
+	authed bool
+
+	readChunkSize int
+	ackWindow     uint32
+	acked         uint64
+
+	tcURL, app string
+	fourCCs    []any
+	publishing bool
+	closed     bool
+
+	media mediaState
+	log   zerolog.Logger
+
+	metaMu  sync.Mutex
+	encoder model.EncoderInfo
+	onCue   func(model.Cue)
+}
+
+type chunkStream struct {
+	timestamp uint32
+	delta     uint32
+	length    uint32
+	typeID    uint8
+	streamID  uint32
+	extended  bool
+	buf       []byte
+}
+
+type message struct {
+	typeID    uint8
+	streamID  uint32
+	timestamp uint32
+	payload   []byte
+}
+
+type countingReader struct {
+	r *bufio.Reader
+	n uint64
+}
+
+func (r *countingReader) Read(d []byte) (int, error) {
+	n, err := r.r.Read(d)
+	r.n += uint64(n)
+	return n, err
+}
+
+func newConn(nc net.Conn, l zerolog.Logger) *Conn {
+	return &Conn{
+		log:           l,
+		nc:            nc,
+		r:             &countingReader{r: bufio.NewReaderSize(nc, 8192)},
+		w:             bufio.NewWriterSize(nc, 8192),
+		chunks:        make(map[uint32]*chunkStream),
+		readChunkSize: defaultChunkSize,
+	}
+}
+
+func (c *Conn) NetConn() net.Conn {
+	return c.nc
+}
+
+func (c *Conn) Close() error {
+	return c.nc.Close()
+}
+
+// Prepare performs the handshake and processes commands until the client
+// starts publishing
+func (c *Conn) Prepare() error {
+	if err := c.handshake(); err != nil {
+		return fmt.Errorf("handshake: %w", err)
+	}
+	for !c.publishing {
+		msg, err := c.readMessage()
+		if err != nil {
+			return err
+		}
+		if err := c.handleMessage(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Conn) handshake() error {
+	c.nc.SetDeadline(time.Now().Add(readTimeout))
+	defer c.nc.SetDeadline(time.Time{})
+	// C0 + C1
+	c0c1 := make([]byte, 1+handshakeSize)
+	if _, err := io.ReadFull(c.r, c0c1); err != nil {
+		return err
+	}
+	if c0c1[0] != 3 {
+		return fmt.Errorf("unsupported RTMP version %d", c0c1[0])
+	}
+	// S0 + S1 + S2, using the simple handshake with a zero version field
+	s := make([]byte, 1+2*handshakeSize)
+	s[0] = 3
+	binary.BigEndian.PutUint32(s[1:], uint32(time.Now().Unix()))
+	if _, err := io.ReadFull(rand.Reader, s[9:1+handshakeSize]); err != nil {
+		return err
+	}
+	copy(s[1+handshakeSize:], c0c1[1:])
+	if _, err := c.w.Write(s); err != nil {
+		return err
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	// C2
+	_, err := io.ReadFull(c.r, make([]byte, handshakeSize))
+	return err
+}
+
+func (c *Conn) readByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(c.r, b[:])
+	return b[0], err
+}
+
+func (c *Conn) readMessage() (*message, error) {
+	for {
+		c.nc.SetReadDeadline(time.Now().Add(readTimeout))
+		msg, err := c.readChunk()
+		if err != nil {
+			return nil, err
+		}
+		if err := c.sendAck(); err != nil {
+			return nil, err
+		}
+		if msg != nil {
+			return msg, nil
+		}
+	}
+}
+
+// readChunk reads one chunk and returns the message it completes, if any
+func (c *Conn) readChunk() (*message, error) {
+	b0, err := c.readByte()
+	if err != nil {
+		return nil, err
+	}
+	format := b0 >> 6
+	csid := uint32(b0 & 0x3f)
+	switch csid {
+	case 0:
+		b, err := c.readByte()
+		if err != nil {
+			return nil, err
+		}
+		csid = 64 + uint32(b)
+	case 1:
+		var b [2]byte
+		if _, err := io.ReadFull(c.r, b[:]); err != nil {
+			return nil, err
+		}
+		csid = 64 + uint32(b[0]) + uint32(b[1])*256
+	}
+	cs := c.chunks[csid]
+	if cs == nil {
+		switch {
+		case format != 0:
+			return nil, fmt.Errorf("chunk stream %d started without a full header", csid)
+		case !c.authed && csid > preAuthMaxCSID:
+			return nil, fmt.Errorf("unexpected chunk stream %d before publishing", csid)
+		case len(c.chunks) >= maxChunkStreams:
+			return nil, errors.New("too many chunk streams")
+		}
+		cs = new(chunkStream)
+		c.chunks[csid] = cs
+	}
+	var hdr [11]byte
+	hdrLen := [4]int{11, 7, 3, 0}[format]
+	if _, err := io.ReadFull(c.r, hdr[:hdrLen]); err != nil {
+		return nil, err
+	}
+	var ts uint32
+	if format < 3 {
+		ts = uint24(hdr[:])
+		cs.extended = ts == 0xffffff
+	}
+	if format < 2 {
+		cs.length = uint24(hdr[3:])
+		cs.typeID = hdr[6]
+	}
+	if format == 0 {
+		cs.streamID = binary.LittleEndian.Uint32(hdr[7:])
+	}
+	if cs.extended {
+		var ext [4]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return nil, err
+		}
+		if format < 3 {
+			ts = binary.BigEndian.Uint32(ext[:])
+		}
+	}
+	if len(cs.buf) == 0 {
+		// first chunk of a new message
+		switch format {
+		case 0:
+			cs.timestamp = ts
+			cs.delta = 0
+		case 1, 2:
+			cs.delta = ts
+			cs.timestamp += ts
+		case 3:
+			cs.timestamp += cs.delta
+		}
+		if cs.length > c.maxMessageSize() {
+			return nil, fmt.Errorf("message too large (%d bytes)", cs.length)
+		}
+	}
+	n := int(cs.length) - len(cs.buf)
+	if n > c.readChunkSize {
+		n = c.readChunkSize
+	}
+	if c.buffered+n > c.maxBuffered() {
+		return nil, errors.New("too much data buffered in partial messages")
+	}
+	// grow as the data arrives so that a large length alone allocates nothing
+	start := len(cs.buf)
+	cs.buf = slices.Grow(cs.buf, n)[:start+n]
+	c.buffered += n
+	if _, err := io.ReadFull(c.r, cs.buf[start:]); err != nil {
+		return nil, err
+	}
+	if len(cs.buf) < int(cs.length) {
+		return nil, nil
+	}
+	c.buffered -= len(cs.buf)
+	msg := &message{
+		typeID:    cs.typeID,
+		streamID:  cs.streamID,
+		timestamp: cs.timestamp,
+		payload:   cs.buf,
+	}
+	cs.buf = nil
+	return msg, nil
+}
+
+func (c *Conn) maxMessageSize() uint32 {
+	if c.authed {
+		return maxMessageSize
+	}
+	return preAuthMaxMessageSize
+}
+
+func (c *Conn) maxBuffered() int {
+	if c.authed {
+		return maxBuffered
+	}
+	return preAuthMaxBuffered
+}
+
+func (c *Conn) sendAck() error {
+	if c.ackWindow == 0 || c.r.n-c.acked < uint64(c.ackWindow) {
+		return nil
+	}
+	c.acked = c.r.n
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(c.acked))
+	return c.writeMessage(csidControl, msgAck, 0, b[:])
+}
+
+func (c *Conn) writeMessage(csid uint32, typeID uint8, streamID uint32, payload []byte) error {
+	c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
+	var hdr [12]byte
+	hdr[0] = byte(csid)
+	putUint24(hdr[4:], uint32(len(payload)))
+	hdr[7] = typeID
+	binary.LittleEndian.PutUint32(hdr[8:], streamID)
+	c.w.Write(hdr[:])
+	for {
+		n := len(payload)
+		if n > outChunkSize {
+			n = outChunkSize
+		}
+		c.w.Write(payload[:n])
+		payload = payload[n:]
+		if len(payload) == 0 {
+			break
+		}
+		c.w.WriteByte(0xc0 | byte(csid))
+	}
+	return c.w.Flush()
+}
+
+func (c *Conn) writeCommand(csid, streamID uint32, vals ...any) error {
+	return c.writeMessage(csid, msgCommandAMF0, streamID, amfEncode(vals...))
+}
+
+func (c *Conn) writeUserControl(event uint16, value uint32) error {
+	var b [6]byte
+	binary.BigEndian.PutUint16(b[:], event)
+	binary.BigEndian.PutUint32(b[2:], value)
+	return c.writeMessage(csidControl, msgUserControl, 0, b[:])
+}
+
+func (c *Conn) handleMessage(msg *message) error {
+	p := msg.payload
+	switch msg.typeID {
+	case msgSetChunkSize:
+		if len(p) < 4 {
+			return errors.New("short set chunk size message")
+		}
+		size := binary.BigEndian.Uint32(p) & 0x7fffffff
+		if size < 1 || size > maxMessageSize {
+			return fmt.Errorf("invalid chunk size %d", size)
+		}
+		c.readChunkSize = int(size)
+	case msgAbort:
+		if len(p) >= 4 {
+			if cs := c.chunks[binary.BigEndian.Uint32(p)]; cs != nil {
+				c.buffered -= len(cs.buf)
+				cs.buf = nil
+			}
+		}
+	case msgWindowAckSize:
+		if len(p) >= 4 {
+			c.ackWindow = binary.BigEndian.Uint32(p)
+		}
+	case msgUserControl:
+		if len(p) >= 6 && binary.BigEndian.Uint16(p) == eventPingRequest {
+			return c.writeUserControl(eventPingResponse, binary.BigEndian.Uint32(p[2:]))
+		}
+	case msgCommandAMF3:
+		if len(p) > 0 {
+			return c.handleCommand(msg.streamID, p[1:])
+		}
+	case msgCommandAMF0:
+		return c.handleCommand(msg.streamID, p)
+	case msgDataAMF3:
+		if len(p) > 0 {
+			return c.handleData(p[1:])
+		}
+	case msgDataAMF0:
+		return c.handleData(p)
+	case msgAudio, msgVideo:
+		if c.publishing {
+			return c.handleMedia(msg)
+		}
+	}
+	return nil
+}
+
+func (c *Conn) handleCommand(streamID uint32, p []byte) error {
+	vals, err := amfDecode(p)
+	if err != nil {
+		return fmt.Errorf("decoding command: %w", err)
+	}
+	if len(vals) < 2 {
+		return nil
+	}
+	name, _ := vals[0].(string)
+	txn, _ := vals[1].(float64)
+	args := vals[2:]
+	switch name {
+	case "connect":
+		return c.handleConnect(txn, args)
+	case "createStream":
+		return c.writeCommand(csidCommand, 0, "_result", txn, nil, publishStreamID)
+	case "releaseStream", "FCPublish":
+		if txn != 0 {
+			return c.writeCommand(csidCommand, 0, "_result", txn, nil)
+		}
+	case "publish":
+		return c.handlePublishCommand(streamID, txn, args)
+	case "play":
+		return errors.New("playback is not supported")
+	case "FCUnpublish", "deleteStream", "closeStream":
+		if c.publishing {
+			return errUnpublished
+		}
+	}
+	return nil
+}
+
+func (c *Conn) handleConnect(txn float64, args []any) error {
+	if len(args) < 1 {
+		return errors.New("connect is missing command object")
+	}
+	obj, _ := args[0].(amfMap)
+	c.app = obj.String("app")
+	c.tcURL = obj.String("tcUrl")
+	// Enhanced RTMP clients list the FourCCs they want to send
+	if list, ok := obj["fourCcList"].([]any); ok {
+		for _, v := range list {
+			if s, _ := v.(string); s == "*" || supportedFourCC(s) {
+				c.fourCCs = append(c.fourCCs, s)
+			}
+		}
+	}
+	var b [5]byte
+	binary.BigEndian.PutUint32(b[:], ackWindowSize)
+	if err := c.writeMessage(csidControl, msgWindowAckSize, 0, b[:4]); err != nil {
+		return err
+	}
+	b[4] = 2 // dynamic
+	if err := c.writeMessage(csidControl, msgSetPeerBandwidth, 0, b[:]); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(b[:], outChunkSize)
+	if err := c.writeMessage(csidControl, msgSetChunkSize, 0, b[:4]); err != nil {
+		return err
+	}
+	props := amfMap{
+		"fmsVer":       "FMS/3,0,1,123",
+		"capabilities": 31,
+	}
+	info := amfMap{
+		"level":          "status",
+		"code":           "NetConnection.Connect.Success",
+		"description":    "Connection succeeded.",
+		"objectEncoding": 0,
+	}
+	if c.fourCCs != nil {
+		info["fourCcList"] = c.fourCCs
+	}
+	return c.writeCommand(csidCommand, 0, "_result", txn, props, info)
+}
+
+func (c *Conn) handlePublishCommand(streamID uint32, txn float64, args []any) error {
+	if len(args) < 2 {
+		return errors.New("publish is missing stream name")
+	}
+	name, _ := args[1].(string)
+	u, err := createURL(c.tcURL, c.app, name)
+	if err != nil {
+		return fmt.Errorf("parsing publish URL: %w", err)
+	}
+	c.URL = u
+	if err := c.writeUserControl(eventStreamBegin, streamID); err != nil {
+		return err
+	}
+	if err := c.writeCommand(csidStream, streamID, "onStatus", 0, nil, amfMap{
+		"level":       "status",
+		"code":        "NetStream.Publish.Start",
+		"description": "Start publishing",
+	}); err != nil {
+		return err
+	}
+	c.publishing = true
+	return nil
+}
+
+// createURL combines the app and stream name into a URL of the form
+// rtmp://host/app/name?query
+func createURL(tcURL, app, name string) (*url.URL, error) {
+	var parts []string
+	for _, p := range strings.Split(app+"/"+name, "/") {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	u, err := url.ParseRequestURI("/" + strings.Join(parts, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if tu, err := url.Parse(tcURL); err == nil && tcURL != "" {
+		u.Scheme = tu.Scheme
+		u.Host = tu.Host
+	}
+	return u, nil
+}
+
+// Streams waits for the publisher to send its codec headers
+func (c *Conn) Streams() ([]av.CodecData, error) {
+	for !c.media.probed {
+		if err := c.pump(); err != nil {
+			return nil, err
+		}
+	}
+	return c.media.streams, nil
+}
+
+// ReadPacket returns the next audio or video packet
+func (c *Conn) ReadPacket() (av.Packet, error) {
+	if _, err := c.Streams(); err != nil {
+		return av.Packet{}, err
+	}
+	for len(c.media.pending) == 0 {
+		if err := c.pump(); err != nil {
+			return av.Packet{}, err
+		}
+	}
+	pkt := c.media.pending[0]
+	c.media.pending = c.media.pending[1:]
+	return pkt.pkt, nil
+}
+
+// pump reads and handles one message
+func (c *Conn) pump() error {
+	if c.closed {
+		return io.EOF
+	}
+	msg, err := c.readMessage()
+	if err == nil {
+		err = c.handleMessage(msg)
+	}
+	if errors.Is(err, errUnpublished) {
+		c.closed = true
+		return io.EOF
+	}
+	return err
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v >> 16)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v)
+}
@@ -0,0 +1,393 @@
+package irtmp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testConn(data []byte) *Conn {
+	return &Conn{
+		r:             &countingReader{r: bufio.NewReader(bytes.NewReader(data))},
+		chunks:        make(map[uint32]*chunkStream),
+		readChunkSize: defaultChunkSize,
+	}
+}
+
+// chunkHeader encodes a basic header and the message header for the format.
+// ts is the timestamp for format 0 and the delta for formats 1 and 2. Large
+// values use an extended timestamp, which continuation chunks must repeat by
+// passing ext.
+func chunkHeader(format byte, csid uint32, ts, length uint32, typeID byte, streamID uint32, ext bool) []byte {
+	var b []byte
+	switch {
+	case csid >= 320:
+		b = append(b, format<<6|1, byte(csid-64), byte((csid-64)>>8))
+	case csid >= 64:
+		b = append(b, format<<6, byte(csid-64))
+	default:
+		b = append(b, format<<6|byte(csid))
+	}
+	field := ts
+	if ts >= 0xffffff || ext {
+		field = 0xffffff
+	}
+	var hdr [11]byte
+	putUint24(hdr[:], field)
+	putUint24(hdr[3:], length)
+	hdr[6] = typeID
+	binary.LittleEndian.PutUint32(hdr[7:], streamID)
+	b = append(b, hdr[:[4]int{11, 7, 3, 0}[format]]...)
+	if field == 0xffffff {
+		b = binary.BigEndian.AppendUint32(b, ts)
+	}
+	return b
+}
+
+func cat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestReadChunk(t *testing.T) {
+	payload := []byte("0123456789")
+	cases := []struct {
+		name      string
+		authed    bool
+		chunkSize int
+		in        []byte
+		want      []message
+		err       string
+	}{
+		{
+			name: "Type0",
+			in:   cat(chunkHeader(0, 3, 1000, 10, msgCommandAMF0, 1, false), payload),
+			want: []message{{typeID: msgCommandAMF0, streamID: 1, timestamp: 1000, payload: payload}},
+		},
+		{
+			name: "Type1Delta",
+			in: cat(
+				chunkHeader(0, 4, 1000, 10, msgVideo, 1, false), payload,
+				chunkHeader(1, 4, 40, 3, msgAudio, 0, false), payload[:3],
+			),
+			want: []message{
+				{typeID: msgVideo, streamID: 1, timestamp: 1000, payload: payload},
+				{typeID: msgAudio, streamID: 1, timestamp: 1040, payload: payload[:3]},
+			},
+		},
+		{
+			name: "Type2And3RepeatDelta",
+			in: cat(
+				chunkHeader(0, 4, 1000, 4, msgVideo, 1, false), payload[:4],
+				chunkHeader(2, 4, 33, 0, 0, 0, false), payload[:4],
+				chunkHeader(3, 4, 0, 0, 0, 0, false), payload[:4],
+			),
+			want: []message{
+				{typeID: msgVideo, streamID: 1, timestamp: 1000, payload: payload[:4]},
+				{typeID: msgVideo, streamID: 1, timestamp: 1033, payload: payload[:4]},
+				{typeID: msgVideo, streamID: 1, timestamp: 1066, payload: payload[:4]},
+			},
+		},
+		{
+			name:      "Continuation",
+			chunkSize: 4,
+			in: cat(
+				chunkHeader(0, 6, 500, 10, msgVideo, 1, false), payload[:4],
+				chunkHeader(3, 6, 0, 0, 0, 0, false), payload[4:8],
+				chunkHeader(3, 6, 0, 0, 0, 0, false), payload[8:],
+			),
+			want: []message{{typeID: msgVideo, streamID: 1, timestamp: 500, payload: payload}},
+		},
+		{
+			name:      "Interleaved",
+			chunkSize: 4,
+			in: cat(
+				chunkHeader(0, 6, 500, 8, msgVideo, 1, false), payload[:4],
+				chunkHeader(0, 4, 510, 2, msgAudio, 1, false), payload[:2],
+				chunkHeader(3, 6, 0, 0, 0, 0, false), payload[4:8],
+			),
+			want: []message{
+				{typeID: msgAudio, streamID: 1, timestamp: 510, payload: payload[:2]},
+				{typeID: msgVideo, streamID: 1, timestamp: 500, payload: payload[:8]},
+			},
+		},
+		{
+			name:      "ExtendedTimestamp",
+			chunkSize: 4,
+			in: cat(
+				chunkHeader(0, 6, 0x1000000, 6, msgVideo, 1, false), payload[:4],
+				// continuation chunks repeat the extended timestamp
+				chunkHeader(3, 6, 0x1000000, 0, 0, 0, true), payload[4:6],
+				chunkHeader(1, 6, 0xffffff, 2, msgVideo, 0, false), payload[:2],
+			),
+			want: []message{
+				{typeID: msgVideo, streamID: 1, timestamp: 0x1000000, payload: payload[:6]},
+				{typeID: msgVideo, streamID: 1, timestamp: 0x1ffffff, payload: payload[:2]},
+			},
+		},
+		{
+			name: "Type3AfterExtendedDelta",
+			in: cat(
+				chunkHeader(0, 6, 1000, 2, msgVideo, 1, false), payload[:2],
+				chunkHeader(1, 6, 0x1000000, 2, msgVideo, 0, false), payload[:2],
+				// a new message reuses the extended delta and repeats it
+				chunkHeader(3, 6, 0x1000000, 0, 0, 0, true), payload[2:4],
+			),
+			want: []message{
+				{typeID: msgVideo, streamID: 1, timestamp: 1000, payload: payload[:2]},
+				{typeID: msgVideo, streamID: 1, timestamp: 1000 + 0x1000000, payload: payload[:2]},
+				{typeID: msgVideo, streamID: 1, timestamp: 1000 + 0x2000000, payload: payload[2:4]},
+			},
+		},
+		{
+			name:   "TwoByteCSID",
+			authed: true,
+			in:     cat(chunkHeader(0, 100, 1, 2, msgVideo, 1, false), payload[:2]),
+			want:   []message{{typeID: msgVideo, streamID: 1, timestamp: 1, payload: payload[:2]}},
+		},
+		{
+			name:   "ThreeByteCSID",
+			authed: true,
+			in:     cat(chunkHeader(0, 1000, 1, 2, msgVideo, 1, false), payload[:2]),
+			want:   []message{{typeID: msgVideo, streamID: 1, timestamp: 1, payload: payload[:2]}},
+		},
+		{
+			name: "EmptyMessage",
+			in:   chunkHeader(0, 3, 0, 0, msgCommandAMF0, 0, false),
+			want: []message{{typeID: msgCommandAMF0}},
+		},
+		{
+			name: "NoFullHeader",
+			in:   cat(chunkHeader(1, 3, 0, 2, msgVideo, 0, false), payload[:2]),
+			err:  "started without a full header",
+		},
+		{
+			name: "UnknownCSIDBeforeAuth",
+			in:   cat(chunkHeader(0, 1000, 0, 2, msgVideo, 1, false), payload[:2]),
+			err:  "unexpected chunk stream 1000",
+		},
+		{
+			name: "LargeMessageBeforeAuth",
+			in:   cat(chunkHeader(0, 3, 0, preAuthMaxMessageSize+1, msgCommandAMF0, 0, false), payload),
+			err:  "message too large",
+		},
+		{
+			name:   "LargeMessage",
+			authed: true,
+			in:     cat(chunkHeader(0, 3, 0, maxMessageSize+1, msgVideo, 0, false), payload),
+			err:    "message too large",
+		},
+		{
+			name: "TruncatedHeader",
+			in:   chunkHeader(0, 3, 0, 10, msgCommandAMF0, 0, false)[:6],
+			err:  io.ErrUnexpectedEOF.Error(),
+		},
+		{
+			name: "TruncatedExtendedTimestamp",
+			in:   chunkHeader(0, 3, 0x1000000, 10, msgCommandAMF0, 0, false)[:14],
+			err:  io.ErrUnexpectedEOF.Error(),
+		},
+		{
+			name: "TruncatedPayload",
+			in:   cat(chunkHeader(0, 3, 0, 10, msgCommandAMF0, 0, false), payload[:5]),
+			err:  io.ErrUnexpectedEOF.Error(),
+		},
+		{
+			name: "TruncatedCSID",
+			in:   []byte{1},
+			err:  io.EOF.Error(),
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn := testConn(c.in)
+			conn.authed = c.authed
+			if c.chunkSize != 0 {
+				conn.readChunkSize = c.chunkSize
+			}
+			var got []message
+			var err error
+			for {
+				var msg *message
+				msg, err = conn.readChunk()
+				if err != nil {
+					break
+				}
+				if msg != nil {
+					got = append(got, *msg)
+				}
+			}
+			if c.err != "" {
+				assert.ErrorContains(t, err, c.err)
+				return
+			}
+			assert.Equal(t, io.EOF, err)
+			require.Len(t, got, len(c.want))
+			for i, want := range c.want {
+				assert.Equal(t, want.typeID, got[i].typeID, "message %d", i)
+				assert.Equal(t, want.streamID, got[i].streamID, "message %d", i)
+				assert.Equal(t, want.timestamp, got[i].timestamp, "message %d", i)
+				assert.Equal(t, string(want.payload), string(got[i].payload), "message %d", i)
+			}
+			assert.Zero(t, conn.buffered)
+		})
+	}
+}
+
+func TestReadChunkLimits(t *testing.T) {
+	t.Run("ChunkStreams", func(t *testing.T) {
+		var in []byte
+		for csid := uint32(2); csid < 2+maxChunkStreams+1; csid++ {
+			in = append(in, chunkHeader(0, csid, 0, 1, msgVideo, 1, false)...)
+			in = append(in, 'x')
+		}
+		conn := testConn(in)
+		conn.authed = true
+		var err error
+		for err == nil {
+			_, err = conn.readChunk()
+		}
+		assert.ErrorContains(t, err, "too many chunk streams")
+	})
+	t.Run("Buffered", func(t *testing.T) {
+		// each partial message is allowed but together they are too much
+		var in []byte
+		chunk := make([]byte, defaultChunkSize)
+		for csid := uint32(2); csid <= preAuthMaxCSID; csid++ {
+			for i := 0; i < 200; i++ {
+				if i == 0 {
+					in = append(in, chunkHeader(0, csid, 0, preAuthMaxMessageSize, msgCommandAMF0, 0, false)...)
+				} else {
+					in = append(in, chunkHeader(3, csid, 0, 0, 0, 0, false)...)
+				}
+				in = append(in, chunk...)
+			}
+		}
+		conn := testConn(in)
+		var err error
+		for err == nil {
+			_, err = conn.readChunk()
+		}
+		assert.ErrorContains(t, err, "too much data buffered")
+		assert.LessOrEqual(t, conn.buffered, preAuthMaxBuffered)
+	})
+	t.Run("LengthAloneAllocatesNothing", func(t *testing.T) {
+		conn := testConn(chunkHeader(0, 4, 0, maxMessageSize, msgVideo, 1, false))
+		conn.authed = true
+		_, err := conn.readChunk()
+		assert.Error(t, err)
+		assert.Less(t, cap(conn.chunks[4].buf), 4096)
+	})
+}
+
+// control messages change how the chunks that follow them are read
+func TestReadChunkControl(t *testing.T) {
+	payload := []byte("0123456789")
+	setChunkSize := func(size uint32) []byte {
+		return cat(chunkHeader(0, csidControl, 0, 4, msgSetChunkSize, 0, false), binary.BigEndian.AppendUint32(nil, size))
+	}
+	abort := func(csid uint32) []byte {
+		return cat(chunkHeader(0, csidControl, 0, 4, msgAbort, 0, false), binary.BigEndian.AppendUint32(nil, csid))
+	}
+	cases := []struct {
+		name string
+		in   []byte
+		want []message
+		err  string
+	}{
+		{
+			name: "ChunkSizeChangeMidMessage",
+			in: cat(
+				chunkHeader(0, 6, 500, 10, msgVideo, 1, false), payload[:4],
+				setChunkSize(6),
+				// the rest of the message arrives in one larger chunk
+				chunkHeader(3, 6, 0, 0, 0, 0, false), payload[4:],
+				chunkHeader(0, 6, 600, 10, msgVideo, 1, false), payload[:6],
+				chunkHeader(3, 6, 0, 0, 0, 0, false), payload[6:],
+			),
+			want: []message{
+				{typeID: msgVideo, streamID: 1, timestamp: 500, payload: payload},
+				{typeID: msgVideo, streamID: 1, timestamp: 600, payload: payload},
+			},
+		},
+		{
+			name: "AbortPartialMessage",
+			in: cat(
+				chunkHeader(0, 6, 500, 10, msgVideo, 1, false), payload[:4],
+				abort(6),
+				chunkHeader(0, 6, 600, 2, msgAudio, 1, false), payload[:2],
+			),
+			want: []message{{typeID: msgAudio, streamID: 1, timestamp: 600, payload: payload[:2]}},
+		},
+		{
+			name: "Type3AfterAbort",
+			in: cat(
+				chunkHeader(0, 6, 500, 4, msgVideo, 1, false), payload[:4],
+				chunkHeader(1, 6, 40, 10, msgVideo, 0, false), payload[:4],
+				abort(6),
+				// starts a new message with the same header and delta
+				chunkHeader(3, 6, 0, 0, 0, 0, false), payload[:4],
+				chunkHeader(3, 6, 0, 0, 0, 0, false), payload[4:8],
+				chunkHeader(3, 6, 0, 0, 0, 0, false), payload[8:],
+			),
+			want: []message{
+				{typeID: msgVideo, streamID: 1, timestamp: 500, payload: payload[:4]},
+				{typeID: msgVideo, streamID: 1, timestamp: 580, payload: payload},
+			},
+		},
+		{
+			name: "AbortUnknownStream",
+			in: cat(
+				abort(9),
+				chunkHeader(0, 6, 500, 2, msgVideo, 1, false), payload[:2],
+			),
+			want: []message{{typeID: msgVideo, streamID: 1, timestamp: 500, payload: payload[:2]}},
+		},
+		{
+			name: "InvalidChunkSize",
+			in:   setChunkSize(0),
+			err:  "invalid chunk size",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn := testConn(c.in)
+			conn.readChunkSize = 4
+			var got []message
+			var err error
+			for {
+				var msg *message
+				msg, err = conn.readChunk()
+				if err != nil {
+					break
+				}
+				if msg == nil {
+					continue
+				}
+				if msg.typeID == msgSetChunkSize || msg.typeID == msgAbort {
+					if err = conn.handleMessage(msg); err != nil {
+						break
+					}
+					continue
+				}
+				got = append(got, *msg)
+			}
+			if c.err != "" {
+				assert.ErrorContains(t, err, c.err)
+				return
+			}
+			assert.Equal(t, io.EOF, err)
+			require.Len(t, got, len(c.want))
+			for i, want := range c.want {
+				assert.Equal(t, want.typeID, got[i].typeID, "message %d", i)
+				assert.Equal(t, want.timestamp, got[i].timestamp, "message %d", i)
+				assert.Equal(t, string(want.payload), string(got[i].payload), "message %d", i)
+			}
+			assert.Zero(t, conn.buffered)
+		})
+	}
+}
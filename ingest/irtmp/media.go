@@ -0,0 +1,327 @@
+package irtmp
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"eaglesong.dev/gunk/codec/av1parser"
+	"eaglesong.dev/gunk/codec/hevcparser"
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+const (
+	// how long to wait for a missing codec header before giving up on that track
+	probeDuration = 3 * time.Second
+	// how long to wait for any usable track at all
+	probeTimeout = 10 * time.Second
+)
+
+// legacy FLV codec IDs
+const (
+	soundFormatAAC = 10
+	videoCodecAVC  = 7
+
+	aacSequenceHeader = 0
+	avcSequenceHeader = 0
+	avcNALU           = 1
+	avcEndOfSequence  = 2
+
+	frameTypeKey     = 1
+	frameTypeCommand = 5
+)
+
+// Enhanced RTMP video packet types
+const (
+	exHeaderFlag = 0x80
+
+	packetTypeSequenceStart        = 0
+	packetTypeCodedFrames          = 1
+	packetTypeSequenceEnd          = 2
+	packetTypeCodedFramesX         = 3
+	packetTypeMetadata             = 4
+	packetTypeMPEG2TSSequenceStart = 5
+)
+
+const (
+	fourCCAVC  = "avc1"
+	fourCCHEVC = "hvc1"
+	fourCCAV1  = "av01"
+)
+
+func supportedFourCC(s string) bool {
+	switch s {
+	case fourCCAVC, fourCCHEVC, fourCCAV1:
+		return true
+	}
+	return false
+}
+
+type mediaState struct {
+	probed     bool
+	video      av.CodecData
+	audio      av.CodecData
+	streams    []av.CodecData
+	vidx, aidx int8
+
+	// tracks the client says it will send, from onMetaData
+	expectVideo, expectAudio bool
+	gotMetadata              bool
+	firstTime, lastTime      uint32
+	gotTime                  bool
+	warned                   map[string]bool
+
+	pending []mediaPacket
+}
+
+type mediaPacket struct {
+	video bool
+	pkt   av.Packet
+}
+
+func (c *Conn) handleData(p []byte) error {
+	vals, err := amfDecode(p)
+	if err != nil {
+		// metadata is informational only
+		return nil
+	}
+	if len(vals) > 0 && vals[0] == "@setDataFrame" {
+		vals = vals[1:]
+	}
+	if len(vals) < 1 {
+		return nil
+	}
+	name, _ := vals[0].(string)
+	if name != "onMetaData" {
+		c.handleCue(name, vals[1:])
+		return nil
+	}
+	var meta amfMap
+	if len(vals) > 1 {
+		meta, _ = vals[1].(amfMap)
+	}
+	if meta == nil {
+		return nil
+	}
+	c.setEncoder(meta)
+	m := &c.media
+	if m.probed {
+		return nil
+	}
+	m.gotMetadata = true
+	_, m.expectVideo = meta["videocodecid"]
+	_, m.expectAudio = meta["audiocodecid"]
+	return nil
+}
+
+func (c *Conn) handleMedia(msg *message) error {
+	m := &c.media
+	if !m.gotTime {
+		m.firstTime = msg.timestamp
+		m.gotTime = true
+	}
+	m.lastTime = msg.timestamp
+	var err error
+	if msg.typeID == msgVideo {
+		err = c.handleVideo(msg.timestamp, msg.payload)
+	} else {
+		err = c.handleAudio(msg.timestamp, msg.payload)
+	}
+	if err != nil {
+		return err
+	}
+	if !m.probed {
+		return m.checkProbe()
+	}
+	return nil
+}
+
+func (c *Conn) handleVideo(ts uint32, p []byte) error {
+	if len(p) < 1 {
+		return nil
+	}
+	var (
+		fourCC     string
+		frameType  byte
+		packetType byte
+		cts        int32
+	)
+	if p[0]&exHeaderFlag != 0 {
+		// Enhanced RTMP
+		if len(p) < 5 {
+			return errors.New("short enhanced video tag")
+		}
+		frameType = (p[0] >> 4) & 7
+		packetType = p[0] & 0xf
+		fourCC = string(p[1:5])
+		p = p[5:]
+		if packetType == packetTypeCodedFrames && fourCC != fourCCAV1 {
+			if len(p) < 3 {
+				return errors.New("short enhanced video tag")
+			}
+			cts = int24(p)
+			p = p[3:]
+		}
+	} else {
+		frameType = p[0] >> 4
+		if codecID := p[0] & 0xf; codecID != videoCodecAVC {
+			c.warnOnce(fmt.Sprintf("video codec ID %d", codecID))
+			return nil
+		}
+		if len(p) < 5 {
+			return errors.New("short video tag")
+		}
+		fourCC = fourCCAVC
+		switch p[1] {
+		case avcSequenceHeader:
+			packetType = packetTypeSequenceStart
+		case avcNALU:
+			packetType = packetTypeCodedFrames
+		default:
+			packetType = packetTypeSequenceEnd
+		}
+		cts = int24(p[2:])
+		p = p[5:]
+	}
+	if frameType == frameTypeCommand {
+		return nil
+	}
+	switch packetType {
+	case packetTypeSequenceStart:
+		if c.media.video != nil || c.media.probed {
+			// joy4 can't signal a change of codec parameters midstream
+			return nil
+		}
+		cd, err := parseVideoHeader(fourCC, p)
+		if err != nil {
+			return err
+		} else if cd == nil {
+			c.warnOnce("video FourCC " + fourCC)
+		}
+		c.media.video = cd
+	case packetTypeCodedFrames, packetTypeCodedFramesX:
+		if c.media.video == nil || len(p) == 0 {
+			return nil
+		}
+		c.media.push(true, av.Packet{
+			IsKeyFrame:      frameType == frameTypeKey,
+			Idx:             c.media.vidx,
+			Time:            time.Duration(ts) * time.Millisecond,
+			CompositionTime: time.Duration(cts) * time.Millisecond,
+			Data:            p,
+		})
+	}
+	return nil
+}
+
+func parseVideoHeader(fourCC string, p []byte) (av.CodecData, error) {
+	switch fourCC {
+	case fourCCAVC:
+		cd, err := h264parser.NewCodecDataFromAVCDecoderConfRecord(p)
+		if err != nil {
+			return nil, fmt.Errorf("parsing AVC sequence header: %w", err)
+		}
+		return cd, nil
+	case fourCCHEVC:
+		cd, err := hevcparser.NewCodecDataFromDecoderConfRecord(p)
+		if err != nil {
+			return nil, fmt.Errorf("parsing HEVC sequence header: %w", err)
+		}
+		return cd, nil
+	case fourCCAV1:
+		cd, err := av1parser.NewCodecDataFromConfigurationRecord(p)
+		if err != nil {
+			return nil, fmt.Errorf("parsing AV1 sequence header: %w", err)
+		}
+		return cd, nil
+	}
+	return nil, nil
+}
+
+func (c *Conn) handleAudio(ts uint32, p []byte) error {
+	if len(p) < 2 {
+		return nil
+	}
+	if format := p[0] >> 4; format != soundFormatAAC {
+		c.warnOnce(fmt.Sprintf("audio format %d", format))
+		return nil
+	}
+	if p[1] == aacSequenceHeader {
+		if c.media.audio != nil || c.media.probed {
+			return nil
+		}
+		cd, err := aacparser.NewCodecDataFromMPEG4AudioConfigBytes(p[2:])
+		if err != nil {
+			return fmt.Errorf("parsing AAC sequence header: %w", err)
+		}
+		c.media.audio = cd
+		return nil
+	}
+	if c.media.audio == nil || len(p) == 2 {
+		return nil
+	}
+	c.media.push(false, av.Packet{
+		Idx:  c.media.aidx,
+		Time: time.Duration(ts) * time.Millisecond,
+		Data: p[2:],
+	})
+	return nil
+}
+
+func (m *mediaState) push(video bool, pkt av.Packet) {
+	m.pending = append(m.pending, mediaPacket{video: video, pkt: pkt})
+}
+
+func (c *Conn) warnOnce(what string) {
+	m := &c.media
+	if m.warned == nil {
+		m.warned = make(map[string]bool)
+	}
+	if !m.warned[what] {
+		m.warned[what] = true
+		c.log.Warn().Msgf("ignoring unsupported %s", what)
+	}
+}
+
+// checkProbe decides whether enough headers have arrived to start demuxing
+func (m *mediaState) checkProbe() error {
+	haveVideo, haveAudio := m.video != nil, m.audio != nil
+	elapsed := time.Duration(m.lastTime-m.firstTime) * time.Millisecond
+	switch {
+	case haveVideo && haveAudio:
+	case m.gotMetadata && (haveVideo || !m.expectVideo) && (haveAudio || !m.expectAudio) && (haveVideo || haveAudio):
+	case (haveVideo || haveAudio) && elapsed >= probeDuration:
+	case elapsed >= probeTimeout:
+		return errors.New("no supported audio or video tracks were published")
+	default:
+		return nil
+	}
+	m.probed = true
+	if haveVideo {
+		m.vidx = int8(len(m.streams))
+		m.streams = append(m.streams, m.video)
+	}
+	if haveAudio {
+		m.aidx = int8(len(m.streams))
+		m.streams = append(m.streams, m.audio)
+	}
+	// assign indexes to packets that arrived while probing
+	for i, p := range m.pending {
+		if p.video {
+			m.pending[i].pkt.Idx = m.vidx
+		} else {
+			m.pending[i].pkt.Idx = m.aidx
+		}
+	}
+	return nil
+}
+
+func int24(b []byte) int32 {
+	v := int32(uint24(b))
+	if v&0x800000 != 0 {
+		v -= 1 << 24
+	}
+	return v
+}
@@ -0,0 +1,136 @@
+package irtmp
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"eaglesong.dev/gunk/codec"
+	"eaglesong.dev/gunk/codec/av1parser"
+	"eaglesong.dev/gunk/codec/hevcparser"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// parameter sets from a 1080p x265 stream and a 540p libaom stream
+var (
+	sampleVPS = unhex("40010c01ffff016000000300900000030000030078959809")
+	sampleSPS = unhex("420101016000000300900000030000030078a003c08010e59659a4932bc05a02000003000200000300651008")
+	samplePPS = unhex("4401c172b46240")
+	sampleAV1 = unhex("0a0b00000024cf7f0dbfff3008")
+)
+
+func hvcC(t *testing.T) []byte {
+	cd, err := hevcparser.NewCodecDataFromVPSAndSPSAndPPS(sampleVPS, sampleSPS, samplePPS)
+	require.NoError(t, err)
+	return cd.DecoderConfRecordBytes()
+}
+
+func av1C(t *testing.T) []byte {
+	cd, err := av1parser.NewCodecDataFromSequenceHeader(sampleAV1)
+	require.NoError(t, err)
+	return cd.ConfigurationRecordBytes()
+}
+
+// exVideo builds an Enhanced RTMP video tag
+func exVideo(frameType, packetType byte, fourCC string, body ...[]byte) []byte {
+	p := append([]byte{exHeaderFlag | frameType<<4 | packetType}, fourCC...)
+	for _, b := range body {
+		p = append(p, b...)
+	}
+	return p
+}
+
+func TestEnhancedVideo(t *testing.T) {
+	t.Run("HEVC", func(t *testing.T) {
+		c := testConn(nil)
+		require.NoError(t, c.handleVideo(0, exVideo(frameTypeKey, packetTypeSequenceStart, fourCCHEVC, hvcC(t))))
+		require.NotNil(t, c.media.video)
+		assert.Equal(t, codec.HEVC, c.media.video.Type())
+		assert.Equal(t, 1920, c.media.video.(hevcparser.CodecData).Width())
+		// coded frames carry a signed composition time offset
+		require.NoError(t, c.handleVideo(1000, exVideo(frameTypeKey, packetTypeCodedFrames, fourCCHEVC, []byte{0xff, 0xff, 0xd8}, []byte("idr"))))
+		require.NoError(t, c.handleVideo(1033, exVideo(2, packetTypeCodedFramesX, fourCCHEVC, []byte("p"))))
+		require.Len(t, c.media.pending, 2)
+		key := c.media.pending[0].pkt
+		assert.True(t, key.IsKeyFrame)
+		assert.Equal(t, time.Second, key.Time)
+		assert.Equal(t, -40*time.Millisecond, key.CompositionTime)
+		assert.Equal(t, []byte("idr"), key.Data)
+		inter := c.media.pending[1].pkt
+		assert.False(t, inter.IsKeyFrame)
+		assert.Zero(t, inter.CompositionTime)
+		assert.Equal(t, []byte("p"), inter.Data)
+	})
+	t.Run("AV1", func(t *testing.T) {
+		c := testConn(nil)
+		require.NoError(t, c.handleVideo(0, exVideo(frameTypeKey, packetTypeSequenceStart, fourCCAV1, av1C(t))))
+		require.NotNil(t, c.media.video)
+		assert.Equal(t, codec.AV1, c.media.video.Type())
+		// AV1 coded frames have no composition time
+		require.NoError(t, c.handleVideo(40, exVideo(frameTypeKey, packetTypeCodedFrames, fourCCAV1, []byte{0x12, 0x00})))
+		require.Len(t, c.media.pending, 1)
+		assert.Equal(t, []byte{0x12, 0x00}, c.media.pending[0].pkt.Data)
+	})
+	t.Run("UnsupportedFourCC", func(t *testing.T) {
+		c := testConn(nil)
+		require.NoError(t, c.handleVideo(0, exVideo(frameTypeKey, packetTypeSequenceStart, "vp09", []byte{1, 2, 3})))
+		assert.Nil(t, c.media.video)
+		require.NoError(t, c.handleVideo(0, exVideo(frameTypeKey, packetTypeCodedFrames, "vp09", []byte{0, 0, 0, 1})))
+		assert.Empty(t, c.media.pending)
+	})
+	t.Run("CommandFrame", func(t *testing.T) {
+		c := testConn(nil)
+		require.NoError(t, c.handleVideo(0, exVideo(frameTypeCommand, packetTypeSequenceStart, fourCCHEVC, []byte{0})))
+		assert.Nil(t, c.media.video)
+	})
+}
+
+func TestEnhancedVideoMalformed(t *testing.T) {
+	cases := []struct {
+		name string
+		in   func(t *testing.T) []byte
+		err  string
+	}{
+		{"ShortFourCC", func(*testing.T) []byte { return []byte{exHeaderFlag | 0x10, 'h', 'v'} }, "short enhanced video tag"},
+		{"ShortCompositionTime", func(*testing.T) []byte {
+			return exVideo(frameTypeKey, packetTypeCodedFrames, fourCCHEVC, []byte{0})
+		}, "short enhanced video tag"},
+		{"ShortLegacyTag", func(*testing.T) []byte { return []byte{0x17, 1, 0} }, "short video tag"},
+		{"TruncatedHVCC", func(t *testing.T) []byte {
+			rec := hvcC(t)
+			return exVideo(frameTypeKey, packetTypeSequenceStart, fourCCHEVC, rec[:len(rec)-4])
+		}, "parsing HEVC sequence header"},
+		{"EmptyHVCC", func(*testing.T) []byte {
+			return exVideo(frameTypeKey, packetTypeSequenceStart, fourCCHEVC)
+		}, "parsing HEVC sequence header"},
+		{"BadAV1CVersion", func(t *testing.T) []byte {
+			rec := av1C(t)
+			rec[0] = 0x01
+			return exVideo(frameTypeKey, packetTypeSequenceStart, fourCCAV1, rec)
+		}, "parsing AV1 sequence header"},
+		{"TruncatedAV1C", func(t *testing.T) []byte {
+			rec := av1C(t)
+			return exVideo(frameTypeKey, packetTypeSequenceStart, fourCCAV1, rec[:len(rec)-3])
+		}, "parsing AV1 sequence header"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn := testConn(nil)
+			err := conn.handleVideo(0, c.in(t))
+			assert.ErrorContains(t, err, c.err)
+		})
+	}
+	// frames before any sequence header are dropped
+	conn := testConn(nil)
+	require.NoError(t, conn.handleVideo(0, exVideo(frameTypeKey, packetTypeCodedFramesX, fourCCHEVC, []byte("idr"))))
+	assert.Empty(t, conn.media.pending)
+}
@@ -0,0 +1,137 @@
+package irtmp
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"strings"
+	"time"
+
+	"eaglesong.dev/gunk/model"
+)
+
+// legacy FLV codec IDs named in onMetaData
+var (
+	videoCodecNames = map[int]string{2: "H263", 4: "VP6", 7: "H264", 12: "HEVC"}
+	audioCodecNames = map[int]string{2: "MP3", 10: "AAC", 11: "SPEEX", 13: "OPUS"}
+)
+
+// Encoder returns what the publisher said about its encoder in onMetaData
+func (c *Conn) Encoder() model.EncoderInfo {
+	c.metaMu.Lock()
+	defer c.metaMu.Unlock()
+	return c.encoder
+}
+
+// SetCueHandler sets a function to call with timed metadata. It is called
+// from ReadPacket, so cues arrive in order with the packets around them.
+func (c *Conn) SetCueHandler(f func(model.Cue)) {
+	c.metaMu.Lock()
+	defer c.metaMu.Unlock()
+	c.onCue = f
+}
+
+func (c *Conn) setEncoder(meta amfMap) {
+	info := model.EncoderInfo{
+		Encoder:      meta.String("encoder"),
+		VideoCodec:   codecName(meta["videocodecid"], videoCodecNames),
+		Width:        int(meta.Number("width")),
+		Height:       int(meta.Number("height")),
+		FrameRate:    meta.Number("framerate"),
+		VideoBitrate: int(meta.Number("videodatarate")),
+		AudioCodec:   codecName(meta["audiocodecid"], audioCodecNames),
+		SampleRate:   int(meta.Number("audiosamplerate")),
+		Channels:     int(meta.Number("audiochannels")),
+		AudioBitrate: int(meta.Number("audiodatarate")),
+		Updated:      time.Now().UnixNano() / 1000000,
+	}
+	if info.Channels == 0 && info.AudioCodec != "" {
+		if stereo, ok := meta["stereo"].(bool); ok {
+			info.Channels = 1
+			if stereo {
+				info.Channels = 2
+			}
+		}
+	}
+	c.metaMu.Lock()
+	c.encoder = info
+	c.metaMu.Unlock()
+}
+
+// codecName turns a codec ID, which is either a legacy FLV ID or a FourCC
+// packed into a number or string, into a name
+func codecName(v any, names map[int]string) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		if name := names[int(v)]; name != "" {
+			return name
+		} else if v > 255 && v <= math.MaxUint32 {
+			var b [4]byte
+			binary.BigEndian.PutUint32(b[:], uint32(v))
+			return string(b[:])
+		}
+	}
+	return ""
+}
+
+// handleCue turns the timed metadata messages sent by encoders into cues.
+// onCuePoint carrying a base64 SCTE-35 section is passed through as is, and
+// anything else is carried as an ID3 tag.
+func (c *Conn) handleCue(name string, args []any) {
+	c.metaMu.Lock()
+	onCue := c.onCue
+	c.metaMu.Unlock()
+	if onCue == nil || !c.media.probed {
+		return
+	}
+	var arg amfMap
+	if len(args) > 0 {
+		arg, _ = args[0].(amfMap)
+	}
+	var cue model.Cue
+	switch name {
+	case "onTextData":
+		cue = model.Cue{Kind: model.CueID3, Data: id3Tag("text", arg.String("text"))}
+	case "onCuePoint":
+		params, _ := arg["parameters"].(amfMap)
+		if t := strings.ToLower(arg.String("type")); t == "scte35" || t == "scte-35" {
+			section, err := base64.StdEncoding.DecodeString(params.String("cue"))
+			if err != nil || len(section) == 0 {
+				c.log.Debug().Err(err).Msg("ignoring SCTE-35 cue point without a section")
+				return
+			}
+			cue = model.Cue{Kind: model.CueSCTE35, Data: section}
+			if d := params.Number("duration"); d > 0 {
+				cue.Duration = time.Duration(d * float64(time.Second))
+			}
+			break
+		}
+		value, _ := json.Marshal(params)
+		cue = model.Cue{Kind: model.CueID3, Data: id3Tag(arg.String("name"), string(value))}
+	default:
+		return
+	}
+	onCue(cue)
+}
+
+// id3Tag builds an ID3v2.4 tag with one user-defined text frame
+func id3Tag(description, value string) []byte {
+	frame := []byte{3} // UTF-8
+	frame = append(frame, description...)
+	frame = append(frame, 0)
+	frame = append(frame, value...)
+	tag := []byte{'I', 'D', '3', 4, 0, 0}
+	tag = appendSyncsafe(tag, uint32(10+len(frame)))
+	tag = append(tag, "TXXX"...)
+	tag = appendSyncsafe(tag, uint32(len(frame)))
+	tag = append(tag, 0, 0) // frame flags
+	return append(tag, frame...)
+}
+
+// appendSyncsafe appends a 28-bit integer using 7 bits per byte
+func appendSyncsafe(b []byte, v uint32) []byte {
+	return append(b, byte(v>>21)&0x7f, byte(v>>14)&0x7f, byte(v>>7)&0x7f, byte(v)&0x7f)
+}
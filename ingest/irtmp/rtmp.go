@@ -2,18 +2,20 @@ package irtmp
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
 	"net/url"
 
 	"eaglesong.dev/gunk/model"
 	"github.com/nareix/joy4/av"
 	"github.com/nareix/joy4/av/pktque"
-	"github.com/nareix/joy4/format/rtmp"
 	"github.com/rs/zerolog/log"
 )
 
+const defaultAddr = ":1935"
+
 type Server struct {
-	rtmp.Server
+	Addr      string
 	CheckUser CheckUserFunc
 	Publish   PublishFunc
 }
@@ -22,25 +24,81 @@ type CheckUserFunc func(*url.URL) (model.ChannelAuth, error)
 type PublishFunc func(ctx context.Context, auth model.ChannelAuth, src av.Demuxer) error
 
 func (s *Server) ListenAndServe() error {
-	s.HandlePublish = s.handlePublish
-	return s.Server.ListenAndServe()
+	addr := s.Addr
+	if addr == "" {
+		addr = defaultAddr
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.serve(lis, "rtmp")
 }
 
-func (s *Server) handlePublish(conn *rtmp.Conn) {
-	defer conn.Close()
-	remote := conn.NetConn().RemoteAddr().(*net.TCPAddr).IP.String()
-	fm := &pktque.FilterDemuxer{
-		Demuxer: conn,
-		Filter:  &DeJitter{},
+// ListenAndServeTLS accepts RTMPS connections on addr
+func (s *Server) ListenAndServeTLS(addr string, config *tls.Config) error {
+	lis, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return err
+	}
+	return s.serve(lis, "rtmps")
+}
+
+func (s *Server) serve(lis net.Listener, kind string) error {
+	defer lis.Close()
+	for {
+		nc, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleConn(nc, kind)
+	}
+}
+
+func (s *Server) handleConn(nc net.Conn, kind string) {
+	defer nc.Close()
+	remote := nc.RemoteAddr().(*net.TCPAddr).IP.String()
+	l := log.With().Str("rtmp_ip", remote).Str("kind", kind).Logger()
+	if tc, ok := nc.(*tls.Conn); ok {
+		// the TLS connection is served directly, finish its handshake first so
+		// that failures are reported as such
+		ctx, cancel := context.WithTimeout(context.Background(), readTimeout)
+		err := tc.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			l.Debug().Err(err).Msg("TLS handshake failed")
+			return
+		}
+	}
+	conn := newConn(nc, l)
+	if err := conn.Prepare(); err != nil {
+		l.Debug().Err(err).Msg("RTMP setup failed")
+		return
+	}
+	fm := source{
+		FilterDemuxer: &pktque.FilterDemuxer{
+			Demuxer: conn,
+			Filter:  &DeJitter{},
+		},
+		conn: conn,
 	}
-	l := log.With().Str("rtmp_ip", remote).Str("kind", "rtmp").Logger()
 	ctx := l.WithContext(context.Background())
 	auth, err := s.CheckUser(conn.URL)
 	if err != nil {
 		l.Err(err).Stringer("rtmp_url", conn.URL).Msg("RTMP auth failed")
 		return
 	}
+	conn.authed = true
 	if err := s.Publish(ctx, auth, fm); err != nil {
 		l.Err(err).Stringer("rtmp_url", conn.URL).Msg("RTMP publish failed")
 	}
 }
+
+// source is a publisher's stream, along with the metadata it sends
+type source struct {
+	*pktque.FilterDemuxer
+	conn *Conn
+}
+
+func (s source) Encoder() model.EncoderInfo      { return s.conn.Encoder() }
+func (s source) SetCueHandler(f func(model.Cue)) { s.conn.SetCueHandler(f) }
@@ -1,6 +1,7 @@
 package ingest
 
 import (
+	"net/url"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -8,7 +9,9 @@ import (
 	"eaglesong.dev/gunk/ingest/whip"
 	"eaglesong.dev/gunk/internal/rtcengine"
 	"eaglesong.dev/gunk/model"
+	"eaglesong.dev/gunk/sinks/cues"
 	"eaglesong.dev/gunk/sinks/grabber"
+	"eaglesong.dev/gunk/sinks/llhls"
 	"eaglesong.dev/hls"
 	"github.com/nareix/joy4/av"
 	"github.com/nareix/joy4/av/pubsub"
@@ -22,12 +25,32 @@ type Manager struct {
 	OpusBitrate  int
 	PublishEvent PublishEvent
 	PublishMode  hls.Mode
+	LowLatency   bool // also publish LL-HLS for native players
 	WorkDir      string
 	RTCHost      string
 	RTCWindow    time.Duration
-
-	channels sync.Map
-	rtc      *rtcengine.Engine
+	// Changed is called when a channel's live state, viewers or playback
+	// options may have changed
+	Changed func(name string)
+	// switch to a standby publisher if the active one stalls for this long
+	FailoverTimeout time.Duration
+	// show the channel's slate for this long when its publisher drops
+	SlateGrace time.Duration
+	// without a slate, keep the channel live this long for the publisher to
+	// reconnect
+	ReconnectGrace time.Duration
+
+	// Origin makes this an edge node that pulls channels from another node
+	Origin        *url.URL
+	ClusterSecret string // authenticates requests between nodes
+	NodeID        string
+
+	channels    sync.Map
+	rtc         *rtcengine.Engine
+	edge        *edge
+	edgeReports sync.Map
+	pullMu      sync.Mutex
+	pullSources map[string]*pullSource
 }
 
 func (m *Manager) Initialize() error {
@@ -37,20 +60,29 @@ func (m *Manager) Initialize() error {
 		return err
 	}
 	m.rtc.ReceiveWindow = m.RTCWindow
+	if m.isEdge() {
+		m.edge = newEdge()
+		go m.runEdge()
+	}
 	return nil
 }
 
 type channel struct {
 	mu        sync.Mutex
 	ingest    *pubsub.Queue
-	aac, opus *pubsub.Queue
+	aac, opus *gopCache
 	web       *hls.Publisher
+	webCues   *cues.Injector // serves web with timed metadata added
+	ll        *llhls.Publisher
+	streams   []av.CodecData
+	sw        *switcher
 
-	whip   *whip.Receiver
-	whipID string
+	// WHIP sessions by ID
+	whips map[string]*whip.Receiver
 
 	stoppedAt time.Time
 	name      string
+	changed   func()
 
 	live, rtc uintptr
 	viewers   int32 // excluding web
@@ -66,22 +98,61 @@ func (m *Manager) channel(name string) *channel {
 	return nil
 }
 
+// getChannel returns the named channel, creating it if needed
+func (m *Manager) getChannel(name string) *channel {
+	if ch := m.channel(name); ch != nil {
+		return ch
+	}
+	ch := &channel{name: name}
+	if m.Changed != nil {
+		ch.changed = func() { m.Changed(name) }
+	}
+	v, _ := m.channels.LoadOrStore(name, ch)
+	return v.(*channel)
+}
+
+// notify reports a change in the channel's state
+func (ch *channel) notify() {
+	if ch.changed != nil {
+		ch.changed()
+	}
+}
+
 func (ch *channel) queue(opus bool) av.Demuxer {
 	if ch == nil {
 		return nil
 	}
 	ch.mu.Lock()
 	defer ch.mu.Unlock()
-	var q *pubsub.Queue
-	if opus {
-		q = ch.opus
-	} else {
-		q = ch.aac
+	g := ch.pubQueue(opus)
+	if g == nil {
+		return nil
 	}
-	if q == nil {
+	return g.cursor()
+}
+
+// rewind returns a reader for the channel that starts at the cached keyframe,
+// or nil if there isn't one
+func (ch *channel) rewind(opus bool) av.Demuxer {
+	if ch == nil {
 		return nil
 	}
-	return q.Latest()
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	g := ch.pubQueue(opus)
+	if g == nil {
+		return nil
+	}
+	return g.rewind()
+}
+
+// pubQueue returns the queue with the requested audio codec. The lock must be
+// held.
+func (ch *channel) pubQueue(opus bool) *gopCache {
+	if opus {
+		return ch.opus
+	}
+	return ch.aac
 }
 
 type liveState uintptr
@@ -104,6 +175,7 @@ func (ch *channel) addViewer(delta int32) {
 		return
 	}
 	atomic.AddInt32(&ch.viewers, delta)
+	ch.notify()
 }
 
 func (ch *channel) webViewed(host string) {
@@ -121,7 +193,9 @@ func (ch *channel) countWebViewers() {
 		}
 		return true
 	})
-	atomic.StoreInt32(&ch.webvTotal, views)
+	if atomic.SwapInt32(&ch.webvTotal, views) != views {
+		ch.notify()
+	}
 }
 
 func (ch *channel) getWeb() *hls.Publisher {
@@ -134,6 +208,27 @@ func (ch *channel) getWeb() *hls.Publisher {
 	return p
 }
 
+// getWebHandler returns the handler that serves the web stream
+func (ch *channel) getWebHandler() *cues.Injector {
+	if ch == nil {
+		return nil
+	}
+	ch.mu.Lock()
+	h := ch.webCues
+	ch.mu.Unlock()
+	return h
+}
+
+func (ch *channel) getLL() *llhls.Publisher {
+	if ch == nil {
+		return nil
+	}
+	ch.mu.Lock()
+	p := ch.ll
+	ch.mu.Unlock()
+	return p
+}
+
 func (ch *channel) currentViewers() int {
 	v := int(atomic.LoadInt32(&ch.viewers))
 	v += int(atomic.LoadInt32(&ch.webvTotal))
@@ -0,0 +1,192 @@
+package ingest
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+)
+
+const (
+	// forward jumps larger than this are spliced out
+	maxTimestampGap = 10 * time.Second
+	// backward jumps larger than this are spliced out, smaller ones are
+	// clamped
+	maxTimestampRewind = time.Second
+	// a backward jump within this distance of a wrap period is a wraparound
+	wrapWindow = time.Minute
+	// audio within this distance of its sample clock is snapped to it,
+	// beyond it the sample clock is resynced
+	maxAudioDrift = 50 * time.Millisecond
+	// audio further than this from the video timeline is moved back onto it
+	maxAVDrift = 2 * time.Second
+	// used to splice a track whose frame duration isn't known yet
+	defaultSpliceGap = time.Millisecond
+)
+
+// timestamp wrap periods of 32-bit milliseconds (RTMP) and 33-bit 90kHz
+// (MPEG-TS)
+var wrapPeriods = []time.Duration{
+	(1 << 32) * time.Millisecond,
+	(1 << 33) * time.Second / 90000,
+}
+
+var timestampCorrections = expvar.NewMap("timestamp_corrections")
+
+// Corrections counts the changes made by a Normalizer
+type Corrections struct {
+	Wraps        uint64 `json:"wraps"`
+	Jumps        uint64 `json:"jumps"`
+	Gaps         uint64 `json:"gaps"`
+	Reordered    uint64 `json:"reordered"`
+	AudioResyncs uint64 `json:"audio_resyncs"`
+	NegativeCTS  uint64 `json:"negative_cts"`
+}
+
+// Normalizer is a pktque.Filter that repairs the timestamps of an ingested
+// stream. Wraparounds are unwrapped, large jumps and gaps are spliced out so
+// that every track continues where it left off, DTS is kept monotonic per
+// track, audio follows its sample clock and stays near the video timeline, and
+// decode times are moved earlier so that composition times are never
+// negative.
+type Normalizer struct {
+	tracks  []trackTimes
+	offset  time.Duration // added to every track after splicing
+	last    time.Duration // latest DTS output on any track
+	started bool
+
+	mu          sync.Mutex
+	corrections Corrections
+}
+
+type trackTimes struct {
+	started bool
+	prevRaw time.Duration
+	wrap    time.Duration
+	last    time.Duration
+	gap     time.Duration // duration of the previous packet
+	// subtracted from DTS and added to CTS so that CTS is never negative
+	ctsShift time.Duration
+	// added to an audio track to keep it on the video timeline
+	adjust time.Duration
+}
+
+// Corrections returns the number of changes made so far
+func (n *Normalizer) Corrections() Corrections {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.corrections
+}
+
+func (n *Normalizer) count(counter *uint64, name string) {
+	n.mu.Lock()
+	*counter++
+	n.mu.Unlock()
+	timestampCorrections.Add(name, 1)
+}
+
+func (n *Normalizer) ModifyPacket(pkt *av.Packet, streams []av.CodecData, videoidx int, audioidx int) (drop bool, err error) {
+	idx := int(pkt.Idx)
+	if idx >= len(streams) {
+		return
+	}
+	if len(n.tracks) < len(streams) {
+		n.tracks = append(n.tracks, make([]trackTimes, len(streams)-len(n.tracks))...)
+	}
+	tr := &n.tracks[idx]
+	if pkt.CompositionTime < -tr.ctsShift {
+		tr.ctsShift = -pkt.CompositionTime
+		n.count(&n.corrections.NegativeCTS, "negative_cts")
+	}
+	pkt.CompositionTime += tr.ctsShift
+	acd, isAudio := streams[idx].(av.AudioCodecData)
+	var vt *trackTimes
+	if videoidx >= 0 && videoidx < len(n.tracks) && videoidx != idx && n.tracks[videoidx].started {
+		vt = &n.tracks[videoidx]
+	}
+	// unwrap
+	raw := pkt.Time
+	if tr.started {
+		back := tr.prevRaw - raw
+		for _, period := range wrapPeriods {
+			if back > period-wrapWindow && back < period+wrapWindow {
+				tr.wrap += period
+				n.count(&n.corrections.Wraps, "wraps")
+				break
+			}
+		}
+	}
+	tr.prevRaw = raw
+	t := raw + tr.wrap + n.offset + tr.adjust - tr.ctsShift
+	// splice out jumps
+	gap := tr.gap
+	if gap <= 0 {
+		gap = defaultSpliceGap
+	}
+	switch {
+	case !n.started:
+	case isAudio && vt != nil:
+		// audio follows the video timeline instead of splicing it
+		if d := t - vt.last; d < -maxAVDrift || d > maxAVDrift {
+			n.count(&n.corrections.AudioResyncs, "audio_resyncs")
+			target := vt.last
+			if next := tr.last + tr.gap; tr.started && next > vt.last-maxAVDrift && next < vt.last+maxAVDrift {
+				// carry on from the previous packet if it was in sync
+				target = next
+			}
+			tr.adjust += target - t
+			t = target
+		}
+	case tr.started && t < tr.last-maxTimestampRewind:
+		n.count(&n.corrections.Jumps, "jumps")
+		n.splice(&t, gap)
+	case t > n.last+maxTimestampGap:
+		n.count(&n.corrections.Gaps, "gaps")
+		n.splice(&t, gap)
+	}
+	// keep audio on its sample clock
+	var duration time.Duration
+	if isAudio {
+		duration, _ = acd.PacketDuration(pkt.Data)
+		if expected := tr.last + tr.gap; tr.started && tr.gap > 0 {
+			if diff := t - expected; diff < -maxAudioDrift || diff > maxAudioDrift {
+				n.count(&n.corrections.AudioResyncs, "audio_resyncs")
+			} else {
+				t = expected
+			}
+		}
+	}
+	// keep DTS monotonic, and PTS where the composition time allows
+	if tr.started && t <= tr.last {
+		n.count(&n.corrections.Reordered, "reordered")
+		pts := t + pkt.CompositionTime
+		t = tr.last + time.Millisecond
+		pkt.CompositionTime = max(0, pts-t)
+	}
+	if duration > 0 {
+		tr.gap = duration
+	} else if tr.started {
+		tr.gap = t - tr.last
+	}
+	tr.started = true
+	tr.last = t
+	n.started = true
+	// audio held on the video timeline doesn't move it
+	if t > n.last && tr.adjust == 0 {
+		n.last = t
+	}
+	pkt.Time = t
+	return
+}
+
+// splice moves the timeline so that t continues just after the latest packet.
+// The splice covers any jump that audio was adjusted for on its own.
+func (n *Normalizer) splice(t *time.Duration, gap time.Duration) {
+	target := n.last + gap
+	n.offset += target - *t
+	*t = target
+	for i := range n.tracks {
+		n.tracks[i].adjust = 0
+	}
+}
@@ -0,0 +1,243 @@
+package ingest
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testVideo struct{}
+
+func (testVideo) Type() av.CodecType { return av.H264 }
+
+// testAudio has packets of 20ms
+type testAudio struct{}
+
+func (testAudio) Type() av.CodecType                           { return av.AAC }
+func (testAudio) SampleFormat() av.SampleFormat                { return av.FLTP }
+func (testAudio) SampleRate() int                              { return 48000 }
+func (testAudio) ChannelLayout() av.ChannelLayout              { return av.CH_STEREO }
+func (testAudio) PacketDuration([]byte) (time.Duration, error) { return 20 * time.Millisecond, nil }
+
+func video(t time.Duration) av.Packet { return av.Packet{Idx: 0, Time: t} }
+func audio(t time.Duration) av.Packet { return av.Packet{Idx: 1, Time: t} }
+
+func ms(n int64) time.Duration { return time.Duration(n) * time.Millisecond }
+
+func withCTS(pkt av.Packet, cts time.Duration) av.Packet {
+	pkt.CompositionTime = cts
+	return pkt
+}
+
+func TestNormalizer(t *testing.T) {
+	rtmpWrap := (1 << 32) * time.Millisecond
+	tsWrap := (1 << 33) * time.Second / 90000
+	cases := []struct {
+		name        string
+		in, want    []av.Packet
+		corrections Corrections
+	}{
+		{
+			name: "clean",
+			in:   []av.Packet{video(0), audio(0), audio(ms(20)), video(ms(40)), audio(ms(40)), audio(ms(60)), video(ms(80))},
+			want: []av.Packet{video(0), audio(0), audio(ms(20)), video(ms(40)), audio(ms(40)), audio(ms(60)), video(ms(80))},
+		},
+		{
+			name:        "encoder restart",
+			in:          []av.Packet{video(ms(5000)), video(ms(5040)), video(ms(5080)), video(0), video(ms(40))},
+			want:        []av.Packet{video(ms(5000)), video(ms(5040)), video(ms(5080)), video(ms(5120)), video(ms(5160))},
+			corrections: Corrections{Jumps: 1},
+		},
+		{
+			name:        "gap",
+			in:          []av.Packet{video(0), video(ms(40)), video(time.Hour), video(time.Hour + ms(40))},
+			want:        []av.Packet{video(0), video(ms(40)), video(ms(80)), video(ms(120))},
+			corrections: Corrections{Gaps: 1},
+		},
+		{
+			name:        "rtmp wrap",
+			in:          []av.Packet{video(rtmpWrap - ms(80)), video(rtmpWrap - ms(40)), video(0), video(ms(40))},
+			want:        []av.Packet{video(rtmpWrap - ms(80)), video(rtmpWrap - ms(40)), video(rtmpWrap), video(rtmpWrap + ms(40))},
+			corrections: Corrections{Wraps: 1},
+		},
+		{
+			name:        "mpegts wrap",
+			in:          []av.Packet{video(tsWrap - ms(80)), video(tsWrap - ms(40)), video(0), video(ms(40))},
+			want:        []av.Packet{video(tsWrap - ms(80)), video(tsWrap - ms(40)), video(tsWrap), video(tsWrap + ms(40))},
+			corrections: Corrections{Wraps: 1},
+		},
+		{
+			name:        "wrap on each track",
+			in:          []av.Packet{video(rtmpWrap - ms(40)), audio(rtmpWrap - ms(20)), audio(0), video(0), audio(ms(20))},
+			want:        []av.Packet{video(rtmpWrap - ms(40)), audio(rtmpWrap - ms(20)), audio(rtmpWrap), video(rtmpWrap), audio(rtmpWrap + ms(20))},
+			corrections: Corrections{Wraps: 2},
+		},
+		{
+			name: "audio jitter",
+			in:   []av.Packet{audio(0), audio(ms(22)), audio(ms(38)), audio(ms(61)), audio(ms(80))},
+			want: []av.Packet{audio(0), audio(ms(20)), audio(ms(40)), audio(ms(60)), audio(ms(80))},
+		},
+		{
+			name:        "audio drift",
+			in:          []av.Packet{audio(0), audio(ms(20)), audio(ms(40)), audio(ms(140)), audio(ms(160))},
+			want:        []av.Packet{audio(0), audio(ms(20)), audio(ms(40)), audio(ms(140)), audio(ms(160))},
+			corrections: Corrections{AudioResyncs: 1},
+		},
+		{
+			name:        "negative cts",
+			in:          []av.Packet{withCTS(video(ms(80)), ms(-80)), withCTS(video(ms(120)), ms(40)), withCTS(video(ms(160)), ms(-80)), withCTS(video(ms(200)), ms(-80))},
+			want:        []av.Packet{video(0), withCTS(video(ms(40)), ms(120)), video(ms(80)), video(ms(120))},
+			corrections: Corrections{NegativeCTS: 1},
+		},
+		{
+			name:        "negative cts mid-stream",
+			in:          []av.Packet{video(0), video(ms(40)), withCTS(video(ms(80)), ms(-40)), withCTS(video(ms(120)), ms(-40))},
+			want:        []av.Packet{video(0), video(ms(40)), video(ms(41)), video(ms(80))},
+			corrections: Corrections{NegativeCTS: 1, Reordered: 1},
+		},
+		{
+			name:        "audio jumps away from video",
+			in:          []av.Packet{video(0), audio(0), audio(ms(20)), video(ms(40)), audio(ms(5040)), audio(ms(5060)), video(ms(80))},
+			want:        []av.Packet{video(0), audio(0), audio(ms(20)), video(ms(40)), audio(ms(40)), audio(ms(60)), video(ms(80))},
+			corrections: Corrections{AudioResyncs: 1},
+		},
+		{
+			name:        "audio restarts before video",
+			in:          []av.Packet{video(ms(5000)), audio(ms(5000)), audio(ms(5020)), video(ms(5040)), audio(0), audio(ms(20)), video(0), audio(ms(40)), video(ms(40))},
+			want:        []av.Packet{video(ms(5000)), audio(ms(5000)), audio(ms(5020)), video(ms(5040)), audio(ms(5040)), audio(ms(5060)), video(ms(5080)), audio(ms(5080)), video(ms(5120))},
+			corrections: Corrections{AudioResyncs: 1, Jumps: 1},
+		},
+		{
+			name:        "duplicate dts",
+			in:          []av.Packet{video(0), video(ms(40)), video(ms(40)), video(ms(80))},
+			want:        []av.Packet{video(0), video(ms(40)), video(ms(41)), video(ms(80))},
+			corrections: Corrections{Reordered: 1},
+		},
+		{
+			name:        "small rewind",
+			in:          []av.Packet{video(0), video(ms(40)), video(ms(80)), video(ms(60)), video(ms(120))},
+			want:        []av.Packet{video(0), video(ms(40)), video(ms(80)), video(ms(81)), video(ms(120))},
+			corrections: Corrections{Reordered: 1},
+		},
+	}
+	streams := []av.CodecData{testVideo{}, testAudio{}}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			n := new(Normalizer)
+			var got []av.Packet
+			for _, pkt := range c.in {
+				drop, err := n.ModifyPacket(&pkt, streams, 0, 1)
+				assert.NoError(t, err)
+				assert.False(t, drop)
+				got = append(got, pkt)
+			}
+			assert.Equal(t, c.want, got)
+			assert.Equal(t, c.corrections, n.Corrections())
+		})
+	}
+}
+
+// aacAudio has packets of 1024 samples at 44.1kHz
+type aacAudio struct{ testAudio }
+
+func (aacAudio) SampleRate() int { return 44100 }
+func (aacAudio) PacketDuration([]byte) (time.Duration, error) {
+	return 1024 * time.Second / 44100, nil
+}
+
+// readTrace reads packet timings from testdata. Each line has the kind of
+// packet, v or a, its DTS in milliseconds and for video its composition time.
+// The traces are synthetic, modelled on the failures seen from publishers
+// rather than captured from them.
+func readTrace(t *testing.T, name string) []av.Packet {
+	f, err := os.Open(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	defer f.Close()
+	var pkts []av.Packet
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		var nums []int64
+		for _, field := range fields[1:] {
+			n, err := strconv.ParseInt(field, 10, 64)
+			require.NoError(t, err)
+			nums = append(nums, n)
+		}
+		switch fields[0] {
+		case "v":
+			require.Len(t, nums, 2)
+			pkts = append(pkts, withCTS(video(ms(nums[0])), ms(nums[1])))
+		case "a":
+			require.Len(t, nums, 1)
+			pkts = append(pkts, audio(ms(nums[0])))
+		default:
+			t.Fatalf("unknown packet kind %q", fields[0])
+		}
+	}
+	require.NoError(t, scanner.Err())
+	return pkts
+}
+
+func TestNormalizerTraces(t *testing.T) {
+	cases := []struct {
+		file        string
+		duration    time.Duration // of the video output, within a frame
+		corrections Corrections
+	}{
+		{
+			file:        "wrap.txt",
+			duration:    ms(3967),
+			corrections: Corrections{Wraps: 2},
+		},
+		{
+			file:        "restart.txt",
+			duration:    ms(5000),
+			corrections: Corrections{Jumps: 1, AudioResyncs: 1},
+		},
+		{
+			file:        "drift.txt",
+			duration:    ms(9967),
+			corrections: Corrections{AudioResyncs: 2},
+		},
+	}
+	streams := []av.CodecData{testVideo{}, aacAudio{}}
+	for _, c := range cases {
+		t.Run(c.file, func(t *testing.T) {
+			n := new(Normalizer)
+			var first, last [2]*av.Packet
+			for _, pkt := range readTrace(t, c.file) {
+				pkt := pkt
+				cts := pkt.CompositionTime
+				drop, err := n.ModifyPacket(&pkt, streams, 0, 1)
+				require.NoError(t, err)
+				require.False(t, drop)
+				if prev := last[pkt.Idx]; prev != nil {
+					step := pkt.Time - prev.Time
+					require.Positive(t, step, "DTS must increase at %s", prev.Time)
+					require.LessOrEqual(t, step, maxTimestampRewind, "gap after %s", prev.Time)
+				} else {
+					first[pkt.Idx] = &pkt
+				}
+				if pkt.Idx == 0 {
+					assert.Equal(t, cts, pkt.CompositionTime, "composition time at %s", pkt.Time)
+				} else if v := last[0]; v != nil {
+					assert.InDelta(t, v.Time, pkt.Time, float64(maxAVDrift), "audio at %s is away from video at %s", pkt.Time, v.Time)
+				}
+				last[pkt.Idx] = &pkt
+			}
+			assert.InDelta(t, c.duration, last[0].Time-first[0].Time, float64(ms(34)))
+			assert.Equal(t, c.corrections, n.Corrections())
+		})
+	}
+}
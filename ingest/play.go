@@ -6,9 +6,16 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"path"
+	"strings"
 	"sync/atomic"
+	"time"
 
+	"eaglesong.dev/gunk/codec"
+	"eaglesong.dev/gunk/internal"
+	"eaglesong.dev/gunk/internal/fmp4"
 	"eaglesong.dev/gunk/model"
+	"eaglesong.dev/gunk/sinks/llhls"
 	"eaglesong.dev/gunk/sinks/playrtc"
 	"eaglesong.dev/hls"
 	"github.com/nareix/joy4/av"
@@ -19,7 +26,7 @@ import (
 var ErrNoChannel = errors.New("channel not found")
 
 func (m *Manager) ServeTS(rw http.ResponseWriter, req *http.Request, name string) error {
-	ch := m.channel(name)
+	ch := m.viewChannel(req.Context(), name)
 	src := ch.queue(false)
 	if src == nil {
 		return ErrNoChannel
@@ -28,29 +35,37 @@ func (m *Manager) ServeTS(rw http.ResponseWriter, req *http.Request, name string
 	rw.Header().Set("Transfer-Encoding", "chunked")
 	muxer := ts.NewMuxer(rw)
 	streams, _ := src.Streams()
-	muxer.WriteHeader(streams)
+	if err := muxer.WriteHeader(streams); err != nil {
+		return err
+	}
 	ch.addViewer(1)
 	defer ch.addViewer(-1)
-	return copyStream(req.Context(), muxer, src)
+	return copyStream(req.Context(), muxer, src, "ts")
 }
 
 func (m *Manager) ServeMP4(rw http.ResponseWriter, req *http.Request, name string) error {
-	ch := m.channel(name)
-	p := ch.getWeb()
-	if p == nil {
+	ch := m.viewChannel(req.Context(), name)
+	src := ch.queue(false)
+	if src == nil {
 		return ErrNoChannel
 	}
+	rw.Header().Set("Content-Type", "video/mp4")
+	rw.Header().Set("Transfer-Encoding", "chunked")
+	muxer := fmp4.NewMuxer(rw)
+	streams, _ := src.Streams()
+	if err := muxer.WriteHeader(streams); err != nil {
+		return err
+	}
 	ch.addViewer(1)
 	defer ch.addViewer(-1)
-	p.Tail(rw, req)
-	return nil
+	return copyStream(req.Context(), muxer, src, "mp4")
 }
 
 func (m *Manager) ServeWeb(rw http.ResponseWriter, req *http.Request, name string) error {
 	if req.Header.Get("Origin") != "" {
 		rw.Header().Set("Access-Control-Allow-Origin", "*")
 	}
-	ch := m.channel(name)
+	ch := m.viewChannel(req.Context(), name)
 	if ch == nil {
 		return ErrNoChannel
 	}
@@ -61,16 +76,24 @@ func (m *Manager) ServeWeb(rw http.ResponseWriter, req *http.Request, name strin
 	if host != "" {
 		ch.webViewed(host)
 	}
-	p := ch.getWeb()
-	if p == nil {
+	if strings.HasPrefix(path.Base(req.URL.Path), llhls.Prefix) {
+		ll := ch.getLL()
+		if ll == nil {
+			return ErrNoChannel
+		}
+		ll.ServeHTTP(rw, req)
+		return nil
+	}
+	h := ch.getWebHandler()
+	if h == nil {
 		return ErrNoChannel
 	}
-	p.ServeHTTP(rw, req)
+	h.ServeHTTP(rw, req)
 	return nil
 }
 
 func (m *Manager) OfferSDP(ctx context.Context, name string, sendCandidate playrtc.CandidateSender) (*playrtc.Sender, error) {
-	ch := m.channel(name)
+	ch := m.viewChannel(ctx, name)
 	if ch == nil {
 		return nil, ErrNoChannel
 	}
@@ -81,35 +104,134 @@ func (m *Manager) OfferSDP(ctx context.Context, name string, sendCandidate playr
 	addViewer := func(delta int) { ch.addViewer(int32(delta)) }
 	l := zerolog.Ctx(ctx).With().Str("channel", name).Logger()
 	ctx = l.WithContext(ctx)
-	return playrtc.OfferToSend(ctx, m.rtc, src, addViewer, sendCandidate)
+	rewind := func() av.Demuxer { return ch.rewind(true) }
+	return playrtc.OfferToSend(ctx, m.rtc, src, rewind, ch.layers(), addViewer, sendCandidate)
+}
+
+// layers returns the video layers of the active WHIP publisher so that viewers
+// can switch between them and ask for keyframes. Other sources have none.
+func (ch *channel) layers() []playrtc.Layer {
+	ch.mu.Lock()
+	sw := ch.sw
+	ch.mu.Unlock()
+	if sw == nil {
+		return nil
+	}
+	recv := sw.activeWHIP()
+	if recv == nil {
+		return nil
+	}
+	if len(recv.Layers()) == 0 {
+		// not simulcast
+		return []playrtc.Layer{{RequestKeyframe: func() { recv.RequestKeyframe("") }}}
+	}
+	var layers []playrtc.Layer
+	for _, l := range recv.Layers() {
+		rid := l.RID
+		layer := playrtc.Layer{
+			Name:            rid,
+			RequestKeyframe: func() { recv.RequestKeyframe(rid) },
+		}
+		if !l.Primary {
+			layer.Src = l.Queue.Latest()
+		}
+		layers = append(layers, layer)
+	}
+	return layers
 }
 
 func (m *Manager) PopulateLive(infos []*model.ChannelInfo) {
 	for _, info := range infos {
 		ch := m.channel(info.Name)
-		if ch == nil {
+		if m.isEdge() && m.populateOrigin(info, ch) {
 			continue
 		}
-		switch ch.isLive() {
-		case statePending:
-			info.Pending = true
-		case stateLive:
-			info.Live = true
+		if ch != nil {
+			m.populateLocal(info, ch)
 		}
-		info.Viewers = ch.currentViewers()
+	}
+}
+
+// populateLocal fills in the state of a channel on this node
+func (m *Manager) populateLocal(info *model.ChannelInfo, ch *channel) {
+	switch ch.isLive() {
+	case statePending:
+		info.Pending = true
+	case stateLive:
+		info.Live = true
+	}
+	info.Viewers = m.totalViewers(ch)
+	ch.mu.Lock()
+	streams := ch.streams
+	ch.mu.Unlock()
+	info.Codec = videoCodec(streams)
+	native := nativeHLS(streams)
+	if p := ch.getWeb(); p != nil {
 		if m.PublishMode == hls.ModeSingleTrack {
 			// HLS only
-			info.WebURL = ch.getWeb().Playlist()
+			if native {
+				info.WebURL = p.Playlist()
+			}
 		} else {
 			// Prefer DASH
-			info.WebURL = ch.getWeb().MPD()
+			info.WebURL = p.MPD()
+			info.Modes = append(info.Modes, model.PlaybackDASH)
+		}
+		if native {
+			info.NativeURL = p.Playlist()
+			if ll := ch.getLL(); ll != nil {
+				info.NativeURL = ll.Playlist()
+			}
+			info.Modes = append(info.Modes, model.PlaybackHLS)
+		}
+	}
+	info.RTC = atomic.LoadUintptr(&ch.rtc) != 0
+	if info.RTC {
+		info.Modes = append(info.Modes, model.PlaybackRTC)
+	}
+	if len(streams) != 0 && tsSupported(streams) {
+		info.Modes = append(info.Modes, model.PlaybackTS)
+	}
+}
+
+// videoCodec returns the name of the first video codec in streams
+func videoCodec(streams []av.CodecData) string {
+	for _, cd := range streams {
+		if cd.Type().IsVideo() {
+			return codec.Name(cd.Type())
 		}
-		info.NativeURL = ch.getWeb().Playlist()
-		info.RTC = atomic.LoadUintptr(&ch.rtc) != 0
 	}
+	return ""
 }
 
-func copyStream(ctx context.Context, dest av.Muxer, src av.Demuxer) error {
+// nativeHLS returns true if the video codec can be played by native HLS
+// players. VP8 and VP9 are only playable through DASH.
+func nativeHLS(streams []av.CodecData) bool {
+	for _, cd := range streams {
+		switch cd.Type() {
+		case codec.VP8, codec.VP9:
+			return false
+		}
+	}
+	return true
+}
+
+// tsSupported returns true if the stream can be muxed to MPEG-TS by ServeTS
+func tsSupported(streams []av.CodecData) bool {
+	for _, cd := range streams {
+		switch cd.Type() {
+		case av.H264, av.AAC:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// copyStream sends src to a viewer of output until either goes away
+func copyStream(ctx context.Context, dest av.Muxer, src av.Demuxer, output string) error {
+	started := time.Now()
+	waiting := true
 	for ctx.Err() == nil {
 		pkt, err := src.ReadPacket()
 		if err == io.EOF || ctx.Err() != nil {
@@ -120,6 +242,10 @@ func copyStream(ctx context.Context, dest av.Muxer, src av.Demuxer) error {
 		if err := dest.WritePacket(pkt); err != nil {
 			return err
 		}
+		if waiting && pkt.IsKeyFrame {
+			waiting = false
+			internal.FirstFrame(output, time.Since(started))
+		}
 	}
 	return nil
 }
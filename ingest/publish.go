@@ -2,17 +2,23 @@ package ingest
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"sync/atomic"
 	"time"
 
+	"eaglesong.dev/gunk/codec"
 	"eaglesong.dev/gunk/internal"
 	"eaglesong.dev/gunk/model"
+	"eaglesong.dev/gunk/sinks/cues"
 	"eaglesong.dev/gunk/sinks/grabber"
+	"eaglesong.dev/gunk/sinks/llhls"
+	"eaglesong.dev/gunk/sinks/playrtc"
 	"eaglesong.dev/gunk/transcode/opus"
 	"eaglesong.dev/hls"
 	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/av/pktque"
 	"github.com/nareix/joy4/av/pubsub"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -22,6 +28,12 @@ import (
 const webExpiry = 60 * time.Second
 
 func (m *Manager) Publish(ctx context.Context, auth model.ChannelAuth, src av.Demuxer) error {
+	return m.publish(ctx, auth, src, false)
+}
+
+// publish makes src live on this node, either starting a new session or
+// joining the current one as another input. It returns when src ends.
+func (m *Manager) publish(ctx context.Context, auth model.ChannelAuth, src av.Demuxer, relayed bool) error {
 	name := auth.Name
 	l := zerolog.Ctx(ctx)
 	l.UpdateContext(func(c zerolog.Context) zerolog.Context {
@@ -35,12 +47,50 @@ func (m *Manager) Publish(ctx context.Context, auth model.ChannelAuth, src av.De
 	}
 	// log stream configuration
 	for i, cd := range streams {
-		ev := l.Debug().Int("idx", i).Stringer("codec", cd.Type())
+		ev := l.Debug().Int("idx", i).Str("codec", codec.Name(cd.Type()))
 		if ev.Enabled() {
 			internal.CodecTag(cd, ev)
 			ev.Send()
 		}
 	}
+	ch := m.getChannel(name)
+	norm := new(Normalizer)
+	in := newInput(&pktque.FilterDemuxer{Demuxer: src, Filter: norm}, auth.Backup)
+	in.norm = norm
+	meta, _ := src.(metadataSource)
+	in.meta = meta
+	if ws, ok := src.(*whipSource); ok {
+		in.whip = ws.recv
+	}
+	sw, joined, err := ch.attach(in, streams, m.FailoverTimeout, m.ReconnectGrace, *l)
+	if err != nil {
+		return err
+	}
+	if meta != nil {
+		meta.SetCueHandler(func(c model.Cue) { sw.cue(in, c) })
+	}
+	if joined {
+		if auth.Backup {
+			l.Info().Msg("standing by as backup publisher")
+		} else {
+			l.Info().Msg("taking over as primary publisher")
+		}
+	} else {
+		go func() { sw.finish(m.runSession(l, auth, ch, sw, relayed)) }()
+	}
+	<-in.done
+	if c := norm.Corrections(); c != (Corrections{}) {
+		l.Info().Interface("corrections", c).Msg("repaired ingest timestamps")
+	}
+	return in.err
+}
+
+// runSession publishes a channel until all of its publishers are gone. A
+// relayed stream is pulled from the origin, which already announces it and
+// grabs thumbnails.
+func (m *Manager) runSession(l *zerolog.Logger, auth model.ChannelAuth, ch *channel, src *switcher, relayed bool) error {
+	name := auth.Name
+	streams := src.streams
 	q := pubsub.NewQueue()
 	q.WriteHeader(streams)
 	eg, ctx := errgroup.WithContext(context.Background())
@@ -49,9 +99,19 @@ func (m *Manager) Publish(ctx context.Context, auth model.ChannelAuth, src av.De
 		q.Close()
 	}()
 	// grab keyframes for thumbnail
-	grabch, err := grabber.Grab(name, q.Oldest())
-	if err != nil {
-		return fmt.Errorf("setting up frame grabber: %w", err)
+	var grabch <-chan grabber.Result
+	var err error
+	if !relayed {
+		grabch, err = grabber.Grab(name, q.Oldest())
+		if errors.Is(err, grabber.ErrUnsupported) {
+			l.Warn().Err(err).Msg("thumbnails are not available for this stream")
+		} else if err != nil {
+			return fmt.Errorf("setting up frame grabber: %w", err)
+		}
+	}
+	publishEvent := m.PublishEvent
+	if relayed {
+		publishEvent = nil
 	}
 	aacq := q
 	opusq := q
@@ -61,50 +121,74 @@ func (m *Manager) Publish(ctx context.Context, auth model.ChannelAuth, src av.De
 		opusq = convertOpus(eg, q, m.OpusBitrate)
 	}
 
+	if !relayed && m.SlateGrace > 0 {
+		go m.loadSlate(l, name, src)
+	}
 	// go live
-	v, _ := m.channels.LoadOrStore(name, new(channel))
-	ch := v.(*channel)
-	ch.name = name
-	p := ch.setStream(q, aacq, opusq, m.WorkDir, m.PublishMode)
+	p, ll := ch.setStream(q, aacq, opusq, src, m.WorkDir, m.PublishMode, m.LowLatency)
+	webCues := ch.getWebHandler()
+	webCues.SetStreams(streams)
+	src.onCue = func(c model.Cue) {
+		writeCue(webCues, c)
+		if ll != nil {
+			writeCue(ll, c)
+		}
+	}
+	if ll != nil {
+		// timestamps are rebased, but the encoder may have changed
+		src.onSwitch = ll.Discontinuity
+	}
 	defer func() {
 		l.Info().Msg("stopped publishing")
-		if ch.stopStream(q) && m.PublishEvent != nil {
-			m.PublishEvent(auth, false, grabber.Result{})
+		if ch.stopStream(q) && publishEvent != nil {
+			publishEvent(auth, false, grabber.Result{})
 		}
 	}()
 	// announce
 	l.Info().Msg("started publishing")
-	if m.PublishEvent != nil {
-		m.PublishEvent(auth, true, grabber.Result{})
+	if publishEvent != nil {
+		publishEvent(auth, true, grabber.Result{})
 	}
 	// start outputs
 	eg.Go(func() error {
-		err := ch.copyWeb(p, q.Latest())
+		err := ch.copyWeb(p, ll, q.Latest())
 		if err != nil {
 			err = fmt.Errorf("web publish: %w", err)
 		}
 		return err
 	})
-	eg.Go(func() error {
-		// notify ws clients when thumbnail is updated
-		for thumb := range grabch {
-			ch.countWebViewers()
-			if m.PublishEvent != nil {
-				m.PublishEvent(auth, true, thumb)
-			}
-			if thumb.HasBframes {
-				atomic.StoreUintptr(&ch.rtc, 0)
-			} else {
-				atomic.StoreUintptr(&ch.rtc, 1)
-			}
-		}
-		return nil
-	})
+	if grabch != nil {
+		rtcOK := playrtc.CanSend(streams)
+		eg.Go(func() error {
+			ch.watchThumbs(auth, grabch, rtcOK, publishEvent)
+			return nil
+		})
+	} else if !relayed && playrtc.CanSend(streams) {
+		// no thumbnails to check for B-frames, the codec doesn't use them
+		atomic.StoreUintptr(&ch.rtc, 1)
+	}
 	// copy
 	eg.Go(func() error { return ch.copyStream(ctx, q, src) })
 	return eg.Wait()
 }
 
+// notify ws clients when thumbnail is updated
+func (ch *channel) watchThumbs(auth model.ChannelAuth, grabch <-chan grabber.Result, rtcOK bool, publishEvent PublishEvent) {
+	for thumb := range grabch {
+		ch.countWebViewers()
+		if publishEvent != nil {
+			publishEvent(auth, true, thumb)
+		}
+		var rtc uintptr
+		if rtcOK && !thumb.HasBframes {
+			rtc = 1
+		}
+		if atomic.SwapUintptr(&ch.rtc, rtc) != rtc {
+			ch.notify()
+		}
+	}
+}
+
 func (m *Manager) Cleanup() {
 	m.channels.Range(func(k, v interface{}) bool {
 		v.(*channel).cleanup()
@@ -112,15 +196,23 @@ func (m *Manager) Cleanup() {
 	})
 }
 
-func (ch *channel) setStream(q, aacq, opusq *pubsub.Queue, workDir string, mode hls.Mode) *hls.Publisher {
+func (ch *channel) setStream(q, aacq, opusq *pubsub.Queue, sw *switcher, workDir string, mode hls.Mode, lowLatency bool) (*hls.Publisher, *llhls.Publisher) {
 	ch.mu.Lock()
 	defer ch.mu.Unlock()
 	if ch.ingest != nil {
 		ch.ingest.Close()
 	}
+	if ch.sw != nil && ch.sw != sw {
+		ch.sw.finish(errReplaced)
+	}
+	ch.sw = sw
 	ch.ingest = q
-	ch.aac = aacq
-	ch.opus = opusq
+	ch.aac = newGOPCache(aacq)
+	ch.opus = ch.aac
+	if opusq != aacq {
+		ch.opus = newGOPCache(opusq)
+	}
+	ch.streams = nil
 	if ch.web != nil {
 		ch.web.Close()
 	}
@@ -128,9 +220,19 @@ func (ch *channel) setStream(q, aacq, opusq *pubsub.Queue, workDir string, mode
 		WorkDir: workDir,
 		Mode:    mode,
 	}
+	ch.webCues = &cues.Injector{Handler: ch.web}
+	if ch.ll != nil {
+		ch.ll.Close()
+		ch.ll = nil
+	}
+	if lowLatency {
+		ch.ll = new(llhls.Publisher)
+	}
 	ch.stoppedAt = time.Time{}
 	atomic.StoreUintptr(&ch.live, uintptr(statePending))
-	return ch.web
+	atomic.StoreUintptr(&ch.rtc, 0)
+	ch.notify()
+	return ch.web, ch.ll
 }
 
 func (ch *channel) stopStream(q *pubsub.Queue) bool {
@@ -144,6 +246,7 @@ func (ch *channel) stopStream(q *pubsub.Queue) bool {
 	ch.aac = nil
 	ch.opus = nil
 	ch.stoppedAt = time.Now()
+	ch.notify()
 	return true
 }
 
@@ -165,16 +268,44 @@ func (ch *channel) copyStream(ctx context.Context, dest *pubsub.Queue, src av.De
 	}
 }
 
-func (ch *channel) copyWeb(dest av.Muxer, src av.Demuxer) error {
+func (ch *channel) copyWeb(p *hls.Publisher, ll *llhls.Publisher, src av.Demuxer) error {
+	var dest av.Muxer = p
 	var streams []av.CodecData
 	var err error
 	if streams, err = src.Streams(); err != nil {
 		return err
 	}
+	ch.mu.Lock()
+	ch.streams = streams
+	ch.mu.Unlock()
+	ch.notify()
 	if err = dest.WriteHeader(streams); err != nil {
-		return err
+		// keep the ingest running for the other outputs
+		log.Warn().Err(err).Str("channel", ch.name).Msg("web playback is not available for this stream")
+		dest = nil
+		ch.mu.Lock()
+		if ch.web == p {
+			ch.web.Close()
+			ch.web = nil
+			ch.webCues = nil
+		}
+		ch.mu.Unlock()
+	}
+	if ll != nil {
+		if err := ll.WriteHeader(streams); err != nil {
+			log.Warn().Err(err).Str("channel", ch.name).Msg("LL-HLS is not available for this stream")
+			ch.mu.Lock()
+			if ch.ll == ll {
+				ch.ll.Close()
+				ch.ll = nil
+			}
+			ch.mu.Unlock()
+			ll = nil
+		}
 	}
-	needKeys := 3
+	// viewers start from the cached keyframe, so wait only until the first
+	// segment is complete
+	needKeys := 2
 	log.Info().Str("channel", ch.name).Msgf("live in %d", needKeys)
 	for {
 		pkt, err := src.ReadPacket()
@@ -183,8 +314,15 @@ func (ch *channel) copyWeb(dest av.Muxer, src av.Demuxer) error {
 		} else if err != nil {
 			return err
 		}
-		if err := dest.WritePacket(pkt); err != nil {
-			return err
+		if dest != nil {
+			if err := dest.WritePacket(pkt); err != nil {
+				return err
+			}
+		}
+		if ll != nil {
+			if err := ll.WritePacket(pkt); err != nil {
+				return err
+			}
 		}
 		if pkt.IsKeyFrame && needKeys > 0 {
 			needKeys--
@@ -192,6 +330,7 @@ func (ch *channel) copyWeb(dest av.Muxer, src av.Demuxer) error {
 			if needKeys == 0 {
 				ev.Msgf("going live")
 				atomic.StoreUintptr(&ch.live, uintptr(stateLive))
+				ch.notify()
 			} else {
 				ev.Msgf("live in %d", needKeys)
 			}
@@ -204,6 +343,11 @@ func (ch *channel) cleanup() {
 	if ch.web != nil && !ch.stoppedAt.IsZero() && time.Since(ch.stoppedAt) > webExpiry {
 		ch.web.Close()
 		ch.web = nil
+		ch.webCues = nil
+		if ch.ll != nil {
+			ch.ll.Close()
+			ch.ll = nil
+		}
 	}
 	ch.mu.Unlock()
 }
@@ -3,98 +3,79 @@ package ingest
 import (
 	"context"
 	"errors"
-	"sync/atomic"
 
 	"eaglesong.dev/gunk/ingest/whip"
 	"eaglesong.dev/gunk/internal"
 	"eaglesong.dev/gunk/model"
-	"eaglesong.dev/gunk/sinks/grabber"
+	"github.com/nareix/joy4/av"
 	"github.com/nareix/joy4/av/pubsub"
 	"github.com/rs/zerolog/log"
 )
 
+// whipSource is the stream of a WHIP session, which keeps the receiver so that
+// viewers of the active input can use its layers
+type whipSource struct {
+	av.Demuxer
+	recv *whip.Receiver
+}
+
+// PublishRTC starts a WHIP session. The stream goes through the same path as
+// any other publisher, so it can fail over to or from other inputs and the
+// slate covers it when the connection drops.
 func (m *Manager) PublishRTC(auth model.ChannelAuth, offer []byte) ([]byte, string, error) {
-	name := auth.Name
-	c := log.Logger.With()
-	c = c.Str("channel", name)
-	c = c.Str("user_id", auth.UserID)
-	l := c.Logger()
+	l := log.Logger.With().
+		Str("channel", auth.Name).
+		Str("user_id", auth.UserID).
+		Str("kind", "whip").
+		Logger()
 	ctx := l.WithContext(context.Background())
 	q := pubsub.NewQueue()
 	receiver, err := whip.Receive(ctx, m.rtc, offer, q)
 	if err != nil {
 		return nil, "", err
 	}
-	// go live
 	sessionID := internal.RandomID(12)
-	v, _ := m.channels.LoadOrStore(name, new(channel))
-	ch := v.(*channel)
-	ch.name = name
+	ch := m.getChannel(auth.Name)
 	ch.mu.Lock()
-	if ch.whip != nil {
-		ch.whip.Close()
+	if ch.whips == nil {
+		ch.whips = make(map[string]*whip.Receiver)
 	}
-	ch.whip = receiver
-	ch.whipID = sessionID
+	ch.whips[sessionID] = receiver
 	ch.mu.Unlock()
-	p := ch.setStream(q, q, q, m.WorkDir, m.PublishMode) // TODO: AAC?
 	go func() {
+		// the queue is closed when the connection fails, but not always when
+		// the session is stopped
 		<-receiver.Done()
-		l.Info().Msg("stopped publishing")
-		if ch.stopStream(q) && m.PublishEvent != nil {
-			m.PublishEvent(auth, false, grabber.Result{})
-		}
+		q.Close()
 	}()
-	// announce
-	l.Info().Msg("started publishing")
-	if m.PublishEvent != nil {
-		m.PublishEvent(auth, true, grabber.Result{})
-	}
-	// start outputs
-	// eg.Go(func() error {
 	go func() {
-		err := ch.copyWeb(p, q.Latest())
-		if err != nil {
-			l.Err(err).Msg("error in web publishing")
-			// err = fmt.Errorf("web publish: %w", err)
+		defer func() {
+			receiver.Close()
+			ch.mu.Lock()
+			delete(ch.whips, sessionID)
+			ch.mu.Unlock()
+		}()
+		src := &whipSource{Demuxer: q.Oldest(), recv: receiver}
+		if err := m.publish(ctx, auth, src, false); err != nil && !errors.Is(err, errReplaced) {
+			l.Err(err).Msg("WHIP publish failed")
 		}
-		// return err
-	}()
-	// grab keyframes for thumbnail
-	// eg.Go(func() error {
-	go func() {
-		grabch, err := grabber.Grab(name, q.Oldest())
-		if err != nil {
-			l.Err(err).Msg("error in frame grabber")
-		}
-		// notify ws clients when thumbnail is updated
-		for thumb := range grabch {
-			ch.countWebViewers()
-			if m.PublishEvent != nil {
-				m.PublishEvent(auth, true, thumb)
-			}
-			if thumb.HasBframes {
-				atomic.StoreUintptr(&ch.rtc, 0)
-			} else {
-				atomic.StoreUintptr(&ch.rtc, 1)
-			}
-		}
-		// return nil
 	}()
 	return receiver.SDP(), sessionID, nil
 }
 
+// StopRTC ends a WHIP session
 func (m *Manager) StopRTC(auth model.ChannelAuth, sessionID string) error {
 	ch := m.channel(auth.Name)
 	if ch == nil {
 		return ErrNoChannel
 	}
 	ch.mu.Lock()
-	defer ch.mu.Unlock()
-	if ch.whip == nil || ch.whipID != sessionID {
+	receiver := ch.whips[sessionID]
+	delete(ch.whips, sessionID)
+	ch.mu.Unlock()
+	if receiver == nil {
 		return errors.New("session already closed")
 	}
-	ch.whip.Close()
-	ch.whip = nil
+	receiver.Close()
 	return nil
 }
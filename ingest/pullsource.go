@@ -0,0 +1,141 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+
+	"eaglesong.dev/gunk/ingest/remote"
+	"eaglesong.dev/gunk/model"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	minPullBackoff = time.Second
+	maxPullBackoff = time.Minute
+	// reset the backoff once a source has stayed up this long
+	pullStableAfter = time.Minute
+)
+
+var errPullEnded = errors.New("stream ended")
+
+// pullSource publishes a channel from a remote URL, reconnecting whenever it
+// fails
+type pullSource struct {
+	url    string
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	status model.PullStatus
+}
+
+// SetPullSource starts publishing a channel from a remote URL, replacing any
+// previous pull source. An empty URL stops pulling.
+func (m *Manager) SetPullSource(auth model.ChannelAuth, rawURL string) {
+	if m.isEdge() {
+		// the origin pulls
+		return
+	}
+	m.pullMu.Lock()
+	defer m.pullMu.Unlock()
+	if ps := m.pullSources[auth.Name]; ps != nil {
+		if ps.url == rawURL {
+			return
+		}
+		ps.cancel()
+		delete(m.pullSources, auth.Name)
+	}
+	if rawURL == "" {
+		return
+	}
+	if m.pullSources == nil {
+		m.pullSources = make(map[string]*pullSource)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ps := &pullSource{url: rawURL, cancel: cancel}
+	m.pullSources[auth.Name] = ps
+	go m.supervise(ctx, auth, ps)
+}
+
+// PopulatePull fills in the status of each channel's pull source
+func (m *Manager) PopulatePull(defs []*model.ChannelDef) {
+	m.pullMu.Lock()
+	defer m.pullMu.Unlock()
+	for _, def := range defs {
+		if ps := m.pullSources[def.Name]; ps != nil {
+			ps.mu.Lock()
+			status := ps.status
+			ps.mu.Unlock()
+			def.Pull = &status
+		}
+	}
+}
+
+func (m *Manager) supervise(ctx context.Context, auth model.ChannelAuth, ps *pullSource) {
+	l := log.With().Str("channel", auth.Name).Str("pull_url", redactURL(ps.url)).Logger()
+	backoff := minPullBackoff
+	for {
+		started := time.Now()
+		err := m.pullSourceOnce(ctx, auth, ps)
+		if ctx.Err() != nil {
+			l.Info().Msg("stopped pulling")
+			return
+		}
+		if time.Since(started) > pullStableAfter {
+			backoff = minPullBackoff
+		}
+		l.Warn().Err(err).Dur("retry_in", backoff).Msg("pull source failed")
+		ps.setState(model.PullRetrying, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxPullBackoff)
+	}
+}
+
+func (m *Manager) pullSourceOnce(ctx context.Context, auth model.ChannelAuth, ps *pullSource) error {
+	ps.setState(model.PullConnecting, nil)
+	src, err := remote.Dial(ctx, ps.url)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if _, err := src.Streams(); err != nil {
+		return err
+	}
+	ps.setState(model.PullLive, nil)
+	l := log.With().Str("kind", "pull").Logger()
+	if err := m.Publish(l.WithContext(ctx), auth, src); err != nil {
+		return err
+	}
+	return errPullEnded
+}
+
+func (ps *pullSource) setState(state string, err error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if state == model.PullRetrying {
+		ps.status.Retries++
+	} else if state == model.PullLive {
+		ps.status.Retries = 0
+	}
+	ps.status.State = state
+	ps.status.Since = time.Now().UnixNano() / 1000000
+	ps.status.Error = ""
+	if err != nil {
+		ps.status.Error = err.Error()
+	}
+}
+
+// redactURL hides credentials in a pull URL for logging
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Redacted()
+}
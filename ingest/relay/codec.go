@@ -0,0 +1,97 @@
+package relay
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"eaglesong.dev/gunk/codec"
+	"eaglesong.dev/gunk/codec/av1parser"
+	"eaglesong.dev/gunk/codec/hevcparser"
+	"eaglesong.dev/gunk/codec/vp8parser"
+	"eaglesong.dev/gunk/codec/vp9parser"
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/codec/opusparser"
+)
+
+// codec tags used in the stream header
+const (
+	tagH264 = iota + 1
+	tagHEVC
+	tagAV1
+	tagVP8
+	tagVP9
+	tagAAC
+	tagOpus
+)
+
+var errShortConfig = errors.New("relay: codec configuration too short")
+
+// marshalCodec returns the tag and configuration needed to recreate cd
+func marshalCodec(cd av.CodecData) (byte, []byte, error) {
+	switch cd := cd.(type) {
+	case h264parser.CodecData:
+		return tagH264, cd.AVCDecoderConfRecordBytes(), nil
+	case hevcparser.CodecData:
+		return tagHEVC, cd.DecoderConfRecordBytes(), nil
+	case av1parser.CodecData:
+		return tagAV1, cd.ConfigurationRecordBytes(), nil
+	case vp8parser.CodecData:
+		b := binary.BigEndian.AppendUint16(nil, uint16(cd.Width()))
+		return tagVP8, binary.BigEndian.AppendUint16(b, uint16(cd.Height())), nil
+	case vp9parser.CodecData:
+		fh := cd.FrameHeader
+		b := []byte{fh.Profile, fh.BitDepth, fh.ChromaSubsampling, 0}
+		if fh.FullRange {
+			b[3] = 1
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(fh.Width))
+		return tagVP9, binary.BigEndian.AppendUint16(b, uint16(fh.Height)), nil
+	case aacparser.CodecData:
+		return tagAAC, cd.MPEG4AudioConfigBytes(), nil
+	}
+	if cd.Type() == av.OPUS {
+		channels := cd.(av.AudioCodecData).ChannelLayout().Count()
+		return tagOpus, []byte{byte(channels)}, nil
+	}
+	return 0, nil, fmt.Errorf("relay: unsupported codec %s", codec.Name(cd.Type()))
+}
+
+func unmarshalCodec(tag byte, b []byte) (av.CodecData, error) {
+	switch tag {
+	case tagH264:
+		return h264parser.NewCodecDataFromAVCDecoderConfRecord(b)
+	case tagHEVC:
+		return hevcparser.NewCodecDataFromDecoderConfRecord(b)
+	case tagAV1:
+		return av1parser.NewCodecDataFromConfigurationRecord(b)
+	case tagVP8:
+		if len(b) < 4 {
+			return nil, errShortConfig
+		}
+		return vp8parser.NewCodecData(int(binary.BigEndian.Uint16(b)), int(binary.BigEndian.Uint16(b[2:]))), nil
+	case tagVP9:
+		if len(b) < 8 {
+			return nil, errShortConfig
+		}
+		return vp9parser.NewCodecData(vp9parser.FrameHeader{
+			Profile:           b[0],
+			KeyFrame:          true,
+			BitDepth:          b[1],
+			ChromaSubsampling: b[2],
+			FullRange:         b[3] != 0,
+			Width:             uint(binary.BigEndian.Uint16(b[4:])),
+			Height:            uint(binary.BigEndian.Uint16(b[6:])),
+		}), nil
+	case tagAAC:
+		return aacparser.NewCodecDataFromMPEG4AudioConfigBytes(b)
+	case tagOpus:
+		if len(b) < 1 {
+			return nil, errShortConfig
+		}
+		return opusparser.NewCodecData(int(b[0])), nil
+	}
+	return nil, fmt.Errorf("relay: unknown codec tag %d", tag)
+}
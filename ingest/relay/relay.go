@@ -0,0 +1,152 @@
+// Package relay carries a live stream between gunk nodes. A stream is a
+// header describing each track followed by length-prefixed packets, and can
+// hold every codec that can be ingested.
+package relay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/nareix/joy4/av"
+)
+
+const (
+	magic = "GUNKRLY1"
+	// idx, flags, time, composition time, size
+	packetHeaderSize = 1 + 1 + 8 + 8 + 4
+	// larger packets are assumed to be corrupt
+	maxPacketSize = 64 << 20
+
+	flagKeyFrame = 1
+)
+
+var errMagic = errors.New("relay: not a relay stream")
+
+// Muxer writes a relay stream
+type Muxer struct {
+	w   io.Writer
+	buf []byte
+}
+
+func NewMuxer(w io.Writer) *Muxer {
+	return &Muxer{w: w}
+}
+
+func (m *Muxer) WriteHeader(streams []av.CodecData) error {
+	b := append([]byte(nil), magic...)
+	b = append(b, byte(len(streams)))
+	for _, cd := range streams {
+		tag, config, err := marshalCodec(cd)
+		if err != nil {
+			return err
+		}
+		b = append(b, tag)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(config)))
+		b = append(b, config...)
+	}
+	_, err := m.w.Write(b)
+	return err
+}
+
+func (m *Muxer) WritePacket(pkt av.Packet) error {
+	b := m.buf[:0]
+	var flags byte
+	if pkt.IsKeyFrame {
+		flags |= flagKeyFrame
+	}
+	b = append(b, byte(pkt.Idx), flags)
+	b = binary.BigEndian.AppendUint64(b, uint64(pkt.Time))
+	b = binary.BigEndian.AppendUint64(b, uint64(pkt.CompositionTime))
+	b = binary.BigEndian.AppendUint32(b, uint32(len(pkt.Data)))
+	b = append(b, pkt.Data...)
+	m.buf = b
+	_, err := m.w.Write(b)
+	return err
+}
+
+func (m *Muxer) WriteTrailer() error {
+	return nil
+}
+
+// Demuxer reads a relay stream
+type Demuxer struct {
+	r       *bufio.Reader
+	streams []av.CodecData
+	err     error
+	header  bool
+}
+
+func NewDemuxer(r io.Reader) *Demuxer {
+	return &Demuxer{r: bufio.NewReader(r)}
+}
+
+// Streams reads the header if it hasn't been read yet
+func (d *Demuxer) Streams() ([]av.CodecData, error) {
+	if !d.header {
+		d.header = true
+		d.streams, d.err = d.readHeader()
+	}
+	return d.streams, d.err
+}
+
+func (d *Demuxer) readHeader() ([]av.CodecData, error) {
+	b := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return nil, err
+	} else if string(b[:len(magic)]) != magic {
+		return nil, errMagic
+	}
+	streams := make([]av.CodecData, b[len(magic)])
+	for i := range streams {
+		var hdr [5]byte
+		if _, err := io.ReadFull(d.r, hdr[:]); err != nil {
+			return nil, err
+		}
+		size := binary.BigEndian.Uint32(hdr[1:])
+		if size > maxPacketSize {
+			return nil, errors.New("relay: codec configuration too large")
+		}
+		config := make([]byte, size)
+		if _, err := io.ReadFull(d.r, config); err != nil {
+			return nil, err
+		}
+		cd, err := unmarshalCodec(hdr[0], config)
+		if err != nil {
+			return nil, err
+		}
+		streams[i] = cd
+	}
+	return streams, nil
+}
+
+func (d *Demuxer) ReadPacket() (pkt av.Packet, err error) {
+	if _, err := d.Streams(); err != nil {
+		return pkt, err
+	}
+	var hdr [packetHeaderSize]byte
+	if _, err := io.ReadFull(d.r, hdr[:]); err != nil {
+		return pkt, err
+	}
+	pkt.Idx = int8(hdr[0])
+	if int(pkt.Idx) >= len(d.streams) || pkt.Idx < 0 {
+		return pkt, errors.New("relay: invalid stream index")
+	}
+	pkt.IsKeyFrame = hdr[1]&flagKeyFrame != 0
+	pkt.Time = time.Duration(binary.BigEndian.Uint64(hdr[2:]))
+	pkt.CompositionTime = time.Duration(binary.BigEndian.Uint64(hdr[10:]))
+	size := binary.BigEndian.Uint32(hdr[18:])
+	if size > maxPacketSize {
+		return pkt, errors.New("relay: packet too large")
+	}
+	pkt.Data = make([]byte, size)
+	if _, err := io.ReadFull(d.r, pkt.Data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return pkt, err
+	}
+	return pkt, nil
+}
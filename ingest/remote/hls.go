@@ -0,0 +1,194 @@
+package remote
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// number of segments from the end of the playlist to start at
+const hlsLiveEdge = 3
+
+var errFMP4 = errors.New("HLS: only MPEG-TS segments are supported")
+
+type playlist struct {
+	// master playlist
+	variants []variant
+	// media playlist
+	targetDuration time.Duration
+	sequence       int
+	segments       []*url.URL
+	ended          bool
+}
+
+type variant struct {
+	bandwidth int
+	uri       *url.URL
+}
+
+// parsePlaylist parses the parts of a master or media playlist needed to
+// follow a live stream. URIs are left relative to the playlist.
+func parsePlaylist(r io.Reader) (*playlist, error) {
+	p := &playlist{targetDuration: 2 * time.Second}
+	scanner := bufio.NewScanner(r)
+	var bandwidth int
+	var streamInf, segment bool
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		tag, value, _ := strings.Cut(line, ":")
+		switch {
+		case line == "":
+		case tag == "#EXT-X-STREAM-INF":
+			streamInf = true
+			bandwidth, _ = strconv.Atoi(attribute(value, "BANDWIDTH"))
+		case tag == "#EXT-X-TARGETDURATION":
+			if v, err := strconv.Atoi(value); err == nil && v > 0 {
+				p.targetDuration = time.Duration(v) * time.Second
+			}
+		case tag == "#EXT-X-MEDIA-SEQUENCE":
+			p.sequence, _ = strconv.Atoi(value)
+		case tag == "#EXTINF":
+			segment = true
+		case tag == "#EXT-X-ENDLIST":
+			p.ended = true
+		case tag == "#EXT-X-MAP":
+			return nil, errFMP4
+		case tag == "#EXT-X-KEY":
+			if m := attribute(value, "METHOD"); m != "NONE" {
+				return nil, fmt.Errorf("HLS: encryption method %s is not supported", m)
+			}
+		case strings.HasPrefix(line, "#"):
+		default:
+			uri, err := url.Parse(line)
+			if err != nil {
+				return nil, err
+			}
+			if streamInf {
+				p.variants = append(p.variants, variant{bandwidth: bandwidth, uri: uri})
+			} else if segment {
+				p.segments = append(p.segments, uri)
+			}
+			streamInf, segment = false, false
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(p.variants) == 0 && len(p.segments) == 0 && !p.ended {
+		return nil, errors.New("HLS: playlist is empty")
+	}
+	return p, nil
+}
+
+// attribute returns one attribute from a tag's attribute list
+func attribute(list, name string) string {
+	for len(list) > 0 {
+		var key, value string
+		key, list, _ = strings.Cut(list, "=")
+		if strings.HasPrefix(list, `"`) {
+			value, list, _ = strings.Cut(list[1:], `"`)
+			list = strings.TrimPrefix(list, ",")
+		} else {
+			value, list, _ = strings.Cut(list, ",")
+		}
+		if strings.TrimSpace(key) == name {
+			return value
+		}
+	}
+	return ""
+}
+
+// newHLSReader follows a live HLS playlist and concatenates its segments
+// into a single transport stream
+func newHLSReader(ctx context.Context, base *url.URL, p *playlist) *io.PipeReader {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(follow(ctx, base, p, pw))
+	}()
+	return pr
+}
+
+// follow writes each new segment to w until the playlist ends
+func follow(ctx context.Context, base *url.URL, p *playlist, w io.Writer) error {
+	if len(p.variants) != 0 {
+		// pick the best quality
+		best := p.variants[0]
+		for _, v := range p.variants[1:] {
+			if v.bandwidth > best.bandwidth {
+				best = v
+			}
+		}
+		base = base.ResolveReference(best.uri)
+		var err error
+		if p, err = fetchPlaylist(ctx, base); err != nil {
+			return err
+		}
+		if len(p.variants) != 0 {
+			return errors.New("HLS: nested master playlists are not supported")
+		}
+	}
+	next := p.sequence + len(p.segments) - hlsLiveEdge
+	if p.ended || next < p.sequence {
+		next = p.sequence
+	}
+	for {
+		last := p.sequence + len(p.segments) - 1
+		if next > last+1 {
+			// sequence numbers went backwards, the stream was restarted
+			log.Debug().Stringer("playlist", base).Msg("HLS playlist restarted")
+			next = max(p.sequence, last+1-hlsLiveEdge)
+		}
+		wait := p.targetDuration / 2
+		for i, uri := range p.segments {
+			seq := p.sequence + i
+			if seq < next {
+				continue
+			}
+			if err := copySegment(ctx, base.ResolveReference(uri), w); err != nil {
+				return err
+			}
+			next = seq + 1
+			// the next segment shouldn't be ready yet
+			wait = p.targetDuration
+		}
+		if p.ended {
+			return io.EOF
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		var err error
+		if p, err = fetchPlaylist(ctx, base); err != nil {
+			return err
+		}
+	}
+}
+
+func fetchPlaylist(ctx context.Context, u *url.URL) (*playlist, error) {
+	resp, err := get(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return parsePlaylist(resp.Body)
+}
+
+func copySegment(ctx context.Context, u *url.URL, w io.Writer) error {
+	resp, err := get(ctx, u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
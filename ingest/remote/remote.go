@@ -0,0 +1,190 @@
+// Package remote fetches a live stream from another server so it can be
+// published as if it had been pushed to us.
+package remote
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"eaglesong.dev/gunk/internal/safedial"
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/av/pktque"
+	"github.com/nareix/joy4/format/rtmp"
+	"github.com/nareix/joy4/format/ts"
+)
+
+// close the source if it doesn't produce a packet for this long
+const readTimeout = 15 * time.Second
+
+var ErrUnsupported = errors.New("pull URL must be rtmp, http or https")
+
+// pull URLs come from users, so connections only go to public addresses
+var (
+	dialer     = safedial.Dialer()
+	httpClient = &http.Client{Transport: safedial.Transport()}
+)
+
+// Source is a stream being fetched from a remote server
+type Source struct {
+	av.Demuxer
+	closer  io.Closer
+	once    sync.Once
+	done    chan struct{}
+	timeout *time.Timer
+}
+
+// Check returns an error if rawURL can't be pulled from
+func Check(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "rtmp", "http", "https":
+	default:
+		return ErrUnsupported
+	}
+	if u.Host == "" {
+		return errors.New("pull URL has no host")
+	}
+	if ip, err := netip.ParseAddr(u.Hostname()); err == nil && !safedial.Allowed(ip) {
+		// names are checked when they are resolved
+		return errors.New("pull URL must be a public address")
+	}
+	return nil
+}
+
+// Dial connects to a RTMP, HTTP MPEG-TS or HLS source. Cancelling ctx closes
+// the source.
+func Dial(ctx context.Context, rawURL string) (*Source, error) {
+	if err := Check(rawURL); err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(rawURL)
+	var src av.Demuxer
+	var closer io.Closer
+	switch u.Scheme {
+	case "rtmp":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "1935")
+		}
+		// the handshake happens when the streams are first read, which the
+		// read timeout covers
+		nc, err := dialer.DialContext(ctx, "tcp", host)
+		if err != nil {
+			return nil, err
+		}
+		conn := rtmp.NewConn(nc)
+		conn.URL = u
+		src, closer = conn, conn
+	default:
+		var err error
+		src, closer, err = dialHTTP(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s := &Source{
+		// files and HLS segments arrive faster than real time
+		Demuxer: &pktque.FilterDemuxer{
+			Demuxer: src,
+			Filter: pktque.Filters{
+				&pktque.FixTime{StartFromZero: true},
+				&pktque.Walltime{},
+			},
+		},
+		closer: closer,
+		done:   make(chan struct{}),
+	}
+	s.timeout = time.AfterFunc(readTimeout, func() { s.Close() })
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-s.done:
+		}
+	}()
+	return s, nil
+}
+
+func (s *Source) Streams() ([]av.CodecData, error) {
+	streams, err := s.Demuxer.Streams()
+	s.timeout.Reset(readTimeout)
+	return streams, err
+}
+
+func (s *Source) ReadPacket() (av.Packet, error) {
+	pkt, err := s.Demuxer.ReadPacket()
+	s.timeout.Reset(readTimeout)
+	return pkt, err
+}
+
+// Close disconnects from the remote server
+func (s *Source) Close() (err error) {
+	s.once.Do(func() {
+		close(s.done)
+		s.timeout.Stop()
+		err = s.closer.Close()
+	})
+	return
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+// dialHTTP fetches a MPEG-TS stream or HLS playlist
+func dialHTTP(ctx context.Context, u *url.URL) (av.Demuxer, io.Closer, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	resp, err := get(ctx, u)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	br := bufio.NewReader(resp.Body)
+	head, _ := br.Peek(7)
+	if strings.Contains(resp.Header.Get("Content-Type"), "mpegurl") || string(head) == "#EXTM3U" {
+		playlist, err := parsePlaylist(br)
+		resp.Body.Close()
+		if err != nil {
+			cancel()
+			return nil, nil, fmt.Errorf("parsing playlist: %w", err)
+		}
+		r := newHLSReader(ctx, resp.Request.URL, playlist)
+		return ts.NewDemuxer(r), closerFunc(func() error {
+			cancel()
+			return r.Close()
+		}), nil
+	}
+	return ts.NewDemuxer(br), closerFunc(func() error {
+		cancel()
+		return resp.Body.Close()
+	}), nil
+}
+
+func get(ctx context.Context, u *url.URL) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s returned %s", u.Redacted(), resp.Status)
+	}
+	return resp, nil
+}
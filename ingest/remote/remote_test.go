@@ -0,0 +1,141 @@
+package remote
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"eaglesong.dev/gunk/internal/safedial"
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/format/ts"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	cases := []struct {
+		url string
+		err string
+	}{
+		{url: "rtmp://example.com/live/key"},
+		{url: "https://example.com/live.m3u8"},
+		{url: "http://93.184.216.34:8080/stream.ts"},
+		{url: "srt://example.com:9000", err: "must be rtmp"},
+		{url: "file:///etc/passwd", err: "must be rtmp"},
+		{url: "http:///stream.ts", err: "no host"},
+		{url: "http://127.0.0.1/stream.ts", err: "public address"},
+		{url: "rtmp://[::1]/live/key", err: "public address"},
+		{url: "http://169.254.169.254/latest/meta-data/", err: "public address"},
+	}
+	for _, c := range cases {
+		t.Run(c.url, func(t *testing.T) {
+			err := Check(c.url)
+			if c.err != "" {
+				assert.ErrorContains(t, err, c.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// allowLoopback lets the test reach servers on localhost
+func allowLoopback(t *testing.T) {
+	client := httpClient
+	httpClient = http.DefaultClient
+	t.Cleanup(func() { httpClient = client })
+}
+
+// localURL addresses a test server by name, since Check refuses loopback
+// addresses outright
+func localURL(srv *httptest.Server, path string) string {
+	return strings.Replace(srv.URL, "127.0.0.1", "localhost", 1) + path
+}
+
+// tsServer serves an MPEG-TS stream of AAC frames
+func tsServer(t *testing.T, frames [][]byte) *httptest.Server {
+	cd, err := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{
+		ObjectType:      2, // AAC LC
+		SampleRateIndex: 3, // 48kHz
+		ChannelConfig:   2,
+	})
+	require.NoError(t, err)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "video/MP2T")
+		muxer := ts.NewMuxer(rw)
+		if err := muxer.WriteHeader([]av.CodecData{cd}); err != nil {
+			return
+		}
+		for i, frame := range frames {
+			pkt := av.Packet{Time: time.Duration(i) * 1024 * time.Second / 48000, Data: frame}
+			if err := muxer.WritePacket(pkt); err != nil {
+				return
+			}
+		}
+		_ = muxer.WriteTrailer()
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestDialHTTP(t *testing.T) {
+	allowLoopback(t)
+	frames := [][]byte{[]byte("frame one"), []byte("frame two"), []byte("frame three")}
+	srv := tsServer(t, frames)
+	src, err := Dial(context.Background(), localURL(srv, "/live.ts"))
+	require.NoError(t, err)
+	defer src.Close()
+	streams, err := src.Streams()
+	require.NoError(t, err)
+	require.Len(t, streams, 1)
+	for _, want := range frames {
+		pkt, err := src.ReadPacket()
+		require.NoError(t, err)
+		assert.Equal(t, string(want), string(pkt.Data))
+	}
+	_, err = src.ReadPacket()
+	assert.Error(t, err, "end of stream")
+}
+
+func TestDialHTTPError(t *testing.T) {
+	allowLoopback(t)
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	_, err := Dial(context.Background(), localURL(srv, "/live.ts"))
+	assert.ErrorContains(t, err, "404")
+}
+
+func TestDialCancel(t *testing.T) {
+	allowLoopback(t)
+	srv := tsServer(t, [][]byte{[]byte("frame")})
+	ctx, cancel := context.WithCancel(context.Background())
+	src, err := Dial(ctx, localURL(srv, "/live.ts"))
+	require.NoError(t, err)
+	cancel()
+	select {
+	case <-src.done:
+	case <-time.After(time.Second):
+		t.Fatal("source not closed after cancelling")
+	}
+}
+
+func TestDialBlocked(t *testing.T) {
+	srv := tsServer(t, nil)
+	// a name that resolves to loopback gets past Check but not the dialer
+	u := localURL(srv, "/live.ts")
+	require.NoError(t, Check(u))
+	_, err := Dial(context.Background(), u)
+	assert.ErrorIs(t, err, safedial.ErrBlocked)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	_, err = Dial(context.Background(), "rtmp://localhost:"+port+"/live/key")
+	assert.ErrorIs(t, err, safedial.ErrBlocked)
+}
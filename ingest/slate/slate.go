@@ -0,0 +1,226 @@
+// Package slate renders an owner-uploaded image or clip into packets that can
+// stand in for a live stream while its publisher is away.
+package slate
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/format/ts"
+)
+
+const (
+	frameRate = 30
+	// a still image is shown as a clip of this length
+	imageLength = 5 * time.Second
+	// longer clips are cut short
+	maxLength = 30 * time.Second
+	// MaxSize is the largest slate that can be uploaded
+	MaxSize = 32 << 20
+)
+
+// ErrUnsupported is returned if the live stream can't be matched by a slate
+var ErrUnsupported = errors.New("slates need a H.264 stream with AAC or no audio")
+
+// Slate is one loop of a rendered slate
+type Slate struct {
+	// Packets use the live stream's indexes and start at zero
+	Packets  []av.Packet
+	Duration time.Duration
+	// Params are the parameter sets to send with each video keyframe
+	Params []byte
+}
+
+// Render converts an image or clip to match the codecs of a live stream
+func Render(ctx context.Context, data []byte, streams []av.CodecData) (*Slate, error) {
+	videoIdx, audioIdx := -1, -1
+	var video h264parser.CodecData
+	var audio aacparser.CodecData
+	for i, cd := range streams {
+		switch cd := cd.(type) {
+		case h264parser.CodecData:
+			if videoIdx < 0 {
+				videoIdx, video = i, cd
+			}
+		case aacparser.CodecData:
+			if audioIdx < 0 {
+				audioIdx, audio = i, cd
+			}
+		default:
+			return nil, ErrUnsupported
+		}
+	}
+	if videoIdx < 0 {
+		return nil, ErrUnsupported
+	}
+	opts := options{width: video.Width(), height: video.Height(), length: maxLength}
+	if audioIdx >= 0 {
+		opts.sampleRate = audio.SampleRate()
+		opts.channels = audio.ChannelLayout().Count()
+	}
+	raw, err := render(ctx, data, opts)
+	if err != nil {
+		return nil, err
+	}
+	dm := ts.NewDemuxer(bytes.NewReader(raw))
+	rendered, err := dm.Streams()
+	if err != nil {
+		return nil, fmt.Errorf("reading rendered slate: %w", err)
+	}
+	// map rendered tracks onto the live ones
+	idxMap := make([]int, len(rendered))
+	s := new(Slate)
+	for i, cd := range rendered {
+		idxMap[i] = -1
+		switch cd := cd.(type) {
+		case h264parser.CodecData:
+			idxMap[i] = videoIdx
+			s.Params = ParamSets(cd)
+		case aacparser.CodecData:
+			// ADTS headers come from the live stream's config
+			if audioIdx >= 0 && bytes.Equal(cd.MPEG4AudioConfigBytes(), audio.MPEG4AudioConfigBytes()) {
+				idxMap[i] = audioIdx
+			}
+		}
+	}
+	var start, end time.Duration = -1, 0
+	for {
+		pkt, err := dm.ReadPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("reading rendered slate: %w", err)
+		}
+		idx := idxMap[pkt.Idx]
+		if idx < 0 {
+			continue
+		}
+		if start < 0 {
+			start = pkt.Time
+		}
+		pkt.Idx = int8(idx)
+		pkt.Time -= start
+		if idx == videoIdx && pkt.Time > end {
+			end = pkt.Time
+		}
+		s.Packets = append(s.Packets, pkt)
+	}
+	if len(s.Packets) == 0 || !s.Packets[0].IsKeyFrame {
+		return nil, errors.New("rendered slate does not start with a keyframe")
+	}
+	s.Duration = end + time.Second/frameRate
+	return s, nil
+}
+
+// Validate checks that an uploaded image or clip can be rendered
+func Validate(ctx context.Context, data []byte) error {
+	_, err := render(ctx, data, options{width: 320, height: 180, length: time.Second})
+	return err
+}
+
+type options struct {
+	width, height        int
+	sampleRate, channels int
+	length               time.Duration
+}
+
+// render runs ffmpeg to produce a transport stream
+func render(ctx context.Context, data []byte, opts options) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	// ffmpeg needs to seek in some formats, and images are read twice
+	f, err := os.CreateTemp("", "slate")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return nil, err
+	}
+	image := strings.HasPrefix(http.DetectContentType(data), "image/")
+	args := []string{"-loglevel", "warning"}
+	if image {
+		args = append(args, "-loop", "1", "-t", seconds(min(imageLength, opts.length)))
+	}
+	args = append(args, "-i", f.Name(), "-map", "0:v:0")
+	if opts.sampleRate != 0 {
+		if !image && hasAudio(ctx, f.Name()) {
+			args = append(args, "-map", "0:a:0")
+		} else {
+			layout := "mono"
+			if opts.channels > 1 {
+				layout = "stereo"
+			}
+			args = append(args,
+				"-f", "lavfi", "-i", fmt.Sprintf("anullsrc=r=%d:cl=%s", opts.sampleRate, layout),
+				"-map", "1:a", "-shortest")
+		}
+		args = append(args,
+			"-c:a", "aac",
+			"-ar", strconv.Itoa(opts.sampleRate),
+			"-ac", strconv.Itoa(opts.channels))
+	}
+	args = append(args,
+		"-vf", fmt.Sprintf("scale=%[1]d:%[2]d:force_original_aspect_ratio=decrease,pad=%[1]d:%[2]d:(ow-iw)/2:(oh-ih)/2,fps=%[3]d,format=yuv420p",
+			opts.width, opts.height, frameRate),
+		"-c:v", "libx264", "-preset", "veryfast",
+		"-bf", "0", "-g", strconv.Itoa(frameRate), "-sc_threshold", "0",
+		"-t", seconds(opts.length),
+		"-f", "mpegts", "-")
+	var out, errmsg bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stdout = &out
+	cmd.Stderr = &errmsg
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("rendering slate: %w\n%s", err, errmsg.String())
+	} else if out.Len() == 0 {
+		return nil, errors.New("rendering slate: no output")
+	}
+	return out.Bytes(), nil
+}
+
+func hasAudio(ctx context.Context, name string) bool {
+	out, err := exec.CommandContext(ctx, "ffprobe",
+		"-loglevel", "error",
+		"-select_streams", "a",
+		"-show_entries", "stream=index",
+		"-of", "csv=p=0",
+		name).Output()
+	return err == nil && len(bytes.TrimSpace(out)) != 0
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+// ParamSets returns the SPS and PPS of a H.264 stream as length-prefixed
+// NALUs, ready to put in front of a keyframe
+func ParamSets(cd av.CodecData) []byte {
+	h, ok := cd.(h264parser.CodecData)
+	if !ok {
+		return nil
+	}
+	var b []byte
+	for _, nalu := range [][]byte{h.SPS(), h.PPS()} {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(nalu)))
+		b = append(b, nalu...)
+	}
+	return b
+}
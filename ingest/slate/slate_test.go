@@ -0,0 +1,63 @@
+package slate
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"os/exec"
+	"testing"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/codec/opusparser"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func needFFmpeg(t *testing.T) {
+	for _, name := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s is not installed", name)
+		}
+	}
+}
+
+func testPNG(t *testing.T) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for i := range img.Pix {
+		img.Pix[i] = 0x80
+	}
+	img.Set(10, 10, color.White)
+	var b bytes.Buffer
+	require.NoError(t, png.Encode(&b, img))
+	return b.Bytes()
+}
+
+func TestValidate(t *testing.T) {
+	needFFmpeg(t)
+	ctx := context.Background()
+	assert.NoError(t, Validate(ctx, testPNG(t)))
+	assert.Error(t, Validate(ctx, []byte("not an image")))
+	// a truncated image can't be decoded either
+	assert.Error(t, Validate(ctx, testPNG(t)[:40]))
+}
+
+func TestRenderUnsupported(t *testing.T) {
+	cases := []struct {
+		name    string
+		streams []av.CodecData
+	}{
+		{"NoStreams", nil},
+		{"AudioOnly", []av.CodecData{aacparser.CodecData{}}},
+		{"Opus", []av.CodecData{h264parser.CodecData{}, &opusparser.CodecData{Channels: 2}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := Render(context.Background(), testPNG(t), c.streams)
+			assert.ErrorIs(t, err, ErrUnsupported)
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package whip
+
+import (
+	"fmt"
+
+	"eaglesong.dev/gunk/codec/av1parser"
+	"github.com/nareix/joy4/av"
+)
+
+type av1sampler struct {
+	sh av1parser.SequenceHeader
+
+	cd chan<- av.CodecData
+}
+
+func (s *av1sampler) Update(pkt *av.Packet) error {
+	obus, err := av1parser.SplitOBUs(pkt.Data)
+	if err != nil {
+		return fmt.Errorf("splitting av1 temporal unit: %w", err)
+	}
+	for _, obu := range obus {
+		if av1parser.OBUType(obu) != av1parser.OBUSequenceHeader {
+			continue
+		}
+		cd, err := av1parser.NewCodecDataFromSequenceHeader(obu)
+		if err != nil {
+			return fmt.Errorf("parsing av1 codec data: %w", err)
+		}
+		s.sh = cd.SequenceHeader
+		if s.cd != nil {
+			s.cd <- cd
+			close(s.cd)
+			s.cd = nil
+		}
+	}
+	pkt.IsKeyFrame = av1parser.IsKeyFrame(obus, s.sh)
+	return nil
+}
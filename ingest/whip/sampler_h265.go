@@ -0,0 +1,46 @@
+package whip
+
+import (
+	"fmt"
+
+	"eaglesong.dev/gunk/codec/hevcparser"
+	"eaglesong.dev/gunk/h265util"
+	"github.com/nareix/joy4/av"
+)
+
+type h265sampler struct {
+	vps, sps, pps []byte
+
+	cd chan<- av.CodecData
+}
+
+func (s *h265sampler) Update(pkt *av.Packet) error {
+	nalus := h265util.SplitNALUs(pkt.Data)
+	for _, nalu := range nalus {
+		t := h265util.NALType(nalu)
+		if t.IsKeyFrame() {
+			pkt.IsKeyFrame = true
+		}
+		if s.cd == nil {
+			continue
+		}
+		switch t {
+		case h265util.TypeVideoParameter:
+			s.vps = nalu
+		case h265util.TypeSequenceParameter:
+			s.sps = nalu
+		case h265util.TypePictureParameter:
+			s.pps = nalu
+		}
+	}
+	if s.cd != nil && len(s.vps) > 0 && len(s.sps) > 0 && len(s.pps) > 0 {
+		cd, err := hevcparser.NewCodecDataFromVPSAndSPSAndPPS(s.vps, s.sps, s.pps)
+		if err != nil {
+			return fmt.Errorf("parsing h265 codec data: %w", err)
+		}
+		s.cd <- cd
+		close(s.cd)
+		s.cd = nil
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package whip
+
+import (
+	"fmt"
+
+	"eaglesong.dev/gunk/codec/vp8parser"
+	"eaglesong.dev/gunk/codec/vp9parser"
+	"github.com/nareix/joy4/av"
+)
+
+type vp8sampler struct {
+	cd chan<- av.CodecData
+}
+
+func (s *vp8sampler) Update(pkt *av.Packet) error {
+	pkt.IsKeyFrame = vp8parser.IsKeyFrame(pkt.Data)
+	if s.cd != nil && pkt.IsKeyFrame {
+		cd, err := vp8parser.NewCodecDataFromKeyFrame(pkt.Data)
+		if err != nil {
+			return fmt.Errorf("parsing vp8 codec data: %w", err)
+		}
+		s.cd <- cd
+		close(s.cd)
+		s.cd = nil
+	}
+	return nil
+}
+
+type vp9sampler struct {
+	cd chan<- av.CodecData
+}
+
+func (s *vp9sampler) Update(pkt *av.Packet) error {
+	pkt.IsKeyFrame = vp9parser.IsKeyFrame(pkt.Data)
+	if s.cd != nil && pkt.IsKeyFrame {
+		cd, err := vp9parser.NewCodecDataFromKeyFrame(pkt.Data)
+		if err != nil {
+			return fmt.Errorf("parsing vp9 codec data: %w", err)
+		}
+		s.cd <- cd
+		close(s.cd)
+		s.cd = nil
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package whip
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/av/pubsub"
+	"github.com/pion/rtcp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// how long to wait for the other simulcast layers once the first one is ready
+	simulcastWait = 2 * time.Second
+	// minimum time between keyframe requests for the same layer
+	keyframeInterval = 500 * time.Millisecond
+)
+
+// Layer is one simulcast encoding of the published video
+type Layer struct {
+	RID       string
+	CodecData av.CodecData
+	// Queue holds the layer's video. The primary layer is also copied into the
+	// receiver's destination queue.
+	Queue   *pubsub.Queue
+	Primary bool
+}
+
+type simulcast struct {
+	mu     sync.Mutex
+	rids   []string
+	layers map[string]*Layer
+	ready  chan *Layer
+}
+
+// simulcastRIDs returns the RIDs of the video layers the client offers to
+// send, if there is more than one
+func simulcastRIDs(offer []byte) []string {
+	var desc sdp.SessionDescription
+	if err := desc.Unmarshal(offer); err != nil {
+		return nil
+	}
+	for _, md := range desc.MediaDescriptions {
+		if md.MediaName.Media != "video" {
+			continue
+		}
+		var rids []string
+		for _, a := range md.Attributes {
+			fields := strings.Fields(a.Value)
+			if a.Key == "rid" && len(fields) >= 2 && fields[1] == "send" {
+				rids = append(rids, fields[0])
+			}
+		}
+		if len(rids) > 1 {
+			return rids
+		}
+		return nil
+	}
+	return nil
+}
+
+func newSimulcast(rids []string) *simulcast {
+	return &simulcast{
+		rids:   rids,
+		layers: make(map[string]*Layer),
+		ready:  make(chan *Layer, len(rids)),
+	}
+}
+
+// addLayer creates the queue for a newly received layer. The layer is
+// reported as ready once its codec data is known.
+func (sc *simulcast) addLayer(tr *webrtc.TrackRemote) (av.PacketWriter, chan<- av.CodecData) {
+	l := &Layer{RID: tr.RID(), Queue: pubsub.NewQueue()}
+	codecData := make(chan av.CodecData, 1)
+	sc.mu.Lock()
+	if old := sc.layers[l.RID]; old != nil {
+		old.Queue.Close()
+	}
+	sc.layers[l.RID] = l
+	sc.mu.Unlock()
+	go func() {
+		cd := <-codecData
+		if cd == nil {
+			return
+		}
+		l.Queue.WriteHeader([]av.CodecData{cd})
+		sc.mu.Lock()
+		l.CodecData = cd
+		sc.mu.Unlock()
+		select {
+		case sc.ready <- l:
+		default:
+		}
+	}()
+	return l.Queue, codecData
+}
+
+// selectPrimary waits for the layers to start and copies the largest one to
+// dest
+func (r *Receiver) selectPrimary(codecData chan<- av.CodecData, dest av.PacketWriter) {
+	sc := r.simulcast
+	var ready []*Layer
+	var timeout <-chan time.Time
+	for len(ready) < len(sc.rids) {
+		select {
+		case l := <-sc.ready:
+			ready = append(ready, l)
+			if timeout == nil {
+				timeout = time.After(simulcastWait)
+			}
+			continue
+		case <-timeout:
+		case <-r.ctx.Done():
+			return
+		}
+		break
+	}
+	sort.Slice(ready, func(i, j int) bool { return layerSize(ready[i]) > layerSize(ready[j]) })
+	primary := ready[0]
+	sc.mu.Lock()
+	primary.Primary = true
+	sc.mu.Unlock()
+	r.log.Info().Str("rid", primary.RID).Int("layers", len(ready)).Msg("selected primary simulcast layer")
+	codecData <- primary.CodecData
+	src := primary.Queue.Latest()
+	for {
+		pkt, err := src.ReadPacket()
+		if err != nil {
+			return
+		}
+		if err := dest.WritePacket(pkt); err != nil {
+			return
+		}
+	}
+}
+
+func layerSize(l *Layer) int {
+	if vcd, ok := l.CodecData.(av.VideoCodecData); ok {
+		return vcd.Width() * vcd.Height()
+	}
+	return 0
+}
+
+func (sc *simulcast) close() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, l := range sc.layers {
+		l.Queue.Close()
+	}
+}
+
+// Layers returns the simulcast layers that are ready to play
+func (r *Receiver) Layers() []Layer {
+	if r.simulcast == nil {
+		return nil
+	}
+	sc := r.simulcast
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	var layers []Layer
+	for _, l := range sc.layers {
+		if l.CodecData != nil {
+			layers = append(layers, *l)
+		}
+	}
+	return layers
+}
+
+// RequestKeyframe asks the publisher to send a keyframe on the given layer.
+// Use an empty RID when simulcast is not in use.
+func (r *Receiver) RequestKeyframe(rid string) {
+	r.ssrcMu.Lock()
+	ssrc, ok := r.videoSSRCs[rid]
+	if !ok || time.Since(r.lastPLI[rid]) < keyframeInterval {
+		r.ssrcMu.Unlock()
+		return
+	}
+	r.lastPLI[rid] = time.Now()
+	r.ssrcMu.Unlock()
+	if err := r.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: ssrc}}); err != nil {
+		r.log.Debug().Err(err).Str("rid", rid).Msg("failed to request keyframe")
+	}
+}
+
+func (r *Receiver) setVideoSSRC(tr *webrtc.TrackRemote) {
+	r.ssrcMu.Lock()
+	defer r.ssrcMu.Unlock()
+	if r.videoSSRCs == nil {
+		r.videoSSRCs = make(map[string]uint32)
+		r.lastPLI = make(map[string]time.Time)
+	}
+	r.videoSSRCs[tr.RID()] = uint32(tr.SSRC())
+}
@@ -5,9 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"eaglesong.dev/gunk/av1util"
+	"eaglesong.dev/gunk/h265util"
 	"eaglesong.dev/gunk/internal"
 	"eaglesong.dev/gunk/internal/rtcengine"
 	"github.com/nareix/joy4/av"
@@ -39,6 +42,11 @@ type Receiver struct {
 	cancel context.CancelFunc
 	log    *zerolog.Logger
 	sdp    webrtc.SessionDescription
+
+	simulcast  *simulcast
+	ssrcMu     sync.Mutex
+	videoSSRCs map[string]uint32
+	lastPLI    map[string]time.Time
 }
 
 func Receive(ctx context.Context, e *rtcengine.Engine, offer []byte, dest *pubsub.Queue) (*Receiver, error) {
@@ -78,12 +86,35 @@ func (r *Receiver) start(offer []byte, dest *pubsub.Queue) error {
 		}
 	})
 	codecDatas := r.startGatheringHeaders(dest)
+	if rids := simulcastRIDs(offer); rids != nil {
+		// each layer gets its own queue, and the best one is copied to dest
+		r.simulcast = newSimulcast(rids)
+		go r.selectPrimary(codecDatas[videoIdx], dest)
+	}
 	r.pc.OnTrack(func(tr *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		var vdest av.PacketWriter = dest
+		var vcd chan<- av.CodecData = codecDatas[videoIdx]
+		if tr.Kind() == webrtc.RTPCodecTypeVideo {
+			if r.simulcast != nil && tr.RID() != "" {
+				vdest, vcd = r.simulcast.addLayer(tr)
+			}
+			r.setVideoSSRC(tr)
+		}
 		switch strings.ToLower(tr.Codec().MimeType) {
 		case strings.ToLower(webrtc.MimeTypeOpus):
 			r.startOpusTrack(tr, dest, codecDatas[audioIdx])
 		case strings.ToLower(webrtc.MimeTypeH264):
-			r.startH264Track(tr, dest, codecDatas[videoIdx])
+			dpkt := &codecs.H264Packet{IsAVC: true} // convert to AVCC
+			r.startVideoTrack(tr, vdest, dpkt, &h264sampler{cd: vcd})
+		case strings.ToLower(webrtc.MimeTypeH265):
+			dpkt := &h265util.Depacketizer{} // convert to HVCC
+			r.startVideoTrack(tr, vdest, dpkt, &h265sampler{cd: vcd})
+		case strings.ToLower(webrtc.MimeTypeVP8):
+			r.startVideoTrack(tr, vdest, &codecs.VP8Packet{}, &vp8sampler{cd: vcd})
+		case strings.ToLower(webrtc.MimeTypeVP9):
+			r.startVideoTrack(tr, vdest, &codecs.VP9Packet{}, &vp9sampler{cd: vcd})
+		case strings.ToLower(webrtc.MimeTypeAV1):
+			r.startVideoTrack(tr, vdest, &av1util.Depacketizer{}, &av1sampler{cd: vcd})
 		default:
 			r.log.Error().Msgf("unsupported codec type %s", tr.Codec().MimeType)
 			return
@@ -133,6 +164,9 @@ func (r *Receiver) Done() <-chan struct{} {
 func (r *Receiver) Close() {
 	r.cancel()
 	r.pc.Close()
+	if r.simulcast != nil {
+		r.simulcast.close()
+	}
 }
 
 func (r *Receiver) receiveTrack(tr *webrtc.TrackRemote, dest av.PacketWriter, idx int8, depacketizer rtp.Depacketizer, sampler sampler) error {
@@ -214,13 +248,11 @@ func (r *Receiver) startOpusTrack(tr *webrtc.TrackRemote, dest av.PacketWriter,
 	}()
 }
 
-func (r *Receiver) startH264Track(tr *webrtc.TrackRemote, dest av.PacketWriter, codecData chan<- av.CodecData) {
+func (r *Receiver) startVideoTrack(tr *webrtc.TrackRemote, dest av.PacketWriter, dpkt rtp.Depacketizer, sampler sampler) {
 	go r.trackStats(tr)
 	go func() {
-		dpkt := &codecs.H264Packet{IsAVC: true} // convert to AVCC
-		sampler := &h264sampler{cd: codecData}
 		if err := r.receiveTrack(tr, dest, videoIdx, dpkt, sampler); err != nil {
-			r.log.Err(err).Msg("h264 track terminated")
+			r.log.Err(err).Str("mtype", tr.Codec().MimeType).Msg("video track terminated")
 		}
 	}()
 }
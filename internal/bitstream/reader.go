@@ -0,0 +1,89 @@
+// Package bitstream reads bit fields from codec headers
+package bitstream
+
+import "errors"
+
+var errBitsExhausted = errors.New("bitstream exhausted")
+
+// Reader reads big-endian bit fields from a byte slice
+type Reader struct {
+	buf []byte
+	pos int
+}
+
+func NewReader(b []byte) *Reader {
+	return &Reader{buf: b}
+}
+
+// ReadBits reads up to 64 bits as an unsigned integer
+func (r *Reader) ReadBits(n int) (v uint64, err error) {
+	if r.pos+n > len(r.buf)*8 {
+		return 0, errBitsExhausted
+	}
+	for i := 0; i < n; i++ {
+		bit := r.buf[r.pos/8] >> (7 - r.pos%8) & 1
+		v = v<<1 | uint64(bit)
+		r.pos++
+	}
+	return v, nil
+}
+
+func (r *Reader) ReadBit() (bool, error) {
+	v, err := r.ReadBits(1)
+	return v != 0, err
+}
+
+func (r *Reader) Skip(n int) error {
+	if r.pos+n > len(r.buf)*8 {
+		return errBitsExhausted
+	}
+	r.pos += n
+	return nil
+}
+
+// ReadUE reads an unsigned Exp-Golomb code
+func (r *Reader) ReadUE() (uint64, error) {
+	zeros := 0
+	for {
+		bit, err := r.ReadBit()
+		if err != nil {
+			return 0, err
+		} else if bit {
+			break
+		}
+		zeros++
+		if zeros > 32 {
+			return 0, errors.New("invalid exp-golomb code")
+		}
+	}
+	v, err := r.ReadBits(zeros)
+	return v + 1<<zeros - 1, err
+}
+
+// ReadSE reads a signed Exp-Golomb code
+func (r *Reader) ReadSE() (int64, error) {
+	v, err := r.ReadUE()
+	if v&1 != 0 {
+		return int64(v+1) / 2, err
+	}
+	return -int64(v / 2), err
+}
+
+// UnescapeRBSP removes emulation prevention bytes from a H.264 or H.265 NALU
+func UnescapeRBSP(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, c)
+	}
+	return out
+}
@@ -0,0 +1,81 @@
+// Package blobstore keeps binary objects such as thumbnails outside the
+// database
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ErrNotFound is returned when a blob does not exist
+var ErrNotFound = errors.New("blob not found")
+
+// Store holds blobs by key. Keys are slash-separated paths.
+type Store interface {
+	Put(ctx context.Context, key, contentType string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+	// URL returns a public URL serving the blob directly, or an empty string
+	// if the store can't be reached by clients
+	URL(key string) string
+}
+
+// Open returns the store described by spec, which is either a directory,
+// a file:// URL or an S3 URL of the form
+//
+//	s3://[key:secret@]bucket[/prefix]?endpoint=https://...&region=...&path_style=1&public_url=https://...
+//
+// S3 credentials not given in the URL are read from AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY.
+func Open(spec string) (Store, error) {
+	if !strings.Contains(spec, "://") {
+		return &FS{Dir: spec}, nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		return &FS{Dir: u.Path}, nil
+	case "s3":
+		return openS3(u)
+	}
+	return nil, fmt.Errorf("unsupported blob store %q", u.Scheme)
+}
+
+func openS3(u *url.URL) (*S3, error) {
+	q := u.Query()
+	s := &S3{
+		Bucket:    u.Host,
+		Prefix:    strings.Trim(u.Path, "/"),
+		Region:    q.Get("region"),
+		PathStyle: q.Get("path_style") != "",
+		PublicURL: q.Get("public_url"),
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}
+	if u.User != nil {
+		s.AccessKey = u.User.Username()
+		s.SecretKey, _ = u.User.Password()
+	}
+	if s.Region == "" {
+		s.Region = "us-east-1"
+	}
+	endpoint := q.Get("endpoint")
+	if endpoint == "" {
+		endpoint = "https://s3." + s.Region + ".amazonaws.com"
+	}
+	var err error
+	if s.Endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("parsing S3 endpoint: %w", err)
+	}
+	if s.Bucket == "" {
+		return nil, errors.New("S3 blob store URL is missing the bucket")
+	}
+	return s, nil
+}
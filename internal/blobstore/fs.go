@@ -0,0 +1,75 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FS stores blobs as files under a directory
+type FS struct {
+	Dir string
+}
+
+func (s *FS) path(key string) (string, error) {
+	p := filepath.Join(s.Dir, filepath.FromSlash(key))
+	if !strings.HasPrefix(p, filepath.Clean(s.Dir)+string(filepath.Separator)) {
+		return "", errors.New("invalid blob key")
+	}
+	return p, nil
+}
+
+// Put writes a blob, replacing it atomically
+func (s *FS) Put(ctx context.Context, key, contentType string, data []byte) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), ".blob-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+func (s *FS) Get(ctx context.Context, key string) ([]byte, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (s *FS) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// URL returns an empty string, files are served by the application
+func (s *FS) URL(key string) string {
+	return ""
+}
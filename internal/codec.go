@@ -1,6 +1,8 @@
 package internal
 
 import (
+	"eaglesong.dev/gunk/codec/av1parser"
+	"eaglesong.dev/gunk/codec/hevcparser"
 	"github.com/nareix/joy4/av"
 	"github.com/nareix/joy4/codec/aacparser"
 	"github.com/nareix/joy4/codec/h264parser"
@@ -25,6 +27,12 @@ func CodecTag(cd av.CodecData, e *zerolog.Event) {
 			cd.RecordInfo.AVCLevelIndication})
 		e.Hex("avc1_pps", cd.PPS())
 		e.Hex("avc1_sps", cd.SPS())
+	case hevcparser.CodecData:
+		e.Hex("hvc1_vps", cd.VPS())
+		e.Hex("hvc1_sps", cd.SPS())
+		e.Hex("hvc1_pps", cd.PPS())
+	case av1parser.CodecData:
+		e.Hex("av1c", cd.ConfigurationRecordBytes())
 	case aacparser.CodecData:
 		e.Hex("aac_conf", cd.MPEG4AudioConfigBytes())
 	}
@@ -0,0 +1,18 @@
+package internal
+
+import (
+	"expvar"
+	"time"
+)
+
+// firstFrame counts new viewers of each output and the total time they waited
+// for their first keyframe. Viewers that start from a cached GOP get one
+// right away, so the average shows how often that happens.
+var firstFrame = expvar.NewMap("first_frame")
+
+// FirstFrame records how long a new viewer of output waited for its first
+// keyframe
+func FirstFrame(output string, wait time.Duration) {
+	firstFrame.Add(output+"_viewers", 1)
+	firstFrame.Add(output+"_wait_ms", wait.Milliseconds())
+}
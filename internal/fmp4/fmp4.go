@@ -0,0 +1,429 @@
+// Package fmp4 writes streams as fragmented MP4, for the outputs that build
+// their own segments or send a continuous stream
+package fmp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"eaglesong.dev/gunk/codec/av1parser"
+	"eaglesong.dev/gunk/codec/hevcparser"
+	"eaglesong.dev/gunk/internal"
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+const (
+	videoTimescale = 90000
+
+	sampleFlagsSync    = 0x02000000 // depends on no other sample
+	sampleFlagsNonSync = 0x01010000 // depends on others, not a sync sample
+)
+
+// boxWriter builds ISO BMFF boxes, filling in their sizes when they end
+type boxWriter struct {
+	b     []byte
+	stack []int
+}
+
+func (w *boxWriter) start(typ string) {
+	w.stack = append(w.stack, len(w.b))
+	w.b = append(w.b, 0, 0, 0, 0)
+	w.b = append(w.b, typ...)
+}
+
+func (w *boxWriter) startFull(typ string, version byte, flags uint32) {
+	w.start(typ)
+	w.u32(uint32(version)<<24 | flags)
+}
+
+func (w *boxWriter) end() {
+	i := w.stack[len(w.stack)-1]
+	w.stack = w.stack[:len(w.stack)-1]
+	binary.BigEndian.PutUint32(w.b[i:], uint32(len(w.b)-i))
+}
+
+func (w *boxWriter) u8(v uint8)   { w.b = append(w.b, v) }
+func (w *boxWriter) u16(v uint16) { w.b = binary.BigEndian.AppendUint16(w.b, v) }
+func (w *boxWriter) u32(v uint32) { w.b = binary.BigEndian.AppendUint32(w.b, v) }
+func (w *boxWriter) u64(v uint64) { w.b = binary.BigEndian.AppendUint64(w.b, v) }
+func (w *boxWriter) raw(b []byte) { w.b = append(w.b, b...) }
+
+func (w *boxWriter) zeros(n int) {
+	for i := 0; i < n; i++ {
+		w.b = append(w.b, 0)
+	}
+}
+
+// unity transformation matrix
+func (w *boxWriter) matrix() {
+	for _, v := range []uint32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000} {
+		w.u32(v)
+	}
+}
+
+// Track is one stream of a fragmented MP4 file
+type Track struct {
+	ID        uint32
+	Codec     av.CodecData
+	Timescale uint64
+	Video     bool
+
+	pending *av.Packet
+}
+
+// Sample is a packet ready to be written to a fragment
+type Sample struct {
+	Data     []byte
+	DTS      uint64 // in the track's timescale
+	Duration uint32
+	CTO      int32
+	Key      bool
+
+	// position on the stream timeline
+	Time, Length time.Duration
+}
+
+// NewTrack returns a track for a stream. Video is timed at 90kHz and audio at
+// its sample rate.
+func NewTrack(id uint32, cd av.CodecData) (*Track, error) {
+	t := &Track{ID: id, Codec: cd}
+	switch cd.(type) {
+	case h264parser.CodecData, hevcparser.CodecData, av1parser.CodecData:
+		t.Video = true
+		t.Timescale = videoTimescale
+	case aacparser.CodecData:
+		t.Timescale = uint64(cd.(av.AudioCodecData).SampleRate())
+	default:
+		if cd.Type() != av.OPUS {
+			return nil, fmt.Errorf("fmp4: unsupported codec %T", cd)
+		}
+		t.Timescale = 48000
+	}
+	return t, nil
+}
+
+// Push holds a packet until the next one on the same track arrives, so that
+// its duration is known, and returns the sample for the previous one
+func (t *Track) Push(pkt av.Packet) (Sample, bool) {
+	prev := t.pending
+	t.pending = &pkt
+	if prev == nil {
+		return Sample{}, false
+	}
+	dts := internal.ToTS(prev.Time, t.Timescale)
+	s := Sample{
+		Data:   prev.Data,
+		DTS:    dts,
+		CTO:    int32(internal.ToTS(prev.CompositionTime, t.Timescale)),
+		Key:    prev.IsKeyFrame,
+		Time:   prev.Time,
+		Length: pkt.Time - prev.Time,
+	}
+	if pkt.Time >= prev.Time {
+		s.Duration = uint32(internal.ToTS(pkt.Time, t.Timescale) - dts)
+	} else {
+		s.Length = 0
+	}
+	return s, true
+}
+
+// InitSegment returns the ftyp and moov boxes describing tracks
+func InitSegment(tracks []*Track) []byte {
+	w := new(boxWriter)
+	w.start("ftyp")
+	w.raw([]byte("iso6"))
+	w.u32(0)
+	w.raw([]byte("iso6cmfcmp41"))
+	w.end()
+
+	w.start("moov")
+	w.startFull("mvhd", 0, 0)
+	w.u32(0)    // creation time
+	w.u32(0)    // modification time
+	w.u32(1000) // timescale
+	w.u32(0)    // duration
+	w.u32(0x10000)
+	w.u16(0x100)
+	w.zeros(10)
+	w.matrix()
+	w.zeros(24)
+	w.u32(uint32(len(tracks) + 1)) // next track ID
+	w.end()
+	for _, t := range tracks {
+		writeTrak(w, t)
+	}
+	w.start("mvex")
+	for _, t := range tracks {
+		w.startFull("trex", 0, 0)
+		w.u32(t.ID)
+		w.u32(1) // sample description index
+		w.u32(0)
+		w.u32(0)
+		w.u32(0)
+		w.end()
+	}
+	w.end()
+	w.end()
+	return w.b
+}
+
+func writeTrak(w *boxWriter, t *Track) {
+	var width, height int
+	if vcd, ok := t.Codec.(av.VideoCodecData); ok {
+		width, height = vcd.Width(), vcd.Height()
+	}
+	w.start("trak")
+	w.startFull("tkhd", 0, 3) // enabled, in movie
+	w.u32(0)
+	w.u32(0)
+	w.u32(t.ID)
+	w.u32(0)
+	w.u32(0) // duration
+	w.zeros(8)
+	w.u16(0) // layer
+	w.u16(0) // alternate group
+	if t.Video {
+		w.u16(0)
+	} else {
+		w.u16(0x100)
+	}
+	w.u16(0)
+	w.matrix()
+	w.u32(uint32(width) << 16)
+	w.u32(uint32(height) << 16)
+	w.end()
+
+	w.start("mdia")
+	w.startFull("mdhd", 0, 0)
+	w.u32(0)
+	w.u32(0)
+	w.u32(uint32(t.Timescale))
+	w.u32(0)
+	w.u16(0x55c4) // und
+	w.u16(0)
+	w.end()
+	w.startFull("hdlr", 0, 0)
+	w.u32(0)
+	if t.Video {
+		w.raw([]byte("vide"))
+		w.zeros(12)
+		w.raw([]byte("Video\x00"))
+	} else {
+		w.raw([]byte("soun"))
+		w.zeros(12)
+		w.raw([]byte("Audio\x00"))
+	}
+	w.end()
+
+	w.start("minf")
+	if t.Video {
+		w.startFull("vmhd", 0, 1)
+		w.zeros(8)
+	} else {
+		w.startFull("smhd", 0, 0)
+		w.zeros(4)
+	}
+	w.end()
+	w.start("dinf")
+	w.startFull("dref", 0, 0)
+	w.u32(1)
+	w.startFull("url ", 0, 1) // self-contained
+	w.end()
+	w.end()
+	w.end()
+
+	w.start("stbl")
+	w.startFull("stsd", 0, 0)
+	w.u32(1)
+	writeSampleEntry(w, t, width, height)
+	w.end()
+	for _, typ := range []string{"stts", "stsc", "stco"} {
+		w.startFull(typ, 0, 0)
+		w.u32(0)
+		w.end()
+	}
+	w.startFull("stsz", 0, 0)
+	w.u32(0)
+	w.u32(0)
+	w.end()
+	w.end() // stbl
+	w.end() // minf
+	w.end() // mdia
+	w.end() // trak
+}
+
+func writeSampleEntry(w *boxWriter, t *Track, width, height int) {
+	var typ, configType string
+	var config []byte
+	switch cd := t.Codec.(type) {
+	case h264parser.CodecData:
+		typ, configType, config = "avc1", "avcC", cd.AVCDecoderConfRecordBytes()
+	case hevcparser.CodecData:
+		typ, configType, config = "hvc1", "hvcC", cd.DecoderConfRecordBytes()
+	case av1parser.CodecData:
+		typ, configType, config = "av01", "av1C", cd.ConfigurationRecordBytes()
+	}
+	if t.Video {
+		w.start(typ)
+		w.zeros(6)
+		w.u16(1) // data reference index
+		w.zeros(16)
+		w.u16(uint16(width))
+		w.u16(uint16(height))
+		w.u32(0x480000) // 72 dpi
+		w.u32(0x480000)
+		w.u32(0)
+		w.u16(1) // frame count
+		w.zeros(32)
+		w.u16(0x18) // depth
+		w.u16(0xffff)
+		w.start(configType)
+		w.raw(config)
+		w.end()
+		w.end()
+		return
+	}
+	acd := t.Codec.(av.AudioCodecData)
+	channels := acd.ChannelLayout().Count()
+	if t.Codec.Type() == av.OPUS {
+		w.start("Opus")
+	} else {
+		w.start("mp4a")
+	}
+	w.zeros(6)
+	w.u16(1)
+	w.zeros(8)
+	w.u16(uint16(channels))
+	w.u16(16) // sample size
+	w.zeros(4)
+	w.u32(uint32(t.Timescale) << 16)
+	if cd, ok := t.Codec.(aacparser.CodecData); ok {
+		writeESDS(w, cd.MPEG4AudioConfigBytes())
+	} else {
+		w.start("dOps")
+		w.u8(0)
+		w.u8(uint8(channels))
+		w.u16(3840) // pre-skip
+		w.u32(48000)
+		w.u16(0) // output gain
+		w.u8(0)  // mono or stereo mapping
+		w.end()
+	}
+	w.end()
+}
+
+func writeESDS(w *boxWriter, asc []byte) {
+	w.startFull("esds", 0, 0)
+	descriptor := func(tag byte, size int) {
+		w.u8(tag)
+		w.u8(byte(size))
+	}
+	decSpecific := 2 + len(asc)
+	decConfig := 2 + 13 + decSpecific
+	slConfig := 2 + 1
+	descriptor(0x03, 3+decConfig+slConfig) // ES descriptor
+	w.u16(1)                               // ES ID
+	w.u8(0)
+	descriptor(0x04, 13+decSpecific) // decoder config
+	w.u8(0x40)                       // MPEG-4 audio
+	w.u8(0x15)                       // audio stream
+	w.zeros(3)                       // buffer size
+	w.u32(0)                         // max bitrate
+	w.u32(0)                         // average bitrate
+	descriptor(0x05, len(asc))
+	w.raw(asc)
+	descriptor(0x06, 1) // SL config
+	w.u8(2)
+	w.end()
+}
+
+// Fragment returns a moof and mdat holding one run of samples per track.
+// Tracks without samples are left out.
+func Fragment(seq uint32, tracks []*Track, samples [][]Sample) []byte {
+	w := new(boxWriter)
+	w.start("moof")
+	w.startFull("mfhd", 0, 0)
+	w.u32(seq)
+	w.end()
+	type offsetField struct {
+		pos    int
+		offset int
+	}
+	var offsets []offsetField
+	var mdatSize int
+	for i, t := range tracks {
+		if len(samples[i]) == 0 {
+			continue
+		}
+		w.start("traf")
+		w.startFull("tfhd", 0, 0x020000) // default base is moof
+		w.u32(t.ID)
+		w.end()
+		w.startFull("tfdt", 1, 0)
+		w.u64(samples[i][0].DTS)
+		w.end()
+		// data offset, duration, size, flags, composition offset
+		w.startFull("trun", 1, 0x000f01)
+		w.u32(uint32(len(samples[i])))
+		offsets = append(offsets, offsetField{pos: len(w.b), offset: mdatSize})
+		w.u32(0)
+		for _, s := range samples[i] {
+			w.u32(s.Duration)
+			w.u32(uint32(len(s.Data)))
+			if s.Key || !t.Video {
+				w.u32(sampleFlagsSync)
+			} else {
+				w.u32(sampleFlagsNonSync)
+			}
+			w.u32(uint32(s.CTO))
+			mdatSize += len(s.Data)
+		}
+		w.end()
+		w.end()
+	}
+	w.end()
+	// data offsets are relative to the start of moof
+	moofSize := len(w.b)
+	for _, o := range offsets {
+		binary.BigEndian.PutUint32(w.b[o.pos:], uint32(moofSize+8+o.offset))
+	}
+	w.start("mdat")
+	for i := range tracks {
+		for _, s := range samples[i] {
+			w.raw(s.Data)
+		}
+	}
+	w.end()
+	return w.b
+}
+
+// Event is timed metadata carried in an emsg box
+type Event struct {
+	At, Duration time.Duration
+	Scheme       string
+	Data         []byte
+}
+
+// Emsg returns a version 1 event message box, timed in milliseconds on the
+// media timeline
+func Emsg(id uint32, ev Event) []byte {
+	w := new(boxWriter)
+	w.startFull("emsg", 1, 0)
+	w.u32(1000)
+	w.u64(uint64(ev.At / time.Millisecond))
+	if ev.Duration > 0 {
+		w.u32(uint32(ev.Duration / time.Millisecond))
+	} else {
+		w.u32(0xffffffff) // unknown
+	}
+	w.u32(id)
+	w.raw([]byte(ev.Scheme))
+	w.u8(0)
+	w.u8(0) // value
+	w.raw(ev.Data)
+	w.end()
+	return w.b
+}
@@ -0,0 +1,82 @@
+package fmp4
+
+import (
+	"io"
+
+	"github.com/nareix/joy4/av"
+)
+
+// Muxer writes a stream to w as one continuous fragmented MP4 file. A fragment
+// is written for each frame of the first video track, so that a player can
+// start as soon as it has the first keyframe.
+type Muxer struct {
+	w       io.Writer
+	tracks  []*Track
+	samples [][]Sample
+	primary int
+	seq     uint32
+}
+
+func NewMuxer(w io.Writer) *Muxer {
+	return &Muxer{w: w}
+}
+
+// WriteHeader writes the init segment. It fails if a codec can't be carried in
+// fMP4.
+func (m *Muxer) WriteHeader(streams []av.CodecData) error {
+	m.tracks = nil
+	m.primary = -1
+	for i, cd := range streams {
+		t, err := NewTrack(uint32(i+1), cd)
+		if err != nil {
+			return err
+		}
+		if t.Video && m.primary < 0 {
+			m.primary = i
+		}
+		m.tracks = append(m.tracks, t)
+	}
+	if m.primary < 0 {
+		m.primary = 0
+	}
+	m.samples = make([][]Sample, len(m.tracks))
+	_, err := m.w.Write(InitSegment(m.tracks))
+	return err
+}
+
+func (m *Muxer) WritePacket(pkt av.Packet) error {
+	if int(pkt.Idx) >= len(m.tracks) {
+		return nil
+	}
+	s, ok := m.tracks[pkt.Idx].Push(pkt)
+	if !ok {
+		return nil
+	}
+	m.samples[pkt.Idx] = append(m.samples[pkt.Idx], s)
+	if int(pkt.Idx) != m.primary {
+		return nil
+	}
+	return m.flush()
+}
+
+// WriteTrailer writes the samples still waiting for a fragment. The last
+// packet of each track is dropped since its duration isn't known.
+func (m *Muxer) WriteTrailer() error {
+	return m.flush()
+}
+
+func (m *Muxer) flush() error {
+	var any bool
+	for _, s := range m.samples {
+		any = any || len(s) != 0
+	}
+	if !any {
+		return nil
+	}
+	m.seq++
+	_, err := m.w.Write(Fragment(m.seq, m.tracks, m.samples))
+	for i := range m.samples {
+		m.samples[i] = m.samples[i][:0]
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package fmp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testBox struct {
+	typ  string
+	body []byte
+}
+
+func splitBoxes(t *testing.T, b []byte) []testBox {
+	var boxes []testBox
+	for len(b) > 0 {
+		require.GreaterOrEqual(t, len(b), 8)
+		size := binary.BigEndian.Uint32(b)
+		require.LessOrEqual(t, int(size), len(b))
+		boxes = append(boxes, testBox{typ: string(b[4:8]), body: b[8:size]})
+		b = b[size:]
+	}
+	return boxes
+}
+
+func findBox(t *testing.T, b []byte, path ...string) []byte {
+	for _, typ := range path {
+		var found []byte
+		for _, c := range splitBoxes(t, b) {
+			if c.typ == typ {
+				found = c.body
+				break
+			}
+		}
+		require.NotNil(t, found, "no %s box", typ)
+		b = found
+	}
+	return b
+}
+
+func TestMuxer(t *testing.T) {
+	const frame = time.Second / 30
+	var buf bytes.Buffer
+	m := NewMuxer(&buf)
+	require.NoError(t, m.WriteHeader([]av.CodecData{h264parser.CodecData{}}))
+	for i := 0; i < 4; i++ {
+		require.NoError(t, m.WritePacket(av.Packet{
+			IsKeyFrame: i == 0,
+			Time:       time.Duration(i) * frame,
+			Data:       []byte{byte(i), byte(i)},
+		}))
+	}
+	require.NoError(t, m.WriteTrailer())
+
+	boxes := splitBoxes(t, buf.Bytes())
+	var types []string
+	for _, b := range boxes {
+		types = append(types, b.typ)
+	}
+	// the last frame is held since its duration isn't known
+	require.Equal(t, []string{"ftyp", "moov", "moof", "mdat", "moof", "mdat", "moof", "mdat"}, types)
+	for i := 0; i < 3; i++ {
+		moof := boxes[2+2*i].body
+		tfdt := findBox(t, moof, "traf", "tfdt")
+		assert.EqualValues(t, i*3000, binary.BigEndian.Uint64(tfdt[4:]), "fragment %d", i)
+		trun := findBox(t, moof, "traf", "trun")
+		assert.EqualValues(t, 1, binary.BigEndian.Uint32(trun[4:]), "sample count")
+		assert.EqualValues(t, 3000, binary.BigEndian.Uint32(trun[12:]), "duration")
+		flags := binary.BigEndian.Uint32(trun[20:])
+		if i == 0 {
+			assert.EqualValues(t, sampleFlagsSync, flags)
+		} else {
+			assert.EqualValues(t, sampleFlagsNonSync, flags)
+		}
+		assert.Equal(t, []byte{byte(i), byte(i)}, boxes[3+2*i].body)
+	}
+}
+
+func TestTrackPush(t *testing.T) {
+	tr, err := NewTrack(1, h264parser.CodecData{})
+	require.NoError(t, err)
+	_, ok := tr.Push(av.Packet{Time: time.Second, CompositionTime: 40 * time.Millisecond, IsKeyFrame: true})
+	assert.False(t, ok, "first packet is held")
+	s, ok := tr.Push(av.Packet{Time: time.Second + 20*time.Millisecond})
+	require.True(t, ok)
+	assert.Equal(t, Sample{
+		DTS:      90000,
+		Duration: 1800,
+		CTO:      3600,
+		Key:      true,
+		Time:     time.Second,
+		Length:   20 * time.Millisecond,
+	}, s)
+	// going backwards gives an empty duration
+	s, ok = tr.Push(av.Packet{Time: time.Second})
+	require.True(t, ok)
+	assert.Zero(t, s.Duration)
+	assert.Zero(t, s.Length)
+}
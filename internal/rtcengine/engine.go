@@ -10,11 +10,18 @@ import (
 
 	"github.com/pion/ice/v2"
 	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
 	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/interceptor/pkg/twcc"
+	"github.com/pion/sdp/v3"
 	"github.com/pion/webrtc/v3"
 	"github.com/rs/zerolog/log"
 )
 
+// starting point for the send-side bandwidth estimate, before feedback arrives
+const initialBitrate = 2_500_000
+
 type Engine struct {
 	AdvertiseHost string
 	ReceiveWindow time.Duration
@@ -30,6 +37,15 @@ func New(advertiseHost string) (*Engine, error) {
 	if err := m.RegisterDefaultCodecs(); err != nil {
 		return nil, err
 	}
+	if err := registerExtraCodecs(m); err != nil {
+		return nil, err
+	}
+	// needed to receive simulcast
+	for _, uri := range []string{sdp.SDESMidURI, sdp.SDESRTPStreamIDURI} {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: uri}, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
+	}
 	e := &Engine{
 		media: m,
 		conf: webrtc.Configuration{
@@ -71,7 +87,7 @@ func New(advertiseHost string) (*Engine, error) {
 	return e, nil
 }
 
-func (e *Engine) Connection() (*webrtc.PeerConnection, stats.Getter, error) {
+func (e *Engine) newConnection(intReg *interceptor.Registry) (*webrtc.PeerConnection, error) {
 	var se webrtc.SettingEngine
 	types := []webrtc.NetworkType{webrtc.NetworkTypeUDP4}
 	if e.AdvertiseHost != "" {
@@ -108,6 +124,15 @@ func (e *Engine) Connection() (*webrtc.PeerConnection, stats.Getter, error) {
 		se.SetLite(true)
 		conf.ICEServers = nil
 	}
+	api := webrtc.NewAPI(
+		webrtc.WithMediaEngine(e.media),
+		webrtc.WithInterceptorRegistry(intReg),
+		webrtc.WithSettingEngine(se),
+	)
+	return api.NewPeerConnection(conf)
+}
+
+func (e *Engine) Connection() (*webrtc.PeerConnection, stats.Getter, error) {
 	intReg := new(interceptor.Registry)
 	if err := webrtc.RegisterDefaultInterceptors(e.media, intReg); err != nil {
 		return nil, nil, fmt.Errorf("configuring webrtc interceptors: %w", err)
@@ -121,11 +146,58 @@ func (e *Engine) Connection() (*webrtc.PeerConnection, stats.Getter, error) {
 		sgetter = g
 	})
 	intReg.Add(sFact)
-	api := webrtc.NewAPI(
-		webrtc.WithMediaEngine(e.media),
-		webrtc.WithInterceptorRegistry(intReg),
-		webrtc.WithSettingEngine(se),
-	)
-	pc, err := api.NewPeerConnection(conf)
+	pc, err := e.newConnection(intReg)
 	return pc, sgetter, err
 }
+
+// SenderConnection creates a connection for sending media, along with a
+// bandwidth estimator fed by the viewer's transport-wide congestion control
+// feedback
+func (e *Engine) SenderConnection() (*webrtc.PeerConnection, cc.BandwidthEstimator, error) {
+	intReg := new(interceptor.Registry)
+	if err := webrtc.RegisterDefaultInterceptors(e.media, intReg); err != nil {
+		return nil, nil, fmt.Errorf("configuring webrtc interceptors: %w", err)
+	}
+	// number outgoing packets so the viewer can send feedback
+	twccExt, err := twcc.NewHeaderExtensionInterceptor()
+	if err != nil {
+		return nil, nil, fmt.Errorf("configuring twcc interceptor: %w", err)
+	}
+	intReg.Add(twccExt)
+	ccFact, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(initialBitrate),
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+		)
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("configuring congestion control: %w", err)
+	}
+	var estimator cc.BandwidthEstimator
+	ccFact.OnNewPeerConnection(func(s string, bwe cc.BandwidthEstimator) {
+		estimator = bwe
+	})
+	intReg.Add(ccFact)
+	pc, err := e.newConnection(intReg)
+	return pc, estimator, err
+}
+
+// registerExtraCodecs adds codecs that pion doesn't enable by default
+func registerExtraCodecs(m *webrtc.MediaEngine) error {
+	videoRTCPFeedback := []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"}}
+	for _, codec := range []webrtc.RTPCodecParameters{
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH265, ClockRate: 90000, SDPFmtpLine: "level-id=93;profile-id=1;tier-flag=0;tx-mode=SRST", RTCPFeedback: videoRTCPFeedback},
+			PayloadType:        116,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH265, ClockRate: 90000, SDPFmtpLine: "level-id=93;profile-id=2;tier-flag=0;tx-mode=SRST", RTCPFeedback: videoRTCPFeedback},
+			PayloadType:        117,
+		},
+	} {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
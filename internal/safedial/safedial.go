@@ -0,0 +1,75 @@
+// Package safedial connects to addresses that users supply, such as webhook
+// and pull URLs, without letting them reach the server's own network
+package safedial
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+const dialTimeout = 10 * time.Second
+
+// ErrBlocked is returned when dialing an address that isn't public
+var ErrBlocked = errors.New("address is not public")
+
+// non-public ranges that aren't covered by the netip predicates
+var blocked = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT, some cloud metadata
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// Allowed returns true if ip is a public unicast address. Loopback, private,
+// link-local (including the 169.254.169.254 metadata service) and other
+// special ranges are not.
+func Allowed(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, p := range blocked {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// control refuses connections to addresses that aren't public. It runs after
+// names have been resolved, so it also catches names that point inside.
+func control(network, address string, c syscall.RawConn) error {
+	addr, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrBlocked, address)
+	}
+	if !Allowed(addr.Addr()) {
+		return fmt.Errorf("%w: %s", ErrBlocked, addr.Addr())
+	}
+	return nil
+}
+
+// Dialer returns a dialer that only connects to public addresses
+func Dialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+		Control:   control,
+	}
+}
+
+// Transport returns a HTTP transport that only connects to public addresses.
+// Redirects are checked as well since every connection goes through it.
+func Transport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	// a proxy would make the connection on our behalf
+	t.Proxy = nil
+	t.DialContext = Dialer().DialContext
+	return t
+}
@@ -0,0 +1,69 @@
+package safedial
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowed(t *testing.T) {
+	cases := []struct {
+		addr string
+		ok   bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"8.8.8.8", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00:ec2::254", false},
+		{"100.100.100.200", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"::ffff:8.8.8.8", true},
+	}
+	for _, c := range cases {
+		t.Run(c.addr, func(t *testing.T) {
+			assert.Equal(t, c.ok, Allowed(netip.MustParseAddr(c.addr)))
+		})
+	}
+}
+
+func TestDialer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	_, err = Dialer().DialContext(context.Background(), "tcp", l.Addr().String())
+	assert.ErrorIs(t, err, ErrBlocked)
+	// names are checked after they are resolved
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	_, err = Dialer().DialContext(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+	assert.ErrorIs(t, err, ErrBlocked)
+}
+
+func TestTransport(t *testing.T) {
+	var hit bool
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		hit = true
+	}))
+	defer srv.Close()
+	cli := &http.Client{Transport: Transport()}
+	_, err := cli.Get(srv.URL)
+	assert.ErrorIs(t, err, ErrBlocked)
+	assert.False(t, hit)
+}
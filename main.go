@@ -7,18 +7,19 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"eaglesong.dev/gunk/ingest"
 	"eaglesong.dev/gunk/ingest/irtmp"
 	"eaglesong.dev/gunk/ingest/rist"
+	"eaglesong.dev/gunk/internal/blobstore"
 	"eaglesong.dev/gunk/model"
 	"eaglesong.dev/gunk/web"
 	"eaglesong.dev/hls"
 	"github.com/joho/godotenv"
 	"github.com/nareix/joy4/av"
-	"github.com/nareix/joy4/format/rtmp"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
@@ -31,6 +32,10 @@ func main() {
 	_ = godotenv.Load(".env")
 	_ = godotenv.Load(".env.local")
 	viper.SetDefault("rtc_window", "1s")
+	viper.SetDefault("failover_timeout", "3s")
+	viper.SetDefault("slate_grace", "2m")
+	viper.SetDefault("reconnect_grace", "10s")
+	viper.SetDefault("listen_http", ":8009")
 	viper.AutomaticEnv()
 
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
@@ -59,6 +64,10 @@ func main() {
 			OpusBitrate: viper.GetInt("opus_bitrate"),
 			RTCHost:     viper.GetString("rtc_host"),
 			RTCWindow:   viper.GetDuration("rtc_window"),
+
+			FailoverTimeout: viper.GetDuration("failover_timeout"),
+			SlateGrace:      viper.GetDuration("slate_grace"),
+			ReconnectGrace:  viper.GetDuration("reconnect_grace"),
 		},
 	}
 	s.SetOauth(viper.GetString("client_id"), viper.GetString("client_secret"))
@@ -98,8 +107,27 @@ func main() {
 		s.Channels.PublishMode = hls.ModeSingleTrack
 	case "both":
 		s.Channels.PublishMode = hls.ModeSingleAndSeparate
+	case "llhls":
+		// DASH for the web player, LL-HLS for native players
+		s.Channels.PublishMode = hls.ModeSeparateTracks
+		s.Channels.LowLatency = true
 	default:
-		log.Fatal().Msg("WEB_MODE must be one of: dash, hls, both")
+		log.Fatal().Msg("WEB_MODE must be one of: dash, hls, both, llhls")
+	}
+	s.Channels.ClusterSecret = viper.GetString("cluster_secret")
+	if v := viper.GetString("origin_url"); v != "" {
+		// edge mode, channels are pulled from the origin
+		s.Channels.Origin, err = url.Parse(v)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid ORIGIN_URL")
+		}
+		if s.Channels.ClusterSecret == "" {
+			log.Fatal().Msg("ORIGIN_URL requires CLUSTER_SECRET")
+		}
+		s.Channels.NodeID = viper.GetString("node_id")
+		if s.Channels.NodeID == "" {
+			s.Channels.NodeID, _ = os.Hostname()
+		}
 	}
 	if v := viper.GetString("work_dir"); v != "" {
 		if err := os.MkdirAll(v, 0700); err != nil {
@@ -107,9 +135,41 @@ func main() {
 		}
 		s.Channels.WorkDir = v
 	}
+	blobSpec := viper.GetString("blob_store")
+	if blobSpec == "" {
+		blobSpec = filepath.Join(s.Channels.WorkDir, "blobs")
+	}
+	blobs, err := blobstore.Open(blobSpec)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid BLOB_STORE")
+	}
+	model.SetBlobStore(blobs)
+	tlsConfig, acm, err := configureTLS(s.Channels.WorkDir)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to configure TLS")
+	}
+	if tlsConfig != nil && viper.GetString("listen_https") != "" {
+		// served over TLS even if BASE_URL says otherwise
+		s.Secure = true
+	}
+	if viper.GetString("listen_http") == "off" && viper.GetString("listen_https") == "" {
+		log.Fatal().Msg("LISTEN_HTTP=off requires LISTEN_HTTPS")
+	}
 	if err := model.Connect(); err != nil {
 		log.Fatal().Err(err).Msg("failed to connect database")
 	}
+	if s.Channels.Origin == nil {
+		// thumbnails belong to the origin's blob store
+		if err := model.MigrateBlobs(context.Background()); err != nil {
+			log.Fatal().Err(err).Msg("failed to migrate database")
+		}
+		if viper.GetBool("drop_blob_columns") {
+			// once the blob store is known to hold every image
+			if err := model.DropBlobColumns(context.Background()); err != nil {
+				log.Fatal().Err(err).Msg("failed to migrate database")
+			}
+		}
+	}
 	if err := s.Initialize(); err != nil {
 		log.Fatal().Err(err).Msg("failed to start server")
 	}
@@ -123,21 +183,39 @@ func main() {
 	}
 
 	eg := new(errgroup.Group)
-	// rtmp.Debug = true
 	rs := &irtmp.Server{
-		Server: rtmp.Server{
-			Addr: viper.GetString("listen_rtmp"),
-		},
+		Addr: viper.GetString("listen_rtmp"),
 		CheckUser: func(u *url.URL) (model.ChannelAuth, error) {
 			chname := path.Base(u.Path)
 			key := u.Query().Get("key")
 			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 			defer cancel()
-			return model.VerifyPassword(ctx, chname, key)
+			auth, err := model.VerifyPassword(ctx, chname, key)
+			auth.Backup = u.Query().Get("backup") != ""
+			return auth, err
 		},
 		Publish: s.Channels.Publish,
 	}
 	eg.Go(func() error { return rs.ListenAndServe() })
+	if v := viper.GetString("listen_rtmps"); v != "" {
+		if tlsConfig == nil {
+			log.Fatal().Msg("LISTEN_RTMPS requires either TLS_CERT or ACME_DOMAINS")
+		}
+		eg.Go(func() error { return rs.ListenAndServeTLS(v, tlsConfig) })
+		if w := viper.GetString("rtmps_url"); w != "" {
+			s.AdvertiseRTMPS = strings.TrimSuffix(w, "/") + "/live"
+		} else {
+			_, port, err := net.SplitHostPort(v)
+			if err != nil {
+				log.Fatal().Err(err).Msg("unable to parse port from LISTEN_RTMPS")
+			}
+			hostport := liveHost
+			if port != "443" {
+				hostport = net.JoinHostPort(liveHost, port)
+			}
+			s.AdvertiseRTMPS = "rtmps://" + hostport + "/live"
+		}
+	}
 	if v := viper.GetString("listen_rist"); v != "" {
 		ristServer := rist.New(func(ctx context.Context, name string, src av.Demuxer) error {
 			ch, err := model.GetChannel(ctx, name)
@@ -165,14 +243,29 @@ func main() {
 			}
 		}
 	}
-	eg.Go(func() error {
+	handler := s.Handler()
+	// viper treats an empty variable as unset, so plain HTTP is turned off
+	// with LISTEN_HTTP=off
+	if v := viper.GetString("listen_http"); v != "off" {
+		srv := &http.Server{
+			Addr:              v,
+			Handler:           acmeHandler(acm, handler),
+			ReadHeaderTimeout: 15 * time.Second,
+		}
+		eg.Go(srv.ListenAndServe)
+	}
+	if v := viper.GetString("listen_https"); v != "" {
+		if tlsConfig == nil {
+			log.Fatal().Msg("LISTEN_HTTPS requires either TLS_CERT or ACME_DOMAINS")
+		}
 		srv := &http.Server{
-			Addr:              ":8009",
-			Handler:           s.Handler(),
+			Addr:              v,
+			Handler:           handler,
+			TLSConfig:         tlsConfig,
 			ReadHeaderTimeout: 15 * time.Second,
 		}
-		return srv.ListenAndServe()
-	})
+		eg.Go(func() error { return srv.ListenAndServeTLS("", "") })
+	}
 	go func() {
 		for range time.NewTicker(15 * time.Second).C {
 			s.Channels.Cleanup()
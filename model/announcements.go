@@ -0,0 +1,19 @@
+package model
+
+import (
+	"context"
+	"time"
+)
+
+// PutAnnouncement remembers the Discord message announcing a stream
+func PutAnnouncement(ctx context.Context, channelName, messageID string, started time.Time) error {
+	_, err := db.Exec(ctx, "INSERT INTO announcements (name, message_id, started) VALUES ($1, $2, $3) ON CONFLICT (name) DO UPDATE SET message_id = EXCLUDED.message_id, started = EXCLUDED.started", channelName, messageID, started)
+	return err
+}
+
+// TakeAnnouncement returns and forgets the message announcing a stream
+func TakeAnnouncement(ctx context.Context, channelName string) (messageID string, started time.Time, err error) {
+	row := db.QueryRow(ctx, "DELETE FROM announcements WHERE name = $1 RETURNING message_id, started", channelName)
+	err = row.Scan(&messageID, &started)
+	return
+}
@@ -0,0 +1,24 @@
+package model
+
+import (
+	"context"
+
+	"eaglesong.dev/gunk/internal/blobstore"
+)
+
+var blobs blobstore.Store = &blobstore.FS{Dir: "blobs"}
+
+// SetBlobStore sets where thumbnails and other images are kept
+func SetBlobStore(s blobstore.Store) {
+	blobs = s
+}
+
+// GetBlob returns the contents of a stored blob
+func GetBlob(ctx context.Context, key string) ([]byte, error) {
+	return blobs.Get(ctx, key)
+}
+
+// BlobURL returns a public URL for a stored blob, if the store has one
+func BlobURL(key string) string {
+	return blobs.URL(key)
+}
@@ -15,12 +15,16 @@ type ChannelAuth struct {
 	Name     string
 	Announce bool
 	Token    *oauth2.Token
+	// Backup publishers stand by until the primary fails
+	Backup bool
+	// AnnounceEnd is what happens to the announcement when the stream ends
+	AnnounceEnd string
 }
 
 func findChannel(ctx context.Context, column, value string) (auth ChannelAuth, key string, err error) {
-	row := db.QueryRow(ctx, "SELECT user_id, channel_defs.name, channel_defs.key, users.refresh_token, COALESCE(channel_defs.announce AND users.announce, false) FROM channel_defs LEFT JOIN users USING (user_id) WHERE "+column+" = $1", value)
+	row := db.QueryRow(ctx, "SELECT user_id, channel_defs.name, channel_defs.key, users.refresh_token, COALESCE(channel_defs.announce AND users.announce, false), channel_defs.announce_end FROM channel_defs LEFT JOIN users USING (user_id) WHERE "+column+" = $1", value)
 	var blob *string
-	err = row.Scan(&auth.UserID, &auth.Name, &key, &blob, &auth.Announce)
+	err = row.Scan(&auth.UserID, &auth.Name, &key, &blob, &auth.Announce, &auth.AnnounceEnd)
 	if err != nil || blob == nil || *blob == "" {
 		return
 	}
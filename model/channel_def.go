@@ -12,16 +12,55 @@ type ChannelDef struct {
 	Name     string `json:"name"`
 	Key      string `json:"key"`
 	Announce bool   `json:"announce"`
+	// AnnounceEnd is what happens to the announcement when the stream ends
+	AnnounceEnd string `json:"announce_end"`
 
 	RTMPDir  string `json:"rtmp_dir"`
+	RTMPSDir string `json:"rtmps_dir,omitempty"`
 	RTMPBase string `json:"rtmp_base"`
 
 	RISTUrl string `json:"rist_url"`
+
+	// PullURL is a remote stream to publish instead of waiting for a push
+	PullURL string      `json:"pull_url,omitempty"`
+	Pull    *PullStatus `json:"pull,omitempty"`
+	// Slate is true if an image or clip is shown while the publisher is away
+	Slate bool `json:"slate"`
+
+	ChannelMeta
+}
+
+// announcement behaviors for ChannelDef.AnnounceEnd
+const (
+	AnnounceEdit   = "edit"
+	AnnounceDelete = "delete"
+)
+
+// PullStatus is the state of a channel's pull source
+type PullStatus struct {
+	State   string `json:"state"`
+	Error   string `json:"error,omitempty"`
+	Since   int64  `json:"since"`
+	Retries int    `json:"retries"`
 }
 
-func (d *ChannelDef) SetURL(base string, rist *url.URL) {
+// pull source states reported in PullStatus.State
+const (
+	PullConnecting = "connecting"
+	PullLive       = "live"
+	PullRetrying   = "retrying"
+)
+
+// PullSource is a channel that is pulled from a remote URL
+type PullSource struct {
+	Auth ChannelAuth
+	URL  string
+}
+
+func (d *ChannelDef) SetURL(base, secureBase string, rist *url.URL) {
 	v := url.Values{"key": []string{d.Key}}
 	d.RTMPDir = base
+	d.RTMPSDir = secureBase
 	d.RTMPBase = url.PathEscape(d.Name) + "?" + v.Encode()
 	if rist != nil {
 		u2 := new(url.URL)
@@ -34,7 +73,7 @@ func (d *ChannelDef) SetURL(base string, rist *url.URL) {
 }
 
 func ListChannelDefs(ctx context.Context, userID string) (defs []*ChannelDef, err error) {
-	rows, err := db.Query(ctx, "SELECT name, key, announce FROM channel_defs WHERE user_id = $1", userID)
+	rows, err := db.Query(ctx, "SELECT name, key, announce, announce_end, COALESCE(pull_url, ''), title, description, category, tags, nsfw, EXISTS (SELECT 1 FROM slates WHERE slates.name = channel_defs.name) FROM channel_defs WHERE user_id = $1", userID)
 	if err != nil {
 		return
 	}
@@ -42,7 +81,7 @@ func ListChannelDefs(ctx context.Context, userID string) (defs []*ChannelDef, er
 	defs = []*ChannelDef{}
 	for rows.Next() {
 		def := new(ChannelDef)
-		if err = rows.Scan(&def.Name, &def.Key, &def.Announce); err != nil {
+		if err = rows.Scan(&def.Name, &def.Key, &def.Announce, &def.AnnounceEnd, &def.PullURL, &def.Title, &def.Description, &def.Category, &def.Tags, &def.NSFW, &def.Slate); err != nil {
 			return
 		}
 		defs = append(defs, def)
@@ -59,14 +98,20 @@ func CreateChannel(ctx context.Context, userID, name string) (def *ChannelDef, e
 		return
 	}
 	return &ChannelDef{
-		Name:     name,
-		Key:      key,
-		Announce: true,
+		Name:        name,
+		Key:         key,
+		Announce:    true,
+		AnnounceEnd: AnnounceEdit,
+		ChannelMeta: ChannelMeta{Tags: []string{}},
 	}, nil
 }
 
-func UpdateChannel(ctx context.Context, userID, name string, announce bool) error {
-	tag, err := db.Exec(ctx, "UPDATE channel_defs SET announce = $1 WHERE user_id = $2 AND name = $3", announce, userID, name)
+func UpdateChannel(ctx context.Context, userID, name string, announce bool, announceEnd string, meta ChannelMeta) error {
+	if meta.Tags == nil {
+		meta.Tags = []string{}
+	}
+	tag, err := db.Exec(ctx, "UPDATE channel_defs SET announce = $1, announce_end = $4, title = $5, description = $6, category = $7, tags = $8, nsfw = $9 WHERE user_id = $2 AND name = $3",
+		announce, userID, name, announceEnd, meta.Title, meta.Description, meta.Category, meta.Tags, meta.NSFW)
 	if err != nil {
 		return err
 	} else if tag.RowsAffected() == 0 {
@@ -79,3 +124,46 @@ func DeleteChannel(ctx context.Context, userID, name string) error {
 	_, err := db.Exec(ctx, "DELETE FROM channel_defs WHERE user_id = $1 AND name = $2", userID, name)
 	return err
 }
+
+// SetPullURL changes a channel's pull source. An empty URL removes it.
+func SetPullURL(ctx context.Context, userID, name, pullURL string) error {
+	var v *string
+	if pullURL != "" {
+		v = &pullURL
+	}
+	tag, err := db.Exec(ctx, "UPDATE channel_defs SET pull_url = $1 WHERE user_id = $2 AND name = $3", v, userID, name)
+	if err != nil {
+		return err
+	} else if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// ListPullSources returns every channel that has a pull source
+func ListPullSources(ctx context.Context) ([]PullSource, error) {
+	rows, err := db.Query(ctx, "SELECT name, pull_url FROM channel_defs WHERE pull_url IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	var sources []PullSource
+	for rows.Next() {
+		var name, pullURL string
+		if err := rows.Scan(&name, &pullURL); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		sources = append(sources, PullSource{Auth: ChannelAuth{Name: name}, URL: pullURL})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// fill in the owner for announcements
+	for i, src := range sources {
+		if sources[i].Auth, err = GetChannel(ctx, src.Auth.Name); err != nil {
+			return nil, err
+		}
+	}
+	return sources, nil
+}
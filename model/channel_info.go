@@ -2,6 +2,7 @@ package model
 
 import (
 	"context"
+	"slices"
 	"time"
 )
 
@@ -16,10 +17,26 @@ type ChannelInfo struct {
 	NativeURL string `json:"native_url"`
 	Viewers   int    `json:"viewers"`
 	RTC       bool   `json:"rtc"`
+	// video codec and playback modes of the live stream
+	Codec string   `json:"codec,omitempty"`
+	Modes []string `json:"modes,omitempty"`
+	// animated preview for hovering over the thumbnail
+	Preview     string `json:"preview,omitempty"`
+	PreviewLast int64  `json:"preview_last,omitempty"`
+
+	ChannelMeta
 }
 
+// playback modes reported in ChannelInfo.Modes
+const (
+	PlaybackDASH = "dash"
+	PlaybackHLS  = "hls"
+	PlaybackRTC  = "rtc"
+	PlaybackTS   = "ts"
+)
+
 func ListChannelInfo(ctx context.Context) (ret []*ChannelInfo, err error) {
-	rows, err := db.Query(ctx, "SELECT name, updated FROM thumbs WHERE updated > now() - '1 month'::interval ORDER BY greatest(now() - updated, '1 minute'::interval) ASC, 1 ASC")
+	rows, err := db.Query(ctx, "SELECT name, thumbs.updated, previews.updated, COALESCE(title, ''), COALESCE(description, ''), COALESCE(category, ''), COALESCE(tags, '{}'), COALESCE(nsfw, false) FROM thumbs LEFT JOIN channel_defs USING (name) LEFT JOIN previews USING (name) WHERE thumbs.updated > now() - '1 month'::interval ORDER BY greatest(now() - thumbs.updated, '1 minute'::interval) ASC, 1 ASC")
 	if err != nil {
 		return nil, err
 	}
@@ -27,10 +44,14 @@ func ListChannelInfo(ctx context.Context) (ret []*ChannelInfo, err error) {
 	for rows.Next() {
 		info := new(ChannelInfo)
 		var last time.Time
-		if err := rows.Scan(&info.Name, &last); err != nil {
+		var preview *time.Time
+		if err := rows.Scan(&info.Name, &last, &preview, &info.Title, &info.Description, &info.Category, &info.Tags, &info.NSFW); err != nil {
 			return nil, err
 		}
 		info.Last = last.UnixNano() / 1000000
+		if preview != nil {
+			info.PreviewLast = preview.UnixNano() / 1000000
+		}
 		ret = append(ret, info)
 	}
 	err = rows.Err()
@@ -45,6 +66,15 @@ func (i *ChannelInfo) Equal(j *ChannelInfo) bool {
 		i.Live == j.Live &&
 		i.Pending == j.Pending &&
 		i.Last == j.Last &&
+		i.PreviewLast == j.PreviewLast &&
 		i.Viewers == j.Viewers &&
-		i.RTC == j.RTC
+		i.RTC == j.RTC &&
+		i.Codec == j.Codec &&
+		slices.Equal(i.Modes, j.Modes) &&
+		i.ChannelMeta.Equal(j.ChannelMeta)
+}
+
+// HasMode returns true if the live stream can be played with the given mode
+func (i *ChannelInfo) HasMode(mode string) bool {
+	return slices.Contains(i.Modes, mode)
 }
@@ -0,0 +1,40 @@
+package model
+
+import (
+	"context"
+	"slices"
+)
+
+// ChannelMeta describes what a channel is streaming
+type ChannelMeta struct {
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Category    string   `json:"category"`
+	Tags        []string `json:"tags"`
+	NSFW        bool     `json:"nsfw"`
+}
+
+// limits on channel metadata
+const (
+	MaxTitle       = 140
+	MaxDescription = 2000
+	MaxCategory    = 50
+	MaxTags        = 10
+	MaxTag         = 25
+)
+
+// Equal returns true if both describe the same stream
+func (m ChannelMeta) Equal(o ChannelMeta) bool {
+	return m.Title == o.Title &&
+		m.Description == o.Description &&
+		m.Category == o.Category &&
+		m.NSFW == o.NSFW &&
+		slices.Equal(m.Tags, o.Tags)
+}
+
+// GetChannelMeta returns the metadata of a channel
+func GetChannelMeta(ctx context.Context, name string) (meta ChannelMeta, err error) {
+	row := db.QueryRow(ctx, "SELECT title, description, category, tags, nsfw FROM channel_defs WHERE name = $1", name)
+	err = row.Scan(&meta.Title, &meta.Description, &meta.Category, &meta.Tags, &meta.NSFW)
+	return
+}
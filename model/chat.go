@@ -0,0 +1,82 @@
+package model
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+// ChatMessage is a message posted to a channel's chat
+type ChatMessage struct {
+	ID       int64  `json:"id"`
+	UserID   string `json:"user_id"`
+	Username string `json:"username"`
+	Text     string `json:"text"`
+	Time     int64  `json:"time"`
+}
+
+// AddChatMessage stores a message, filling in its ID and time
+func AddChatMessage(ctx context.Context, channelName string, m *ChatMessage) error {
+	var created time.Time
+	row := db.QueryRow(ctx, "INSERT INTO chat_messages (name, user_id, username, text) VALUES ($1, $2, $3, $4) RETURNING id, created", channelName, m.UserID, m.Username, m.Text)
+	if err := row.Scan(&m.ID, &created); err != nil {
+		return err
+	}
+	m.Time = created.UnixNano() / 1000000
+	return nil
+}
+
+// ChatHistory returns the latest messages of a channel, oldest first
+func ChatHistory(ctx context.Context, channelName string, limit int) ([]*ChatMessage, error) {
+	rows, err := db.Query(ctx, "SELECT id, user_id, username, text, created FROM chat_messages WHERE name = $1 ORDER BY id DESC LIMIT $2", channelName, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := []*ChatMessage{}
+	for rows.Next() {
+		m := new(ChatMessage)
+		var created time.Time
+		if err := rows.Scan(&m.ID, &m.UserID, &m.Username, &m.Text, &created); err != nil {
+			return nil, err
+		}
+		m.Time = created.UnixNano() / 1000000
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	slices.Reverse(messages)
+	return messages, nil
+}
+
+// DeleteChatMessage removes a message from a channel's chat
+func DeleteChatMessage(ctx context.Context, channelName string, id int64) error {
+	_, err := db.Exec(ctx, "DELETE FROM chat_messages WHERE name = $1 AND id = $2", channelName, id)
+	return err
+}
+
+// BanChatUser stops a user from posting to a channel's chat until the given
+// time, or forever if it is zero
+func BanChatUser(ctx context.Context, channelName, userID string, until time.Time) error {
+	var v *time.Time
+	if !until.IsZero() {
+		v = &until
+	}
+	_, err := db.Exec(ctx, "INSERT INTO chat_bans (name, user_id, until) VALUES ($1, $2, $3) ON CONFLICT (name, user_id) DO UPDATE SET until = EXCLUDED.until", channelName, userID, v)
+	return err
+}
+
+// UnbanChatUser lifts a ban or timeout
+func UnbanChatUser(ctx context.Context, channelName, userID string) error {
+	_, err := db.Exec(ctx, "DELETE FROM chat_bans WHERE name = $1 AND user_id = $2", channelName, userID)
+	return err
+}
+
+// ChatBanned returns true if a user may not currently post to a channel's chat
+func ChatBanned(ctx context.Context, channelName, userID string) (bool, error) {
+	var banned bool
+	row := db.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM chat_bans WHERE name = $1 AND user_id = $2 AND (until IS NULL OR until > now()))", channelName, userID)
+	err := row.Scan(&banned)
+	return banned, err
+}
@@ -0,0 +1,37 @@
+package model
+
+import "time"
+
+// EncoderInfo is what a publisher reports about its encoder and stream
+type EncoderInfo struct {
+	Encoder      string  `json:"encoder,omitempty"`
+	VideoCodec   string  `json:"video_codec,omitempty"`
+	Width        int     `json:"width,omitempty"`
+	Height       int     `json:"height,omitempty"`
+	FrameRate    float64 `json:"frame_rate,omitempty"`
+	VideoBitrate int     `json:"video_bitrate,omitempty"` // kbit/s
+	AudioCodec   string  `json:"audio_codec,omitempty"`
+	SampleRate   int     `json:"sample_rate,omitempty"`
+	Channels     int     `json:"channels,omitempty"`
+	AudioBitrate int     `json:"audio_bitrate,omitempty"` // kbit/s
+	// Updated is when the publisher last sent its metadata
+	Updated int64 `json:"updated,omitempty"`
+}
+
+// Cue is timed metadata sent by a publisher, such as an overlay update or a
+// chapter marker
+type Cue struct {
+	// Time is when the cue takes effect, on the timeline of the stream
+	Time     time.Duration
+	Duration time.Duration
+	Kind     string
+	Data     []byte
+}
+
+// cue formats for Cue.Kind
+const (
+	// CueID3 holds a complete ID3v2 tag
+	CueID3 = "id3"
+	// CueSCTE35 holds a binary SCTE-35 splice_info_section
+	CueSCTE35 = "scte35"
+)
@@ -0,0 +1,123 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"eaglesong.dev/gunk/internal/blobstore"
+	"github.com/rs/zerolog/log"
+)
+
+// blobColumn is a column that used to hold images in the database
+type blobColumn struct {
+	table, column, timeColumn string
+	contentType               string
+	keys                      func(channelName string, t time.Time) []string
+}
+
+var blobColumns = []blobColumn{
+	{"thumbs", "thumb", "updated", "image/jpeg", thumbKeys},
+	{"thumb_history", "thumb", "taken", "image/jpeg", thumbKeys},
+	{"previews", "clip", "updated", "image/webp", func(channelName string, t time.Time) []string {
+		return []string{previewKey(channelName, t)}
+	}},
+}
+
+// thumbKeys returns the keys of every size of a thumbnail. Thumbnails from the
+// database only came in one size, so it is used for all of them.
+func thumbKeys(channelName string, taken time.Time) []string {
+	var keys []string
+	for _, width := range ThumbWidths {
+		keys = append(keys, ThumbHistoryKey(channelName, taken, width))
+	}
+	return keys
+}
+
+// MigrateBlobs copies images that are still in the database to the blob
+// store and lets new rows leave them out. The columns that held them are kept
+// until DropBlobColumns is run, so nothing is lost if the copy turns out
+// wrong. It must run before anything writes to those tables.
+func MigrateBlobs(ctx context.Context) error {
+	for _, c := range blobColumns {
+		if err := c.migrate(ctx); err != nil {
+			return fmt.Errorf("moving %s.%s to the blob store: %w", c.table, c.column, err)
+		}
+	}
+	return nil
+}
+
+// DropBlobColumns removes the columns that held images from the database,
+// once MigrateBlobs has copied them
+func DropBlobColumns(ctx context.Context) error {
+	if err := MigrateBlobs(ctx); err != nil {
+		return err
+	}
+	for _, c := range blobColumns {
+		if exists, err := c.exists(ctx); err != nil {
+			return err
+		} else if !exists {
+			continue
+		}
+		// names are all constants above
+		if _, err := db.Exec(ctx, fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", c.table, c.column)); err != nil {
+			return fmt.Errorf("dropping %s.%s: %w", c.table, c.column, err)
+		}
+		log.Info().Str("table", c.table).Str("column", c.column).Msg("dropped images from the database")
+	}
+	return nil
+}
+
+func (c blobColumn) exists(ctx context.Context) (bool, error) {
+	var exists bool
+	row := db.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_schema = 'public' AND table_name = $1 AND column_name = $2)", c.table, c.column)
+	err := row.Scan(&exists)
+	return exists, err
+}
+
+// migrate copies the images that aren't in the blob store yet. Rows written
+// since the upgrade have no image, and ones whose timestamp has moved on
+// already have a blob from the new code, so neither is copied.
+func (c blobColumn) migrate(ctx context.Context) error {
+	if exists, err := c.exists(ctx); err != nil || !exists {
+		return err
+	}
+	// names are all constants above
+	rows, err := db.Query(ctx, fmt.Sprintf("SELECT name, %s, %s FROM %s WHERE %s IS NOT NULL", c.timeColumn, c.column, c.table, c.column))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var copied int
+	for rows.Next() {
+		var name string
+		var t time.Time
+		var d []byte
+		if err := rows.Scan(&name, &t, &d); err != nil {
+			return err
+		}
+		for _, key := range c.keys(name, t) {
+			if _, err := blobs.Get(ctx, key); err == nil {
+				continue
+			} else if !errors.Is(err, blobstore.ErrNotFound) {
+				return err
+			}
+			if err := blobs.Put(ctx, key, c.contentType, d); err != nil {
+				return err
+			}
+			copied++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	if _, err := db.Exec(ctx, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s DROP NOT NULL", c.table, c.column)); err != nil {
+		return err
+	}
+	if copied != 0 {
+		log.Info().Str("table", c.table).Int("blobs", copied).Msg("copied images to the blob store, set DROP_BLOB_COLUMNS=true to remove them from the database")
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+package model
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// connectTest connects to the database named by the usual PG* variables,
+// which must have schema.psql loaded. Tests that need it are skipped
+// otherwise.
+func connectTest(t *testing.T) {
+	if os.Getenv("PGDATABASE") == "" {
+		t.Skip("PGDATABASE is not set")
+	}
+	if db == nil {
+		require.NoError(t, Connect())
+	}
+}
@@ -0,0 +1,31 @@
+package model
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// GetSlate returns the image or clip shown while a channel's publisher is away
+func GetSlate(ctx context.Context, channelName string) (d []byte, err error) {
+	row := db.QueryRow(ctx, "SELECT data FROM slates WHERE name = $1", channelName)
+	err = row.Scan(&d)
+	return
+}
+
+// PutSlate sets the slate of a channel owned by userID
+func PutSlate(ctx context.Context, userID, channelName string, d []byte) error {
+	tag, err := db.Exec(ctx, "INSERT INTO slates (name, data) SELECT name, $3 FROM channel_defs WHERE user_id = $1 AND name = $2 ON CONFLICT (name) DO UPDATE SET data = EXCLUDED.data, updated = now()", userID, channelName, d)
+	if err != nil {
+		return err
+	} else if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteSlate removes the slate of a channel owned by userID
+func DeleteSlate(ctx context.Context, userID, channelName string) error {
+	_, err := db.Exec(ctx, "DELETE FROM slates WHERE name = (SELECT name FROM channel_defs WHERE user_id = $1 AND name = $2)", userID, channelName)
+	return err
+}
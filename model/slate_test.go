@@ -0,0 +1,46 @@
+package model
+
+import (
+	"context"
+	"testing"
+
+	"eaglesong.dev/gunk/internal"
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlateStorage(t *testing.T) {
+	connectTest(t)
+	ctx := context.Background()
+	userID, name := "test-"+internal.RandomID(4), "test-"+internal.RandomID(4)
+	_, err := CreateChannel(ctx, userID, name)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = DeleteSlate(ctx, userID, name)
+		_ = DeleteChannel(ctx, userID, name)
+	})
+
+	_, err = GetSlate(ctx, name)
+	assert.ErrorIs(t, err, pgx.ErrNoRows)
+	require.NoError(t, PutSlate(ctx, userID, name, []byte("first")))
+	d, err := GetSlate(ctx, name)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("first"), d)
+	// uploading again replaces it
+	require.NoError(t, PutSlate(ctx, userID, name, []byte("second")))
+	d, err = GetSlate(ctx, name)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("second"), d)
+
+	// only the owner can change it
+	assert.ErrorIs(t, PutSlate(ctx, "someone-else", name, []byte("third")), pgx.ErrNoRows)
+	require.NoError(t, DeleteSlate(ctx, "someone-else", name))
+	d, err = GetSlate(ctx, name)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("second"), d)
+
+	require.NoError(t, DeleteSlate(ctx, userID, name))
+	_, err = GetSlate(ctx, name)
+	assert.ErrorIs(t, err, pgx.ErrNoRows)
+}
@@ -1,14 +1,162 @@
 package model
 
-import "context"
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"time"
 
-func GetThumb(ctx context.Context, channelName string) (d []byte, err error) {
-	row := db.QueryRow(ctx, "SELECT thumb FROM thumbs WHERE name = $1", channelName)
-	err = row.Scan(&d)
-	return
+	"github.com/jackc/pgx/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// ThumbHistory is how many past thumbnails are kept for each channel
+const ThumbHistory = 30
+
+// ThumbWidths are the sizes each thumbnail is stored in. The first is the
+// main thumbnail, smaller ones are for the history strip.
+var ThumbWidths = []int{400, 160}
+
+// ThumbHistoryKey returns the blob key of the thumbnail taken at the given
+// time in one of ThumbWidths
+func ThumbHistoryKey(channelName string, taken time.Time, width int) string {
+	key := "thumbs/" + url.PathEscape(channelName) + "/" + strconv.FormatInt(taken.UnixMilli(), 10)
+	if width != ThumbWidths[0] {
+		key += "-" + strconv.Itoa(width)
+	}
+	return key + ".jpg"
+}
+
+// ThumbKey returns the blob key of the channel's current thumbnail
+func ThumbKey(ctx context.Context, channelName string, width int) (string, error) {
+	var taken time.Time
+	row := db.QueryRow(ctx, "SELECT updated FROM thumbs WHERE name = $1", channelName)
+	if err := row.Scan(&taken); err != nil {
+		return "", err
+	}
+	return ThumbHistoryKey(channelName, taken, width), nil
+}
+
+func GetThumb(ctx context.Context, channelName string) ([]byte, error) {
+	key, err := ThumbKey(ctx, channelName, ThumbWidths[0])
+	if err != nil {
+		return nil, err
+	}
+	return blobs.Get(ctx, key)
+}
+
+// PutThumb replaces the channel's thumbnail and adds it to the history. thumbs
+// holds a JPEG for each of ThumbWidths. The current thumbnail is always the
+// newest entry in the history, so both share the same blobs.
+func PutThumb(ctx context.Context, channelName string, thumbs map[int][]byte) error {
+	// postgres keeps microseconds but keys only have milliseconds
+	taken := time.Now().Truncate(time.Millisecond)
+	var keys []string
+	for _, width := range ThumbWidths {
+		key := ThumbHistoryKey(channelName, taken, width)
+		if err := blobs.Put(ctx, key, "image/jpeg", thumbs[width]); err != nil {
+			deleteBlobs(ctx, channelName, keys...)
+			return err
+		}
+		keys = append(keys, key)
+	}
+	var pruned []time.Time
+	err := pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "INSERT INTO thumbs (name, updated) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET updated = EXCLUDED.updated", channelName, taken); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, "INSERT INTO thumb_history (name, taken) VALUES ($1, $2) ON CONFLICT DO NOTHING", channelName, taken); err != nil {
+			return err
+		}
+		rows, err := tx.Query(ctx, "DELETE FROM thumb_history WHERE name = $1 AND taken < (SELECT taken FROM thumb_history WHERE name = $1 ORDER BY taken DESC OFFSET $2 LIMIT 1) RETURNING taken", channelName, ThumbHistory-1)
+		if err != nil {
+			return err
+		}
+		pruned, err = pgx.CollectRows(rows, pgx.RowTo[time.Time])
+		return err
+	})
+	if err != nil {
+		// nothing refers to the new blobs
+		deleteBlobs(ctx, channelName, keys...)
+		return err
+	}
+	for _, t := range pruned {
+		deleteBlobs(ctx, channelName, thumbKeys(channelName, t)...)
+	}
+	return nil
+}
+
+// ListThumbHistory returns when each of the channel's past thumbnails was
+// taken, oldest first
+func ListThumbHistory(ctx context.Context, channelName string) ([]time.Time, error) {
+	rows, err := db.Query(ctx, "SELECT taken FROM thumb_history WHERE name = $1 ORDER BY taken", channelName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var taken []time.Time
+	for rows.Next() {
+		var t time.Time
+		if err := rows.Scan(&t); err != nil {
+			return nil, err
+		}
+		taken = append(taken, t)
+	}
+	return taken, rows.Err()
+}
+
+func previewKey(channelName string, updated time.Time) string {
+	return "previews/" + url.PathEscape(channelName) + "/" + strconv.FormatInt(updated.UnixMilli(), 10) + ".webp"
+}
+
+// PreviewKey returns the blob key of the channel's animated preview clip,
+// which must have been taken at the given time in milliseconds
+func PreviewKey(ctx context.Context, channelName string, taken int64) (string, error) {
+	var updated time.Time
+	row := db.QueryRow(ctx, "SELECT updated FROM previews WHERE name = $1", channelName)
+	if err := row.Scan(&updated); err != nil {
+		return "", err
+	} else if updated.UnixMilli() != taken {
+		// replaced since
+		return "", pgx.ErrNoRows
+	}
+	return previewKey(channelName, updated), nil
+}
+
+// PutPreview replaces the channel's animated preview clip
+func PutPreview(ctx context.Context, channelName string, d []byte) error {
+	updated := time.Now().Truncate(time.Millisecond)
+	key := previewKey(channelName, updated)
+	if err := blobs.Put(ctx, key, "image/webp", d); err != nil {
+		return err
+	}
+	var old *time.Time
+	err := pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		if err := tx.QueryRow(ctx, "SELECT updated FROM previews WHERE name = $1 FOR UPDATE", channelName).Scan(&old); err != nil && err != pgx.ErrNoRows {
+			return err
+		}
+		_, err := tx.Exec(ctx, "INSERT INTO previews (name, updated) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET updated = EXCLUDED.updated", channelName, updated)
+		return err
+	})
+	if err != nil {
+		deleteBlobs(ctx, channelName, key)
+		return err
+	}
+	if old != nil {
+		deleteBlobs(ctx, channelName, previewKey(channelName, *old))
+	}
+	return nil
 }
 
-func PutThumb(ctx context.Context, channelName string, d []byte) error {
-	_, err := db.Exec(ctx, "INSERT INTO thumbs (name, thumb) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET thumb = EXCLUDED.thumb, updated = now()", channelName, d)
-	return err
+// deleteBlobs removes images that nothing refers to. Failures only leave
+// garbage behind, so they are logged.
+func deleteBlobs(ctx context.Context, channelName string, keys ...string) {
+	// the request that wrote them may have been cancelled
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+	defer cancel()
+	for _, key := range keys {
+		if err := blobs.Delete(ctx, key); err != nil {
+			log.Err(err).Str("channel", channelName).Str("key", key).Msg("failed to delete image")
+		}
+	}
 }
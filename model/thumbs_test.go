@@ -0,0 +1,50 @@
+package model
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"testing"
+
+	"eaglesong.dev/gunk/internal/blobstore"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestPutFailure checks that images written ahead of a transaction that
+// fails are removed again
+func TestPutFailure(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	// nothing listens here, so every transaction fails
+	pool, err := pgxpool.New(ctx, "postgres://gunk@127.0.0.1:1/gunk?connect_timeout=1")
+	require.NoError(t, err)
+	t.Cleanup(pool.Close)
+	oldDB, oldBlobs := db, blobs
+	db, blobs = pool, &blobstore.FS{Dir: dir}
+	t.Cleanup(func() { db, blobs = oldDB, oldBlobs })
+
+	files := func() []string {
+		var names []string
+		require.NoError(t, filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				names = append(names, path)
+			}
+			return err
+		}))
+		return names
+	}
+	t.Run("Thumb", func(t *testing.T) {
+		thumbs := make(map[int][]byte)
+		for _, width := range ThumbWidths {
+			thumbs[width] = []byte("jpeg")
+		}
+		assert.Error(t, PutThumb(ctx, "test", thumbs))
+		assert.Empty(t, files())
+	})
+	t.Run("Preview", func(t *testing.T) {
+		assert.Error(t, PutPreview(ctx, "test", []byte("webp")))
+		assert.Empty(t, files())
+	})
+}
@@ -0,0 +1,158 @@
+package model
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Webhook receives signed notifications of stream events
+type Webhook struct {
+	ID     int64  `json:"id"`
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+	// Channel limits the webhook to one channel, otherwise it covers all of
+	// the owner's channels
+	Channel string   `json:"channel,omitempty"`
+	Events  []string `json:"events"`
+}
+
+// WebhookDelivery is one event queued for or sent to a webhook
+type WebhookDelivery struct {
+	ID          int64  `json:"id"`
+	WebhookID   int64  `json:"webhook_id"`
+	Event       string `json:"event"`
+	Payload     []byte `json:"-"`
+	Status      string `json:"status"`
+	Attempts    int    `json:"attempts"`
+	LastStatus  int    `json:"last_status,omitempty"`
+	LastError   string `json:"last_error,omitempty"`
+	Created     int64  `json:"created"`
+	NextAttempt int64  `json:"next_attempt,omitempty"`
+
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+// delivery states reported in WebhookDelivery.Status
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// CreateWebhook adds a webhook owned by userID, filling in its ID
+func CreateWebhook(ctx context.Context, userID string, h *Webhook) error {
+	var channel *string
+	if h.Channel != "" {
+		channel = &h.Channel
+	}
+	row := db.QueryRow(ctx, "INSERT INTO webhooks (user_id, name, url, secret, events) SELECT $1, $2, $3, $4, $5 WHERE $2::text IS NULL OR EXISTS (SELECT 1 FROM channel_defs WHERE user_id = $1 AND name = $2) RETURNING id", userID, channel, h.URL, h.Secret, h.Events)
+	return row.Scan(&h.ID)
+}
+
+// ListWebhooks returns the webhooks owned by userID
+func ListWebhooks(ctx context.Context, userID string) ([]*Webhook, error) {
+	rows, err := db.Query(ctx, "SELECT id, url, secret, COALESCE(name, ''), events FROM webhooks WHERE user_id = $1 ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hooks := []*Webhook{}
+	for rows.Next() {
+		h := new(Webhook)
+		if err := rows.Scan(&h.ID, &h.URL, &h.Secret, &h.Channel, &h.Events); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, rows.Err()
+}
+
+// DeleteWebhook removes a webhook owned by userID
+func DeleteWebhook(ctx context.Context, userID string, id int64) error {
+	tag, err := db.Exec(ctx, "DELETE FROM webhooks WHERE user_id = $1 AND id = $2", userID, id)
+	if err != nil {
+		return err
+	} else if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// QueueWebhooks queues an event for every webhook of a channel that wants it
+func QueueWebhooks(ctx context.Context, channelName, event string, payload []byte) (int64, error) {
+	tag, err := db.Exec(ctx, "INSERT INTO webhook_deliveries (webhook_id, event, payload) SELECT webhooks.id, $2, $3 FROM webhooks JOIN channel_defs USING (user_id) WHERE channel_defs.name = $1 AND (webhooks.name IS NULL OR webhooks.name = $1) AND $2 = ANY (webhooks.events)", channelName, event, payload)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// ClaimDeliveries returns pending deliveries that are due, holding them for
+// the given time so that no other node sends them meanwhile
+func ClaimDeliveries(ctx context.Context, limit int, hold time.Duration) ([]*WebhookDelivery, error) {
+	rows, err := db.Query(ctx, `UPDATE webhook_deliveries d SET next_attempt = now() + $2::interval
+FROM webhooks h
+WHERE h.id = d.webhook_id AND d.id IN (
+	SELECT id FROM webhook_deliveries
+	WHERE status = 'pending' AND next_attempt <= now()
+	ORDER BY next_attempt LIMIT $1 FOR UPDATE SKIP LOCKED)
+RETURNING d.id, d.webhook_id, d.event, d.payload, d.attempts, h.url, h.secret`, limit, hold)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var deliveries []*WebhookDelivery
+	for rows.Next() {
+		d := &WebhookDelivery{Status: DeliveryPending}
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Payload, &d.Attempts, &d.URL, &d.Secret); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// FinishDelivery records the outcome of an attempt. A pending delivery is
+// tried again at the given time.
+func FinishDelivery(ctx context.Context, d *WebhookDelivery, next time.Time) error {
+	var nextAttempt *time.Time
+	if d.Status == DeliveryPending {
+		nextAttempt = &next
+	}
+	_, err := db.Exec(ctx, "UPDATE webhook_deliveries SET status = $2, attempts = $3, last_status = $4, last_error = $5, next_attempt = COALESCE($6, next_attempt), updated = now() WHERE id = $1",
+		d.ID, d.Status, d.Attempts, d.LastStatus, d.LastError, nextAttempt)
+	return err
+}
+
+// ListDeliveries returns the latest deliveries of a webhook owned by userID
+func ListDeliveries(ctx context.Context, userID string, webhookID int64, limit int) ([]*WebhookDelivery, error) {
+	rows, err := db.Query(ctx, "SELECT d.id, d.webhook_id, d.event, d.status, d.attempts, COALESCE(d.last_status, 0), COALESCE(d.last_error, ''), d.created, d.next_attempt FROM webhook_deliveries d JOIN webhooks h ON h.id = d.webhook_id WHERE h.user_id = $1 AND h.id = $2 ORDER BY d.id DESC LIMIT $3", userID, webhookID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		d := new(WebhookDelivery)
+		var created, next time.Time
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Status, &d.Attempts, &d.LastStatus, &d.LastError, &created, &next); err != nil {
+			return nil, err
+		}
+		d.Created = created.UnixNano() / 1000000
+		if d.Status == DeliveryPending {
+			d.NextAttempt = next.UnixNano() / 1000000
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// PruneDeliveries removes delivered and failed deliveries older than the
+// given ages
+func PruneDeliveries(ctx context.Context, delivered, failed time.Duration) error {
+	_, err := db.Exec(ctx, "DELETE FROM webhook_deliveries WHERE (status = 'delivered' AND updated < now() - $1::interval) OR (status = 'failed' AND updated < now() - $2::interval)", delivered, failed)
+	return err
+}
@@ -0,0 +1,240 @@
+package cues
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// box is the position of an ISO BMFF box and its body
+type box struct {
+	typ        string
+	start, end int
+	body       []byte
+}
+
+// boxHeader reads the size and type of the box at the start of b. A size of
+// zero means the box runs to the end of the file.
+func boxHeader(b []byte) (size uint64, typ string, ok bool) {
+	if len(b) < 8 {
+		return 0, "", false
+	}
+	size = uint64(binary.BigEndian.Uint32(b))
+	typ = string(b[4:8])
+	if size == 1 {
+		if len(b) < 16 {
+			return 0, "", false
+		}
+		size = binary.BigEndian.Uint64(b[8:])
+		if size < 16 {
+			size = 0
+		}
+	} else if size != 0 && size < 8 {
+		size = 0
+	}
+	return size, typ, true
+}
+
+// topLevel splits a buffer into boxes, stopping at anything malformed
+func topLevel(b []byte) []box {
+	var boxes []box
+	for pos := 0; len(b)-pos >= 8; {
+		size := uint64(binary.BigEndian.Uint32(b[pos:]))
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(b) - pos)
+		case 1:
+			if len(b)-pos < 16 {
+				return boxes
+			}
+			size = binary.BigEndian.Uint64(b[pos+8:])
+			header = 16
+		}
+		if size < header || size > uint64(len(b)-pos) {
+			return boxes
+		}
+		end := pos + int(size)
+		boxes = append(boxes, box{
+			typ:   string(b[pos+4 : pos+8]),
+			start: pos,
+			end:   end,
+			body:  b[pos+int(header) : end],
+		})
+		pos = end
+	}
+	return boxes
+}
+
+// children returns the boxes of a given type inside a container
+func children(b []byte, typ string) [][]byte {
+	var bodies [][]byte
+	for _, c := range topLevel(b) {
+		if c.typ == typ {
+			bodies = append(bodies, c.body)
+		}
+	}
+	return bodies
+}
+
+func child(b []byte, typ string) []byte {
+	if c := children(b, typ); len(c) != 0 {
+		return c[0]
+	}
+	return nil
+}
+
+// reader reads the fields of a box body, returning zero once it runs out
+type reader struct {
+	b   []byte
+	bad bool
+}
+
+func (r *reader) skip(n int) {
+	if len(r.b) < n {
+		r.b, r.bad = nil, true
+		return
+	}
+	r.b = r.b[n:]
+}
+
+func (r *reader) u16() uint16 {
+	if len(r.b) < 2 {
+		r.skip(2)
+		return 0
+	}
+	v := binary.BigEndian.Uint16(r.b)
+	r.b = r.b[2:]
+	return v
+}
+
+func (r *reader) u32() uint32 {
+	if len(r.b) < 4 {
+		r.skip(4)
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *reader) u64() uint64 {
+	if len(r.b) < 8 {
+		r.skip(8)
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v
+}
+
+// versionFlags reads the header of a full box
+func (r *reader) versionFlags() (byte, uint32) {
+	vf := r.u32()
+	return byte(vf >> 24), vf & 0xffffff
+}
+
+// moofRange returns the span of the stream timeline that a fragment covers,
+// given the body of its moof
+func moofRange(moof []byte, scales map[uint32]uint32) (start, end time.Duration, ok bool) {
+	for _, traf := range children(moof, "traf") {
+		tfhd := &reader{b: child(traf, "tfhd")}
+		_, flags := tfhd.versionFlags()
+		id := tfhd.u32()
+		if flags&0x01 != 0 {
+			tfhd.skip(8) // base data offset
+		}
+		if flags&0x02 != 0 {
+			tfhd.skip(4) // sample description index
+		}
+		var defaultDuration uint32
+		if flags&0x08 != 0 {
+			defaultDuration = tfhd.u32()
+		}
+		tfdt := &reader{b: child(traf, "tfdt")}
+		var base uint64
+		if v, _ := tfdt.versionFlags(); v == 1 {
+			base = tfdt.u64()
+		} else {
+			base = uint64(tfdt.u32())
+		}
+		scale := scales[id]
+		if tfhd.bad || tfdt.bad || scale == 0 {
+			continue
+		}
+		duration := uint64(0)
+		for _, body := range children(traf, "trun") {
+			duration += runDuration(body, defaultDuration)
+		}
+		trackStart := toDuration(base, scale)
+		trackEnd := toDuration(base+duration, scale)
+		if !ok || trackStart < start {
+			start = trackStart
+		}
+		if !ok || trackEnd > end {
+			end = trackEnd
+		}
+		ok = true
+	}
+	return start, end, ok
+}
+
+// sidxRange returns the span of the stream timeline that a segment index
+// covers, in its own timescale
+func sidxRange(sidx []byte) (start, end time.Duration, ok bool) {
+	r := &reader{b: sidx}
+	version, _ := r.versionFlags()
+	r.skip(4) // reference ID
+	scale := r.u32()
+	var earliest uint64
+	if version == 0 {
+		earliest = uint64(r.u32())
+		r.skip(4) // first offset
+	} else {
+		earliest = r.u64()
+		r.skip(8)
+	}
+	r.skip(2) // reserved
+	count := r.u16()
+	var duration uint64
+	for i := uint16(0); i < count && !r.bad; i++ {
+		r.skip(4) // reference type and size
+		duration += uint64(r.u32())
+		r.skip(4) // SAP
+	}
+	if r.bad || scale == 0 {
+		return 0, 0, false
+	}
+	return toDuration(earliest, scale), toDuration(earliest+duration, scale), true
+}
+
+// runDuration adds up the sample durations of a trun box
+func runDuration(body []byte, defaultDuration uint32) uint64 {
+	r := &reader{b: body}
+	_, flags := r.versionFlags()
+	count := r.u32()
+	if flags&0x001 != 0 {
+		r.skip(4) // data offset
+	}
+	if flags&0x004 != 0 {
+		r.skip(4) // first sample flags
+	}
+	if flags&0x100 == 0 {
+		return uint64(count) * uint64(defaultDuration)
+	}
+	var total uint64
+	for i := uint32(0); i < count && !r.bad; i++ {
+		total += uint64(r.u32())
+		for _, bit := range []uint32{0x200, 0x400, 0x800} {
+			if flags&bit != 0 {
+				r.skip(4)
+			}
+		}
+	}
+	return total
+}
+
+func toDuration(ts uint64, scale uint32) time.Duration {
+	secs := ts / uint64(scale)
+	frac := ts % uint64(scale)
+	return time.Duration(secs)*time.Second + time.Duration(frac)*time.Second/time.Duration(scale)
+}
@@ -0,0 +1,260 @@
+// Package cues adds timed metadata to the fMP4 segments of a publisher that
+// has no way to carry it. Cues are written as version 1 emsg boxes ahead of
+// the moof of each fragment they fall in, which is how both DASH and fMP4 HLS
+// deliver inband events. ID3 tags use the AOM ID3 scheme that HLS clients play
+// as timed metadata.
+package cues
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"eaglesong.dev/gunk/internal/fmp4"
+	"github.com/nareix/joy4/av"
+)
+
+const (
+	// cues this far behind the newest segment are forgotten
+	defaultRetention = 2 * time.Minute
+	// most cues kept at once
+	maxCues = 100
+	// moof and sidx boxes larger than this are passed through without cues
+	maxHeldBox = 1 << 20
+)
+
+// Injector is a http.Handler that serves the files of another handler and
+// adds cues to the media segments. Segments are passed on as they are
+// written, only their moof and sidx boxes are held back to find out where
+// they fall.
+type Injector struct {
+	Handler   http.Handler
+	Retention time.Duration // how long cues are kept, should cover the playlist
+
+	mu     sync.Mutex
+	nextID uint32
+	cues   []cue
+	scales map[uint32]uint32 // timescale of each track
+	newest time.Duration     // end of the latest fragment served
+}
+
+type cue struct {
+	id uint32
+	ev fmp4.Event
+}
+
+// SetStreams sets the codecs of the stream being published, which give the
+// timescale of each track. Tracks are numbered from 1 in the order of streams.
+func (inj *Injector) SetStreams(streams []av.CodecData) {
+	scales := make(map[uint32]uint32, len(streams))
+	for i, cd := range streams {
+		if t, err := fmp4.NewTrack(uint32(i+1), cd); err == nil && t.Timescale != 0 {
+			scales[t.ID] = uint32(t.Timescale)
+		}
+	}
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	inj.scales = scales
+}
+
+// WriteEvent adds timed metadata at the given time on the stream timeline
+func (inj *Injector) WriteEvent(at, duration time.Duration, scheme string, data []byte) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	inj.nextID++
+	inj.cues = append(inj.cues, cue{
+		id: inj.nextID,
+		ev: fmp4.Event{At: at, Duration: duration, Scheme: scheme, Data: data},
+	})
+	if len(inj.cues) > maxCues {
+		inj.cues = inj.cues[len(inj.cues)-maxCues:]
+	}
+}
+
+func (inj *Injector) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" {
+		inj.Handler.ServeHTTP(rw, req)
+		return
+	}
+	w := &segmentWriter{ResponseWriter: rw, inj: inj, status: http.StatusOK}
+	inj.Handler.ServeHTTP(w, req)
+	w.finish()
+}
+
+func (inj *Injector) pending() bool {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	return len(inj.cues) != 0
+}
+
+// events returns emsg boxes for the cues that fall in the span of a moof or
+// sidx box
+func (inj *Injector) events(b box) []byte {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	var start, end time.Duration
+	var ok bool
+	if b.typ == "sidx" {
+		start, end, ok = sidxRange(b.body)
+	} else {
+		start, end, ok = moofRange(b.body, inj.scales)
+	}
+	if !ok {
+		return nil
+	}
+	if end > inj.newest {
+		inj.newest = end
+		retention := inj.Retention
+		if retention <= 0 {
+			retention = defaultRetention
+		}
+		keep := inj.cues[:0]
+		for _, c := range inj.cues {
+			if c.ev.At+c.ev.Duration >= end-retention {
+				keep = append(keep, c)
+			}
+		}
+		inj.cues = keep
+	}
+	var boxes []byte
+	for _, c := range inj.cues {
+		if c.ev.At >= start && c.ev.At < end {
+			boxes = append(boxes, fmp4.Emsg(c.id, c.ev)...)
+		}
+	}
+	return boxes
+}
+
+// segmentWriter passes a response through, adding emsg boxes ahead of each
+// moof of a media segment. A sidx is followed by offsets relative to its own
+// end, so emsg goes ahead of it instead and the rest passes through as is.
+type segmentWriter struct {
+	http.ResponseWriter
+	inj         *Injector
+	status      int
+	wroteHeader bool
+	// set once the response is known to be a segment
+	segment bool
+	// set once the rest of the response passes through unchanged
+	direct bool
+	// the start of a box not yet written
+	buf []byte
+	// bytes left of a box being passed through
+	skip uint64
+}
+
+func (w *segmentWriter) WriteHeader(status int) {
+	w.status = status
+	if status != http.StatusOK {
+		w.passThrough()
+	}
+}
+
+func (w *segmentWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if w.direct {
+		return w.ResponseWriter.Write(p)
+	}
+	if !w.segment {
+		w.buf = append(w.buf, p...)
+		if len(w.buf) < 8 {
+			return n, nil
+		}
+		switch string(w.buf[4:8]) {
+		case "styp", "sidx", "moof":
+			if w.inj.pending() {
+				break
+			}
+			fallthrough
+		default:
+			w.passThrough()
+			return n, nil
+		}
+		w.segment = true
+		// boxes are added, so the length isn't known
+		w.Header().Del("Content-Length")
+		w.writeHeader()
+		p, w.buf = w.buf, nil
+	}
+	return n, w.parse(p)
+}
+
+// parse writes out the boxes in p, holding back each moof or sidx until it is
+// complete
+func (w *segmentWriter) parse(p []byte) error {
+	for len(p) > 0 {
+		if w.direct {
+			_, err := w.ResponseWriter.Write(p)
+			return err
+		}
+		if w.skip > 0 {
+			k := min(w.skip, uint64(len(p)))
+			if _, err := w.ResponseWriter.Write(p[:k]); err != nil {
+				return err
+			}
+			w.skip -= k
+			p = p[k:]
+			continue
+		}
+		w.buf = append(w.buf, p...)
+		p = nil
+		size, typ, ok := boxHeader(w.buf)
+		switch {
+		case !ok:
+			// wait for the rest of the header
+			return nil
+		case size == 0 || (typ == "moof" || typ == "sidx") && size > maxHeldBox:
+			w.direct = true
+		case typ == "moof" || typ == "sidx":
+			if uint64(len(w.buf)) < size {
+				return nil
+			}
+			b := topLevel(w.buf[:size])[0]
+			if boxes := w.inj.events(b); boxes != nil {
+				if _, err := w.ResponseWriter.Write(boxes); err != nil {
+					return err
+				}
+			}
+			w.skip = size
+			w.direct = typ == "sidx"
+		default:
+			w.skip = size
+		}
+		p, w.buf = w.buf, nil
+	}
+	return nil
+}
+
+// Flush is passed on once nothing is being held back
+func (w *segmentWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && w.wroteHeader && len(w.buf) == 0 {
+		f.Flush()
+	}
+}
+
+func (w *segmentWriter) writeHeader() {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+}
+
+func (w *segmentWriter) passThrough() {
+	if w.direct {
+		return
+	}
+	w.direct = true
+	w.writeHeader()
+	if len(w.buf) != 0 {
+		w.ResponseWriter.Write(w.buf)
+		w.buf = nil
+	}
+}
+
+// finish writes whatever is left, such as a truncated box
+func (w *segmentWriter) finish() {
+	w.writeHeader()
+	if len(w.buf) != 0 {
+		w.ResponseWriter.Write(w.buf)
+	}
+}
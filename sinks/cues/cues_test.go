@@ -0,0 +1,206 @@
+package cues
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func plainBox(typ string, body ...[]byte) []byte {
+	b := bytes.Join(body, nil)
+	out := binary.BigEndian.AppendUint32(nil, uint32(8+len(b)))
+	out = append(out, typ...)
+	return append(out, b...)
+}
+
+func fullBox(typ string, version byte, flags uint32, body ...[]byte) []byte {
+	header := binary.BigEndian.AppendUint32(nil, uint32(version)<<24|flags)
+	return plainBox(typ, append([][]byte{header}, body...)...)
+}
+
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func u64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+// testStreams are a video track, timed at 90kHz, and a 48kHz audio track
+var testStreams = []av.CodecData{
+	h264parser.CodecData{},
+	aacparser.CodecData{Config: aacparser.MPEG4AudioConfig{SampleRate: 48000}},
+}
+
+// testFragment is one second of 30fps video and 48kHz audio
+func testFragment(start time.Duration) []byte {
+	video := plainBox("traf",
+		fullBox("tfhd", 0, 0x020008, u32(1), u32(3000)),
+		fullBox("tfdt", 1, 0, u64(uint64(start/time.Second)*90000)),
+		fullBox("trun", 0, 0x000001, u32(30), u32(0)),
+	)
+	var durations []byte
+	for i := 0; i < 2; i++ {
+		durations = append(durations, u32(24000)...)
+		durations = append(durations, u32(100)...)
+	}
+	audio := plainBox("traf",
+		fullBox("tfhd", 0, 0x020000, u32(2)),
+		fullBox("tfdt", 0, 0, u32(uint32(start/time.Second)*48000)),
+		fullBox("trun", 0, 0x000300, u32(2), durations),
+	)
+	return append(
+		plainBox("moof", fullBox("mfhd", 0, 0, u32(1)), video, audio),
+		plainBox("mdat", make([]byte, 64))...)
+}
+
+// testSegment has a fragment for each second from start
+func testSegment(start time.Duration, seconds int) []byte {
+	seg := plainBox("styp", []byte("msdh"), u32(0))
+	for i := 0; i < seconds; i++ {
+		seg = append(seg, testFragment(start+time.Duration(i)*time.Second)...)
+	}
+	return seg
+}
+
+// testIndexed is a segment with a sidx timed in milliseconds
+func testIndexed(start time.Duration) []byte {
+	frag := testFragment(start)
+	sidx := fullBox("sidx", 0, 0,
+		u32(1), u32(1000), u32(uint32(start/time.Millisecond)), u32(0),
+		u16(0), u16(1),
+		u32(uint32(len(frag))), u32(1000), u32(0x90000000),
+	)
+	return bytes.Join([][]byte{plainBox("styp", []byte("msdh"), u32(0)), sidx, frag}, nil)
+}
+
+func topTypes(b []byte) []string {
+	var types []string
+	for _, b := range topLevel(b) {
+		types = append(types, b.typ)
+	}
+	return types
+}
+
+func TestRanges(t *testing.T) {
+	scales := map[uint32]uint32{1: 90000, 2: 48000}
+	moof := topLevel(testFragment(3 * time.Second))[0].body
+	start, end, ok := moofRange(moof, scales)
+	require.True(t, ok)
+	assert.Equal(t, 3*time.Second, start)
+	assert.Equal(t, 4*time.Second, end)
+	_, _, ok = moofRange(moof, nil)
+	assert.False(t, ok, "no timescales")
+	_, _, ok = moofRange(moof[:40], scales)
+	assert.False(t, ok, "truncated")
+
+	sidx := topLevel(testIndexed(5 * time.Second))[1]
+	require.Equal(t, "sidx", sidx.typ)
+	start, end, ok = sidxRange(sidx.body)
+	require.True(t, ok)
+	assert.Equal(t, 5*time.Second, start)
+	assert.Equal(t, 6*time.Second, end)
+	_, _, ok = sidxRange(sidx.body[:20])
+	assert.False(t, ok, "truncated")
+}
+
+func TestInjector(t *testing.T) {
+	files := map[string][]byte{
+		"/0.m4s":      testSegment(0, 1),
+		"/1.m4s":      testSegment(time.Second, 1),
+		"/2.m4s":      testSegment(2*time.Second, 1),
+		"/multi.m4s":  testSegment(0, 2),
+		"/sidx.m4s":   testIndexed(time.Second),
+		"/300.m4s":    testSegment(300*time.Second, 1),
+		"/index.m3u8": []byte("#EXTM3U\n"),
+	}
+	inj := &Injector{Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, ok := files[req.URL.Path]
+		if !ok {
+			http.NotFound(rw, req)
+			return
+		}
+		rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		// written in pieces, as a file would be
+		for len(body) > 0 {
+			n := min(5, len(body))
+			rw.Write(body[:n])
+			body = body[n:]
+		}
+	})}
+	get := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		inj.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+	tag := []byte("ID3\x04\x00\x00\x00\x00\x00\x00")
+	inj.WriteEvent(1500*time.Millisecond, 0, "https://aomedia.org/emsg/ID3", tag)
+	// nothing is added until the timescales are known
+	assert.Equal(t, files["/1.m4s"], get("GET", "/1.m4s").Body.Bytes())
+	inj.SetStreams(testStreams)
+
+	rec := get("GET", "/1.m4s")
+	seg := rec.Body.Bytes()
+	assert.Empty(t, rec.Header().Get("Content-Length"), "length changed")
+	require.Equal(t, []string{"styp", "emsg", "moof", "mdat"}, topTypes(seg))
+	ev := &reader{b: topLevel(seg)[1].body}
+	version, _ := ev.versionFlags()
+	assert.EqualValues(t, 1, version)
+	assert.EqualValues(t, 1000, ev.u32(), "timescale")
+	assert.EqualValues(t, 1500, ev.u64(), "presentation time")
+	assert.EqualValues(t, 0xffffffff, ev.u32(), "duration")
+	assert.EqualValues(t, 1, ev.u32(), "id")
+	assert.Equal(t, append([]byte("https://aomedia.org/emsg/ID3\x00\x00"), tag...), ev.b)
+	// the rest of the segment is untouched
+	assert.Equal(t, files["/1.m4s"][:topLevel(seg)[1].start], seg[:topLevel(seg)[1].start])
+	assert.Equal(t, files["/1.m4s"][topLevel(seg)[1].start:], seg[topLevel(seg)[1].end:])
+
+	// each fragment gets the cues that fall in it
+	seg = get("GET", "/multi.m4s").Body.Bytes()
+	assert.Equal(t, []string{"styp", "moof", "mdat", "emsg", "moof", "mdat"}, topTypes(seg))
+	// and a segment index covers the whole segment
+	seg = get("GET", "/sidx.m4s").Body.Bytes()
+	assert.Equal(t, []string{"styp", "emsg", "sidx", "moof", "mdat"}, topTypes(seg))
+
+	// other segments and files pass through
+	assert.Equal(t, files["/0.m4s"], get("GET", "/0.m4s").Body.Bytes())
+	assert.Equal(t, files["/2.m4s"], get("GET", "/2.m4s").Body.Bytes())
+	rec = get("GET", "/index.m3u8")
+	assert.Equal(t, files["/index.m3u8"], rec.Body.Bytes())
+	assert.Equal(t, strconv.Itoa(len(files["/index.m3u8"])), rec.Header().Get("Content-Length"))
+	assert.Equal(t, http.StatusNotFound, get("GET", "/missing.m4s").Code)
+	assert.Equal(t, strconv.Itoa(len(files["/1.m4s"])), get("HEAD", "/1.m4s").Header().Get("Content-Length"))
+
+	// old cues are forgotten
+	get("GET", "/300.m4s")
+	assert.Empty(t, inj.cues)
+	rec = get("GET", "/1.m4s")
+	assert.Equal(t, files["/1.m4s"], rec.Body.Bytes())
+	assert.Equal(t, strconv.Itoa(len(files["/1.m4s"])), rec.Header().Get("Content-Length"))
+}
+
+func TestInjectorStreams(t *testing.T) {
+	// a segment still being written is passed on as each fragment arrives
+	rec := httptest.NewRecorder()
+	var before []string
+	inj := &Injector{Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		seg := testSegment(0, 2)
+		second := topLevel(seg)[3].start
+		rw.Write(seg[:second])
+		rw.(http.Flusher).Flush()
+		before = topTypes(rec.Body.Bytes())
+		rw.Write(seg[second:])
+	})}
+	inj.SetStreams(testStreams)
+	inj.WriteEvent(500*time.Millisecond, 0, "https://aomedia.org/emsg/ID3", nil)
+	inj.ServeHTTP(rec, httptest.NewRequest("GET", "/0.m4s", nil))
+	assert.Equal(t, []string{"styp", "emsg", "moof", "mdat"}, before)
+	assert.True(t, rec.Flushed)
+	assert.Equal(t, []string{"styp", "emsg", "moof", "mdat", "moof", "mdat"}, topTypes(rec.Body.Bytes()))
+}
@@ -0,0 +1,30 @@
+//go:build libav || ffmpeg
+
+package grabber
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nareix/joy4/av"
+	"github.com/stretchr/testify/require"
+)
+
+// testThumbnailers are the decoders selected by build tags. Each one must be
+// available, so that a missing decoder fails instead of skipping.
+var testThumbnailers = map[string]Thumbnailer{}
+
+func TestThumbnailers(t *testing.T) {
+	raw, err := os.ReadFile(filepath.Join("testdata", "pattern.h264"))
+	require.NoError(t, err)
+	for name, th := range testThumbnailers {
+		t.Run(name, func(t *testing.T) {
+			img, err := th.DecodeFrame(context.Background(), av.H264, raw)
+			require.NoError(t, err)
+			// I_PCM macroblocks are lossless so the picture must match exactly
+			golden(t, "pattern.png", toRGBA(img))
+		})
+	}
+}
@@ -0,0 +1,7 @@
+//go:build ffmpeg
+
+package grabber
+
+func init() {
+	testThumbnailers["ffmpeg"] = FFmpeg{}
+}
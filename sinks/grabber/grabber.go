@@ -4,22 +4,23 @@ import (
 	"bytes"
 	"context"
 	"errors"
-	"fmt"
 	"io"
-	"os/exec"
 	"time"
 
+	"eaglesong.dev/gunk/codec/hevcparser"
 	"eaglesong.dev/gunk/h264util"
+	"eaglesong.dev/gunk/h265util"
 	"eaglesong.dev/gunk/model"
 	"github.com/nareix/joy4/av"
 	"github.com/nareix/joy4/codec/h264parser"
 	"github.com/rs/zerolog/log"
 )
 
-const (
-	targetWidth  = 400
-	grabInterval = 10 * time.Second
-)
+const grabInterval = 10 * time.Second
+
+// ErrUnsupported is returned when the stream has no video track that
+// thumbnails can be made from
+var ErrUnsupported = errors.New("no h264 or h265 stream found")
 
 type Result struct {
 	Time       time.Time
@@ -32,15 +33,16 @@ func Grab(channelName string, dm av.Demuxer) (<-chan Result, error) {
 		return nil, err
 	}
 	vidIdx := -1
-	var vidCodec h264parser.CodecData
+	var vidCodec av.VideoCodecData
 	for i, s := range streams {
-		if s.Type() == av.H264 {
+		switch s.(type) {
+		case h264parser.CodecData, hevcparser.CodecData:
 			vidIdx = i
-			vidCodec = s.(h264parser.CodecData)
+			vidCodec = s.(av.VideoCodecData)
 		}
 	}
 	if vidIdx < 0 {
-		return nil, errors.New("no h264 stream found")
+		return nil, ErrUnsupported
 	}
 	grabch := make(chan Result, 1)
 	go func() {
@@ -49,6 +51,10 @@ func Grab(channelName string, dm av.Demuxer) (<-chan Result, error) {
 		var keyTime time.Duration
 		var lastGrab time.Time
 		var lastBframe time.Duration
+		var clip *previewClip
+		var lastPreview time.Time
+		// only one preview is encoded at a time
+		previewing := make(chan struct{}, 1)
 		l := log.With().Str("channel", channelName).Logger()
 		for {
 			pkt, err := dm.ReadPacket()
@@ -61,6 +67,25 @@ func Grab(channelName string, dm av.Demuxer) (<-chan Result, error) {
 			if int(pkt.Idx) != vidIdx {
 				continue
 			}
+			if clip == nil && pkt.IsKeyFrame && time.Since(lastPreview) >= previewInterval {
+				clip = &previewClip{start: pkt.Time}
+			}
+			if clip != nil && pkt.Time-clip.start < previewLength {
+				clip.add(pkt, vidCodec)
+			} else if clip != nil {
+				lastPreview = time.Now()
+				select {
+				case previewing <- struct{}{}:
+					go func(clip *previewClip) {
+						defer func() { <-previewing }()
+						if err := makePreview(channelName, vidCodec, clip); err != nil {
+							l.Err(err).Msg("failed to make preview")
+						}
+					}(clip)
+				default:
+				}
+				clip = nil
+			}
 			if buf.Len() != 0 && (!pkt.IsKeyFrame || pkt.Time != keyTime) {
 				if time.Since(lastGrab) >= grabInterval {
 					if err := makeFrame(channelName, vidCodec, buf.Bytes()); err != nil {
@@ -78,8 +103,13 @@ func Grab(channelName string, dm av.Demuxer) (<-chan Result, error) {
 				buf.Reset()
 			}
 			if pkt.IsKeyFrame {
-				h264util.WriteAnnexBPacket(&buf, pkt, vidCodec)
+				writeAnnexB(&buf, pkt, vidCodec)
 				keyTime = pkt.Time
+			} else if _, ok := vidCodec.(hevcparser.CodecData); ok {
+				// reordered frames have a composition offset
+				if pkt.CompositionTime != 0 {
+					lastBframe = pkt.Time
+				}
 			} else {
 				// check for bframes
 				nalus, _ := h264parser.SplitNALUs(pkt.Data)
@@ -100,24 +130,21 @@ func Grab(channelName string, dm av.Demuxer) (<-chan Result, error) {
 	return grabch, nil
 }
 
-func makeFrame(channelName string, cd h264parser.CodecData, raw []byte) error {
+func writeAnnexB(buf *bytes.Buffer, pkt av.Packet, cd av.CodecData) {
+	switch cd := cd.(type) {
+	case h264parser.CodecData:
+		h264util.WriteAnnexBPacket(buf, pkt, cd)
+	case hevcparser.CodecData:
+		h265util.WriteAnnexBPacket(buf, pkt, cd)
+	}
+}
+
+func makeFrame(channelName string, cd av.VideoCodecData, raw []byte) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	height := targetWidth * cd.Height() / cd.Width()
-	var jpeg bytes.Buffer
-	var errmsg bytes.Buffer
-	cmd := exec.CommandContext(ctx, "ffmpeg",
-		"-loglevel", "warning",
-		"-f", "h264",
-		"-i", "-",
-		"-frames:v", "1",
-		"-s", fmt.Sprintf("%dx%d", targetWidth, height),
-		"-f", "mjpeg", "-")
-	cmd.Stdin = bytes.NewReader(raw)
-	cmd.Stdout = &jpeg
-	cmd.Stderr = &errmsg
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("%s\n%s", err.Error(), errmsg.String())
+	thumbs, err := makeThumbs(ctx, Default, cd.Type(), raw, model.ThumbWidths)
+	if err != nil {
+		return err
 	}
-	return model.PutThumb(ctx, channelName, jpeg.Bytes())
+	return model.PutThumb(ctx, channelName, thumbs)
 }
@@ -0,0 +1,138 @@
+//go:build libav
+
+package grabber
+
+/*
+#cgo pkg-config: libavcodec libavutil
+#include <string.h>
+#include <libavcodec/avcodec.h>
+#include <libavutil/frame.h>
+#include <libavutil/mem.h>
+
+// decode_frame decodes the first picture in a buffer of Annex B NAL units.
+// Decoding is single-threaded so that each thumbnail costs one core at most.
+static int decode_frame(enum AVCodecID id, const uint8_t *data, int size, AVFrame *frame) {
+	const AVCodec *codec = avcodec_find_decoder(id);
+	if (!codec)
+		return AVERROR_DECODER_NOT_FOUND;
+	AVCodecContext *ctx = avcodec_alloc_context3(codec);
+	if (!ctx)
+		return AVERROR(ENOMEM);
+	ctx->thread_count = 1;
+	AVPacket *pkt = NULL;
+	uint8_t *buf = NULL;
+	int ret = avcodec_open2(ctx, codec, NULL);
+	if (ret < 0)
+		goto out;
+	pkt = av_packet_alloc();
+	buf = av_malloc(size + AV_INPUT_BUFFER_PADDING_SIZE);
+	if (!pkt || !buf) {
+		av_free(buf);
+		ret = AVERROR(ENOMEM);
+		goto out;
+	}
+	memcpy(buf, data, size);
+	memset(buf + size, 0, AV_INPUT_BUFFER_PADDING_SIZE);
+	if ((ret = av_packet_from_data(pkt, buf, size)) < 0) {
+		av_free(buf);
+		goto out;
+	}
+	if ((ret = avcodec_send_packet(ctx, pkt)) < 0)
+		goto out;
+	// flush, the picture may be held back for reordering
+	if ((ret = avcodec_send_packet(ctx, NULL)) < 0)
+		goto out;
+	ret = avcodec_receive_frame(ctx, frame);
+out:
+	av_packet_free(&pkt);
+	avcodec_free_context(&ctx);
+	return ret;
+}
+
+static int frame_error_string(int err, char *buf, size_t size) {
+	return av_strerror(err, buf, size);
+}
+*/
+import "C"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"unsafe"
+
+	"eaglesong.dev/gunk/codec"
+	"github.com/nareix/joy4/av"
+)
+
+func init() {
+	Default = LibAV{}
+}
+
+// LibAV decodes frames in-process with libavcodec
+type LibAV struct{}
+
+func (LibAV) DecodeFrame(ctx context.Context, codecType av.CodecType, raw []byte) (image.Image, error) {
+	var id C.enum_AVCodecID
+	switch codecType {
+	case av.H264:
+		id = C.AV_CODEC_ID_H264
+	case codec.HEVC:
+		id = C.AV_CODEC_ID_HEVC
+	default:
+		return nil, ErrUnsupported
+	}
+	if len(raw) == 0 {
+		return nil, errors.New("decoding frame: empty keyframe")
+	}
+	frame := C.av_frame_alloc()
+	if frame == nil {
+		return nil, errors.New("decoding frame: out of memory")
+	}
+	defer C.av_frame_free(&frame)
+	if ret := C.decode_frame(id, (*C.uint8_t)(unsafe.Pointer(&raw[0])), C.int(len(raw)), frame); ret < 0 {
+		return nil, fmt.Errorf("decoding frame: %s", avError(ret))
+	}
+	var ratio image.YCbCrSubsampleRatio
+	fullRange := frame.color_range == C.AVCOL_RANGE_JPEG
+	switch C.enum_AVPixelFormat(frame.format) {
+	case C.AV_PIX_FMT_YUV420P:
+		ratio = image.YCbCrSubsampleRatio420
+	case C.AV_PIX_FMT_YUVJ420P:
+		ratio, fullRange = image.YCbCrSubsampleRatio420, true
+	case C.AV_PIX_FMT_YUV422P:
+		ratio = image.YCbCrSubsampleRatio422
+	case C.AV_PIX_FMT_YUVJ422P:
+		ratio, fullRange = image.YCbCrSubsampleRatio422, true
+	case C.AV_PIX_FMT_YUV444P:
+		ratio = image.YCbCrSubsampleRatio444
+	case C.AV_PIX_FMT_YUVJ444P:
+		ratio, fullRange = image.YCbCrSubsampleRatio444, true
+	default:
+		return nil, fmt.Errorf("decoding frame: unsupported pixel format %d", frame.format)
+	}
+	img := image.NewYCbCr(image.Rect(0, 0, int(frame.width), int(frame.height)), ratio)
+	copyPlane(img.Y, img.YStride, frame.data[0], frame.linesize[0], img.Rect.Dy())
+	chromaHeight := len(img.Cb) / img.CStride
+	copyPlane(img.Cb, img.CStride, frame.data[1], frame.linesize[1], chromaHeight)
+	copyPlane(img.Cr, img.CStride, frame.data[2], frame.linesize[2], chromaHeight)
+	if !fullRange {
+		expandRange(img)
+	}
+	return img, nil
+}
+
+// copyPlane copies rows of samples out of a frame
+func copyPlane(dst []byte, dstStride int, src *C.uint8_t, srcStride C.int, rows int) {
+	plane := unsafe.Slice((*byte)(unsafe.Pointer(src)), int(srcStride)*rows)
+	for y := 0; y < rows; y++ {
+		copy(dst[y*dstStride:(y+1)*dstStride], plane[y*int(srcStride):])
+	}
+}
+
+func avError(ret C.int) string {
+	var buf [128]C.char
+	C.frame_error_string(ret, &buf[0], C.size_t(len(buf)))
+	return C.GoString(&buf[0])
+}
@@ -0,0 +1,7 @@
+//go:build libav
+
+package grabber
+
+func init() {
+	testThumbnailers["libav"] = LibAV{}
+}
@@ -0,0 +1,74 @@
+package grabber
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"eaglesong.dev/gunk/codec"
+	"eaglesong.dev/gunk/model"
+	"github.com/nareix/joy4/av"
+)
+
+const (
+	previewWidth    = 240
+	previewLength   = 4 * time.Second
+	previewInterval = time.Minute
+	previewFPS      = 10
+)
+
+// previewClip collects a few seconds of video starting at a keyframe
+type previewClip struct {
+	buf         bytes.Buffer
+	start, last time.Duration
+	frames      int
+}
+
+func (c *previewClip) add(pkt av.Packet, cd av.CodecData) {
+	writeAnnexB(&c.buf, pkt, cd)
+	c.frames++
+	c.last = pkt.Time
+}
+
+// frameRate estimates the rate of the collected frames, which the raw
+// bitstream doesn't carry
+func (c *previewClip) frameRate() float64 {
+	d := c.last - c.start
+	if d <= 0 || c.frames < 2 {
+		return 30
+	}
+	return float64(c.frames-1) / d.Seconds()
+}
+
+// makePreview encodes a clip as a small looping animated WebP
+func makePreview(channelName string, cd av.VideoCodecData, clip *previewClip) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	format := "h264"
+	if cd.Type() == codec.HEVC {
+		format = "hevc"
+	}
+	var webp bytes.Buffer
+	var errmsg bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-loglevel", "warning",
+		"-f", format,
+		"-framerate", strconv.FormatFloat(clip.frameRate(), 'f', 3, 64),
+		"-i", "-",
+		"-an",
+		"-vf", fmt.Sprintf("fps=%d,scale=%d:-2", previewFPS, previewWidth),
+		"-c:v", "libwebp",
+		"-q:v", "50",
+		"-loop", "0",
+		"-f", "webp", "-")
+	cmd.Stdin = bytes.NewReader(clip.buf.Bytes())
+	cmd.Stdout = &webp
+	cmd.Stderr = &errmsg
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s\n%s", err.Error(), errmsg.String())
+	}
+	return model.PutPreview(ctx, channelName, webp.Bytes())
+}
@@ -0,0 +1,226 @@
+package grabber
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"math"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"eaglesong.dev/gunk/codec"
+	"github.com/nareix/joy4/av"
+)
+
+// Thumbnailer decodes the picture in an Annex B keyframe
+type Thumbnailer interface {
+	DecodeFrame(ctx context.Context, codecType av.CodecType, raw []byte) (image.Image, error)
+}
+
+// Default decodes thumbnails. Builds with the libav tag decode in-process,
+// otherwise ffmpeg is run for each thumbnail.
+var Default Thumbnailer = FFmpeg{}
+
+// decoding limits how many frames are decoded and encoded at once, across
+// all channels
+var decoding = make(chan struct{}, max(1, runtime.NumCPU()/4))
+
+// makeThumbs decodes a keyframe and encodes it as a JPEG for each width.
+// Thumbnails aren't offered as WebP since Go has no WebP encoder, only the
+// animated previews that ffmpeg makes are.
+func makeThumbs(ctx context.Context, t Thumbnailer, codecType av.CodecType, raw []byte, widths []int) (map[int][]byte, error) {
+	select {
+	case decoding <- struct{}{}:
+		defer func() { <-decoding }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	img, err := t.DecodeFrame(ctx, codecType, raw)
+	if err != nil {
+		return nil, err
+	}
+	thumbs := make(map[int][]byte, len(widths))
+	for _, width := range widths {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, scaleImage(img, width), &jpeg.Options{Quality: 85}); err != nil {
+			return nil, err
+		}
+		thumbs[width] = buf.Bytes()
+	}
+	return thumbs, nil
+}
+
+// FFmpeg decodes frames by running ffmpeg
+type FFmpeg struct{}
+
+func (FFmpeg) DecodeFrame(ctx context.Context, codecType av.CodecType, raw []byte) (image.Image, error) {
+	format := "h264"
+	if codecType == codec.HEVC {
+		format = "hevc"
+	}
+	var y4m bytes.Buffer
+	var errmsg bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-loglevel", "warning",
+		"-f", format,
+		"-i", "-",
+		"-frames:v", "1",
+		"-pix_fmt", "yuv420p",
+		"-f", "yuv4mpegpipe", "-")
+	cmd.Stdin = bytes.NewReader(raw)
+	cmd.Stdout = &y4m
+	cmd.Stderr = &errmsg
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s\n%s", err.Error(), errmsg.String())
+	}
+	img, err := decodeY4M(&y4m)
+	if err != nil {
+		return nil, fmt.Errorf("reading ffmpeg output: %w", err)
+	}
+	return img, nil
+}
+
+// decodeY4M reads a limited range frame as written by ffmpeg
+func decodeY4M(r io.Reader) (*image.YCbCr, error) {
+	img, err := readY4M(r)
+	if err != nil {
+		return nil, err
+	}
+	expandRange(img)
+	return img, nil
+}
+
+// readY4M reads the first frame of a 4:2:0 YUV4MPEG2 stream
+func readY4M(r io.Reader) (*image.YCbCr, error) {
+	br := bufio.NewReader(r)
+	header, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(header)
+	if len(fields) == 0 || fields[0] != "YUV4MPEG2" {
+		return nil, errors.New("not a YUV4MPEG2 stream")
+	}
+	var width, height int
+	for _, f := range fields[1:] {
+		switch f[0] {
+		case 'W':
+			width, _ = strconv.Atoi(f[1:])
+		case 'H':
+			height, _ = strconv.Atoi(f[1:])
+		case 'C':
+			if !strings.HasPrefix(f, "C420") {
+				return nil, fmt.Errorf("unsupported colorspace %s", f[1:])
+			}
+		}
+	}
+	if width <= 0 || height <= 0 {
+		return nil, errors.New("missing frame size")
+	}
+	if frame, err := br.ReadString('\n'); err != nil {
+		return nil, err
+	} else if !strings.HasPrefix(frame, "FRAME") {
+		return nil, errors.New("missing frame header")
+	}
+	img := image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420)
+	cw := (width + 1) / 2
+	ch := (height + 1) / 2
+	if _, err := io.ReadFull(br, img.Y[:width*height]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(br, img.Cb[:cw*ch]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(br, img.Cr[:cw*ch]); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// expandRange converts limited range video samples to the full range that
+// JPEG and image.YCbCr use
+func expandRange(img *image.YCbCr) {
+	var luma, chroma [256]uint8
+	for i := range luma {
+		luma[i] = clampByte(math.Round(float64(i-16) * 255 / 219))
+		chroma[i] = clampByte(128 + math.Round(float64(i-128)*255/224))
+	}
+	for i, v := range img.Y {
+		img.Y[i] = luma[v]
+	}
+	for i, v := range img.Cb {
+		img.Cb[i] = chroma[v]
+	}
+	for i, v := range img.Cr {
+		img.Cr[i] = chroma[v]
+	}
+}
+
+func clampByte(v float64) uint8 {
+	switch {
+	case v < 0:
+		return 0
+	case v > 255:
+		return 255
+	}
+	return uint8(v)
+}
+
+// scaleImage shrinks an image to the given width by averaging the source
+// pixels that each output pixel covers. Images are never enlarged.
+func scaleImage(src image.Image, width int) *image.RGBA {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	in := image.NewRGBA(image.Rect(0, 0, sw, sh))
+	draw.Draw(in, in.Rect, src, b.Min, draw.Src)
+	if width >= sw {
+		return in
+	}
+	height := max(1, (sh*width+sw/2)/sw)
+	// horizontal pass, the weights of each sum add up to sw
+	tmp := make([]uint32, width*sh*4)
+	for y := 0; y < sh; y++ {
+		row := in.Pix[y*in.Stride:]
+		forSpans(sw, width, func(src, dst, weight int) {
+			for c := 0; c < 4; c++ {
+				tmp[(y*width+dst)*4+c] += uint32(row[src*4+c]) * uint32(weight)
+			}
+		})
+	}
+	// vertical pass, the weights add up to sw*sh
+	sums := make([]uint64, width*height*4)
+	forSpans(sh, height, func(src, dst, weight int) {
+		for i := 0; i < width*4; i++ {
+			sums[dst*width*4+i] += uint64(tmp[src*width*4+i]) * uint64(weight)
+		}
+	})
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+	total := uint64(sw) * uint64(sh)
+	for i, v := range sums {
+		out.Pix[i] = uint8((v + total/2) / total)
+	}
+	return out
+}
+
+// forSpans calls f for each overlap of n source pixels with m output pixels,
+// with the overlap measured in units of 1/m of a source pixel so that each
+// output pixel's weights add up to n
+func forSpans(n, m int, f func(src, dst, weight int)) {
+	for src := 0; src < n; src++ {
+		lo, hi := src*m, (src+1)*m
+		for dst := lo / n; dst < m && dst*n < hi; dst++ {
+			w := min(hi, (dst+1)*n) - max(lo, dst*n)
+			if w > 0 {
+				f(src, dst, w)
+			}
+		}
+	}
+}
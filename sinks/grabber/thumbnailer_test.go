@@ -0,0 +1,311 @@
+package grabber
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nareix/joy4/av"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden images in testdata")
+
+var goldenWidths = []int{56, 40}
+
+// testPattern is a limited range 4:2:0 picture with gradients in each plane
+func testPattern() *image.YCbCr {
+	img := image.NewYCbCr(image.Rect(0, 0, 112, 64), image.YCbCrSubsampleRatio420)
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 112; x++ {
+			img.Y[img.YOffset(x, y)] = uint8(16 + (x*3+y*2)%220)
+		}
+	}
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 56; x++ {
+			img.Cb[y*img.CStride+x] = uint8(16 + (x*8)%225)
+			img.Cr[y*img.CStride+x] = uint8(16 + (y*12+x)%225)
+		}
+	}
+	return img
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	out := image.NewRGBA(img.Bounds())
+	draw.Draw(out, out.Rect, img, img.Bounds().Min, draw.Src)
+	return out
+}
+
+// golden compares an image to a PNG in testdata, or rewrites it with -update
+func golden(t *testing.T, name string, got *image.RGBA) {
+	t.Helper()
+	p := filepath.Join("testdata", name)
+	if *update {
+		var buf bytes.Buffer
+		require.NoError(t, png.Encode(&buf, got))
+		require.NoError(t, os.WriteFile(p, buf.Bytes(), 0o644))
+	}
+	f, err := os.Open(p)
+	require.NoError(t, err)
+	defer f.Close()
+	want, err := png.Decode(f)
+	require.NoError(t, err)
+	require.Equal(t, want.Bounds(), got.Bounds())
+	assert.Equal(t, toRGBA(want).Pix, got.Pix, "%s differs", name)
+}
+
+func TestPCMStream(t *testing.T) {
+	raw := pcmStream(testPattern())
+	p := filepath.Join("testdata", "pattern.h264")
+	if *update {
+		require.NoError(t, os.WriteFile(p, raw, 0o644))
+	}
+	want, err := os.ReadFile(p)
+	require.NoError(t, err)
+	assert.Equal(t, want, raw)
+	expected := testPattern()
+	expandRange(expected)
+	golden(t, "pattern.png", toRGBA(expected))
+}
+
+// TestDecodeY4M checks the frame that ffmpeg writes for pattern.h264 without
+// running it. I_PCM macroblocks are lossless, so the fixture holds the
+// pattern's own samples.
+func TestDecodeY4M(t *testing.T) {
+	p := filepath.Join("testdata", "pattern.y4m")
+	if *update {
+		src := testPattern()
+		var buf bytes.Buffer
+		buf.WriteString("YUV4MPEG2 W112 H64 F25:1 Ip A0:0 C420jpeg XYSCSS=420JPEG\nFRAME\n")
+		buf.Write(src.Y)
+		buf.Write(src.Cb)
+		buf.Write(src.Cr)
+		require.NoError(t, os.WriteFile(p, buf.Bytes(), 0o644))
+	}
+	f, err := os.Open(p)
+	require.NoError(t, err)
+	defer f.Close()
+	img, err := decodeY4M(f)
+	require.NoError(t, err)
+	golden(t, "pattern.png", toRGBA(img))
+	for _, width := range goldenWidths {
+		golden(t, fmt.Sprintf("pattern_%d.png", width), scaleImage(img, width))
+	}
+}
+
+func TestScaleGolden(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "pattern.png"))
+	require.NoError(t, err)
+	defer f.Close()
+	src, err := png.Decode(f)
+	require.NoError(t, err)
+	for _, width := range goldenWidths {
+		golden(t, fmt.Sprintf("pattern_%d.png", width), scaleImage(src, width))
+	}
+	// never enlarged
+	assert.Equal(t, src.Bounds(), scaleImage(src, 400).Rect)
+}
+
+type fixedFrame struct{ img image.Image }
+
+func (f fixedFrame) DecodeFrame(ctx context.Context, codecType av.CodecType, raw []byte) (image.Image, error) {
+	return f.img, nil
+}
+
+func TestMakeThumbs(t *testing.T) {
+	thumbs, err := makeThumbs(context.Background(), fixedFrame{testPattern()}, av.H264, nil, []int{400, 56})
+	require.NoError(t, err)
+	require.Len(t, thumbs, 2)
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(thumbs[400]))
+	require.NoError(t, err)
+	assert.Equal(t, 112, cfg.Width)
+	assert.Equal(t, 64, cfg.Height)
+	cfg, err = jpeg.DecodeConfig(bytes.NewReader(thumbs[56]))
+	require.NoError(t, err)
+	assert.Equal(t, 56, cfg.Width)
+	assert.Equal(t, 32, cfg.Height)
+}
+
+func TestReadY4M(t *testing.T) {
+	src := testPattern()
+	var buf bytes.Buffer
+	buf.WriteString("YUV4MPEG2 W112 H64 F30:1 Ip A1:1 C420jpeg XYSCSS=420JPEG\nFRAME\n")
+	buf.Write(src.Y)
+	buf.Write(src.Cb)
+	buf.Write(src.Cr)
+	img, err := readY4M(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, src.Rect, img.Rect)
+	assert.Equal(t, src.Y, img.Y)
+	assert.Equal(t, src.Cb, img.Cb)
+	assert.Equal(t, src.Cr, img.Cr)
+
+	// chroma of odd sizes rounds up
+	img, err = readY4M(bytes.NewReader([]byte("YUV4MPEG2 W3 H3 C420mpeg2\nFRAME\n012345678abcdABCD")))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("012345678"), img.Y)
+	assert.Equal(t, []byte("abcd"), img.Cb)
+	assert.Equal(t, []byte("ABCD"), img.Cr)
+
+	for _, bad := range []string{
+		"YUV4MPEG2 W112 H64 C444\nFRAME\n",
+		"YUV4MPEG2 H64\nFRAME\n",
+		"RIFF\n",
+		"YUV4MPEG2 W2 H2\nFRAME\n0123a",
+	} {
+		_, err = readY4M(bytes.NewReader([]byte(bad)))
+		assert.Error(t, err, bad)
+	}
+}
+
+// pcmStream encodes a picture as an H.264 IDR made only of I_PCM macroblocks,
+// which every decoder must reproduce exactly. The picture's size must be a
+// multiple of 16.
+func pcmStream(img *image.YCbCr) []byte {
+	mbWidth, mbHeight := img.Rect.Dx()/16, img.Rect.Dy()/16
+	var sps bitWriter
+	sps.bits(66, 8)   // profile_idc: baseline
+	sps.bits(0xc0, 8) // constraint_set0_flag, constraint_set1_flag
+	sps.bits(30, 8)   // level_idc
+	sps.ue(0)         // seq_parameter_set_id
+	sps.ue(0)         // log2_max_frame_num_minus4
+	sps.ue(2)         // pic_order_cnt_type
+	sps.ue(1)         // max_num_ref_frames
+	sps.bits(0, 1)    // gaps_in_frame_num_value_allowed_flag
+	sps.ue(uint32(mbWidth - 1))
+	sps.ue(uint32(mbHeight - 1))
+	sps.bits(1, 1) // frame_mbs_only_flag
+	sps.bits(1, 1) // direct_8x8_inference_flag
+	sps.bits(0, 1) // frame_cropping_flag
+	sps.bits(0, 1) // vui_parameters_present_flag
+	sps.trailing()
+
+	var pps bitWriter
+	pps.ue(0)      // pic_parameter_set_id
+	pps.ue(0)      // seq_parameter_set_id
+	pps.bits(0, 1) // entropy_coding_mode_flag: CAVLC
+	pps.bits(0, 1) // bottom_field_pic_order_in_frame_present_flag
+	pps.ue(0)      // num_slice_groups_minus1
+	pps.ue(0)      // num_ref_idx_l0_default_active_minus1
+	pps.ue(0)      // num_ref_idx_l1_default_active_minus1
+	pps.bits(0, 1) // weighted_pred_flag
+	pps.bits(0, 2) // weighted_bipred_idc
+	pps.se(0)      // pic_init_qp_minus26
+	pps.se(0)      // pic_init_qs_minus26
+	pps.se(0)      // chroma_qp_index_offset
+	pps.bits(1, 1) // deblocking_filter_control_present_flag
+	pps.bits(0, 1) // constrained_intra_pred_flag
+	pps.bits(0, 1) // redundant_pic_cnt_present_flag
+	pps.trailing()
+
+	var slice bitWriter
+	slice.ue(0)      // first_mb_in_slice
+	slice.ue(7)      // slice_type: I, all slices
+	slice.ue(0)      // pic_parameter_set_id
+	slice.bits(0, 4) // frame_num
+	slice.ue(0)      // idr_pic_id
+	slice.bits(0, 1) // no_output_of_prior_pics_flag
+	slice.bits(0, 1) // long_term_reference_flag
+	slice.se(0)      // slice_qp_delta
+	slice.ue(1)      // disable_deblocking_filter_idc
+	for my := 0; my < mbHeight; my++ {
+		for mx := 0; mx < mbWidth; mx++ {
+			slice.ue(25) // mb_type: I_PCM
+			slice.align()
+			for y := 0; y < 16; y++ {
+				for x := 0; x < 16; x++ {
+					slice.bits(uint32(img.Y[img.YOffset(mx*16+x, my*16+y)]), 8)
+				}
+			}
+			for _, plane := range [][]byte{img.Cb, img.Cr} {
+				for y := 0; y < 8; y++ {
+					for x := 0; x < 8; x++ {
+						slice.bits(uint32(plane[(my*8+y)*img.CStride+mx*8+x]), 8)
+					}
+				}
+			}
+		}
+	}
+	slice.trailing()
+
+	var out []byte
+	out = appendNALU(out, 0x67, sps.buf)
+	out = appendNALU(out, 0x68, pps.buf)
+	out = appendNALU(out, 0x65, slice.buf)
+	return out
+}
+
+// appendNALU adds a start code, the NAL header and the payload with emulation
+// prevention bytes
+func appendNALU(out []byte, header byte, rbsp []byte) []byte {
+	out = append(out, 0, 0, 0, 1, header)
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+type bitWriter struct {
+	buf  []byte
+	used int // bits used in the last byte
+}
+
+func (w *bitWriter) bits(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.used == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		w.buf[len(w.buf)-1] |= byte(v>>i&1) << (7 - w.used)
+		w.used = (w.used + 1) % 8
+	}
+}
+
+// ue writes an unsigned Exp-Golomb code
+func (w *bitWriter) ue(v uint32) {
+	n := 0
+	for x := v + 1; x > 1; x >>= 1 {
+		n++
+	}
+	w.bits(0, n)
+	w.bits(v+1, n+1)
+}
+
+// se writes a signed Exp-Golomb code
+func (w *bitWriter) se(v int32) {
+	if v > 0 {
+		w.ue(uint32(2*v - 1))
+	} else {
+		w.ue(uint32(-2 * v))
+	}
+}
+
+func (w *bitWriter) align() {
+	if w.used != 0 {
+		w.bits(0, 8-w.used)
+	}
+}
+
+// trailing writes the RBSP stop bit and alignment
+func (w *bitWriter) trailing() {
+	w.bits(1, 1)
+	w.align()
+}
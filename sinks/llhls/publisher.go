@@ -0,0 +1,288 @@
+// Package llhls serves a live stream as Low-Latency HLS with fMP4 partial
+// segments, preload hints, blocking playlist reload and delta updates
+package llhls
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"eaglesong.dev/gunk/internal"
+	"eaglesong.dev/gunk/internal/fmp4"
+	"github.com/nareix/joy4/av"
+)
+
+const (
+	defaultPartLength    = 500 * time.Millisecond
+	defaultSegmentLength = 2 * time.Second
+	defaultBufferLength  = 30 * time.Second
+)
+
+// Prefix starts the name of every file served by a Publisher
+const Prefix = "ll-"
+
+// schemes of timed metadata passed to WriteEvent
+const (
+	// SchemeID3 carries an ID3 tag, as played by HLS clients
+	SchemeID3 = "https://aomedia.org/emsg/ID3"
+	// SchemeSCTE35 carries a binary splice_info_section
+	SchemeSCTE35 = "urn:scte:scte35:2013:bin"
+)
+
+var errClosed = errors.New("llhls: publisher closed")
+
+// Publisher cuts a stream into LL-HLS parts and segments and serves them from
+// memory
+type Publisher struct {
+	PartLength    time.Duration // target length of each partial segment
+	SegmentLength time.Duration // target length of each segment, also the most it can be
+	BufferLength  time.Duration // how much of the stream is kept in the playlist
+
+	mu       sync.Mutex
+	id       string // distinguishes the files of each stream
+	changed  chan struct{}
+	closed   bool
+	tracks   []*fmp4.Track
+	primary  int // track whose duration decides where to cut
+	init     []byte
+	segments []*segment
+	seq      uint32 // fragment sequence number
+	discSeq  int    // discontinuities that have aged out of the playlist
+
+	// the next segment starting at or after this time is marked as a
+	// discontinuity
+	discAt      time.Duration
+	discPending bool
+
+	// samples waiting for the current part
+	cur     *segment
+	samples [][]fmp4.Sample
+	partDur time.Duration
+
+	// EXT-X-TARGETDURATION, which can't change during the stream
+	targetDuration int
+
+	// timed metadata waiting for the next part
+	events  []fmp4.Event
+	eventID uint32
+}
+
+type segment struct {
+	msn           int
+	parts         []*part
+	duration      time.Duration
+	done          bool
+	data          []byte
+	discontinuity bool
+}
+
+type part struct {
+	data        []byte
+	duration    time.Duration
+	independent bool
+}
+
+// WriteHeader sets up the tracks. It fails if a codec can't be carried in
+// fMP4.
+func (p *Publisher) WriteHeader(streams []av.CodecData) error {
+	if p.PartLength == 0 {
+		p.PartLength = defaultPartLength
+	}
+	if p.SegmentLength == 0 {
+		p.SegmentLength = defaultSegmentLength
+	}
+	if p.BufferLength == 0 {
+		p.BufferLength = defaultBufferLength
+	}
+	var tracks []*fmp4.Track
+	primary := -1
+	for i, cd := range streams {
+		t, err := fmp4.NewTrack(uint32(i+1), cd)
+		if err != nil {
+			return err
+		}
+		if t.Video && primary < 0 {
+			primary = i
+		}
+		tracks = append(tracks, t)
+	}
+	if primary < 0 {
+		primary = 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.id = internal.RandomID(4)
+	p.tracks = tracks
+	p.primary = primary
+	p.init = fmp4.InitSegment(tracks)
+	p.samples = make([][]fmp4.Sample, len(tracks))
+	p.targetDuration = int((p.SegmentLength + time.Second - 1) / time.Second)
+	p.changed = make(chan struct{})
+	return nil
+}
+
+// WritePacket adds a packet to the stream. Each packet is held until the next
+// one on the same track arrives, so that its duration is known.
+func (p *Publisher) WritePacket(pkt av.Packet) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errClosed
+	}
+	if int(pkt.Idx) >= len(p.tracks) {
+		return nil
+	}
+	t := p.tracks[pkt.Idx]
+	s, ok := t.Push(pkt)
+	if !ok {
+		return nil
+	}
+	disc := p.discPending && int(pkt.Idx) == p.primary && (s.Key || !t.Video) && s.Time >= p.discAt
+	p.addSample(int(pkt.Idx), s, disc)
+	return nil
+}
+
+// Discontinuity starts a new segment marked as a discontinuity at the first
+// keyframe at or after the given time
+func (p *Publisher) Discontinuity(at time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.discAt = at
+	p.discPending = true
+}
+
+// WriteEvent adds timed metadata to the stream. It is sent as an emsg box
+// ahead of the next part and takes effect at the given time.
+func (p *Publisher) WriteEvent(at, duration time.Duration, scheme string, data []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.events = append(p.events, fmp4.Event{At: at, Duration: duration, Scheme: scheme, Data: data})
+}
+
+func (p *Publisher) addSample(idx int, s fmp4.Sample, disc bool) {
+	t := p.tracks[idx]
+	if idx == p.primary {
+		// segments start on a keyframe when there is one in time, but are never
+		// longer than the advertised target. Parts are cut before they get too
+		// long.
+		target := time.Duration(p.targetDuration) * time.Second
+		switch {
+		case p.cur == nil:
+			if t.Video && !s.Key {
+				return
+			}
+			p.startSegment()
+		case disc:
+			p.finishPart()
+			p.finishSegment()
+			p.startSegment()
+		case (s.Key || !t.Video) && p.cur.duration+p.partDur >= p.SegmentLength,
+			p.cur.duration+p.partDur > 0 && p.cur.duration+p.partDur+s.Length > target:
+			p.finishPart()
+			p.finishSegment()
+			p.startSegment()
+		case p.partDur > 0 && p.partDur+s.Length > p.PartLength:
+			p.finishPart()
+		}
+		if disc {
+			p.cur.discontinuity = true
+			p.discPending = false
+		}
+		p.partDur += s.Length
+	} else if p.cur == nil {
+		return
+	}
+	p.samples[idx] = append(p.samples[idx], s)
+}
+
+func (p *Publisher) startSegment() {
+	msn := 0
+	if n := len(p.segments); n > 0 {
+		msn = p.segments[n-1].msn + 1
+	}
+	p.cur = &segment{msn: msn}
+	p.segments = append(p.segments, p.cur)
+	// drop segments that have aged out of the playlist
+	var total time.Duration
+	for i := len(p.segments) - 1; i >= 0; i-- {
+		total += p.segments[i].duration
+		if total > p.BufferLength {
+			for _, seg := range p.segments[:i] {
+				if seg.discontinuity {
+					p.discSeq++
+				}
+			}
+			p.segments = p.segments[i:]
+			break
+		}
+	}
+}
+
+func (p *Publisher) finishPart() {
+	if p.partDur == 0 {
+		return
+	}
+	p.seq++
+	var data []byte
+	for _, ev := range p.events {
+		p.eventID++
+		data = append(data, fmp4.Emsg(p.eventID, ev)...)
+	}
+	p.events = p.events[:0]
+	pt := &part{
+		data:     append(data, fmp4.Fragment(p.seq, p.tracks, p.samples)...),
+		duration: p.partDur,
+	}
+	if ps := p.samples[p.primary]; len(ps) > 0 {
+		pt.independent = ps[0].Key || !p.tracks[p.primary].Video
+	}
+	for i := range p.samples {
+		p.samples[i] = p.samples[i][:0]
+	}
+	p.cur.parts = append(p.cur.parts, pt)
+	p.cur.duration += pt.duration
+	p.partDur = 0
+	p.notify()
+}
+
+func (p *Publisher) finishSegment() {
+	var data []byte
+	for _, pt := range p.cur.parts {
+		data = append(data, pt.data...)
+	}
+	p.cur.data = data
+	p.cur.done = true
+	p.cur = nil
+	p.notify()
+}
+
+// notify wakes up blocked requests
+func (p *Publisher) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+func (p *Publisher) WriteTrailer() error {
+	return nil
+}
+
+// Close ends the stream and releases any blocked requests
+func (p *Publisher) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	if p.changed != nil {
+		close(p.changed)
+	}
+}
+
+// Playlist returns the file name of the media playlist
+func (p *Publisher) Playlist() string {
+	return Prefix + "live.m3u8"
+}
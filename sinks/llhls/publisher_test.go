@@ -0,0 +1,228 @@
+package llhls
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const frame = 100 * time.Millisecond
+
+// testStream writes a video stream at 10fps with a keyframe every gop
+type testStream struct {
+	p   *Publisher
+	gop time.Duration
+	t   time.Duration
+}
+
+func newTestStream(t *testing.T, gop time.Duration) *testStream {
+	p := &Publisher{BufferLength: time.Minute}
+	require.NoError(t, p.WriteHeader([]av.CodecData{h264parser.CodecData{}}))
+	return &testStream{p: p, gop: gop}
+}
+
+// run writes packets up to but not including time end
+func (s *testStream) run(t *testing.T, end time.Duration) {
+	for ; s.t < end; s.t += frame {
+		require.NoError(t, s.p.WritePacket(av.Packet{
+			IsKeyFrame: s.t%s.gop == 0,
+			Time:       s.t,
+			Data:       []byte{1, 2, 3},
+		}))
+	}
+}
+
+func (s *testStream) get(t *testing.T, ctx context.Context, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.p.ServeHTTP(rec, httptest.NewRequest("GET", target, nil).WithContext(ctx))
+	return rec
+}
+
+// playlistTags returns the lines of a playlist starting with tag
+func playlistTags(body, tag string) []string {
+	var lines []string
+	sc := bufio.NewScanner(strings.NewReader(body))
+	for sc.Scan() {
+		if strings.HasPrefix(sc.Text(), tag) {
+			lines = append(lines, sc.Text())
+		}
+	}
+	return lines
+}
+
+func TestSegments(t *testing.T) {
+	cases := []struct {
+		name      string
+		gop       time.Duration
+		durations []time.Duration
+		keyStarts []bool
+	}{
+		{
+			name:      "KeyframeEverySecond",
+			gop:       time.Second,
+			durations: []time.Duration{2 * time.Second, 2 * time.Second},
+			keyStarts: []bool{true, true},
+		},
+		{
+			// cut at the target without a keyframe rather than growing the
+			// target duration
+			name:      "LongGOP",
+			gop:       3 * time.Second,
+			durations: []time.Duration{2 * time.Second, 2 * time.Second},
+			keyStarts: []bool{true, false},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newTestStream(t, c.gop)
+			s.run(t, 5*time.Second)
+			p := s.p
+			assert.Equal(t, 2, p.targetDuration)
+			var durations []time.Duration
+			var keyStarts []bool
+			for _, seg := range p.segments {
+				if !seg.done {
+					continue
+				}
+				durations = append(durations, seg.duration)
+				keyStarts = append(keyStarts, seg.parts[0].independent)
+				var total time.Duration
+				for _, pt := range seg.parts {
+					assert.LessOrEqual(t, pt.duration, p.PartLength)
+					assert.True(t, bytes.HasPrefix(pt.data[4:], []byte("moof")))
+					total += pt.duration
+				}
+				assert.Equal(t, seg.duration, total)
+			}
+			assert.Equal(t, c.durations, durations)
+			assert.Equal(t, c.keyStarts, keyStarts)
+		})
+	}
+}
+
+func TestPlaylist(t *testing.T) {
+	s := newTestStream(t, time.Second)
+	ctx := context.Background()
+	// the playlist waits for the first part
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	rec := s.get(t, short, "/"+s.p.Playlist())
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	s.run(t, 4500*time.Millisecond)
+	rec = s.get(t, ctx, "/"+s.p.Playlist())
+	require.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	assert.Equal(t, []string{"#EXT-X-TARGETDURATION:2"}, playlistTags(body, "#EXT-X-TARGETDURATION"))
+	assert.Len(t, playlistTags(body, "#EXTINF"), 2)
+	parts := playlistTags(body, "#EXT-X-PART:")
+	// the last frame's duration isn't known yet, so segment 2 has no parts
+	require.Len(t, parts, 8)
+	prefix := s.p.filePrefix()
+	assert.Equal(t, fmt.Sprintf(`#EXT-X-PART:DURATION=0.50000,URI="%s0.0.m4s",INDEPENDENT=YES`, prefix), parts[0])
+	assert.Equal(t, fmt.Sprintf(`#EXT-X-PART:DURATION=0.50000,URI="%s0.1.m4s"`, prefix), parts[1])
+	assert.Equal(t, fmt.Sprintf(`#EXT-X-PART:DURATION=0.50000,URI="%s1.0.m4s",INDEPENDENT=YES`, prefix), parts[4])
+	assert.Equal(t, []string{fmt.Sprintf(`#EXT-X-PRELOAD-HINT:TYPE=PART,URI="%s2.0.m4s"`, prefix)},
+		playlistTags(body, "#EXT-X-PRELOAD-HINT"))
+
+	// files in the playlist can be fetched
+	init := s.get(t, ctx, "/"+prefix+"init.mp4")
+	require.Equal(t, http.StatusOK, init.Code)
+	assert.Equal(t, "ftyp", string(init.Body.Bytes()[4:8]))
+	seg := s.get(t, ctx, "/"+prefix+"1.m4s")
+	require.Equal(t, http.StatusOK, seg.Code)
+	assert.Equal(t, "moof", string(seg.Body.Bytes()[4:8]))
+	assert.Equal(t, http.StatusNotFound, s.get(t, ctx, "/"+prefix+"2.m4s").Code, "segment in progress")
+	assert.Equal(t, http.StatusNotFound, s.get(t, ctx, "/ll-other-0.m4s").Code)
+}
+
+func TestBlockingReload(t *testing.T) {
+	s := newTestStream(t, time.Second)
+	s.run(t, 2700*time.Millisecond)
+	ctx := context.Background()
+	prefix := s.p.filePrefix()
+	// segment 1 has one part so far
+	cases := []struct {
+		query string
+		code  int
+	}{
+		{"_HLS_msn=x", http.StatusBadRequest},
+		{"_HLS_msn=1&_HLS_part=-1", http.StatusBadRequest},
+		{"_HLS_msn=5", http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.code, s.get(t, ctx, "/"+s.p.Playlist()+"?"+c.query).Code, c.query)
+	}
+	// parts that exist already return at once
+	rec := s.get(t, ctx, "/"+s.p.Playlist()+"?_HLS_msn=1&_HLS_part=0")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	type result struct {
+		playlist *httptest.ResponseRecorder
+		part     *httptest.ResponseRecorder
+	}
+	done := make(chan result)
+	go func() {
+		var r result
+		r.playlist = s.get(t, ctx, "/"+s.p.Playlist()+"?_HLS_msn=1&_HLS_part=1")
+		r.part = s.get(t, ctx, "/"+prefix+"1.1.m4s")
+		done <- r
+	}()
+	select {
+	case <-done:
+		t.Fatal("request for a future part returned early")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.run(t, 3200*time.Millisecond)
+	r := <-done
+	require.Equal(t, http.StatusOK, r.playlist.Code)
+	assert.Contains(t, r.playlist.Body.String(), fmt.Sprintf(`URI="%s1.1.m4s"`, prefix))
+	require.Equal(t, http.StatusOK, r.part.Code)
+	assert.Equal(t, "moof", string(r.part.Body.Bytes()[4:8]))
+
+	// a blocked request gives up when the client does
+	cctx, cancel := context.WithCancel(ctx)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	rec = s.get(t, cctx, "/"+s.p.Playlist()+"?_HLS_msn=2")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	// and so does one for a stream that ended
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		s.p.Close()
+	}()
+	rec = s.get(t, ctx, "/"+s.p.Playlist()+"?_HLS_msn=2")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestDeltaUpdate(t *testing.T) {
+	s := newTestStream(t, time.Second)
+	s.run(t, 30*time.Second)
+	ctx := context.Background()
+	full := s.get(t, ctx, "/"+s.p.Playlist()).Body.String()
+	assert.Contains(t, full, "CAN-SKIP-UNTIL=12\n")
+	assert.Empty(t, playlistTags(full, "#EXT-X-SKIP"))
+	require.Len(t, playlistTags(full, "#EXTINF"), 14)
+
+	delta := s.get(t, ctx, "/"+s.p.Playlist()+"?_HLS_skip=YES").Body.String()
+	// segments more than 12 seconds from the end are skipped
+	assert.Equal(t, []string{"#EXT-X-SKIP:SKIPPED-SEGMENTS=8"}, playlistTags(delta, "#EXT-X-SKIP"))
+	extinf := playlistTags(delta, "#EXTINF")
+	assert.Len(t, extinf, 6)
+	assert.Equal(t, playlistTags(full, "#EXT-X-MEDIA-SEQUENCE"), playlistTags(delta, "#EXT-X-MEDIA-SEQUENCE"))
+	assert.Equal(t, playlistTags(full, "#EXT-X-PRELOAD-HINT"), playlistTags(delta, "#EXT-X-PRELOAD-HINT"))
+}
@@ -0,0 +1,255 @@
+package llhls
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServeHTTP serves the playlist, init segment, segments and parts
+func (p *Publisher) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	name := path.Base(req.URL.Path)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.changed == nil {
+		http.NotFound(rw, req)
+		return
+	}
+	if name == p.Playlist() {
+		p.servePlaylist(rw, req)
+		return
+	}
+	name, ok := strings.CutPrefix(name, p.filePrefix())
+	if !ok {
+		http.NotFound(rw, req)
+		return
+	}
+	var data []byte
+	var err error
+	if name == "init.mp4" {
+		data = p.init
+	} else if name, ok = strings.CutSuffix(name, ".m4s"); !ok {
+		http.NotFound(rw, req)
+		return
+	} else if msn, partStr, isPart := strings.Cut(name, "."); isPart {
+		data, err = p.part(req.Context(), msn, partStr)
+	} else {
+		data, err = p.segment(msn)
+	}
+	if err != nil || data == nil {
+		http.NotFound(rw, req)
+		return
+	}
+	rw.Header().Set("Content-Type", "video/mp4")
+	rw.Header().Set("Cache-Control", "max-age=60")
+	if req.Method != http.MethodHead {
+		_, _ = rw.Write(data)
+	}
+}
+
+func (p *Publisher) filePrefix() string {
+	return Prefix + p.id + "-"
+}
+
+func (p *Publisher) servePlaylist(rw http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	ready := func() bool { return len(p.segments) > 0 && len(p.segments[0].parts) > 0 }
+	if v := q.Get("_HLS_msn"); v != "" {
+		// blocking playlist reload
+		msn, err := strconv.Atoi(v)
+		if err != nil || msn < 0 {
+			http.Error(rw, "invalid _HLS_msn", http.StatusBadRequest)
+			return
+		}
+		partIdx := -1
+		if v := q.Get("_HLS_part"); v != "" {
+			partIdx, err = strconv.Atoi(v)
+			if err != nil || partIdx < 0 {
+				http.Error(rw, "invalid _HLS_part", http.StatusBadRequest)
+				return
+			}
+		}
+		if msn > p.nextMSN()+1 {
+			http.Error(rw, "_HLS_msn is too far in the future", http.StatusBadRequest)
+			return
+		}
+		ready = func() bool { return p.hasPart(msn, partIdx) }
+	}
+	if !p.wait(req.Context(), ready) {
+		http.Error(rw, "playlist not available", http.StatusServiceUnavailable)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	rw.Header().Set("Cache-Control", "no-cache")
+	if req.Method != http.MethodHead {
+		_, _ = rw.Write(p.playlist(q.Get("_HLS_skip") == "YES"))
+	}
+}
+
+// nextMSN returns the sequence number of the segment in progress
+func (p *Publisher) nextMSN() int {
+	if n := len(p.segments); n > 0 {
+		last := p.segments[n-1]
+		if last.done {
+			return last.msn + 1
+		}
+		return last.msn
+	}
+	return 0
+}
+
+// hasPart returns true once the given part, or the whole segment if partIdx
+// is negative, is available
+func (p *Publisher) hasPart(msn, partIdx int) bool {
+	if len(p.segments) == 0 {
+		return false
+	}
+	last := p.segments[len(p.segments)-1]
+	switch {
+	case msn < last.msn:
+		return true
+	case msn > last.msn:
+		return false
+	case partIdx < 0:
+		return last.done
+	default:
+		return last.done || len(last.parts) > partIdx
+	}
+}
+
+// wait blocks until ready returns true. It is called with the lock held and
+// returns with it held.
+func (p *Publisher) wait(ctx context.Context, ready func() bool) bool {
+	timeout := time.NewTimer(3 * time.Duration(p.targetDuration) * time.Second)
+	defer timeout.Stop()
+	for !ready() {
+		if p.closed {
+			return false
+		}
+		changed := p.changed
+		p.mu.Unlock()
+		select {
+		case <-changed:
+		case <-timeout.C:
+			p.mu.Lock()
+			return false
+		case <-ctx.Done():
+			p.mu.Lock()
+			return false
+		}
+		p.mu.Lock()
+	}
+	return true
+}
+
+func (p *Publisher) findSegment(msnStr string) (*segment, int, error) {
+	msn, err := strconv.Atoi(msnStr)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(p.segments) == 0 {
+		return nil, msn, nil
+	}
+	i := msn - p.segments[0].msn
+	if i < 0 || i >= len(p.segments) {
+		return nil, msn, nil
+	}
+	return p.segments[i], msn, nil
+}
+
+func (p *Publisher) segment(msnStr string) ([]byte, error) {
+	seg, _, err := p.findSegment(msnStr)
+	if err != nil || seg == nil || !seg.done {
+		return nil, err
+	}
+	return seg.data, nil
+}
+
+// part returns a partial segment, waiting for it if it is the one announced
+// by the preload hint
+func (p *Publisher) part(ctx context.Context, msnStr, partStr string) ([]byte, error) {
+	partIdx, err := strconv.Atoi(partStr)
+	if err != nil {
+		return nil, err
+	}
+	_, msn, err := p.findSegment(msnStr)
+	if err != nil {
+		return nil, err
+	}
+	if msn > p.nextMSN()+1 {
+		return nil, nil
+	}
+	if !p.wait(ctx, func() bool { return p.hasPart(msn, partIdx) }) {
+		return nil, nil
+	}
+	seg, _, _ := p.findSegment(msnStr)
+	if seg == nil || partIdx >= len(seg.parts) {
+		return nil, nil
+	}
+	return seg.parts[partIdx].data, nil
+}
+
+func (p *Publisher) playlist(skip bool) []byte {
+	var b bytes.Buffer
+	partTarget := p.PartLength.Seconds()
+	skipUntil := 6 * p.targetDuration
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:9\n#EXT-X-TARGETDURATION:%d\n", p.targetDuration)
+	fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f,CAN-SKIP-UNTIL=%d\n", 3*partTarget, skipUntil)
+	fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget)
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", p.segments[0].msn)
+	if p.discSeq != 0 {
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", p.discSeq)
+	}
+	fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"%sinit.mp4\"\n", p.filePrefix())
+	segments := p.segments
+	if skip {
+		// delta update, leave out segments older than CAN-SKIP-UNTIL
+		var remaining time.Duration
+		for _, seg := range segments {
+			remaining += seg.duration
+		}
+		var skipped int
+		for _, seg := range segments {
+			if !seg.done || remaining-seg.duration < time.Duration(skipUntil)*time.Second {
+				break
+			}
+			remaining -= seg.duration
+			skipped++
+		}
+		if skipped > 0 {
+			fmt.Fprintf(&b, "#EXT-X-SKIP:SKIPPED-SEGMENTS=%d\n", skipped)
+			segments = segments[skipped:]
+		}
+	}
+	// parts are listed for the last few segments only
+	withParts := len(segments) - 4
+	for i, seg := range segments {
+		if seg.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if i >= withParts {
+			for j, pt := range seg.parts {
+				fmt.Fprintf(&b, "#EXT-X-PART:DURATION=%.5f,URI=\"%s%d.%d.m4s\"", pt.duration.Seconds(), p.filePrefix(), seg.msn, j)
+				if pt.independent {
+					b.WriteString(",INDEPENDENT=YES")
+				}
+				b.WriteByte('\n')
+			}
+		}
+		if seg.done {
+			fmt.Fprintf(&b, "#EXTINF:%.5f,\n%s%d.m4s\n", seg.duration.Seconds(), p.filePrefix(), seg.msn)
+		}
+	}
+	// next part to be produced
+	msn, partIdx := p.nextMSN(), 0
+	if last := p.segments[len(p.segments)-1]; !last.done {
+		partIdx = len(last.parts)
+	}
+	fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s%d.%d.m4s\"\n", p.filePrefix(), msn, partIdx)
+	return b.Bytes()
+}
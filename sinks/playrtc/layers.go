@@ -0,0 +1,157 @@
+package playrtc
+
+import (
+	"sort"
+	"time"
+
+	"github.com/nareix/joy4/av"
+)
+
+const (
+	// how often to re-evaluate which layer a viewer gets
+	layerInterval = time.Second
+	// estimated bandwidth must be sustained this long before moving up a layer
+	upgradeDelay = 5 * time.Second
+	// fraction of the estimated bandwidth that the video may use
+	layerHeadroom = 0.85
+)
+
+// Layer is one simulcast encoding of the video track
+type Layer struct {
+	Name string
+	// Src supplies the layer's video as its only stream. It is nil for the
+	// layer that is already part of the main source.
+	Src av.Demuxer
+	// RequestKeyframe asks the publisher for a keyframe on this layer
+	RequestKeyframe func()
+}
+
+type senderLayer struct {
+	Layer
+	cd   av.CodecData
+	size int
+
+	bytes int
+	bps   float64
+	gone  bool
+}
+
+type layerPacket struct {
+	layer int
+	src   av.Demuxer
+	pkt   av.Packet
+	err   error
+}
+
+// layerState tracks which layer is being sent to one viewer
+type layerState struct {
+	layers  []*senderLayer // smallest first
+	primary int            // layer carried by the main source
+	current int
+	target  int
+
+	lastEval time.Time
+	upSince  time.Time
+}
+
+func newLayerState(layers []Layer, mainVideo av.CodecData) (*layerState, error) {
+	ls := new(layerState)
+	for _, l := range layers {
+		sl := &senderLayer{Layer: l, cd: mainVideo}
+		if l.Src != nil {
+			streams, err := l.Src.Streams()
+			if err != nil {
+				return nil, err
+			} else if len(streams) != 1 || streams[0].Type() != mainVideo.Type() {
+				// can't switch to a different codec on the same track
+				continue
+			}
+			sl.cd = streams[0]
+		}
+		if vcd, ok := sl.cd.(av.VideoCodecData); ok {
+			sl.size = vcd.Width() * vcd.Height()
+		}
+		ls.layers = append(ls.layers, sl)
+	}
+	sort.SliceStable(ls.layers, func(i, j int) bool { return ls.layers[i].size < ls.layers[j].size })
+	// start on the main layer
+	ls.primary = -1
+	for i, l := range ls.layers {
+		if l.Src == nil {
+			ls.primary = i
+			ls.current = i
+			ls.target = i
+		}
+	}
+	if len(ls.layers) < 2 || ls.primary < 0 {
+		// nothing to switch between
+		return nil, nil
+	}
+	ls.lastEval = time.Now()
+	return ls, nil
+}
+
+// route accounts for a video packet from the given layer and returns true if
+// it should be sent to the viewer. A pending switch happens at the target
+// layer's next keyframe.
+func (ls *layerState) route(layer int, pkt av.Packet) (send, switched bool) {
+	ls.layers[layer].bytes += len(pkt.Data)
+	if layer == ls.target && layer != ls.current && pkt.IsKeyFrame {
+		ls.current = layer
+		return true, true
+	}
+	return layer == ls.current, false
+}
+
+// remove stops using a layer that has ended
+func (ls *layerState) remove(layer int) {
+	ls.layers[layer].gone = true
+	if ls.target == layer {
+		ls.target = ls.primary
+	}
+}
+
+// evaluate picks a target layer for the available bitrate. It returns the
+// layer to request a keyframe from, if any.
+func (ls *layerState) evaluate(bitrate int) *senderLayer {
+	now := time.Now()
+	elapsed := now.Sub(ls.lastEval)
+	if elapsed < layerInterval {
+		return nil
+	}
+	ls.lastEval = now
+	for _, l := range ls.layers {
+		l.bps = float64(l.bytes*8) / elapsed.Seconds()
+		l.bytes = 0
+	}
+	if bitrate <= 0 {
+		return nil
+	}
+	// highest layer that fits, or the lowest if none do
+	best := -1
+	for i, l := range ls.layers {
+		if l.gone {
+			continue
+		}
+		if best < 0 || l.bps > 0 && l.bps <= float64(bitrate)*layerHeadroom {
+			best = i
+		}
+	}
+	switch {
+	case best > ls.target:
+		if ls.upSince.IsZero() {
+			ls.upSince = now
+		}
+		if now.Sub(ls.upSince) < upgradeDelay {
+			best = ls.target
+		}
+	default:
+		ls.upSince = time.Time{}
+	}
+	ls.target = best
+	if ls.target == ls.current {
+		return nil
+	}
+	// keep asking until the keyframe arrives
+	return ls.layers[ls.target]
+}
@@ -13,23 +13,50 @@ import (
 type ViewerFunc func(int)
 type CandidateSender func(webrtc.ICECandidateInit)
 
-func OfferToSend(ctx context.Context, e *rtcengine.Engine, src av.Demuxer, addViewer ViewerFunc, sendCandidate CandidateSender) (*Sender, error) {
+// OfferToSend creates an offer to send src to a viewer. If the video is
+// simulcast, layers lists every encoding including the one in src, and the
+// viewer is switched between them to fit its bandwidth. A single layer only
+// supplies a way to request keyframes from the publisher. Without one, rewind
+// is used to skip the viewer ahead to the source's cached keyframe instead, if
+// it is newer than what the viewer was sent; it returns nil if there isn't one.
+func OfferToSend(ctx context.Context, e *rtcengine.Engine, src av.Demuxer, rewind func() av.Demuxer, layers []Layer, addViewer ViewerFunc, sendCandidate CandidateSender) (*Sender, error) {
 	// build tracks
 	streams, err := src.Streams()
 	if err != nil {
 		return nil, err
 	}
-	pc, _, err := e.Connection()
+	pc, estimator, err := e.SenderConnection()
 	if err != nil {
 		return nil, err
 	}
 	s := &Sender{
 		pc:            pc,
 		src:           src,
+		rewind:        rewind,
 		tracks:        make([]*senderTrack, len(streams)),
+		estimator:     estimator,
+		connected:     make(chan struct{}),
 		addViewer:     addViewer,
 		sendCandidate: sendCandidate,
 	}
+	s.videoIdx = -1
+	for i, cd := range streams {
+		if !cd.Type().IsVideo() {
+			continue
+		}
+		s.videoIdx = i
+		switch {
+		case len(layers) == 1:
+			s.upstream = layers[0].RequestKeyframe
+		case len(layers) > 1:
+			s.layers, err = newLayerState(layers, cd)
+			if err != nil {
+				pc.Close()
+				return nil, err
+			}
+		}
+		break
+	}
 	s.log = log.Ctx(ctx).Hook(zerolog.HookFunc(func(e *zerolog.Event, level zerolog.Level, message string) {
 		ip, _ := s.lastIP.Load().(string)
 		if ip != "" {
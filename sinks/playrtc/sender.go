@@ -3,14 +3,25 @@ package playrtc
 import (
 	"fmt"
 	"io"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"eaglesong.dev/gunk/internal"
 	"github.com/nareix/joy4/av"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v3"
 	"github.com/rs/zerolog"
 )
 
+const (
+	// minimum time between skips to the cached keyframe for one viewer
+	rewindInterval = time.Second
+	// how much faster than realtime a viewer is sent the cached GOP
+	burstSpeed = 4
+)
+
 type Sender struct {
 	pc     *webrtc.PeerConnection
 	state  uintptr
@@ -18,6 +29,24 @@ type Sender struct {
 	tracks []*senderTrack
 	sdp    webrtc.SessionDescription
 
+	// simulcast layer selection, nil if there is only one layer
+	layers    *layerState
+	videoIdx  int
+	estimator cc.BandwidthEstimator
+	remb      uint64
+
+	// keyframe requests from the viewer
+	pli        uint32
+	upstream   func()
+	rewind     func() av.Demuxer
+	lastRewind time.Time
+	// time of the last video frame sent from the main source
+	lastVideo time.Duration
+	sentVideo bool
+
+	connected     chan struct{}
+	connectedOnce sync.Once
+
 	addViewer     ViewerFunc
 	sendCandidate CandidateSender
 	log           zerolog.Logger
@@ -32,6 +61,10 @@ func (s *Sender) start(streams []av.CodecData) error {
 				s.lastIP.Store(ip)
 			}
 		}
+		switch state {
+		case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateFailed, webrtc.ICEConnectionStateClosed:
+			s.connectedOnce.Do(func() { close(s.connected) })
+		}
 		atomic.StoreUintptr(&s.state, uintptr(state))
 		s.log.Info().Stringer("rtc_state", state).Send()
 	})
@@ -49,10 +82,12 @@ func (s *Sender) start(streams []av.CodecData) error {
 		if err != nil {
 			return err
 		}
-		if _, err := s.pc.AddTransceiverFromTrack(track, sconf); err != nil {
+		tr, err := s.pc.AddTransceiverFromTrack(track, sconf)
+		if err != nil {
 			return err
 		}
 		s.tracks[i] = track
+		go s.readRTCP(tr.Sender())
 	}
 	// create initial offer
 	offer, err := s.pc.CreateOffer(nil) //&webrtc.OfferOptions{ICERestart: true})
@@ -69,6 +104,38 @@ func (s *Sender) start(streams []av.CodecData) error {
 	return nil
 }
 
+// readRTCP consumes feedback from the viewer so that interceptors can act on
+// it, and keeps the latest receiver bandwidth estimate
+func (s *Sender) readRTCP(sender *webrtc.RTPSender) {
+	for {
+		pkts, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, pkt := range pkts {
+			switch pkt := pkt.(type) {
+			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				atomic.StoreUint64(&s.remb, uint64(pkt.Bitrate))
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				// handled by the serving goroutine at the next video frame
+				atomic.StoreUint32(&s.pli, 1)
+			}
+		}
+	}
+}
+
+// bitrate returns the estimated bandwidth available to the viewer
+func (s *Sender) bitrate() int {
+	var bitrate int
+	if s.estimator != nil {
+		bitrate = s.estimator.GetTargetBitrate()
+	}
+	if remb := int(atomic.LoadUint64(&s.remb)); remb > 0 && (bitrate <= 0 || remb < bitrate) {
+		bitrate = remb
+	}
+	return bitrate
+}
+
 func (s *Sender) remoteIP() string {
 	for _, t := range s.pc.GetTransceivers() {
 		send := t.Sender()
@@ -106,23 +173,83 @@ func (s *Sender) serveOnce() error {
 	defer s.addViewer(-1)
 	defer s.Close()
 	const rtcTimeout = time.Minute
+	started := time.Now()
+	// the cached GOP is only useful once the viewer can receive it
+	select {
+	case <-s.connected:
+	case <-time.After(rtcTimeout):
+		return fmt.Errorf("webrtc connection failed: %s", s.getState())
+	}
+	// read the main source and any other simulcast layers
+	pkts := make(chan layerPacket)
+	done := make(chan struct{})
+	defer close(done)
+	stopMain := make(chan struct{})
+	go readLayer(s.src, -1, pkts, done, stopMain)
+	if s.layers != nil {
+		for i, l := range s.layers.layers {
+			if l.Src != nil {
+				go readLayer(l.Src, i, pkts, done, nil)
+			}
+		}
+	}
 	deadline := time.Now().Add(rtcTimeout)
-	for {
-		packet, err := s.src.ReadPacket()
-		if err == io.EOF {
+	var pacer burstPacer
+	var firstFrame bool
+	for lp := range pkts {
+		packet := lp.pkt
+		if lp.layer < 0 && lp.src != s.src {
+			// read before skipping ahead
+			continue
+		}
+		if lp.err == io.EOF && lp.layer < 0 {
 			break
-		} else if err != nil {
-			return fmt.Errorf("read error: %s", err)
+		} else if lp.err != nil {
+			if lp.layer < 0 {
+				return fmt.Errorf("read error: %s", lp.err)
+			}
+			s.log.Debug().Err(lp.err).Str("layer", s.layers.layers[lp.layer].Name).Msg("simulcast layer ended")
+			s.layers.remove(lp.layer)
+			continue
+		}
+		if lp.layer >= 0 {
+			packet.Idx = int8(s.videoIdx)
 		}
 		track := s.tracks[int(packet.Idx)]
 		if track == nil {
 			continue
 		}
+		if !s.routeLayer(lp.layer, packet, track) {
+			continue
+		}
+		if int(packet.Idx) == s.videoIdx {
+			if src := s.handleKeyframeRequest(packet); src != nil {
+				// skip the main source ahead to the cached keyframe
+				close(stopMain)
+				stopMain = make(chan struct{})
+				s.src = src
+				go readLayer(src, -1, pkts, done, stopMain)
+				pacer = burstPacer{}
+				continue
+			}
+		}
+		if lp.layer < 0 {
+			pacer.wait(packet.Time)
+		}
 		// check if RTC is still connected
 		switch s.getState() {
 		case webrtc.ICEConnectionStateConnected:
 			_ = track.WritePacket(packet)
 			deadline = time.Now().Add(rtcTimeout)
+			if lp.layer < 0 && int(packet.Idx) == s.videoIdx {
+				s.lastVideo, s.sentVideo = packet.Time, true
+			}
+			if !firstFrame && packet.IsKeyFrame && int(packet.Idx) == s.videoIdx {
+				firstFrame = true
+				wait := time.Since(started)
+				internal.FirstFrame("rtc", wait)
+				s.log.Info().Dur("first_frame", wait).Msg("sent first keyframe")
+			}
 		case webrtc.ICEConnectionStateClosed:
 			return nil
 		default:
@@ -133,3 +260,117 @@ func (s *Sender) serveOnce() error {
 	}
 	return nil
 }
+
+// routeLayer returns true if the packet belongs to the layer currently being
+// sent to the viewer. Packets from the main source that aren't video always
+// pass.
+func (s *Sender) routeLayer(layer int, packet av.Packet, track *senderTrack) bool {
+	if s.layers == nil {
+		return true
+	}
+	if layer < 0 {
+		if int(packet.Idx) != s.videoIdx {
+			return true
+		}
+		layer = s.layers.primary
+	}
+	send, switched := s.layers.route(layer, packet)
+	if switched {
+		l := s.layers.layers[layer]
+		s.log.Info().Str("layer", l.Name).Msg("switched simulcast layer")
+		track.setCodecData(l.cd)
+	}
+	if l := s.layers.evaluate(s.bitrate()); l != nil && l.RequestKeyframe != nil {
+		l.RequestKeyframe()
+	}
+	return send
+}
+
+// handleKeyframeRequest forwards a keyframe request from the viewer to the
+// publisher. If the source can't produce one on demand, it returns a reader
+// that starts at the channel's cached keyframe, but only if that is newer than
+// what the viewer was already sent. Otherwise the viewer waits for the next
+// keyframe, since going back would replay frames it has seen.
+func (s *Sender) handleKeyframeRequest(packet av.Packet) av.Demuxer {
+	if atomic.SwapUint32(&s.pli, 0) == 0 || packet.IsKeyFrame {
+		return nil
+	}
+	request := s.upstream
+	if s.layers != nil {
+		request = s.layers.layers[s.layers.current].RequestKeyframe
+	}
+	if request != nil {
+		s.log.Debug().Msg("forwarding keyframe request")
+		request()
+		return nil
+	}
+	if s.rewind == nil || time.Since(s.lastRewind) < rewindInterval {
+		return nil
+	}
+	src := s.rewind()
+	if src == nil {
+		// GOP too long to cache, the viewer waits for the next keyframe
+		return nil
+	}
+	if streams, err := src.Streams(); err != nil || len(streams) != len(s.tracks) {
+		// the publisher changed
+		return nil
+	}
+	key, err := src.ReadPacket()
+	if err != nil || !key.IsKeyFrame || int(key.Idx) != s.videoIdx || (s.sentVideo && key.Time <= s.lastVideo) {
+		return nil
+	}
+	s.log.Debug().Msg("skipping ahead to the cached keyframe for keyframe request")
+	s.lastRewind = time.Now()
+	return &resumed{Demuxer: src, first: &key}
+}
+
+// resumed is a reader that has had its first packet read already
+type resumed struct {
+	av.Demuxer
+	first *av.Packet
+}
+
+func (r *resumed) ReadPacket() (av.Packet, error) {
+	if pkt := r.first; pkt != nil {
+		r.first = nil
+		return *pkt, nil
+	}
+	return r.Demuxer.ReadPacket()
+}
+
+// burstPacer limits how fast packets behind realtime are sent, so that a
+// viewer catches up from the cached GOP without flooding its connection
+type burstPacer struct {
+	start   time.Time
+	first   time.Duration
+	started bool
+}
+
+func (p *burstPacer) wait(t time.Duration) {
+	now := time.Now()
+	if !p.started {
+		p.start, p.first, p.started = now, t, true
+		return
+	}
+	due := p.start.Add((t - p.first) / burstSpeed)
+	if d := due.Sub(now); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func readLayer(src av.Demuxer, layer int, pkts chan<- layerPacket, done, stop <-chan struct{}) {
+	for {
+		pkt, err := src.ReadPacket()
+		select {
+		case pkts <- layerPacket{layer: layer, src: src, pkt: pkt, err: err}:
+		case <-done:
+			return
+		case <-stop:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package playrtc
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testSource struct {
+	pkts []av.Packet
+}
+
+func (s *testSource) Streams() ([]av.CodecData, error) {
+	return []av.CodecData{h264parser.CodecData{}}, nil
+}
+
+func (s *testSource) ReadPacket() (av.Packet, error) {
+	if len(s.pkts) == 0 {
+		return av.Packet{}, io.EOF
+	}
+	pkt := s.pkts[0]
+	s.pkts = s.pkts[1:]
+	return pkt, nil
+}
+
+func TestHandleKeyframeRequest(t *testing.T) {
+	const ms = time.Millisecond
+	frame := av.Packet{Time: 500 * ms}
+	newSender := func(cached time.Duration) (*Sender, *int) {
+		rewinds := new(int)
+		s := &Sender{
+			tracks: make([]*senderTrack, 1),
+			log:    zerolog.Nop(),
+			rewind: func() av.Demuxer {
+				*rewinds++
+				return &testSource{pkts: []av.Packet{
+					{IsKeyFrame: true, Time: cached},
+					{Time: cached + 33*ms},
+				}}
+			},
+		}
+		return s, rewinds
+	}
+	t.Run("NoRequest", func(t *testing.T) {
+		s, rewinds := newSender(time.Second)
+		assert.Nil(t, s.handleKeyframeRequest(frame))
+		assert.Zero(t, *rewinds)
+	})
+	t.Run("Upstream", func(t *testing.T) {
+		s, rewinds := newSender(time.Second)
+		var requested int
+		s.upstream = func() { requested++ }
+		s.pli = 1
+		assert.Nil(t, s.handleKeyframeRequest(frame))
+		assert.Equal(t, 1, requested)
+		assert.Zero(t, *rewinds)
+	})
+	t.Run("OlderKeyframe", func(t *testing.T) {
+		// the viewer already has the cached keyframe, going back would replay
+		// frames it has seen
+		s, rewinds := newSender(400 * ms)
+		s.lastVideo, s.sentVideo = frame.Time, true
+		s.pli = 1
+		assert.Nil(t, s.handleKeyframeRequest(frame))
+		assert.Equal(t, 1, *rewinds)
+	})
+	t.Run("NewerKeyframe", func(t *testing.T) {
+		s, _ := newSender(time.Second)
+		s.lastVideo, s.sentVideo = frame.Time, true
+		s.pli = 1
+		src := s.handleKeyframeRequest(frame)
+		require.NotNil(t, src)
+		pkt, err := src.ReadPacket()
+		require.NoError(t, err)
+		assert.Equal(t, av.Packet{IsKeyFrame: true, Time: time.Second}, pkt)
+		pkt, err = src.ReadPacket()
+		require.NoError(t, err)
+		assert.Equal(t, time.Second+33*ms, pkt.Time)
+
+		// another request right away waits for the next keyframe
+		s.pli = 1
+		assert.Nil(t, s.handleKeyframeRequest(frame))
+	})
+	t.Run("KeyframeClearsRequest", func(t *testing.T) {
+		s, rewinds := newSender(time.Second)
+		s.pli = 1
+		assert.Nil(t, s.handleKeyframeRequest(av.Packet{IsKeyFrame: true}))
+		assert.Zero(t, s.pli)
+		assert.Zero(t, *rewinds)
+	})
+}
@@ -6,7 +6,14 @@ import (
 	"sync"
 	"time"
 
+	"eaglesong.dev/gunk/av1util"
+	"eaglesong.dev/gunk/codec"
+	"eaglesong.dev/gunk/codec/av1parser"
+	"eaglesong.dev/gunk/codec/hevcparser"
+	"eaglesong.dev/gunk/codec/vp8parser"
+	"eaglesong.dev/gunk/codec/vp9parser"
 	"eaglesong.dev/gunk/h264util"
+	"eaglesong.dev/gunk/h265util"
 	"eaglesong.dev/gunk/internal"
 	"github.com/nareix/joy4/av"
 	"github.com/nareix/joy4/codec/h264parser"
@@ -24,11 +31,31 @@ type senderTrack struct {
 
 	packetizer rtp.Packetizer
 	h264       *h264parser.CodecData
+	h265       *hevcparser.CodecData
+	av1        *av1parser.CodecData
 
-	ts   uint64
-	rate uint64
-	got  bool
-	buf  bytes.Buffer
+	ts     uint64
+	rate   uint64
+	got    bool
+	resync bool
+	buf    bytes.Buffer
+}
+
+// CanSend returns true if every video track in streams can be sent over
+// WebRTC. Audio is transcoded to Opus before it gets here.
+func CanSend(streams []av.CodecData) bool {
+	for _, cd := range streams {
+		if !cd.Type().IsVideo() {
+			continue
+		}
+		switch cd.(type) {
+		case h264parser.CodecData, hevcparser.CodecData,
+			av1parser.CodecData, vp8parser.CodecData, vp9parser.CodecData:
+		default:
+			return false
+		}
+	}
+	return true
 }
 
 func newSenderTrack(cd av.CodecData) (*senderTrack, error) {
@@ -44,6 +71,34 @@ func newSenderTrack(cd av.CodecData) (*senderTrack, error) {
 			ClockRate:   90000,
 			SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
 		}
+	case hevcparser.CodecData:
+		s.payloader = &h265util.Payloader{}
+		s.h265 = &cd
+		capability = webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeH265,
+			ClockRate:   90000,
+			SDPFmtpLine: fmt.Sprintf("profile-id=%d;tx-mode=SRST", cd.SPSInfo.ProfileIDC),
+		}
+	case av1parser.CodecData:
+		s.payloader = &av1util.Payloader{}
+		s.av1 = &cd
+		capability = webrtc.RTPCodecCapability{
+			MimeType:  webrtc.MimeTypeAV1,
+			ClockRate: 90000,
+		}
+	case vp8parser.CodecData:
+		s.payloader = &codecs.VP8Payloader{EnablePictureID: true}
+		capability = webrtc.RTPCodecCapability{
+			MimeType:  webrtc.MimeTypeVP8,
+			ClockRate: 90000,
+		}
+	case vp9parser.CodecData:
+		s.payloader = &codecs.VP9Payloader{}
+		capability = webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeVP9,
+			ClockRate:   90000,
+			SDPFmtpLine: fmt.Sprintf("profile-id=%d", cd.FrameHeader.Profile),
+		}
 	case *opusparser.CodecData:
 		s.payloader = &codecs.OpusPayloader{}
 		capability = webrtc.RTPCodecCapability{
@@ -56,7 +111,7 @@ func newSenderTrack(cd av.CodecData) (*senderTrack, error) {
 	}
 	// create underlying rtp track
 	var err error
-	s.TrackLocalStaticRTP, err = webrtc.NewTrackLocalStaticRTP(capability, cd.Type().String(), "gunk")
+	s.TrackLocalStaticRTP, err = webrtc.NewTrackLocalStaticRTP(capability, codec.Name(cd.Type()), "gunk")
 	if err != nil {
 		return nil, err
 	}
@@ -86,6 +141,22 @@ func (s *senderTrack) Bind(t webrtc.TrackLocalContext) (webrtc.RTPCodecParameter
 	return codec, nil
 }
 
+// setCodecData switches the track to another simulcast layer of the same
+// codec. The layer's timestamps don't line up with the previous one, so the
+// next frame is sent one nominal frame interval after the last.
+func (s *senderTrack) setCodecData(cd av.CodecData) {
+	switch cd := cd.(type) {
+	case h264parser.CodecData:
+		s.h264 = &cd
+	case hevcparser.CodecData:
+		s.h265 = &cd
+	case av1parser.CodecData:
+		s.av1 = &cd
+	}
+	s.cd = cd
+	s.resync = true
+}
+
 func (s *senderTrack) WritePacket(pkt av.Packet) error {
 	s.mu.Lock()
 	p := s.packetizer
@@ -96,12 +167,24 @@ func (s *senderTrack) WritePacket(pkt av.Packet) error {
 	}
 	// convert timestamp back to clock rate
 	samples := s.delta(pkt.Time, rate)
+	return s.writeFrame(p, pkt, samples)
+}
+
+func (s *senderTrack) writeFrame(p rtp.Packetizer, pkt av.Packet, samples uint32) error {
 	data := pkt.Data
 	if s.h264 != nil {
 		// convert NALUs to Annex B
 		s.buf.Reset()
 		h264util.WriteAnnexBPacket(&s.buf, pkt, *s.h264)
 		data = s.buf.Bytes()
+	} else if s.h265 != nil {
+		s.buf.Reset()
+		h265util.WriteAnnexBPacket(&s.buf, pkt, *s.h265)
+		data = s.buf.Bytes()
+	} else if s.av1 != nil {
+		s.buf.Reset()
+		av1util.WritePacket(&s.buf, pkt, *s.av1)
+		data = s.buf.Bytes()
 	}
 	// packetize and send
 	for _, pkt := range p.Packetize(data, samples) {
@@ -116,7 +199,11 @@ func (s *senderTrack) WritePacket(pkt av.Packet) error {
 func (s *senderTrack) delta(t time.Duration, rate uint64) uint32 {
 	ts := internal.ToTS(t, rate)
 	var samples uint32
-	if s.got {
+	if s.resync {
+		const nominalFPS = 30
+		samples = uint32(rate / nominalFPS)
+		s.resync = false
+	} else if s.got {
 		samples = uint32(ts - s.ts)
 	}
 	s.ts = ts
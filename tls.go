@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// configureTLS builds a TLS configuration from either static certificate
+// files (TLS_CERT and TLS_KEY) or automatic certificates (ACME_DOMAINS). If
+// neither is configured then both return values are nil.
+func configureTLS(workDir string) (*tls.Config, *autocert.Manager, error) {
+	certFile := viper.GetString("tls_cert")
+	keyFile := viper.GetString("tls_key")
+	var domains []string
+	for _, d := range strings.Split(viper.GetString("acme_domains"), ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	switch {
+	case certFile != "" && len(domains) != 0:
+		return nil, nil, errors.New("TLS_CERT and ACME_DOMAINS are mutually exclusive")
+	case certFile != "":
+		if keyFile == "" {
+			keyFile = certFile
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil, nil
+	case len(domains) != 0:
+		if workDir == "" {
+			return nil, nil, errors.New("ACME_DOMAINS requires WORK_DIR to be set")
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(filepath.Join(workDir, "acme")),
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Email:      viper.GetString("acme_email"),
+		}
+		return m.TLSConfig(), m, nil
+	}
+	return nil, nil, nil
+}
+
+// acmeHandler answers ACME HTTP-01 challenges on the plain HTTP listener and
+// passes everything else through
+func acmeHandler(m *autocert.Manager, h http.Handler) http.Handler {
+	if m == nil {
+		return h
+	}
+	return m.HTTPHandler(h)
+}
@@ -12,6 +12,15 @@ export interface ChannelInfo {
   native_url: string;
   viewers: number;
   rtc: boolean;
+  codec?: string;
+  modes?: string[];
+  preview?: string;
+  preview_last?: number;
+  title: string;
+  description: string;
+  category: string;
+  tags: string[];
+  nsfw: boolean;
 }
 
 export function nullChannelInfo(): ChannelInfo {
@@ -26,6 +35,11 @@ export function nullChannelInfo(): ChannelInfo {
     native_url: "",
     viewers: 0,
     rtc: false,
+    title: "",
+    description: "",
+    category: "",
+    tags: [],
+    nsfw: false,
   };
 }
 
@@ -1,5 +1,31 @@
 import type { ChannelInfo } from "@/stores/channels";
 
+export interface ChatMessage {
+  id: number;
+  user_id: string;
+  username: string;
+  text: string;
+  time: number;
+}
+
+export interface ChatUser {
+  id: string;
+  username?: string;
+}
+
+export interface ChatEvent {
+  type: string;
+  name: string;
+  text?: string;
+  message_id?: number;
+  seconds?: number;
+  user?: ChatUser;
+  chat?: ChatMessage;
+  history?: ChatMessage[];
+  read_only?: boolean;
+  moderator?: boolean;
+}
+
 const initialDelay = 100;
 const maxDelay = 10000;
 
@@ -16,6 +42,8 @@ export class WSSession {
   onChannel?: (ch: ChannelInfo) => void;
   onCandidate?: (cand: RTCIceCandidateInit) => void;
   pendOffer?: (offer: RTCSessionDescriptionInit) => void;
+  onChat?: (ev: ChatEvent) => void;
+  chats = new Set<string>();
 
   constructor(loc: Location) {
     let wsURL =
@@ -94,7 +122,13 @@ export class WSSession {
     this.last = performance.now();
     switch (msg.type) {
       case "connected":
-        this.session = msg.id;
+        if (this.session !== msg.id) {
+          // a new session has to join its chats again
+          this.session = msg.id;
+          for (const name of this.chats) {
+            this.sendMsg({ type: "chat_join", name: name });
+          }
+        }
         this.delay = initialDelay;
         break;
       case "offer":
@@ -113,6 +147,11 @@ export class WSSession {
           this.onChannel(msg.channel);
         }
         break;
+      default:
+        if (msg.type.startsWith("chat_") && this.onChat) {
+          this.onChat(msg);
+        }
+        break;
     }
   }
 
@@ -139,6 +178,32 @@ export class WSSession {
     this.sendMsg({ type: "candidate", candidate: candidate });
   }
 
+  chatJoin(name: string) {
+    this.chats.add(name);
+    this.sendMsg({ type: "chat_join", name: name });
+  }
+
+  chatLeave(name: string) {
+    this.chats.delete(name);
+    this.sendMsg({ type: "chat_leave", name: name });
+  }
+
+  chatSend(name: string, text: string) {
+    this.sendMsg({ type: "chat_send", name: name, text: text });
+  }
+
+  chatDelete(name: string, id: number) {
+    this.sendMsg({ type: "chat_delete", name: name, message_id: id });
+  }
+
+  chatTimeout(name: string, user: ChatUser, seconds: number) {
+    this.sendMsg({ type: "chat_timeout", name: name, user: user, seconds });
+  }
+
+  chatBan(name: string, user: ChatUser) {
+    this.sendMsg({ type: "chat_ban", name: name, user: user });
+  }
+
   stop() {
     this.onCandidate = undefined;
     this.sendMsg({ type: "stop" });
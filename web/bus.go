@@ -0,0 +1,235 @@
+package web
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"eaglesong.dev/gunk/model"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// changes arriving closer together than this are sent together
+	busDebounce = 250 * time.Millisecond
+	// refresh this often anyway to pick up changes nobody reported
+	busRefresh = 30 * time.Second
+	// number of past events kept for resuming subscribers
+	busHistory = 256
+)
+
+// kinds of channelEvent
+const (
+	eventAdd    = "add"
+	eventUpdate = "update"
+	eventRemove = "remove"
+)
+
+// channelEvent is a change to one channel
+type channelEvent struct {
+	ID   uint64
+	Kind string
+	Name string
+	// Info is nil if the channel was removed
+	Info *model.ChannelInfo
+}
+
+// channelBus keeps one snapshot of every channel's info and sends changes to
+// all subscribers, so the database is queried once per change rather than
+// once per client
+type channelBus struct {
+	dirty chan struct{}
+
+	mu       sync.Mutex
+	ready    chan struct{} // closed after the first refresh
+	seq      uint64
+	history  []channelEvent
+	snapshot []*model.ChannelInfo
+	byName   map[string]*model.ChannelInfo
+	subs     map[*busSub]struct{}
+}
+
+// busSub collects changes for one subscriber. Changes to the same channel
+// are merged, so a slow subscriber never blocks the bus.
+type busSub struct {
+	bus     *channelBus
+	ready   chan struct{}
+	mu      sync.Mutex
+	pending map[string]channelEvent
+}
+
+func newChannelBus() *channelBus {
+	return &channelBus{
+		dirty:  make(chan struct{}, 1),
+		ready:  make(chan struct{}),
+		byName: make(map[string]*model.ChannelInfo),
+		subs:   make(map[*busSub]struct{}),
+	}
+}
+
+// notify schedules a refresh of the snapshot
+func (b *channelBus) notify() {
+	select {
+	case b.dirty <- struct{}{}:
+	default:
+	}
+}
+
+func (b *channelBus) run(list func(context.Context) ([]*model.ChannelInfo, error)) {
+	t := time.NewTicker(busRefresh)
+	defer t.Stop()
+	first := true
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		infos, err := list(ctx)
+		cancel()
+		if err != nil {
+			log.Err(err).Msg("failed listing channels")
+		} else {
+			b.update(infos)
+			if first {
+				close(b.ready)
+				first = false
+			}
+		}
+		select {
+		case <-b.dirty:
+		case <-t.C:
+		}
+		time.Sleep(busDebounce)
+	}
+}
+
+func (b *channelBus) update(infos []*model.ChannelInfo) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var events []channelEvent
+	byName := make(map[string]*model.ChannelInfo, len(infos))
+	for _, info := range infos {
+		byName[info.Name] = info
+		prev := b.byName[info.Name]
+		if info.Equal(prev) {
+			continue
+		}
+		kind := eventUpdate
+		if prev == nil {
+			kind = eventAdd
+		}
+		b.seq++
+		events = append(events, channelEvent{ID: b.seq, Kind: kind, Name: info.Name, Info: info})
+	}
+	for _, prev := range b.snapshot {
+		if byName[prev.Name] == nil {
+			b.seq++
+			events = append(events, channelEvent{ID: b.seq, Kind: eventRemove, Name: prev.Name})
+		}
+	}
+	b.snapshot = infos
+	b.byName = byName
+	if len(events) == 0 {
+		return
+	}
+	b.history = append(b.history, events...)
+	if n := len(b.history) - busHistory; n > 0 {
+		b.history = slices.Delete(b.history, 0, n)
+	}
+	for sub := range b.subs {
+		sub.push(events)
+	}
+}
+
+// Snapshot returns the current info of every channel. The result must not be
+// modified.
+func (b *channelBus) Snapshot(ctx context.Context) ([]*model.ChannelInfo, error) {
+	select {
+	case <-b.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.snapshot, nil
+}
+
+// Subscribe returns a subscription that starts with the events after the
+// given ID if they are still known, or otherwise with every channel added
+func (b *channelBus) Subscribe(after uint64) *busSub {
+	sub := &busSub{
+		bus:     b,
+		ready:   make(chan struct{}, 1),
+		pending: make(map[string]channelEvent),
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if after != 0 && after <= b.seq && len(b.history) != 0 && b.history[0].ID <= after+1 {
+		i, _ := slices.BinarySearchFunc(b.history, after+1, func(ev channelEvent, id uint64) int {
+			return cmp.Compare(ev.ID, id)
+		})
+		sub.push(b.history[i:])
+	} else {
+		events := make([]channelEvent, len(b.snapshot))
+		for i, info := range b.snapshot {
+			events[i] = channelEvent{ID: b.seq, Kind: eventAdd, Name: info.Name, Info: info}
+		}
+		sub.push(events)
+	}
+	b.subs[sub] = struct{}{}
+	return sub
+}
+
+func (sub *busSub) push(events []channelEvent) {
+	if len(events) == 0 {
+		return
+	}
+	sub.mu.Lock()
+	for _, ev := range events {
+		if prev, ok := sub.pending[ev.Name]; ok && prev.Kind == eventAdd {
+			if ev.Kind == eventRemove {
+				// never seen by the subscriber
+				delete(sub.pending, ev.Name)
+				continue
+			}
+			ev.Kind = eventAdd
+		}
+		sub.pending[ev.Name] = ev
+	}
+	sub.mu.Unlock()
+	select {
+	case sub.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Ready is signaled when there are changes to take
+func (sub *busSub) Ready() <-chan struct{} {
+	return sub.ready
+}
+
+// Take returns the changes since the last call in order. The results must not
+// be modified.
+func (sub *busSub) Take() []channelEvent {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	events := make([]channelEvent, 0, len(sub.pending))
+	for name, ev := range sub.pending {
+		events = append(events, ev)
+		delete(sub.pending, name)
+	}
+	slices.SortFunc(events, func(a, b channelEvent) int {
+		if c := cmp.Compare(a.ID, b.ID); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return events
+}
+
+// Close stops the subscription
+func (sub *busSub) Close() {
+	sub.bus.mu.Lock()
+	delete(sub.bus.subs, sub)
+	sub.bus.mu.Unlock()
+}
@@ -2,11 +2,16 @@ package web
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"slices"
+	"strings"
+	"unicode/utf8"
 
 	"eaglesong.dev/gunk/model"
 	"github.com/gorilla/mux"
 	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/rs/zerolog/hlog"
 )
@@ -26,8 +31,9 @@ func (s *Server) viewDefs(rw http.ResponseWriter, req *http.Request) {
 		http.Error(rw, "", 500)
 	}
 	for _, def := range defs {
-		def.SetURL(s.AdvertiseRTMP, s.AdvertiseRIST)
+		def.SetURL(s.AdvertiseRTMP, s.AdvertiseRTMPS, s.AdvertiseRIST)
 	}
+	s.Channels.PopulatePull(defs)
 	res := defsResponse{
 		Channels: defs,
 	}
@@ -57,12 +63,15 @@ func (s *Server) viewDefsCreate(rw http.ResponseWriter, req *http.Request) {
 		http.Error(rw, "", 500)
 		return
 	}
-	def.SetURL(s.AdvertiseRTMP, s.AdvertiseRIST)
+	def.SetURL(s.AdvertiseRTMP, s.AdvertiseRTMPS, s.AdvertiseRIST)
 	writeJSON(rw, def)
 }
 
 type defUpdate struct {
-	Announce bool `json:"announce"`
+	Announce    bool   `json:"announce"`
+	AnnounceEnd string `json:"announce_end"`
+
+	model.ChannelMeta
 }
 
 func (s *Server) viewDefsUpdate(rw http.ResponseWriter, req *http.Request) {
@@ -74,15 +83,81 @@ func (s *Server) viewDefsUpdate(rw http.ResponseWriter, req *http.Request) {
 	if !parseRequest(rw, req, &du) {
 		return
 	}
+	switch du.AnnounceEnd {
+	case "":
+		du.AnnounceEnd = model.AnnounceEdit
+	case model.AnnounceEdit, model.AnnounceDelete:
+	default:
+		http.Error(rw, "announce_end must be edit or delete", http.StatusBadRequest)
+		return
+	}
+	if err := cleanMeta(&du.ChannelMeta); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
 	name := mux.Vars(req)["name"]
-	if err := model.UpdateChannel(req.Context(), userID, name, du.Announce); err != nil {
+	if err := model.UpdateChannel(req.Context(), userID, name, du.Announce, du.AnnounceEnd, du.ChannelMeta); errors.Is(err, pgx.ErrNoRows) {
+		http.NotFound(rw, req)
+		return
+	} else if err != nil {
 		hlog.FromRequest(req).Err(err).Str("channel", name).Msg("failed to update channel")
 		http.Error(rw, "", 500)
 		return
 	}
+	// push the new metadata to viewers
+	s.bus.notify()
 	writeJSON(rw, nil)
 }
 
+// cleanMeta trims and validates channel metadata
+func cleanMeta(meta *model.ChannelMeta) error {
+	meta.Title = strings.TrimSpace(meta.Title)
+	meta.Description = strings.TrimSpace(meta.Description)
+	meta.Category = strings.TrimSpace(meta.Category)
+	switch {
+	case utf8.RuneCountInString(meta.Title) > model.MaxTitle:
+		return fmt.Errorf("title must be at most %d characters", model.MaxTitle)
+	case utf8.RuneCountInString(meta.Description) > model.MaxDescription:
+		return fmt.Errorf("description must be at most %d characters", model.MaxDescription)
+	case utf8.RuneCountInString(meta.Category) > model.MaxCategory:
+		return fmt.Errorf("category must be at most %d characters", model.MaxCategory)
+	}
+	tags := []string{}
+	for _, tag := range meta.Tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || slices.Contains(tags, tag) {
+			continue
+		} else if utf8.RuneCountInString(tag) > model.MaxTag {
+			return fmt.Errorf("tags must be at most %d characters", model.MaxTag)
+		}
+		tags = append(tags, tag)
+	}
+	if len(tags) > model.MaxTags {
+		return fmt.Errorf("at most %d tags are allowed", model.MaxTags)
+	}
+	meta.Tags = tags
+	return nil
+}
+
+// viewStreamHealth reports what the publishers of a channel are sending
+func (s *Server) viewStreamHealth(rw http.ResponseWriter, req *http.Request) {
+	userID := s.checkAuth(rw, req)
+	if userID == "" {
+		return
+	}
+	name := mux.Vars(req)["name"]
+	auth, err := model.GetChannel(req.Context(), name)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && auth.UserID != userID) {
+		http.NotFound(rw, req)
+		return
+	} else if err != nil {
+		hlog.FromRequest(req).Err(err).Str("channel", name).Msg("failed to get channel")
+		http.Error(rw, "", 500)
+		return
+	}
+	writeJSON(rw, s.Channels.Health(name))
+}
+
 func (s *Server) viewDefsDelete(rw http.ResponseWriter, req *http.Request) {
 	userID := s.checkAuth(rw, req)
 	if userID == "" {
@@ -93,5 +168,6 @@ func (s *Server) viewDefsDelete(rw http.ResponseWriter, req *http.Request) {
 		hlog.FromRequest(req).Err(err).Str("channel", name).Msg("failed to delete channel")
 		return
 	}
+	s.Channels.SetPullSource(model.ChannelAuth{Name: name}, "")
 	writeJSON(rw, nil)
 }
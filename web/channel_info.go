@@ -13,15 +13,12 @@ import (
 	"github.com/rs/zerolog/hlog"
 )
 
-func (s *Server) listChannels(ctx context.Context, m channelMarkers) ([]*model.ChannelInfo, error) {
+func (s *Server) listChannels(ctx context.Context) ([]*model.ChannelInfo, error) {
 	infos, err := model.ListChannelInfo(ctx)
 	if err != nil {
 		return nil, err
 	}
 	s.Channels.PopulateLive(infos)
-	if m != nil {
-		infos = m.Filter(infos)
-	}
 	for _, info := range infos {
 		s.populateChannel(info)
 	}
@@ -31,11 +28,18 @@ func (s *Server) listChannels(ctx context.Context, m channelMarkers) ([]*model.C
 func (s *Server) populateChannel(info *model.ChannelInfo) {
 	u, _ := s.router.Get("thumbs").URL("channel", info.Name, "timestamp", strconv.FormatInt(info.Last, 10))
 	info.Thumb = u.String()
-	liveU, _ := s.router.Get("live").URL("channel", info.Name)
-	if s.AdvertiseLive != nil {
-		liveU = s.AdvertiseLive.ResolveReference(liveU)
+	if info.PreviewLast != 0 {
+		u, _ := s.router.Get("previews").URL("channel", info.Name, "timestamp", strconv.FormatInt(info.PreviewLast, 10))
+		info.Preview = u.String()
+	}
+	// omit the MPEG-TS URL if the live stream's codecs can't be muxed to it
+	if !(info.Live || info.Pending) || info.HasMode(model.PlaybackTS) {
+		liveU, _ := s.router.Get("live").URL("channel", info.Name)
+		if s.AdvertiseLive != nil {
+			liveU = s.AdvertiseLive.ResolveReference(liveU)
+		}
+		info.LiveURL = liveU.String()
 	}
-	info.LiveURL = liveU.String()
 	if info.WebURL != "" {
 		webU, _ := s.router.Get("web").URL("channel", info.Name, "filename", info.WebURL)
 		nativeU, _ := s.router.Get("web").URL("channel", info.Name, "filename", info.NativeURL)
@@ -49,10 +53,11 @@ func (s *Server) populateChannel(info *model.ChannelInfo) {
 }
 
 func (s *Server) viewChannelInfo(rw http.ResponseWriter, req *http.Request) {
-	infos, err := s.listChannels(req.Context(), nil)
+	infos, err := s.bus.Snapshot(req.Context())
 	if err != nil {
 		hlog.FromRequest(req).Err(err).Msg("failed listing channels")
 		http.Error(rw, "", 500)
+		return
 	}
 	ret := struct {
 		Time     int64                         `json:"time"`
@@ -74,7 +79,7 @@ func (s *Server) viewChannelInfo(rw http.ResponseWriter, req *http.Request) {
 
 func (s *Server) viewThumb(rw http.ResponseWriter, req *http.Request) {
 	chname := mux.Vars(req)["channel"]
-	jpeg, err := model.GetThumb(req.Context(), chname)
+	key, err := model.ThumbKey(req.Context(), chname, thumbWidth(req))
 	if err == pgx.ErrNoRows {
 		hlog.FromRequest(req).Info().Str("channel", chname).Msg("channel not found")
 		http.NotFound(rw, req)
@@ -84,9 +89,7 @@ func (s *Server) viewThumb(rw http.ResponseWriter, req *http.Request) {
 		http.Error(rw, "", 500)
 		return
 	}
-	rw.Header().Set("Cache-Control", "max-age=86400, public, immutable")
-	rw.Header().Set("Content-Type", "image/jpeg")
-	rw.Write(jpeg)
+	serveBlob(rw, req, key, "image/jpeg")
 }
 
 func (s *Server) viewPlaylist(rw http.ResponseWriter, req *http.Request) {
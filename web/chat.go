@@ -0,0 +1,296 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"eaglesong.dev/gunk/model"
+	"github.com/jackc/pgx/v5"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	chatHistory   = 50
+	maxChatLength = 500
+	// each user can post a burst of messages, then one per interval
+	chatBurst    = 5
+	chatInterval = 2 * time.Second
+	maxTimeout   = 7 * 24 * time.Hour
+)
+
+// chatUser identifies who posted or is being moderated
+type chatUser struct {
+	ID       string `json:"id"`
+	Username string `json:"username,omitempty"`
+}
+
+// chatRoom is the set of sessions following a channel's chat
+type chatRoom struct {
+	owner   string
+	members map[*wsSession]chatUser
+}
+
+// chatLimit is a token bucket limiting how fast a user can post
+type chatLimit struct {
+	tokens float64
+	last   time.Time
+}
+
+// idle reports whether the bucket has refilled, which makes it the same as a
+// new one
+func (l *chatLimit) idle(now time.Time) bool {
+	return now.Sub(l.last) >= chatBurst*chatInterval
+}
+
+func (l *chatLimit) allow(now time.Time) bool {
+	if l.last.IsZero() {
+		l.tokens = chatBurst
+	} else {
+		l.tokens = min(chatBurst, l.tokens+float64(now.Sub(l.last))/float64(chatInterval))
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+func (w *wsConn) handleChat(ctx context.Context, m wsMsg) error {
+	if m.Name == "" {
+		return errors.New("missing channel name")
+	}
+	var err error
+	switch m.Type {
+	case "chat_join":
+		err = w.server.chatJoin(ctx, w.session, m.Name, w.user)
+	case "chat_leave":
+		w.server.chatLeave(w.session, m.Name)
+	case "chat_send":
+		err = w.server.chatSend(ctx, m.Name, w.user, m.Text)
+	case "chat_delete":
+		err = w.server.chatModerate(ctx, m.Name, w.user, func(ctx context.Context) error {
+			if err := model.DeleteChatMessage(ctx, m.Name, m.MessageID); err != nil {
+				return err
+			}
+			w.server.chatBroadcast(m.Name, wsMsg{Type: "chat_delete", Name: m.Name, MessageID: m.MessageID})
+			return nil
+		})
+	case "chat_timeout", "chat_ban", "chat_unban":
+		if m.User == nil || m.User.ID == "" {
+			return errors.New("missing user")
+		}
+		err = w.server.chatModerate(ctx, m.Name, w.user, func(ctx context.Context) error {
+			return w.server.chatBan(ctx, m)
+		})
+	}
+	if err != nil {
+		// report the problem without dropping the connection, unless the
+		// client is too far behind to hear about it
+		select {
+		case w.session.send <- wsMsg{Type: "chat_error", Name: m.Name, Text: err.Error()}:
+		default:
+		}
+	}
+	return nil
+}
+
+// chatJoin subscribes a session to a channel's chat and sends it the recent
+// history
+func (s *Server) chatJoin(ctx context.Context, n *wsSession, name string, user chatUser) error {
+	auth, err := model.GetChannel(ctx, name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return errors.New("channel not found")
+	} else if err != nil {
+		log.Err(err).Str("channel", name).Msg("failed to look up channel for chat")
+		return errors.New("chat is unavailable")
+	}
+	history, err := model.ChatHistory(ctx, name, chatHistory)
+	if err != nil {
+		log.Err(err).Str("channel", name).Msg("failed to load chat history")
+		return errors.New("chat is unavailable")
+	}
+	s.cmu.Lock()
+	if s.chatRooms == nil {
+		s.chatRooms = make(map[string]*chatRoom)
+	}
+	room := s.chatRooms[name]
+	if room == nil {
+		room = &chatRoom{members: make(map[*wsSession]chatUser)}
+		s.chatRooms[name] = room
+	}
+	room.owner = auth.UserID
+	_, rejoin := room.members[n]
+	room.members[n] = user
+	s.cmu.Unlock()
+	select {
+	case n.send <- wsMsg{
+		Type:      "chat_history",
+		Name:      name,
+		History:   history,
+		ReadOnly:  user.ID == "",
+		Moderator: user.ID != "" && user.ID == auth.UserID,
+	}:
+	default:
+		// without the history the chat would be incomplete, so start the
+		// client over with a new session that joins again
+		s.dropSession(n)
+		return nil
+	}
+	if !rejoin && user.ID != "" {
+		s.chatBroadcast(name, wsMsg{Type: "chat_join", Name: name, User: &user})
+	}
+	return nil
+}
+
+// chatLeave unsubscribes a session from a channel's chat
+func (s *Server) chatLeave(n *wsSession, name string) {
+	s.cmu.Lock()
+	room := s.chatRooms[name]
+	if room == nil {
+		s.cmu.Unlock()
+		return
+	}
+	user, ok := room.members[n]
+	delete(room.members, n)
+	if len(room.members) == 0 {
+		delete(s.chatRooms, name)
+	}
+	s.cmu.Unlock()
+	if ok && user.ID != "" {
+		s.chatBroadcast(name, wsMsg{Type: "chat_leave", Name: name, User: &user})
+	}
+}
+
+// chatLeaveAll unsubscribes an expired session from every chat
+func (s *Server) chatLeaveAll(n *wsSession) {
+	var names []string
+	s.cmu.Lock()
+	for name, room := range s.chatRooms {
+		if _, ok := room.members[n]; ok {
+			names = append(names, name)
+		}
+	}
+	s.cmu.Unlock()
+	for _, name := range names {
+		s.chatLeave(n, name)
+	}
+}
+
+func (s *Server) chatSend(ctx context.Context, name string, user chatUser, text string) error {
+	text = strings.TrimSpace(text)
+	if user.ID == "" {
+		return errors.New("log in to chat")
+	} else if text == "" {
+		return nil
+	} else if utf8.RuneCountInString(text) > maxChatLength {
+		return errors.New("message is too long")
+	}
+	s.cmu.Lock()
+	room := s.chatRooms[name]
+	allowed := true
+	if room != nil && user.ID != room.owner {
+		if s.chatLimits == nil {
+			s.chatLimits = make(map[string]*chatLimit)
+		}
+		limit := s.chatLimits[user.ID]
+		if limit == nil {
+			limit = new(chatLimit)
+			s.chatLimits[user.ID] = limit
+		}
+		allowed = limit.allow(time.Now())
+	}
+	s.cmu.Unlock()
+	if room == nil {
+		return errors.New("join the chat first")
+	} else if !allowed {
+		return errors.New("slow down")
+	}
+	if banned, err := model.ChatBanned(ctx, name, user.ID); err != nil {
+		log.Err(err).Str("channel", name).Msg("failed to check chat ban")
+		return errors.New("chat is unavailable")
+	} else if banned {
+		return errors.New("you are not allowed to chat here right now")
+	}
+	msg := &model.ChatMessage{
+		UserID:   user.ID,
+		Username: user.Username,
+		Text:     text,
+	}
+	if err := model.AddChatMessage(ctx, name, msg); err != nil {
+		log.Err(err).Str("channel", name).Msg("failed to store chat message")
+		return errors.New("chat is unavailable")
+	}
+	s.chatBroadcast(name, wsMsg{Type: "chat_message", Name: name, Chat: msg})
+	return nil
+}
+
+// chatModerate runs a moderation action if user owns the channel
+func (s *Server) chatModerate(ctx context.Context, name string, user chatUser, f func(context.Context) error) error {
+	auth, err := model.GetChannel(ctx, name)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		log.Err(err).Str("channel", name).Msg("failed to look up channel for chat")
+		return errors.New("chat is unavailable")
+	}
+	if user.ID == "" || user.ID != auth.UserID {
+		return errors.New("only the channel owner can moderate")
+	}
+	if err := f(ctx); err != nil {
+		log.Err(err).Str("channel", name).Msg("chat moderation failed")
+		return errors.New("chat is unavailable")
+	}
+	return nil
+}
+
+func (s *Server) chatBan(ctx context.Context, m wsMsg) error {
+	var err error
+	switch m.Type {
+	case "chat_timeout":
+		d := time.Duration(m.Seconds) * time.Second
+		if d <= 0 || d > maxTimeout {
+			d = 10 * time.Minute
+		}
+		m.Seconds = int(d / time.Second)
+		err = model.BanChatUser(ctx, m.Name, m.User.ID, time.Now().Add(d))
+	case "chat_ban":
+		err = model.BanChatUser(ctx, m.Name, m.User.ID, time.Time{})
+	case "chat_unban":
+		err = model.UnbanChatUser(ctx, m.Name, m.User.ID)
+	}
+	if err != nil {
+		return err
+	}
+	s.chatBroadcast(m.Name, wsMsg{Type: m.Type, Name: m.Name, User: m.User, Seconds: m.Seconds})
+	return nil
+}
+
+// pruneChatLimits forgets users who haven't posted recently
+func (s *Server) pruneChatLimits(now time.Time) {
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+	for id, limit := range s.chatLimits {
+		if limit.idle(now) {
+			delete(s.chatLimits, id)
+		}
+	}
+}
+
+// chatBroadcast sends a message to everyone following a channel's chat.
+// Sessions that are disconnected or falling behind miss it.
+func (s *Server) chatBroadcast(name string, m wsMsg) {
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+	room := s.chatRooms[name]
+	if room == nil {
+		return
+	}
+	for n := range room.members {
+		select {
+		case n.send <- m:
+		default:
+		}
+	}
+}
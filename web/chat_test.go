@@ -0,0 +1,48 @@
+package web
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChatLimit(t *testing.T) {
+	now := time.Now()
+	var l chatLimit
+	for i := 0; i < chatBurst; i++ {
+		assert.True(t, l.allow(now), "message %d of the burst", i)
+	}
+	assert.False(t, l.allow(now))
+	assert.True(t, l.allow(now.Add(chatInterval)))
+	assert.False(t, l.idle(now.Add(chatInterval)))
+	assert.True(t, l.idle(now.Add(chatInterval+chatBurst*chatInterval)))
+}
+
+func TestPruneChatLimits(t *testing.T) {
+	now := time.Now()
+	s := &Server{chatLimits: map[string]*chatLimit{
+		"idle":   {last: now.Add(-chatBurst * chatInterval)},
+		"active": {last: now.Add(-chatInterval)},
+	}}
+	s.pruneChatLimits(now)
+	assert.Contains(t, s.chatLimits, "active")
+	assert.NotContains(t, s.chatLimits, "idle")
+}
+
+func TestDropSession(t *testing.T) {
+	s := &Server{sessions: make(map[string]*wsSession)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n := s.newSession(&wsConn{server: s, cancel: cancel}, "")
+	s.chatRooms = map[string]*chatRoom{
+		"test": {members: map[*wsSession]chatUser{n: {}}},
+	}
+	s.dropSession(n)
+	assert.ErrorIs(t, ctx.Err(), context.Canceled, "connection is closed")
+	assert.NotContains(t, s.sessions, n.ID)
+	assert.NotContains(t, s.chatRooms, "test")
+	// the client can't resume it
+	assert.NotEqual(t, n, s.newSession(&wsConn{server: s}, n.ID))
+}
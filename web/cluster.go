@@ -0,0 +1,56 @@
+package web
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"eaglesong.dev/gunk/ingest"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/hlog"
+)
+
+// checkCluster verifies that a request came from another node in the cluster
+func (s *Server) checkCluster(rw http.ResponseWriter, req *http.Request) bool {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	secret := s.Channels.ClusterSecret
+	if !ok || secret == "" || subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		http.Error(rw, "not authorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func (s *Server) viewRelay(rw http.ResponseWriter, req *http.Request) {
+	if !s.checkCluster(rw, req) {
+		return
+	}
+	chname := mux.Vars(req)["channel"]
+	err := s.Channels.ServeRelay(rw, req, chname)
+	if err == ingest.ErrNoChannel {
+		http.NotFound(rw, req)
+	} else if err != nil {
+		hlog.FromRequest(req).Err(err).Str("channel", chname).Msg("failed to relay channel")
+	}
+}
+
+func (s *Server) viewRelayStatus(rw http.ResponseWriter, req *http.Request) {
+	if !s.checkCluster(rw, req) {
+		return
+	}
+	writeJSON(rw, s.Channels.RelayStatus())
+}
+
+func (s *Server) viewRelayViewers(rw http.ResponseWriter, req *http.Request) {
+	if !s.checkCluster(rw, req) {
+		return
+	}
+	var report ingest.ViewerReport
+	if err := json.NewDecoder(req.Body).Decode(&report); err != nil || report.Node == "" {
+		http.Error(rw, "invalid report", http.StatusBadRequest)
+		return
+	}
+	s.Channels.ReportViewers(report)
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -4,13 +4,19 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"eaglesong.dev/gunk/model"
+	"github.com/jackc/pgx/v5"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/oauth2"
 )
@@ -93,16 +99,46 @@ func (s *Server) SetWebhook(u string) error {
 	return nil
 }
 
+type discordEmbed struct {
+	Title       string         `json:"title"`
+	URL         string         `json:"url,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Color       int            `json:"color,omitempty"`
+	Timestamp   string         `json:"timestamp,omitempty"`
+	Image       *discordImage  `json:"image,omitempty"`
+	Fields      []discordField `json:"fields,omitempty"`
+}
+
+type discordImage struct {
+	URL string `json:"url"`
+}
+
+type discordField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline,omitempty"`
+}
+
 type webhookMessage struct {
-	Content string `json:"content"`
+	Content     string         `json:"content"`
+	Embeds      []discordEmbed `json:"embeds"`
+	Attachments []struct{}     `json:"attachments,omitempty"`
 }
 
-func (s *Server) doWebhook(auth model.ChannelAuth) error {
+const (
+	liveColor  = 0xe74c3c
+	endedColor = 0x95a5a6
+)
+
+// announceLive posts a message to Discord when a stream starts and remembers
+// it so it can be updated when the stream ends
+func (s *Server) announceLive(auth model.ChannelAuth) error {
 	if s.webhookURL == "" || !auth.Announce {
 		return nil
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
+	started := time.Now()
 	displayName := auth.Name
 	if auth.Token != nil && (auth.Token.Valid() || auth.Token.RefreshToken != "") {
 		userInfo, err := s.lookupUser(ctx, auth.Token)
@@ -112,21 +148,149 @@ func (s *Server) doWebhook(auth model.ChannelAuth) error {
 			displayName = userInfo.Username
 		}
 	}
-	msg := fmt.Sprintf("**%s** is now live at %s/watch/%s", displayName, s.BaseURL, url.PathEscape(auth.Name))
-	blob, _ := json.Marshal(webhookMessage{Content: msg})
-	req, err := http.NewRequest("POST", s.webhookURL, bytes.NewReader(blob))
+	watchURL := s.BaseURL + "/watch/" + url.PathEscape(auth.Name)
+	embed := discordEmbed{
+		Title:       auth.Name,
+		URL:         watchURL,
+		Description: "Watch at " + watchURL,
+		Color:       liveColor,
+		Timestamp:   started.UTC().Format(time.RFC3339),
+	}
+	meta, err := model.GetChannelMeta(ctx, auth.Name)
+	if err != nil {
+		log.Err(err).Str("channel", auth.Name).Msg("failed to get channel metadata for announcement")
+	}
+	describeStream(&embed, meta)
+	// the latest thumbnail, until the stream makes a new one
+	thumb, err := model.GetThumb(ctx, auth.Name)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		log.Err(err).Str("channel", auth.Name).Msg("failed to get thumbnail for announcement")
+	}
+	if len(thumb) != 0 {
+		embed.Image = &discordImage{URL: "attachment://thumb.jpg"}
+	}
+	msg := webhookMessage{
+		Content: fmt.Sprintf("**%s** is now live", displayName),
+		Embeds:  []discordEmbed{embed},
+	}
+	var posted struct {
+		ID string `json:"id"`
+	}
+	if err := s.discordWebhook(ctx, "POST", "?wait=true", msg, thumb, &posted); err != nil {
+		return err
+	}
+	return model.PutAnnouncement(ctx, auth.Name, posted.ID, started)
+}
+
+// announceEnd edits or deletes the message announcing a stream
+func (s *Server) announceEnd(auth model.ChannelAuth, peak int) error {
+	if s.webhookURL == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	messageID, started, err := model.TakeAnnouncement(ctx, auth.Name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	path := "/messages/" + url.PathEscape(messageID)
+	if auth.AnnounceEnd == model.AnnounceDelete {
+		return s.discordWebhook(ctx, "DELETE", path, nil, nil, nil)
+	}
+	watchURL := s.BaseURL + "/watch/" + url.PathEscape(auth.Name)
+	embed := discordEmbed{
+		Title:     auth.Name,
+		URL:       watchURL,
+		Color:     endedColor,
+		Timestamp: started.UTC().Format(time.RFC3339),
+		Fields: []discordField{
+			{Name: "Duration", Value: time.Since(started).Round(time.Second).String(), Inline: true},
+			{Name: "Peak viewers", Value: strconv.Itoa(peak), Inline: true},
+		},
+	}
+	if meta, err := model.GetChannelMeta(ctx, auth.Name); err == nil && meta.Title != "" {
+		embed.Title = meta.Title
+	}
+	msg := webhookMessage{
+		Content: fmt.Sprintf("**%s** was live", auth.Name),
+		Embeds:  []discordEmbed{embed},
+		// drop the thumbnail
+		Attachments: []struct{}{},
+	}
+	return s.discordWebhook(ctx, "PATCH", path, msg, nil, nil)
+}
+
+// describeStream fills in an announcement from the channel's metadata
+func describeStream(embed *discordEmbed, meta model.ChannelMeta) {
+	if meta.Title != "" {
+		embed.Title = meta.Title
+	}
+	if meta.Description != "" {
+		embed.Description = meta.Description
+	}
+	if meta.Category != "" {
+		embed.Fields = append(embed.Fields, discordField{Name: "Category", Value: meta.Category, Inline: true})
+	}
+	if len(meta.Tags) != 0 {
+		embed.Fields = append(embed.Fields, discordField{Name: "Tags", Value: strings.Join(meta.Tags, ", "), Inline: true})
+	}
+	if meta.NSFW {
+		embed.Fields = append(embed.Fields, discordField{Name: "NSFW", Value: "yes", Inline: true})
+	}
+}
+
+// discordWebhook calls the webhook API, attaching a thumbnail if given
+func (s *Server) discordWebhook(ctx context.Context, method, path string, msg any, thumb []byte, result any) error {
+	var body io.Reader
+	contentType := "application/json"
+	if msg != nil {
+		blob, _ := json.Marshal(msg)
+		body = bytes.NewReader(blob)
+		if thumb != nil {
+			var buf bytes.Buffer
+			w := multipart.NewWriter(&buf)
+			_ = w.WriteField("payload_json", string(blob))
+			part, _ := w.CreateFormFile("files[0]", "thumb.jpg")
+			part.Write(thumb)
+			w.Close()
+			body = &buf
+			contentType = w.FormDataContentType()
+		}
+	}
+	u, err := url.Parse(s.webhookURL)
+	if err != nil {
+		return err
+	}
+	path, rawQuery, _ := strings.Cut(path, "?")
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	if rawQuery != "" {
+		q := u.Query()
+		extra, _ := url.ParseQuery(rawQuery)
+		for k, v := range extra {
+			q[k] = v
+		}
+		u.RawQuery = q.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
-	blob, _ = ioutil.ReadAll(resp.Body)
+	blob, _ := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
 	if resp.StatusCode >= 400 {
 		return fmt.Errorf("HTTP %s on webhook: %s", resp.Status, string(blob))
 	}
+	if result != nil {
+		return json.Unmarshal(blob, result)
+	}
 	return nil
 }
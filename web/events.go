@@ -1,30 +1,47 @@
 package web
 
 import (
+	"context"
+	"strconv"
+
 	"eaglesong.dev/gunk/model"
 	"eaglesong.dev/gunk/sinks/grabber"
 	"github.com/rs/zerolog/log"
 )
 
 func (s *Server) PublishEvent(auth model.ChannelAuth, live bool, thumb grabber.Result) {
-	if live && thumb.Time.IsZero() {
+	// thumbnails are stored before they are announced
+	s.bus.notify()
+	switch {
+	case live && thumb.Time.IsZero():
 		go func() {
-			if err := s.doWebhook(auth); err != nil {
-				log.Err(err).Str("channel", auth.Name).Msg("failed to invoke webhook")
+			if err := s.announceLive(auth); err != nil {
+				log.Err(err).Str("channel", auth.Name).Msg("failed to announce stream")
 			}
 		}()
-	}
-}
-
-type channelMarkers map[string]*model.ChannelInfo
-
-func (m channelMarkers) Filter(infos []*model.ChannelInfo) (ret []*model.ChannelInfo) {
-	for _, ch := range infos {
-		if ch.Equal(m[ch.Name]) {
-			continue
+		s.webhooks.reset(auth.Name)
+		s.emitWebhook(auth.Name, eventStarted, webhookPayload{})
+	case live:
+		if !s.webhooks.thumbDue(auth.Name) {
+			break
 		}
-		ret = append(ret, ch)
-		m[ch.Name] = ch
+		u, err := s.router.Get("thumbs").URL("channel", auth.Name, "timestamp", strconv.FormatInt(thumb.Time.UnixNano()/1000000, 10))
+		if err != nil {
+			log.Err(err).Str("channel", auth.Name).Msg("failed to build thumbnail URL for webhook")
+			break
+		}
+		s.emitWebhook(auth.Name, eventThumb, webhookPayload{Thumb: s.BaseURL + u.String()})
+	default:
+		peak := s.webhooks.peak(auth.Name)
+		s.emitWebhook(auth.Name, eventEnded, webhookPayload{Viewers: peak})
+		go func() {
+			// use the current setting rather than the one the stream started with
+			if cur, err := model.GetChannel(context.Background(), auth.Name); err == nil {
+				auth = cur
+			}
+			if err := s.announceEnd(auth, peak); err != nil {
+				log.Err(err).Str("channel", auth.Name).Msg("failed to update announcement")
+			}
+		}()
 	}
-	return
 }
@@ -18,6 +18,7 @@ func (s *Server) viewPublishTS(rw http.ResponseWriter, req *http.Request) {
 		http.Error(rw, "", http.StatusForbidden)
 		return
 	}
+	auth.Backup = req.URL.Query().Get("backup") != ""
 	src := ts.NewDemuxer(req.Body)
 	if _, err = src.Streams(); err != nil {
 		hlog.FromRequest(req).Err(err).Str("channel", chname).Msg("TS demux failed")
@@ -0,0 +1,77 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"eaglesong.dev/gunk/ingest/remote"
+	"eaglesong.dev/gunk/model"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"github.com/rs/zerolog/hlog"
+)
+
+// start pulling every channel that has a pull source
+func (s *Server) startPullSources() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	sources, err := model.ListPullSources(ctx)
+	if err != nil {
+		return fmt.Errorf("listing pull sources: %w", err)
+	}
+	for _, src := range sources {
+		s.Channels.SetPullSource(src.Auth, src.URL)
+	}
+	return nil
+}
+
+type pullUpdate struct {
+	URL string `json:"url"`
+}
+
+func (s *Server) viewPullUpdate(rw http.ResponseWriter, req *http.Request) {
+	userID := s.checkAuth(rw, req)
+	if userID == "" {
+		return
+	}
+	var pu pullUpdate
+	if !parseRequest(rw, req, &pu) {
+		return
+	}
+	if err := remote.Check(pu.URL); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.setPullURL(rw, req, userID, pu.URL)
+}
+
+func (s *Server) viewPullDelete(rw http.ResponseWriter, req *http.Request) {
+	userID := s.checkAuth(rw, req)
+	if userID == "" {
+		return
+	}
+	s.setPullURL(rw, req, userID, "")
+}
+
+func (s *Server) setPullURL(rw http.ResponseWriter, req *http.Request, userID, pullURL string) {
+	name := mux.Vars(req)["name"]
+	if err := model.SetPullURL(req.Context(), userID, name, pullURL); errors.Is(err, pgx.ErrNoRows) {
+		http.NotFound(rw, req)
+		return
+	} else if err != nil {
+		hlog.FromRequest(req).Err(err).Str("channel", name).Msg("failed to update pull source")
+		http.Error(rw, "", 500)
+		return
+	}
+	auth, err := model.GetChannel(req.Context(), name)
+	if err != nil {
+		hlog.FromRequest(req).Err(err).Str("channel", name).Msg("failed to update pull source")
+		http.Error(rw, "", 500)
+		return
+	}
+	s.Channels.SetPullSource(auth, pullURL)
+	writeJSON(rw, nil)
+}
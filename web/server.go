@@ -17,12 +17,13 @@ import (
 )
 
 type Server struct {
-	Secure        bool     // set secure cookies
-	BaseURL       string   // base URL
-	HLSBase       *url.URL // base URL for web playback
-	AdvertiseRTMP string   // base URL to advertise for RTMP ingest
-	AdvertiseLive *url.URL // base URL to advertise for direct HTTP streams
-	AdvertiseRIST *url.URL
+	Secure         bool     // set secure cookies
+	BaseURL        string   // base URL
+	HLSBase        *url.URL // base URL for web playback
+	AdvertiseRTMP  string   // base URL to advertise for RTMP ingest
+	AdvertiseRTMPS string   // base URL to advertise for RTMPS ingest
+	AdvertiseLive  *url.URL // base URL to advertise for direct HTTP streams
+	AdvertiseRIST  *url.URL
 
 	key    [32]byte
 	router *mux.Router
@@ -33,23 +34,48 @@ type Server struct {
 
 	smu      sync.Mutex
 	sessions map[string]*wsSession
+	bus      *channelBus
+	webhooks *webhookQueue
+
+	cmu        sync.Mutex
+	chatRooms  map[string]*chatRoom
+	chatLimits map[string]*chatLimit
 
 	Channels ingest.Manager
 }
 
 func (s *Server) Initialize() error {
 	s.Channels.PublishEvent = s.PublishEvent
+	// channel URLs are built from the routes
+	s.router = s.routes()
+	s.bus = newChannelBus()
+	s.Channels.Changed = func(string) { s.bus.notify() }
+	s.webhooks = newWebhookQueue()
 	if err := s.Channels.Initialize(); err != nil {
 		return err
 	}
+	go s.bus.run(s.listChannels)
 	s.sessions = make(map[string]*wsSession)
 	go s.checkSessions()
-	return nil
+	go s.deliverWebhooks()
+	if s.Channels.Origin == nil {
+		// edge nodes leave events to the origin
+		go s.watchChannelEvents()
+	}
+	return s.startPullSources()
 }
 
 func (s *Server) Handler() http.Handler {
+	h := noCache(s.router)
+	h = hlog.AccessHandler(accessLog)(h)
+	h = realIPMiddleware(h)
+	access := zerolog.New(os.Stderr)
+	h = hlog.NewHandler(access)(h)
+	return h
+}
+
+func (s *Server) routes() *mux.Router {
 	r := mux.NewRouter()
-	s.router = r
 	r.HandleFunc("/ws", s.serveWS)
 	// video
 	r.HandleFunc("/live/{channel}.ts", corsOK(s.viewPlayTS)).Methods("GET", "OPTIONS").Name("live")
@@ -62,7 +88,11 @@ func (s *Server) Handler() http.Handler {
 	// UI
 	uiRoutes(r)
 	r.HandleFunc("/channels.json", corsOK(s.viewChannelInfo)).Methods("GET", "HEAD", "OPTIONS")
+	r.HandleFunc("/events", corsOK(s.viewEvents)).Methods("GET", "OPTIONS")
 	r.HandleFunc("/thumbs/{channel}/{timestamp}.jpg", corsOK(s.viewThumb)).Name("thumbs")
+	r.HandleFunc("/thumbs/{channel}/preview/{timestamp}.webp", corsOK(s.viewPreview)).Name("previews")
+	r.HandleFunc("/thumbs/{channel}/history.json", corsOK(s.viewThumbHistory))
+	r.HandleFunc("/thumbs/{channel}/history/{timestamp:[0-9]+}.jpg", corsOK(s.viewThumbHistoryImage)).Name("thumb_history")
 	// login
 	r.HandleFunc("/oauth2/user", s.viewUser).Methods("GET")
 	r.HandleFunc("/oauth2/initiate", s.viewOauthLogin).Methods("GET")
@@ -73,13 +103,21 @@ func (s *Server) Handler() http.Handler {
 	r.HandleFunc("/api/mychannels", s.viewDefsCreate).Methods("POST")
 	r.HandleFunc("/api/mychannels/{name}", s.viewDefsUpdate).Methods("PUT")
 	r.HandleFunc("/api/mychannels/{name}", s.viewDefsDelete).Methods("DELETE")
+	r.HandleFunc("/api/mychannels/{name}/health", s.viewStreamHealth).Methods("GET")
+	r.HandleFunc("/api/mychannels/{name}/pull", s.viewPullUpdate).Methods("PUT")
+	r.HandleFunc("/api/mychannels/{name}/pull", s.viewPullDelete).Methods("DELETE")
+	r.HandleFunc("/api/mychannels/{name}/slate", s.viewSlateUpdate).Methods("PUT")
+	r.HandleFunc("/api/mychannels/{name}/slate", s.viewSlateDelete).Methods("DELETE")
+	r.HandleFunc("/api/webhooks", s.viewWebhooks).Methods("GET")
+	r.HandleFunc("/api/webhooks", s.viewWebhookCreate).Methods("POST")
+	r.HandleFunc("/api/webhooks/{id:[0-9]+}", s.viewWebhookDelete).Methods("DELETE")
+	r.HandleFunc("/api/webhooks/{id:[0-9]+}/deliveries", s.viewWebhookDeliveries).Methods("GET")
 	r.HandleFunc("/health", s.viewHealth).Methods("GET")
-	h := noCache(r)
-	h = hlog.AccessHandler(accessLog)(h)
-	h = realIPMiddleware(h)
-	access := zerolog.New(os.Stderr)
-	h = hlog.NewHandler(access)(h)
-	return h
+
+	r.HandleFunc("/relay", s.viewRelayStatus).Methods("GET")
+	r.HandleFunc("/relay/viewers", s.viewRelayViewers).Methods("POST")
+	r.HandleFunc("/relay/{channel}", s.viewRelay).Methods("GET")
+	return r
 }
 
 func (s *Server) viewHealth(rw http.ResponseWriter, req *http.Request) {
@@ -0,0 +1,59 @@
+package web
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"eaglesong.dev/gunk/ingest/slate"
+	"eaglesong.dev/gunk/model"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"github.com/rs/zerolog/hlog"
+)
+
+// viewSlateUpdate stores an image or clip to show while the publisher is away
+func (s *Server) viewSlateUpdate(rw http.ResponseWriter, req *http.Request) {
+	userID := s.checkAuth(rw, req)
+	if userID == "" {
+		return
+	}
+	name := mux.Vars(req)["name"]
+	data, err := io.ReadAll(http.MaxBytesReader(rw, req.Body, slate.MaxSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(rw, "", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(rw, "io error", http.StatusBadRequest)
+		return
+	}
+	if err := slate.Validate(req.Context(), data); err != nil {
+		hlog.FromRequest(req).Err(err).Str("channel", name).Msg("invalid slate")
+		http.Error(rw, "unsupported image or video", http.StatusBadRequest)
+		return
+	}
+	if err := model.PutSlate(req.Context(), userID, name, data); errors.Is(err, pgx.ErrNoRows) {
+		http.NotFound(rw, req)
+		return
+	} else if err != nil {
+		hlog.FromRequest(req).Err(err).Str("channel", name).Msg("failed to store slate")
+		http.Error(rw, "", 500)
+		return
+	}
+	writeJSON(rw, nil)
+}
+
+func (s *Server) viewSlateDelete(rw http.ResponseWriter, req *http.Request) {
+	userID := s.checkAuth(rw, req)
+	if userID == "" {
+		return
+	}
+	name := mux.Vars(req)["name"]
+	if err := model.DeleteSlate(req.Context(), userID, name); err != nil {
+		hlog.FromRequest(req).Err(err).Str("channel", name).Msg("failed to delete slate")
+		http.Error(rw, "", 500)
+		return
+	}
+	writeJSON(rw, nil)
+}
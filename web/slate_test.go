@@ -0,0 +1,83 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"eaglesong.dev/gunk/ingest/slate"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// errReader fails partway through the body
+type errReader struct{ sent bool }
+
+func (r *errReader) Read(p []byte) (int, error) {
+	if r.sent {
+		return 0, errors.New("connection reset")
+	}
+	r.sent = true
+	return copy(p, "GIF89a"), nil
+}
+
+// loginRequest returns a request carrying the login cookie of a user
+func loginRequest(t *testing.T, s *Server, req *http.Request, userID string) *http.Request {
+	rec := httptest.NewRecorder()
+	require.NoError(t, s.setCookie(rec, loginCookie, discordUser{ID: userID}, 60))
+	for _, c := range rec.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+func TestSlateUpdate(t *testing.T) {
+	s := new(Server)
+	s.SetSecret("test")
+	cases := []struct {
+		name  string
+		login bool
+		body  func() *http.Request
+		code  int
+	}{
+		{
+			name: "NotLoggedIn",
+			body: func() *http.Request { return httptest.NewRequest("PUT", "/", strings.NewReader("GIF89a")) },
+			code: http.StatusUnauthorized,
+		},
+		{
+			name:  "TooLarge",
+			login: true,
+			body: func() *http.Request {
+				return httptest.NewRequest("PUT", "/", strings.NewReader(strings.Repeat("x", slate.MaxSize+1)))
+			},
+			code: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:  "ReadError",
+			login: true,
+			body:  func() *http.Request { return httptest.NewRequest("PUT", "/", &errReader{}) },
+			code:  http.StatusBadRequest,
+		},
+		{
+			name:  "NotAnImage",
+			login: true,
+			body:  func() *http.Request { return httptest.NewRequest("PUT", "/", strings.NewReader("not an image")) },
+			code:  http.StatusBadRequest,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := mux.SetURLVars(c.body(), map[string]string{"name": "test"})
+			if c.login {
+				req = loginRequest(t, s, req, "1")
+			}
+			rec := httptest.NewRecorder()
+			s.viewSlateUpdate(rec, req)
+			assert.Equal(t, c.code, rec.Code)
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+)
+
+// comment lines keep proxies from closing an idle stream
+const sseKeepalive = 15 * time.Second
+
+// viewEvents streams channel changes as server-sent events. Each event is
+// named add, update or remove and carries the channel's info. Clients can
+// resume with Last-Event-ID and follow a single channel with ?channel=name.
+func (s *Server) viewEvents(rw http.ResponseWriter, req *http.Request) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	var after uint64
+	if v := req.Header.Get("Last-Event-ID"); v != "" {
+		after, _ = strconv.ParseUint(v, 10, 64)
+	}
+	filter := req.URL.Query().Get("channel")
+	sub := s.bus.Subscribe(after)
+	defer sub.Close()
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("X-Accel-Buffering", "no")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	t := time.NewTicker(sseKeepalive)
+	defer t.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-t.C:
+			if _, err := fmt.Fprint(rw, ":\n\n"); err != nil {
+				return
+			}
+		case <-sub.Ready():
+			for _, ev := range sub.Take() {
+				if filter != "" && ev.Name != filter {
+					continue
+				}
+				var blob []byte
+				if ev.Info != nil {
+					blob, _ = json.Marshal(ev.Info)
+				} else {
+					blob, _ = json.Marshal(struct {
+						Name string `json:"name"`
+					}{ev.Name})
+				}
+				if _, err := fmt.Fprintf(rw, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Kind, blob); err != nil {
+					hlog.FromRequest(req).Debug().Err(err).Msg("event stream closed")
+					return
+				}
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,148 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"eaglesong.dev/gunk/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sseEvent struct {
+	ID      uint64
+	Kind    string
+	Name    string
+	Viewers int
+}
+
+// openEvents connects to the event stream and returns its events as they
+// arrive
+func openEvents(t *testing.T, srv *httptest.Server, query string, lastID uint64) <-chan sseEvent {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, "GET", srv.URL+"/events"+query, nil)
+	require.NoError(t, err)
+	if lastID != 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatUint(lastID, 10))
+	}
+	resp, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	events := make(chan sseEvent, 100)
+	go func() {
+		defer resp.Body.Close()
+		defer close(events)
+		var ev sseEvent
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			field, value, _ := strings.Cut(sc.Text(), ": ")
+			switch field {
+			case "id":
+				ev.ID, _ = strconv.ParseUint(value, 10, 64)
+			case "event":
+				ev.Kind = value
+			case "data":
+				var info model.ChannelInfo
+				if err := json.Unmarshal([]byte(value), &info); err != nil {
+					return
+				}
+				ev.Name, ev.Viewers = info.Name, info.Viewers
+			case "":
+				if ev.Kind != "" {
+					events <- ev
+				}
+				ev = sseEvent{}
+			}
+		}
+	}()
+	return events
+}
+
+// expectEvents asserts that exactly these events arrive next
+func expectEvents(t *testing.T, events <-chan sseEvent, want ...sseEvent) {
+	t.Helper()
+	var got []sseEvent
+	timeout := time.After(time.Second)
+	for len(got) < len(want) {
+		select {
+		case ev := <-events:
+			got = append(got, ev)
+		case <-timeout:
+			t.Fatalf("got %d events, expected %d", len(got), len(want))
+		}
+	}
+	assert.Equal(t, want, got)
+}
+
+func newEventServer(t *testing.T) (*Server, *httptest.Server) {
+	s := &Server{bus: newChannelBus()}
+	srv := httptest.NewServer(http.HandlerFunc(s.viewEvents))
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+func channels(infos ...model.ChannelInfo) []*model.ChannelInfo {
+	var ret []*model.ChannelInfo
+	for i := range infos {
+		ret = append(ret, &infos[i])
+	}
+	return ret
+}
+
+func TestEventsResume(t *testing.T) {
+	s, srv := newEventServer(t)
+	s.bus.update(channels(model.ChannelInfo{Name: "a"}, model.ChannelInfo{Name: "b"}))
+
+	// a new client starts with every channel
+	events := openEvents(t, srv, "", 0)
+	expectEvents(t, events,
+		sseEvent{ID: 2, Kind: eventAdd, Name: "a"},
+		sseEvent{ID: 2, Kind: eventAdd, Name: "b"},
+	)
+	s.bus.update(channels(model.ChannelInfo{Name: "a", Viewers: 1}, model.ChannelInfo{Name: "b"}))
+	expectEvents(t, events, sseEvent{ID: 3, Kind: eventUpdate, Name: "a", Viewers: 1})
+
+	// changes made while the client is away are replayed on reconnect
+	s.bus.update(channels(model.ChannelInfo{Name: "a", Viewers: 1}))
+	s.bus.update(channels(model.ChannelInfo{Name: "a", Viewers: 1}, model.ChannelInfo{Name: "c"}))
+	resumed := openEvents(t, srv, "", 3)
+	expectEvents(t, resumed,
+		sseEvent{ID: 4, Kind: eventRemove, Name: "b"},
+		sseEvent{ID: 5, Kind: eventAdd, Name: "c"},
+	)
+	// and nothing else comes before the next change
+	s.bus.update(channels(model.ChannelInfo{Name: "a", Viewers: 2}, model.ChannelInfo{Name: "c"}))
+	expectEvents(t, resumed, sseEvent{ID: 6, Kind: eventUpdate, Name: "a", Viewers: 2})
+
+	// an ID the bus doesn't know starts over with every channel
+	fresh := openEvents(t, srv, "", 100)
+	expectEvents(t, fresh,
+		sseEvent{ID: 6, Kind: eventAdd, Name: "a", Viewers: 2},
+		sseEvent{ID: 6, Kind: eventAdd, Name: "c"},
+	)
+}
+
+func TestEventsChannelFilter(t *testing.T) {
+	s, srv := newEventServer(t)
+	s.bus.update(channels(model.ChannelInfo{Name: "a"}, model.ChannelInfo{Name: "b"}))
+	events := openEvents(t, srv, "?channel=b", 0)
+	expectEvents(t, events, sseEvent{ID: 2, Kind: eventAdd, Name: "b"})
+	s.bus.update(channels(model.ChannelInfo{Name: "a", Viewers: 1}, model.ChannelInfo{Name: "b"}))
+	s.bus.update(channels(model.ChannelInfo{Name: "a", Viewers: 1}, model.ChannelInfo{Name: "b", Viewers: 3}))
+	expectEvents(t, events, sseEvent{ID: 4, Kind: eventUpdate, Name: "b", Viewers: 3})
+	s.bus.update(channels(model.ChannelInfo{Name: "a", Viewers: 1}))
+	expectEvents(t, events, sseEvent{ID: 5, Kind: eventRemove, Name: "b"})
+
+	// resuming applies the filter to the replayed events too
+	resumed := openEvents(t, srv, "?channel=a", 2)
+	expectEvents(t, resumed, sseEvent{ID: 3, Kind: eventUpdate, Name: "a", Viewers: 1})
+}
@@ -0,0 +1,106 @@
+package web
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"eaglesong.dev/gunk/internal/blobstore"
+	"eaglesong.dev/gunk/model"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"github.com/rs/zerolog/hlog"
+)
+
+// serveBlob redirects to a stored image if the store is public, otherwise it
+// serves the image itself
+func serveBlob(rw http.ResponseWriter, req *http.Request, key, contentType string) {
+	if u := model.BlobURL(key); u != "" {
+		http.Redirect(rw, req, u, http.StatusFound)
+		return
+	}
+	d, err := model.GetBlob(req.Context(), key)
+	if errors.Is(err, blobstore.ErrNotFound) {
+		http.NotFound(rw, req)
+		return
+	} else if err != nil {
+		hlog.FromRequest(req).Err(err).Str("key", key).Msg("failed to get blob")
+		http.Error(rw, "", 500)
+		return
+	}
+	rw.Header().Set("Cache-Control", "max-age=86400, public, immutable")
+	rw.Header().Set("Content-Type", contentType)
+	rw.Write(d)
+}
+
+func (s *Server) viewPreview(rw http.ResponseWriter, req *http.Request) {
+	chname := mux.Vars(req)["channel"]
+	ms, err := strconv.ParseInt(mux.Vars(req)["timestamp"], 10, 64)
+	if err != nil {
+		http.Error(rw, "invalid timestamp", http.StatusBadRequest)
+		return
+	}
+	key, err := model.PreviewKey(req.Context(), chname, ms)
+	if errors.Is(err, pgx.ErrNoRows) {
+		http.NotFound(rw, req)
+		return
+	} else if err != nil {
+		hlog.FromRequest(req).Err(err).Str("channel", chname).Msg("failed to get preview")
+		http.Error(rw, "", 500)
+		return
+	}
+	serveBlob(rw, req, key, "image/webp")
+}
+
+type thumbHistoryResponse struct {
+	Thumbs []thumbHistoryEntry `json:"thumbs"`
+}
+
+type thumbHistoryEntry struct {
+	Time  int64  `json:"time"`
+	URL   string `json:"url"`
+	Small string `json:"small"`
+}
+
+// thumbWidth returns the thumbnail size asked for with ?w=, or the main size
+func thumbWidth(req *http.Request) int {
+	w, _ := strconv.Atoi(req.URL.Query().Get("w"))
+	for _, width := range model.ThumbWidths {
+		if w == width {
+			return w
+		}
+	}
+	return model.ThumbWidths[0]
+}
+
+// viewThumbHistory lists the channel's recent thumbnails, oldest first
+func (s *Server) viewThumbHistory(rw http.ResponseWriter, req *http.Request) {
+	chname := mux.Vars(req)["channel"]
+	taken, err := model.ListThumbHistory(req.Context(), chname)
+	if err != nil {
+		hlog.FromRequest(req).Err(err).Str("channel", chname).Msg("failed to list thumbnail history")
+		http.Error(rw, "", 500)
+		return
+	}
+	res := thumbHistoryResponse{Thumbs: []thumbHistoryEntry{}}
+	for _, t := range taken {
+		ts := strconv.FormatInt(t.UnixNano()/1000000, 10)
+		u, _ := s.router.Get("thumb_history").URL("channel", chname, "timestamp", ts)
+		small := u.String() + "?w=" + strconv.Itoa(model.ThumbWidths[len(model.ThumbWidths)-1])
+		res.Thumbs = append(res.Thumbs, thumbHistoryEntry{Time: t.UnixNano() / 1000000, URL: u.String(), Small: small})
+	}
+	// a new thumbnail is taken every few seconds
+	rw.Header().Set("Cache-Control", "max-age=5, public")
+	writeJSON(rw, res)
+}
+
+func (s *Server) viewThumbHistoryImage(rw http.ResponseWriter, req *http.Request) {
+	chname := mux.Vars(req)["channel"]
+	ms, err := strconv.ParseInt(mux.Vars(req)["timestamp"], 10, 64)
+	if err != nil {
+		http.Error(rw, "invalid timestamp", http.StatusBadRequest)
+		return
+	}
+	serveBlob(rw, req, model.ThumbHistoryKey(chname, time.UnixMilli(ms), thumbWidth(req)), "image/jpeg")
+}
@@ -0,0 +1,22 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThumbBadTimestamp(t *testing.T) {
+	s := new(Server)
+	for _, h := range []http.HandlerFunc{s.viewPreview, s.viewThumbHistoryImage} {
+		for _, ts := range []string{"latest", "99999999999999999999"} {
+			req := mux.SetURLVars(httptest.NewRequest("GET", "/", nil), map[string]string{"channel": "test", "timestamp": ts})
+			rec := httptest.NewRecorder()
+			h(rec, req)
+			assert.Equal(t, http.StatusBadRequest, rec.Code, ts)
+		}
+	}
+}
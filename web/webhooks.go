@@ -0,0 +1,408 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"eaglesong.dev/gunk/internal"
+	"eaglesong.dev/gunk/internal/safedial"
+	"eaglesong.dev/gunk/model"
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"github.com/rs/zerolog/hlog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	webhookTimeout = 15 * time.Second
+	// deliveries are retried with exponential backoff, then given up on
+	maxDeliveryAttempts = 8
+	firstRetry          = 30 * time.Second
+	maxRetry            = time.Hour
+	deliveryBatch       = 20
+	// a claimed delivery is left alone by other nodes for this long
+	deliveryHold = 10 * time.Minute
+	// how long finished deliveries are kept in the log, delivered ones are
+	// only needed to check on recent events
+	keepDelivered = 24 * time.Hour
+	keepFailed    = 7 * 24 * time.Hour
+	// viewers.peak and thumbnail.updated are sent at most this often per
+	// channel
+	peakInterval  = time.Minute
+	thumbInterval = 5 * time.Minute
+)
+
+// webhook event names
+const (
+	eventStarted = "stream.started"
+	eventLive    = "stream.live"
+	eventEnded   = "stream.ended"
+	eventThumb   = "thumbnail.updated"
+	eventPeak    = "viewers.peak"
+)
+
+var webhookEvents = []string{eventStarted, eventLive, eventEnded, eventThumb, eventPeak}
+
+// webhookPayload is the body posted to webhooks
+type webhookPayload struct {
+	Event   string    `json:"event"`
+	Channel string    `json:"channel"`
+	Time    time.Time `json:"time"`
+	URL     string    `json:"url"`
+	Thumb   string    `json:"thumb,omitempty"`
+	// Viewers is the peak number of viewers so far
+	Viewers int `json:"viewers,omitempty"`
+
+	model.ChannelMeta
+}
+
+// webhookQueue delivers queued webhook events
+type webhookQueue struct {
+	client *http.Client
+	wake   chan struct{}
+
+	mu       sync.Mutex
+	channels map[string]*channelEvents
+}
+
+// channelEvents limits how often a channel's stream sends repeating events
+type channelEvents struct {
+	viewers   int
+	peakSent  time.Time
+	thumbSent time.Time
+}
+
+func newWebhookQueue() *webhookQueue {
+	return &webhookQueue{
+		client: &http.Client{
+			Timeout: webhookTimeout,
+			// webhook URLs are user supplied so they must not reach anything
+			// internal, and a redirect could point anywhere
+			Transport: safedial.Transport(),
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		wake:     make(chan struct{}, 1),
+		channels: make(map[string]*channelEvents),
+	}
+}
+
+// emitWebhook queues an event for a channel's webhooks
+func (s *Server) emitWebhook(name, event string, p webhookPayload) {
+	p.Event = event
+	p.Channel = name
+	p.Time = time.Now().UTC()
+	p.URL = s.BaseURL + "/watch/" + url.PathEscape(name)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+		defer cancel()
+		var err error
+		if p.ChannelMeta, err = model.GetChannelMeta(ctx, name); err != nil {
+			log.Err(err).Str("channel", name).Msg("failed to get channel metadata for webhook")
+		}
+		blob, _ := json.Marshal(p)
+		n, err := model.QueueWebhooks(ctx, name, event, blob)
+		if err != nil {
+			log.Err(err).Str("channel", name).Str("event", event).Msg("failed to queue webhooks")
+		} else if n != 0 {
+			select {
+			case s.webhooks.wake <- struct{}{}:
+			default:
+			}
+		}
+	}()
+}
+
+// reset forgets the events of a channel's previous stream
+func (q *webhookQueue) reset(name string) {
+	q.mu.Lock()
+	delete(q.channels, name)
+	q.mu.Unlock()
+}
+
+// events returns the state of a channel's stream. The lock must be held.
+func (q *webhookQueue) events(name string) *channelEvents {
+	ev := q.channels[name]
+	if ev == nil {
+		ev = new(channelEvents)
+		q.channels[name] = ev
+	}
+	return ev
+}
+
+// peak returns the peak viewers of the current stream
+func (q *webhookQueue) peak(name string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if ev := q.channels[name]; ev != nil {
+		return ev.viewers
+	}
+	return 0
+}
+
+// updatePeak records the current viewers and returns true if a new peak
+// should be announced
+func (q *webhookQueue) updatePeak(name string, viewers int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ev := q.events(name)
+	if viewers <= ev.viewers {
+		return false
+	}
+	ev.viewers = viewers
+	if time.Since(ev.peakSent) < peakInterval {
+		return false
+	}
+	ev.peakSent = time.Now()
+	return true
+}
+
+// thumbDue returns true if a new thumbnail should be announced. Thumbnails
+// are taken every few seconds, far more often than receivers need them.
+func (q *webhookQueue) thumbDue(name string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ev := q.events(name)
+	if time.Since(ev.thumbSent) < thumbInterval {
+		return false
+	}
+	ev.thumbSent = time.Now()
+	return true
+}
+
+// watchChannelEvents turns channel changes into stream.live and viewers.peak
+// events
+func (s *Server) watchChannelEvents() {
+	sub := s.bus.Subscribe(0)
+	defer sub.Close()
+	live := make(map[string]bool)
+	first := true
+	for range sub.Ready() {
+		for _, ev := range sub.Take() {
+			info := ev.Info
+			if info == nil {
+				delete(live, ev.Name)
+				continue
+			}
+			if info.Live && !live[info.Name] && !first {
+				s.emitWebhook(info.Name, eventLive, webhookPayload{})
+			}
+			live[info.Name] = info.Live
+			if info.Live && s.webhooks.updatePeak(info.Name, info.Viewers) {
+				s.emitWebhook(info.Name, eventPeak, webhookPayload{Viewers: info.Viewers})
+			}
+		}
+		// channels that were live at startup already announced themselves
+		first = false
+	}
+}
+
+// deliverWebhooks sends queued deliveries until the process exits
+func (s *Server) deliverWebhooks() {
+	t := time.NewTicker(10 * time.Second)
+	defer t.Stop()
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), deliveryHold)
+		deliveries, err := model.ClaimDeliveries(ctx, deliveryBatch, deliveryHold)
+		if err != nil {
+			log.Err(err).Msg("failed to claim webhook deliveries")
+		}
+		for _, d := range deliveries {
+			s.webhooks.attempt(ctx, d)
+		}
+		cancel()
+		if len(deliveries) == deliveryBatch {
+			// there may be more
+			continue
+		}
+		select {
+		case <-s.webhooks.wake:
+		case <-t.C:
+		case <-prune.C:
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			if err := model.PruneDeliveries(ctx, keepDelivered, keepFailed); err != nil {
+				log.Err(err).Msg("failed to prune webhook deliveries")
+			}
+			cancel()
+		}
+	}
+}
+
+// attempt tries a delivery once and records the outcome
+func (q *webhookQueue) attempt(ctx context.Context, d *model.WebhookDelivery) {
+	d.Attempts++
+	status, err := deliver(ctx, q.client, d, time.Now())
+	d.LastStatus = status
+	d.LastError = ""
+	var next time.Time
+	switch {
+	case err == nil:
+		d.Status = model.DeliveryDelivered
+	case d.Attempts >= maxDeliveryAttempts:
+		d.Status = model.DeliveryFailed
+		d.LastError = err.Error()
+	default:
+		d.LastError = err.Error()
+		next = time.Now().Add(min(firstRetry<<(d.Attempts-1), maxRetry))
+	}
+	if err != nil {
+		log.Warn().Err(err).Int64("webhook_id", d.WebhookID).Str("event", d.Event).Int("attempts", d.Attempts).Msg("webhook delivery failed")
+	}
+	if err := model.FinishDelivery(ctx, d, next); err != nil {
+		log.Err(err).Int64("delivery_id", d.ID).Msg("failed to record webhook delivery")
+	}
+}
+
+// deliver posts a delivery's payload, signed with the webhook's secret. The
+// signature is a hex HMAC-SHA256 of the timestamp, a dot and the body.
+func deliver(ctx context.Context, cli *http.Client, d *model.WebhookDelivery, now time.Time) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	ts := strconv.FormatInt(now.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gunk-webhook")
+	req.Header.Set("X-Gunk-Event", d.Event)
+	req.Header.Set("X-Gunk-Delivery", strconv.FormatInt(d.ID, 10))
+	req.Header.Set("X-Gunk-Timestamp", ts)
+	req.Header.Set("X-Gunk-Signature", "sha256="+signWebhook(d.Secret, ts, d.Payload))
+	resp, err := cli.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64e3))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("HTTP %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func signWebhook(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type webhooksResponse struct {
+	Webhooks []*model.Webhook `json:"webhooks"`
+}
+
+func (s *Server) viewWebhooks(rw http.ResponseWriter, req *http.Request) {
+	userID := s.checkAuth(rw, req)
+	if userID == "" {
+		return
+	}
+	hooks, err := model.ListWebhooks(req.Context(), userID)
+	if err != nil {
+		hlog.FromRequest(req).Err(err).Msg("failed listing webhooks")
+		http.Error(rw, "", 500)
+		return
+	}
+	writeJSON(rw, webhooksResponse{Webhooks: hooks})
+}
+
+type webhookRequest struct {
+	URL     string   `json:"url"`
+	Channel string   `json:"channel"`
+	Events  []string `json:"events"`
+}
+
+func (s *Server) viewWebhookCreate(rw http.ResponseWriter, req *http.Request) {
+	userID := s.checkAuth(rw, req)
+	if userID == "" {
+		return
+	}
+	var wr webhookRequest
+	if !parseRequest(rw, req, &wr) {
+		return
+	}
+	if u, err := url.Parse(wr.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(rw, "webhook URL must be http or https", http.StatusBadRequest)
+		return
+	} else if ip, err := netip.ParseAddr(u.Hostname()); err == nil && !safedial.Allowed(ip) {
+		// names are checked when they are resolved at delivery time
+		http.Error(rw, "webhook URL must be a public address", http.StatusBadRequest)
+		return
+	}
+	if len(wr.Events) == 0 {
+		wr.Events = webhookEvents
+	}
+	for _, ev := range wr.Events {
+		if !slices.Contains(webhookEvents, ev) {
+			http.Error(rw, "unknown event "+ev, http.StatusBadRequest)
+			return
+		}
+	}
+	hook := &model.Webhook{
+		URL:     wr.URL,
+		Secret:  internal.RandomID(24),
+		Channel: wr.Channel,
+		Events:  wr.Events,
+	}
+	if err := model.CreateWebhook(req.Context(), userID, hook); errors.Is(err, pgx.ErrNoRows) {
+		http.NotFound(rw, req)
+		return
+	} else if err != nil {
+		hlog.FromRequest(req).Err(err).Msg("failed to create webhook")
+		http.Error(rw, "", 500)
+		return
+	}
+	writeJSON(rw, hook)
+}
+
+func (s *Server) viewWebhookDelete(rw http.ResponseWriter, req *http.Request) {
+	userID := s.checkAuth(rw, req)
+	if userID == "" {
+		return
+	}
+	id, _ := strconv.ParseInt(mux.Vars(req)["id"], 10, 64)
+	if err := model.DeleteWebhook(req.Context(), userID, id); errors.Is(err, pgx.ErrNoRows) {
+		http.NotFound(rw, req)
+		return
+	} else if err != nil {
+		hlog.FromRequest(req).Err(err).Int64("webhook_id", id).Msg("failed to delete webhook")
+		http.Error(rw, "", 500)
+		return
+	}
+	writeJSON(rw, nil)
+}
+
+type deliveriesResponse struct {
+	Deliveries []*model.WebhookDelivery `json:"deliveries"`
+}
+
+func (s *Server) viewWebhookDeliveries(rw http.ResponseWriter, req *http.Request) {
+	userID := s.checkAuth(rw, req)
+	if userID == "" {
+		return
+	}
+	id, _ := strconv.ParseInt(mux.Vars(req)["id"], 10, 64)
+	deliveries, err := model.ListDeliveries(req.Context(), userID, id, 50)
+	if err != nil {
+		hlog.FromRequest(req).Err(err).Int64("webhook_id", id).Msg("failed listing webhook deliveries")
+		http.Error(rw, "", 500)
+		return
+	}
+	writeJSON(rw, deliveriesResponse{Deliveries: deliveries})
+}
@@ -0,0 +1,135 @@
+package web
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"eaglesong.dev/gunk/internal/safedial"
+	"eaglesong.dev/gunk/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testWebhookClient returns the webhook client, except that it can reach the
+// test server. Every address dialed is recorded.
+func testWebhookClient(dialed *[]string) *http.Client {
+	cli := *newWebhookQueue().client
+	tr := cli.Transport.(*http.Transport).Clone()
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		*dialed = append(*dialed, addr)
+		return new(net.Dialer).DialContext(ctx, network, addr)
+	}
+	cli.Transport = tr
+	return &cli
+}
+
+func TestDeliver(t *testing.T) {
+	runs := []struct {
+		Name     string
+		Status   int
+		Location string
+		OK       bool
+	}{
+		{"Delivered", http.StatusOK, "", true},
+		{"NoContent", http.StatusNoContent, "", true},
+		{"ServerError", http.StatusBadGateway, "", false},
+		{"Redirect", http.StatusFound, "http://169.254.169.254/latest/meta-data/", false},
+	}
+	for _, r := range runs {
+		r := r
+		t.Run(r.Name, func(t *testing.T) {
+			var got *http.Request
+			var body []byte
+			srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				got = req
+				body, _ = io.ReadAll(req.Body)
+				if r.Location != "" {
+					rw.Header().Set("Location", r.Location)
+				}
+				rw.WriteHeader(r.Status)
+			}))
+			defer srv.Close()
+			d := &model.WebhookDelivery{
+				ID:      42,
+				Event:   eventStarted,
+				Payload: []byte(`{"event":"stream.started","channel":"test"}`),
+				URL:     srv.URL,
+				Secret:  "s3cret",
+			}
+			now := time.Unix(1700000000, 0)
+			var dialed []string
+			status, err := deliver(context.Background(), testWebhookClient(&dialed), d, now)
+			assert.Equal(t, r.Status, status)
+			// redirects are not followed
+			assert.Equal(t, []string{srv.Listener.Addr().String()}, dialed)
+			if r.OK {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+			require.NotNil(t, got)
+			assert.Equal(t, d.Payload, body)
+			assert.Equal(t, "application/json", got.Header.Get("Content-Type"))
+			assert.Equal(t, eventStarted, got.Header.Get("X-Gunk-Event"))
+			assert.Equal(t, "42", got.Header.Get("X-Gunk-Delivery"))
+			assert.Equal(t, "1700000000", got.Header.Get("X-Gunk-Timestamp"))
+			// verify the way a receiver would
+			mac := hmac.New(sha256.New, []byte("s3cret"))
+			mac.Write([]byte("1700000000." + string(body)))
+			assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), got.Header.Get("X-Gunk-Signature"))
+		})
+	}
+}
+
+func TestDeliverUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	d := &model.WebhookDelivery{URL: srv.URL, Payload: []byte("{}")}
+	status, err := deliver(context.Background(), http.DefaultClient, d, time.Now())
+	assert.Zero(t, status)
+	assert.Error(t, err)
+}
+
+func TestDeliverBlocked(t *testing.T) {
+	var hit bool
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		hit = true
+	}))
+	defer srv.Close()
+	d := &model.WebhookDelivery{URL: srv.URL, Payload: []byte("{}")}
+	status, err := deliver(context.Background(), newWebhookQueue().client, d, time.Now())
+	assert.Zero(t, status)
+	assert.ErrorIs(t, err, safedial.ErrBlocked)
+	assert.False(t, hit)
+}
+
+func TestViewerPeak(t *testing.T) {
+	q := newWebhookQueue()
+	assert.True(t, q.updatePeak("test", 3))
+	// not a new peak
+	assert.False(t, q.updatePeak("test", 2))
+	// a new peak, but too soon to send again
+	assert.False(t, q.updatePeak("test", 5))
+	assert.Equal(t, 5, q.peak("test"))
+	q.reset("test")
+	assert.Zero(t, q.peak("test"))
+	assert.True(t, q.updatePeak("test", 1))
+}
+
+func TestThumbDue(t *testing.T) {
+	q := newWebhookQueue()
+	assert.True(t, q.thumbDue("test"))
+	assert.False(t, q.thumbDue("test"))
+	assert.True(t, q.thumbDue("other"))
+	// a new stream announces its first thumbnail
+	q.reset("test")
+	assert.True(t, q.thumbDue("test"))
+}
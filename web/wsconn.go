@@ -19,11 +19,16 @@ import (
 
 var wsu = websocket.Upgrader{HandshakeTimeout: 10 * time.Second}
 
+// clients disconnect if nothing is received for 12 seconds
+const wsIdleInterval = 5 * time.Second
+
 type wsConn struct {
 	server  *Server
 	session *wsSession
 	conn    *websocket.Conn
 	cancel  context.CancelFunc
+	// logged in user, or empty if anonymous
+	user chatUser
 }
 
 type wsMsg struct {
@@ -34,6 +39,16 @@ type wsMsg struct {
 	SDP       *webrtc.SessionDescription `json:"sdp,omitempty"`
 	Candidate *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
 	Channel   *model.ChannelInfo         `json:"channel,omitempty"`
+
+	// chat
+	Text      string               `json:"text,omitempty"`
+	MessageID int64                `json:"message_id,omitempty"`
+	Seconds   int                  `json:"seconds,omitempty"`
+	User      *chatUser            `json:"user,omitempty"`
+	Chat      *model.ChatMessage   `json:"chat,omitempty"`
+	History   []*model.ChatMessage `json:"history,omitempty"`
+	ReadOnly  bool                 `json:"read_only,omitempty"`
+	Moderator bool                 `json:"moderator,omitempty"`
 }
 
 func (s *Server) serveWS(rw http.ResponseWriter, req *http.Request) {
@@ -49,6 +64,10 @@ func (s *Server) serveWS(rw http.ResponseWriter, req *http.Request) {
 		conn:   conn,
 		cancel: cancel,
 	}
+	var info discordUser
+	if err := s.unseal(req, loginCookie, &info); err == nil {
+		w.user = chatUser{ID: info.ID, Username: info.Username}
+	}
 	var n *wsSession
 	resume := req.URL.Query().Get("session")
 	n = s.newSession(w, resume)
@@ -107,8 +126,10 @@ func (w *wsConn) sendLoop(ctx context.Context) (err error) {
 			}
 		}
 	}()
-	markers := make(channelMarkers)
-	t := time.NewTicker(2 * time.Second)
+	sub := w.server.bus.Subscribe(0)
+	defer sub.Close()
+	t := time.NewTicker(wsIdleInterval)
+	defer t.Stop()
 	for ctx.Err() == nil {
 		select {
 		case <-ctx.Done():
@@ -120,23 +141,22 @@ func (w *wsConn) sendLoop(ctx context.Context) (err error) {
 			if err := w.conn.WriteJSON(msg); err != nil {
 				return fmt.Errorf("write: %w", err)
 			}
-		case <-t.C:
-			changed, err := w.server.listChannels(ctx, markers)
-			if err != nil {
-				log.Ctx(ctx).Err(err).Msg("failed listing channels")
-			}
-			for _, ch := range changed {
-				msg := wsMsg{Type: "channel", Channel: ch}
-				if err := w.conn.WriteJSON(msg); err != nil {
-					return fmt.Errorf("write: %w", err)
+		case <-sub.Ready():
+			for _, ev := range sub.Take() {
+				if ev.Info == nil {
+					continue
 				}
-			}
-			if len(changed) == 0 {
-				msg := wsMsg{Type: "idle"}
+				msg := wsMsg{Type: "channel", Channel: ev.Info}
 				if err := w.conn.WriteJSON(msg); err != nil {
 					return fmt.Errorf("write: %w", err)
 				}
 			}
+		case <-t.C:
+			// keep the client from timing out
+			msg := wsMsg{Type: "idle"}
+			if err := w.conn.WriteJSON(msg); err != nil {
+				return fmt.Errorf("write: %w", err)
+			}
 		}
 	}
 	return nil
@@ -154,6 +174,8 @@ func (w *wsConn) handle(ctx context.Context, m wsMsg) error {
 		return w.session.Stop()
 	case "ping":
 		return nil
+	case "chat_join", "chat_leave", "chat_send", "chat_delete", "chat_timeout", "chat_ban", "chat_unban":
+		return w.handleChat(ctx, m)
 	default:
 		return errors.New("invalid message type " + m.Type)
 	}
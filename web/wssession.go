@@ -34,7 +34,7 @@ func (s *Server) newSession(conn *wsConn, resume string) *wsSession {
 		n = &wsSession{
 			server: s,
 			ID:     internal.RandomID(16),
-			send:   make(chan wsMsg, 10),
+			send:   make(chan wsMsg, 32),
 		}
 		s.sessions[n.ID] = n
 		// log.Println("[ws] created", n.ID)
@@ -71,9 +71,27 @@ func (n *wsSession) close() {
 	}
 }
 
+// dropSession ends a session straight away. Its client has to start over with
+// a new one.
+func (s *Server) dropSession(n *wsSession) {
+	s.smu.Lock()
+	if s.sessions[n.ID] == n {
+		delete(s.sessions, n.ID)
+	}
+	conn := n.conn
+	n.conn = nil
+	s.smu.Unlock()
+	if conn != nil {
+		conn.cancel()
+	}
+	s.chatLeaveAll(n)
+	n.close()
+}
+
 func (s *Server) checkSessions() {
 	t := time.NewTicker(10 * time.Second)
-	for range t.C {
+	for now := range t.C {
+		s.pruneChatLimits(now)
 		s.smu.Lock()
 		var dead []*wsSession
 		for id, n := range s.sessions {
@@ -85,6 +103,7 @@ func (s *Server) checkSessions() {
 		}
 		s.smu.Unlock()
 		for _, n := range dead {
+			s.chatLeaveAll(n)
 			n.close()
 		}
 	}